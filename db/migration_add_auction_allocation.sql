@@ -0,0 +1,46 @@
+-- Migration: Kebijakan alokasi call auction & laporan lelang
+-- trading_sessions.auction_policy: PRICE_TIME (harga lalu waktu) atau PRO_RATA (proporsional
+-- di level harga marjinal). market_schedule.auction_policy dipakai untuk sesi terjadwal.
+-- auction_reports mencatat setiap uncrossing (opening/closing), auction_allocations mencatat
+-- jatah setiap order yang eligible beserta alasannya.
+-- Jalankan script ini di database PostgreSQL (setelah migration_add_session_schedule.sql)
+
+ALTER TABLE public.trading_sessions ADD COLUMN IF NOT EXISTS auction_policy character varying(15) DEFAULT 'PRICE_TIME';
+ALTER TABLE public.market_schedule ADD COLUMN IF NOT EXISTS auction_policy character varying(15) DEFAULT 'PRICE_TIME' NOT NULL;
+
+CREATE TABLE IF NOT EXISTS public.auction_reports (
+    id bigserial PRIMARY KEY,
+    session_id integer REFERENCES public.trading_sessions(id),
+    stock_id integer NOT NULL REFERENCES public.stocks(id),
+    kind character varying(10) NOT NULL,          -- OPENING / CLOSING
+    policy character varying(15) NOT NULL,
+    price numeric(19,4) NOT NULL,
+    matched_volume bigint NOT NULL,               -- volume IEP
+    executed_volume bigint NOT NULL,              -- volume yang benar-benar tereksekusi
+    surplus bigint NOT NULL,
+    imbalance_side character varying(4) NOT NULL, -- BUY / SELL / NONE
+    tie_break character varying(10),
+    created_at timestamp with time zone DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_auction_reports_stock ON public.auction_reports (stock_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_auction_reports_session ON public.auction_reports (session_id);
+
+CREATE TABLE IF NOT EXISTS public.auction_allocations (
+    id bigserial PRIMARY KEY,
+    report_id bigint NOT NULL REFERENCES public.auction_reports(id) ON DELETE CASCADE,
+    order_id character varying(64) NOT NULL,      -- termasuk order bot (BOT-...)
+    user_id character varying(64) NOT NULL,
+    side character varying(4) NOT NULL,
+    price numeric(19,4) NOT NULL,
+    order_timestamp bigint NOT NULL,              -- prioritas waktu (unix ms)
+    requested_quantity bigint NOT NULL,
+    allocated_quantity bigint NOT NULL,
+    filled_quantity bigint NOT NULL,
+    reason character varying(10) NOT NULL         -- FULL / PRICE_TIME / PRO_RATA / NONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_auction_allocations_report ON public.auction_allocations (report_id);
+
+-- Konfirmasi
+SELECT 'Migration completed: auction_policy, auction_reports and auction_allocations added.' as status;
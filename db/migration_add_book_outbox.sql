@@ -0,0 +1,22 @@
+-- Migration: Menambahkan tabel book_outbox (journal mutasi orderbook)
+-- Setiap trade menulis sisa quantity kedua order dalam transaksi yang sama,
+-- sehingga mutasi Redis yang belum diterapkan bisa di-replay saat recovery.
+-- Jalankan script ini di database PostgreSQL
+
+CREATE TABLE IF NOT EXISTS public.book_outbox
+(
+    id                 bigserial PRIMARY KEY,
+    trade_id           uuid        REFERENCES public.trades ON DELETE SET NULL,
+    symbol             varchar(10) NOT NULL,
+    order_id           varchar(64) NOT NULL, -- order user (uuid) atau order bot (BOT-...)
+    side               varchar(4)  NOT NULL,
+    remaining_quantity integer     NOT NULL,
+    created_at         timestamp   DEFAULT now(),
+    applied_at         timestamp
+);
+
+CREATE INDEX IF NOT EXISTS idx_book_outbox_pending
+    ON public.book_outbox (id) WHERE applied_at IS NULL;
+
+-- Konfirmasi
+SELECT 'Migration completed: book_outbox table created.' as status;
@@ -0,0 +1,12 @@
+-- Migration: Harga penutupan dari pre-closing call auction
+-- close_source mencatat asal close_price di daily_stock_data:
+--   AUCTION = harga closing auction, VWAP = VWAP transaksi close_vwap_minutes terakhir,
+--   LAST = transaksi terakhir sesi, PREV = tidak ada transaksi (prev_close dipakai)
+-- Jalankan script ini di database PostgreSQL (setelah migration_add_session_schedule.sql)
+
+ALTER TABLE public.daily_stock_data ADD COLUMN IF NOT EXISTS close_source character varying(10);
+
+ALTER TABLE public.market_schedule ADD COLUMN IF NOT EXISTS close_vwap_minutes integer DEFAULT 10 NOT NULL;
+
+-- Konfirmasi
+SELECT 'Migration completed: daily_stock_data.close_source and market_schedule.close_vwap_minutes added.' as status;
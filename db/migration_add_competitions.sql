@@ -0,0 +1,46 @@
+-- Migration: Kompetisi trading dan leaderboard
+-- Admin membuat kompetisi dengan sesi awal/akhir (session_number), modal awal dan peserta.
+-- Equity awal (baseline) peserta dicatat saat sesi awal dibuka, atau saat bergabung jika
+-- kompetisi sudah berjalan. Equity peserta (RDN + saham x close_price) di-snapshot setiap
+-- sesi ditutup, dan peserta diurutkan berdasarkan return terhadap equity awalnya.
+-- initial_capital hanya informasi (modal yang disarankan), bukan dasar perhitungan return.
+-- Jalankan script ini di database PostgreSQL
+
+CREATE TABLE IF NOT EXISTS public.competitions (
+    id serial PRIMARY KEY,
+    name character varying(100) NOT NULL,
+    start_session integer NOT NULL,                 -- session_number sesi pertama
+    end_session integer NOT NULL,                   -- session_number sesi terakhir
+    initial_capital numeric(19,4) NOT NULL,
+    exclude_system boolean NOT NULL DEFAULT true,   -- akun ADMIN dan SYSTEM_BOT tidak diperingkat
+    created_by uuid REFERENCES public.users(id),
+    created_at timestamp with time zone DEFAULT now(),
+    CONSTRAINT competitions_sessions_check CHECK (end_session >= start_session)
+);
+
+CREATE TABLE IF NOT EXISTS public.competition_participants (
+    competition_id integer NOT NULL REFERENCES public.competitions(id) ON DELETE CASCADE,
+    user_id uuid NOT NULL REFERENCES public.users(id),
+    joined_at timestamp with time zone DEFAULT now(),
+    baseline_equity numeric(19,4),                  -- equity saat kompetisi mulai (atau saat bergabung), NULL sebelum mulai
+    PRIMARY KEY (competition_id, user_id)
+);
+
+ALTER TABLE public.competition_participants ADD COLUMN IF NOT EXISTS baseline_equity numeric(19,4);
+
+CREATE TABLE IF NOT EXISTS public.competition_snapshots (
+    competition_id integer NOT NULL REFERENCES public.competitions(id) ON DELETE CASCADE,
+    session_id integer NOT NULL REFERENCES public.trading_sessions(id),
+    user_id uuid NOT NULL REFERENCES public.users(id),
+    cash numeric(19,4) NOT NULL,                    -- balance_rdn + reserved_rdn
+    holdings numeric(19,4) NOT NULL,                -- saham x close_price sesi
+    equity numeric(19,4) NOT NULL,
+    return_pct numeric(12,4) NOT NULL,
+    rank integer,                                   -- NULL untuk akun yang dikecualikan
+    created_at timestamp with time zone DEFAULT now(),
+    PRIMARY KEY (competition_id, session_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_competition_participants_user ON public.competition_participants (user_id);
+
+SELECT 'Migration completed: competitions, competition_participants and competition_snapshots created' as status;
@@ -0,0 +1,35 @@
+-- Migration: Menambahkan tabel conditional_orders (stop-market, stop-limit, take-profit)
+-- Disimpan di server dan dievaluasi pada setiap trade. Saat terpicu, order biasa
+-- ditempatkan lewat OrderService.PlaceOrder dan id-nya disimpan di order_id.
+-- Lifecycle: ARMED -> TRIGGERED -> PLACED / REJECTED (atau ARMED -> CANCELED)
+-- Jalankan script ini di database PostgreSQL
+
+CREATE TABLE IF NOT EXISTS public.conditional_orders
+(
+    id              uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id         uuid           NOT NULL REFERENCES public.users ON DELETE CASCADE,
+    stock_id        integer        NOT NULL REFERENCES public.stocks ON DELETE CASCADE,
+    kind            varchar(15)    NOT NULL CHECK (kind IN ('STOP_MARKET', 'STOP_LIMIT', 'TAKE_PROFIT')),
+    type            varchar(4)     NOT NULL CHECK (type IN ('BUY', 'SELL')),
+    trigger_price   numeric(19, 4) NOT NULL,
+    limit_price     numeric(19, 4),          -- wajib untuk STOP_LIMIT, opsional untuk TAKE_PROFIT
+    quantity        integer        NOT NULL CHECK (quantity > 0),
+    time_in_force   varchar(3)     NOT NULL DEFAULT 'DAY',
+    status          varchar(10)    NOT NULL DEFAULT 'ARMED'
+        CHECK (status IN ('ARMED', 'TRIGGERED', 'PLACED', 'REJECTED', 'CANCELED')),
+    triggered_price numeric(19, 4),
+    order_id        uuid           REFERENCES public.orders ON DELETE SET NULL,
+    reject_reason   text,
+    created_at      timestamp      DEFAULT now(),
+    triggered_at    timestamp,
+    updated_at      timestamp      DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_conditional_orders_armed
+    ON public.conditional_orders (stock_id) WHERE status = 'ARMED';
+
+CREATE INDEX IF NOT EXISTS idx_conditional_orders_user
+    ON public.conditional_orders (user_id, created_at DESC);
+
+-- Konfirmasi
+SELECT 'Migration completed: conditional_orders table created.' as status;
@@ -0,0 +1,54 @@
+-- Migration: Menambahkan corporate action (stock split, reverse split, saham bonus)
+-- Rasio ratio_old : ratio_new berlaku untuk jumlah saham; harga dibagi factor = ratio_new / ratio_old.
+-- Dijalankan admin saat pasar tutup, dalam satu transaksi: portfolio (jumlah dan harga rata-rata),
+-- order yang masih terbuka, conditional order, max_shares, dividen yang belum dicatat, serta
+-- riwayat harga candles / stock_candles / daily_stock_data (back-adjusted).
+-- Pecahan lot dibayar tunai (cash in lieu) dengan harga penutupan terakhir yang sudah disesuaikan.
+-- Jalankan script ini di database PostgreSQL
+
+-- 1. Catatan audit per corporate action
+CREATE TABLE IF NOT EXISTS public.corporate_actions
+(
+    id                 uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    stock_id           integer        NOT NULL REFERENCES public.stocks ON DELETE CASCADE,
+    action_type        varchar(15)    NOT NULL CHECK (action_type IN ('SPLIT', 'REVERSE_SPLIT', 'BONUS')),
+    ratio_old          integer        NOT NULL CHECK (ratio_old > 0),
+    ratio_new          integer        NOT NULL CHECK (ratio_new > 0),
+    effective_session  integer,                 -- session_number pertama yang berjalan dengan harga baru
+    reference_price    numeric(19, 4) NOT NULL, -- harga penutupan terakhir sebelum penyesuaian
+    adjusted_price     numeric(19, 4) NOT NULL,
+    max_shares_before  bigint         NOT NULL,
+    max_shares_after   bigint         NOT NULL,
+    holders            integer        NOT NULL DEFAULT 0,
+    lots_before        bigint         NOT NULL DEFAULT 0,
+    lots_after         bigint         NOT NULL DEFAULT 0,
+    cash_in_lieu       numeric(19, 4) NOT NULL DEFAULT 0,
+    orders_adjusted    integer        NOT NULL DEFAULT 0,
+    orders_canceled    integer        NOT NULL DEFAULT 0,
+    memo               text,
+    applied_by         uuid           REFERENCES public.users ON DELETE SET NULL,
+    applied_at         timestamp      DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_corporate_actions_stock
+    ON public.corporate_actions (stock_id, applied_at DESC);
+
+-- 2. Penyesuaian per pemegang saham
+CREATE TABLE IF NOT EXISTS public.corporate_action_holders
+(
+    action_id          uuid           NOT NULL REFERENCES public.corporate_actions ON DELETE CASCADE,
+    user_id            uuid           NOT NULL REFERENCES public.users ON DELETE CASCADE,
+    quantity_before    integer        NOT NULL,
+    quantity_after     integer        NOT NULL,
+    avg_price_before   numeric(19, 4) NOT NULL,
+    avg_price_after    numeric(19, 4) NOT NULL,
+    fractional_shares  integer        NOT NULL DEFAULT 0, -- lembar (bukan lot) yang dibayar tunai
+    cash_in_lieu       numeric(19, 4) NOT NULL DEFAULT 0,
+    PRIMARY KEY (action_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_corporate_action_holders_user
+    ON public.corporate_action_holders (user_id);
+
+-- Konfirmasi
+SELECT 'Migration completed: corporate_actions and corporate_action_holders tables created.' as status;
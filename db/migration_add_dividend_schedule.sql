@@ -0,0 +1,30 @@
+-- Migration: Jadwal dan pembayaran dividen tunai
+-- Dividen diumumkan dengan cum-date, ex-date dan pay-date berupa session_number.
+-- Saat sesi cum-date ditutup, kepemilikan di portfolios di-snapshot ke dividend_allocations.
+-- Saat sesi pay-date dibuka, dividen bersih (setelah pajak) dikreditkan ke balance_rdn.
+-- Jalankan script ini di database PostgreSQL
+
+ALTER TABLE public.dividends ADD COLUMN IF NOT EXISTS cum_session integer;             -- session_number
+ALTER TABLE public.dividends ADD COLUMN IF NOT EXISTS ex_session integer;
+ALTER TABLE public.dividends ADD COLUMN IF NOT EXISTS pay_session integer;
+ALTER TABLE public.dividends ADD COLUMN IF NOT EXISTS withholding_tax_pct numeric(7,4) NOT NULL DEFAULT 10;
+ALTER TABLE public.dividends ADD COLUMN IF NOT EXISTS status character varying(20) NOT NULL DEFAULT 'PAID'; -- ANNOUNCED / RECORDED / PAID / CANCELED
+ALTER TABLE public.dividends ADD COLUMN IF NOT EXISTS declared_by uuid REFERENCES public.users(id);
+ALTER TABLE public.dividends ADD COLUMN IF NOT EXISTS created_at timestamp with time zone DEFAULT now();
+ALTER TABLE public.dividends ADD COLUMN IF NOT EXISTS recorded_at timestamp with time zone;
+
+-- Dividen yang sudah ada dianggap sudah dibayar; dividen baru mulai dari ANNOUNCED
+ALTER TABLE public.dividends ALTER COLUMN status SET DEFAULT 'ANNOUNCED';
+
+CREATE INDEX IF NOT EXISTS idx_dividends_status ON public.dividends (status);
+
+ALTER TABLE public.dividend_allocations ADD COLUMN IF NOT EXISTS gross_amount numeric(19,4);
+ALTER TABLE public.dividend_allocations ADD COLUMN IF NOT EXISTS tax_amount numeric(19,4) NOT NULL DEFAULT 0;
+ALTER TABLE public.dividend_allocations ADD COLUMN IF NOT EXISTS paid_at timestamp with time zone;
+
+-- amount adalah nilai bersih; alokasi lama tanpa pajak dan sudah dibayar
+UPDATE public.dividend_allocations SET gross_amount = amount, paid_at = created_at WHERE gross_amount IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS uq_dividend_allocations_user ON public.dividend_allocations (dividend_id, user_id);
+
+SELECT 'Migration completed: dividend schedule and withholding tax added' as status;
@@ -0,0 +1,13 @@
+-- Migration: Menambahkan display_quantity pada orders (iceberg order)
+-- NULL = order biasa. Jika diisi, hanya sejumlah lot ini yang tampil di orderbook;
+-- sisanya tersembunyi dan diisi ulang (antre paling belakang) setiap slice habis.
+-- Jalankan script ini di database PostgreSQL
+
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS display_quantity integer;
+
+ALTER TABLE public.orders DROP CONSTRAINT IF EXISTS orders_display_quantity_check;
+ALTER TABLE public.orders ADD CONSTRAINT orders_display_quantity_check
+    CHECK (display_quantity IS NULL OR (display_quantity > 0 AND display_quantity < quantity));
+
+-- Konfirmasi
+SELECT 'Migration completed: orders.display_quantity added.' as status;
@@ -0,0 +1,26 @@
+-- Migration: Alur IPO (book-building, penjatahan, listing)
+-- Admin membuat penawaran dengan harga, jumlah lot dan sesi masa penawaran (session_number).
+-- User memesan selama masa penawaran; dananya ditahan di reserved_rdn.
+-- Saat sesi terakhir masa penawaran ditutup, saham dijatahkan (pro-rata atau undian) dan
+-- sisa dana dikembalikan. Saat sesi listing dibuka, saham diaktifkan dengan prev_close = harga penawaran.
+-- Jalankan script ini di database PostgreSQL
+
+ALTER TABLE public.ipos ADD COLUMN IF NOT EXISTS offer_start_session integer;   -- session_number
+ALTER TABLE public.ipos ADD COLUMN IF NOT EXISTS offer_end_session integer;
+ALTER TABLE public.ipos ADD COLUMN IF NOT EXISTS listing_session integer;
+ALTER TABLE public.ipos ADD COLUMN IF NOT EXISTS allocation_method character varying(10) NOT NULL DEFAULT 'PRO_RATA'; -- PRO_RATA / LOTTERY
+ALTER TABLE public.ipos ADD COLUMN IF NOT EXISTS allotted_shares bigint NOT NULL DEFAULT 0;  -- lot
+ALTER TABLE public.ipos ADD COLUMN IF NOT EXISTS created_by uuid REFERENCES public.users(id);
+ALTER TABLE public.ipos ADD COLUMN IF NOT EXISTS allotted_at timestamp with time zone;
+ALTER TABLE public.ipos ADD COLUMN IF NOT EXISTS listed_at timestamp with time zone;
+
+-- Status: PENDING / OFFERING / ALLOTTED / LISTED / CANCELED
+CREATE INDEX IF NOT EXISTS idx_ipos_status ON public.ipos (status);
+
+-- Status langganan: PENDING (dana ditahan) / ALLOTTED / NOT_ALLOTTED / CANCELED
+ALTER TABLE public.ipo_subscriptions ADD COLUMN IF NOT EXISTS reserved_amount numeric(19,4) NOT NULL DEFAULT 0;
+ALTER TABLE public.ipo_subscriptions ADD COLUMN IF NOT EXISTS allotted_quantity integer NOT NULL DEFAULT 0;
+ALTER TABLE public.ipo_subscriptions ADD COLUMN IF NOT EXISTS refund_amount numeric(19,4) NOT NULL DEFAULT 0;
+ALTER TABLE public.ipo_subscriptions ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone DEFAULT now();
+
+SELECT 'Migration completed: IPO offering, allotment and listing columns added' as status;
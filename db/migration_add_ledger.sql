@@ -0,0 +1,62 @@
+-- Migration: Ledger double-entry untuk kas RDN dan saham
+-- Setiap perubahan saldo (reservasi order, refund, settlement trade, fee, penyesuaian admin,
+-- dividen) mencatat satu jurnal dengan entri yang jumlahnya nol per aset.
+-- Akun user: CASH (= users.balance_rdn), RESERVED (kas untuk order BUY terbuka),
+-- SHARES (= portfolios.quantity_owned, dalam lot). Akun sistem: MARKET (bot), EXTERNAL, FEES.
+-- Entri dengan stock_id NULL adalah kas (rupiah), selain itu saham (lot).
+-- Jalankan script ini di database PostgreSQL
+
+CREATE TABLE IF NOT EXISTS public.ledger_journals (
+    id bigserial PRIMARY KEY,
+    reason character varying(30) NOT NULL,         -- ORDER_RESERVE / ORDER_REFUND / TRADE_SETTLEMENT / FEE / ADMIN_ADJUSTMENT / DIVIDEND / OPENING_BALANCE
+    ref_type character varying(20),                -- ORDER / TRADE / SESSION / ADMIN / USER / MIGRATION
+    ref_id text,
+    memo text,
+    created_at timestamp with time zone DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS public.ledger_entries (
+    id bigserial PRIMARY KEY,
+    journal_id bigint NOT NULL REFERENCES public.ledger_journals(id),
+    account character varying(20) NOT NULL,        -- CASH / RESERVED / SHARES / MARKET / EXTERNAL / FEES
+    user_id uuid REFERENCES public.users(id),      -- NULL untuk akun sistem
+    stock_id integer REFERENCES public.stocks(id), -- NULL = kas
+    amount numeric(19,4) NOT NULL                  -- positif menambah saldo akun, negatif mengurangi
+);
+
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_user ON public.ledger_entries (user_id, account, stock_id, id);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_journal ON public.ledger_entries (journal_id);
+CREATE INDEX IF NOT EXISTS idx_ledger_journals_ref ON public.ledger_journals (ref_type, ref_id);
+
+-- Saldo awal: saldo yang sudah ada sebelum ledger dicatat sebagai satu jurnal OPENING_BALANCE
+-- dari akun EXTERNAL, supaya saldo tersimpan langsung cocok dengan ledger
+DO $$
+DECLARE
+    jid bigint;
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM public.ledger_journals WHERE reason = 'OPENING_BALANCE' AND ref_type = 'MIGRATION') THEN
+        INSERT INTO public.ledger_journals (reason, ref_type, memo)
+        VALUES ('OPENING_BALANCE', 'MIGRATION', 'Saldo awal dari users, orders dan portfolios')
+        RETURNING id INTO jid;
+
+        INSERT INTO public.ledger_entries (journal_id, account, user_id, stock_id, amount)
+        SELECT jid, 'CASH', id, NULL, balance_rdn FROM public.users WHERE COALESCE(balance_rdn, 0) <> 0;
+
+        INSERT INTO public.ledger_entries (journal_id, account, user_id, stock_id, amount)
+        SELECT jid, 'RESERVED', user_id, NULL, SUM(price * remaining_quantity * 100)
+        FROM public.orders
+        WHERE type = 'BUY' AND status IN ('PENDING', 'PARTIAL')
+        GROUP BY user_id;
+
+        INSERT INTO public.ledger_entries (journal_id, account, user_id, stock_id, amount)
+        SELECT jid, 'SHARES', user_id, stock_id, quantity_owned FROM public.portfolios WHERE quantity_owned <> 0;
+
+        INSERT INTO public.ledger_entries (journal_id, account, user_id, stock_id, amount)
+        SELECT jid, 'EXTERNAL', NULL, stock_id, -SUM(amount)
+        FROM public.ledger_entries
+        WHERE journal_id = jid
+        GROUP BY stock_id;
+    END IF;
+END $$;
+
+SELECT 'Migration completed: ledger_journals and ledger_entries created' as status;
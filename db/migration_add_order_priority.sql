@@ -0,0 +1,9 @@
+-- Migration: Menambahkan priority_at pada orders
+-- Waktu prioritas antrean (time priority). NULL berarti sama dengan created_at.
+-- Di-reset ke NOW() saat order diubah harganya atau jumlahnya dinaikkan.
+-- Jalankan script ini di database PostgreSQL
+
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS priority_at timestamp;
+
+-- Konfirmasi
+SELECT 'Migration completed: orders.priority_at added.' as status;
@@ -0,0 +1,17 @@
+-- Migration: Menambahkan tipe harga (LIMIT/MARKET) dan time in force (DAY/GTC/IOC/FOK) pada orders
+-- Order lama dianggap LIMIT DAY
+-- Jalankan script ini di database PostgreSQL
+
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS price_type varchar(10) NOT NULL DEFAULT 'LIMIT';
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS time_in_force varchar(3) NOT NULL DEFAULT 'DAY';
+
+ALTER TABLE public.orders DROP CONSTRAINT IF EXISTS orders_price_type_check;
+ALTER TABLE public.orders ADD CONSTRAINT orders_price_type_check
+    CHECK (price_type IN ('LIMIT', 'MARKET'));
+
+ALTER TABLE public.orders DROP CONSTRAINT IF EXISTS orders_time_in_force_check;
+ALTER TABLE public.orders ADD CONSTRAINT orders_time_in_force_check
+    CHECK (time_in_force IN ('DAY', 'GTC', 'IOC', 'FOK'));
+
+-- Konfirmasi
+SELECT 'Migration completed: orders.price_type and orders.time_in_force added.' as status;
@@ -0,0 +1,21 @@
+-- Migration: Riwayat rekonsiliasi orderbook
+-- Setiap run reconciler (manual dari admin atau terjadwal) disimpan beserta laporan lengkapnya
+-- (JSON): order di memori/Redis yang tidak cocok dengan tabel orders, order aktif yang hilang
+-- dari orderbook, order bot yatim, dan orderbook yang crossed.
+-- Jalankan script ini di database PostgreSQL
+
+CREATE TABLE IF NOT EXISTS public.orderbook_reconcile_runs (
+    id bigserial PRIMARY KEY,
+    trigger character varying(10) NOT NULL,       -- MANUAL / SCHEDULED
+    repair boolean NOT NULL DEFAULT false,        -- false = dry-run (laporan saja)
+    healthy boolean NOT NULL,
+    symbols integer NOT NULL DEFAULT 0,
+    issues integer NOT NULL DEFAULT 0,
+    repaired integer NOT NULL DEFAULT 0,
+    report jsonb NOT NULL,
+    created_at timestamp with time zone DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_orderbook_reconcile_runs_created ON public.orderbook_reconcile_runs (created_at DESC);
+
+SELECT 'Migration completed: orderbook_reconcile_runs created' as status;
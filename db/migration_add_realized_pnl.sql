@@ -0,0 +1,48 @@
+-- Migration: Realized P&L per fill dan sesi setiap trade
+-- Setiap fill SELL user mencatat laba/rugi terealisasi dengan metode harga rata-rata:
+-- (harga jual - avg_buy_price) * lot * 100, dikurangi fee jual.
+-- trades.session_id menandai sesi tempat trade terjadi, untuk analitik per sesi.
+-- Jalankan script ini di database PostgreSQL
+
+ALTER TABLE public.trades ADD COLUMN IF NOT EXISTS session_id integer REFERENCES public.trading_sessions(id);
+
+-- Trade lama: sesi yang sedang berjalan saat trade dieksekusi
+UPDATE public.trades t
+SET session_id = ts.id
+FROM public.trading_sessions ts
+WHERE t.session_id IS NULL
+  AND t.executed_at >= ts.started_at
+  AND (ts.ended_at IS NULL OR t.executed_at <= ts.ended_at);
+
+CREATE INDEX IF NOT EXISTS idx_trades_session ON public.trades (session_id);
+
+CREATE TABLE IF NOT EXISTS public.realized_pnl (
+    trade_id uuid PRIMARY KEY REFERENCES public.trades(id),
+    order_id uuid NOT NULL REFERENCES public.orders(id), -- order SELL
+    user_id uuid NOT NULL REFERENCES public.users(id),
+    stock_id integer NOT NULL REFERENCES public.stocks(id),
+    quantity integer NOT NULL,                            -- lot
+    sell_price numeric(19,4) NOT NULL,
+    avg_cost numeric(19,4) NOT NULL,                      -- avg_buy_price saat fill
+    gross_pnl numeric(19,4) NOT NULL,                     -- (sell_price - avg_cost) * quantity * 100
+    fee numeric(19,4) NOT NULL DEFAULT 0,                 -- fee jual
+    pnl numeric(19,4) NOT NULL,                           -- gross_pnl - fee
+    created_at timestamp with time zone DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_realized_pnl_user ON public.realized_pnl (user_id, created_at);
+
+-- Fill SELL lama: pakai avg_price_at_order yang dicatat saat order dibuat
+INSERT INTO public.realized_pnl (trade_id, order_id, user_id, stock_id, quantity, sell_price, avg_cost, gross_pnl, fee, pnl, created_at)
+SELECT t.id, o.id, o.user_id, t.stock_id, t.quantity, t.price, o.avg_price_at_order,
+       (t.price - o.avg_price_at_order) * t.quantity * 100,
+       COALESCE(f.fee, 0),
+       (t.price - o.avg_price_at_order) * t.quantity * 100 - COALESCE(f.fee, 0),
+       t.executed_at
+FROM public.trades t
+JOIN public.orders o ON o.id = t.sell_order_id
+LEFT JOIN public.trade_fees f ON f.trade_id = t.id AND f.side = 'SELL'
+WHERE o.avg_price_at_order IS NOT NULL
+ON CONFLICT (trade_id) DO NOTHING;
+
+SELECT 'Migration completed: realized_pnl created and trades.session_id added' as status;
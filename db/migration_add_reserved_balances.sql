@@ -0,0 +1,27 @@
+-- Migration: Saldo RDN tersedia/ditahan dan saham terkunci
+-- users.balance_rdn = saldo tersedia, users.reserved_rdn = saldo yang ditahan order BUY terbuka
+-- (total kas = balance_rdn + reserved_rdn).
+-- portfolios.quantity_owned = total lot, portfolios.locked_quantity = lot yang ada di order SELL
+-- terbuka (tersedia = quantity_owned - locked_quantity).
+-- Kedua kolom dijaga di transaksi yang sama dengan order dan trade; nilai awalnya diisi dari
+-- order PENDING/PARTIAL yang ada.
+-- Jalankan script ini di database PostgreSQL
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS reserved_rdn numeric(19,4) NOT NULL DEFAULT 0;
+ALTER TABLE public.portfolios ADD COLUMN IF NOT EXISTS locked_quantity integer NOT NULL DEFAULT 0;
+
+UPDATE public.users u
+SET reserved_rdn = COALESCE((
+    SELECT SUM(o.price * o.remaining_quantity * 100)
+    FROM public.orders o
+    WHERE o.user_id = u.id AND o.type = 'BUY' AND o.status IN ('PENDING', 'PARTIAL')
+), 0);
+
+UPDATE public.portfolios p
+SET locked_quantity = COALESCE((
+    SELECT SUM(o.remaining_quantity)
+    FROM public.orders o
+    WHERE o.user_id = p.user_id AND o.stock_id = p.stock_id AND o.type = 'SELL' AND o.status IN ('PENDING', 'PARTIAL')
+), 0);
+
+SELECT 'Migration completed: reserved_rdn and locked_quantity added' as status;
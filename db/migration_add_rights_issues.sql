@@ -0,0 +1,70 @@
+-- Migration: Menambahkan rights issue (HMETD) dengan masa exercise
+-- Setiap ratio_old lot saham yang dimiliki saat penutupan cum_session mendapat ratio_new lot rights.
+-- Rights dicatat sebagai saham sementara <SYMBOL>-R di portfolios; jika tradeable, saham itu aktif
+-- dan diperdagangkan lewat matching engine selama masa exercise.
+-- Lifecycle: ANNOUNCED -> RECORDED (penutupan cum_session) -> EXERCISING (pembukaan exercise_start_session)
+--            -> COMPLETED (penutupan exercise_end_session, rights yang tidak di-exercise hangus)
+--            atau ANNOUNCED -> CANCELED
+-- Jalankan script ini di database PostgreSQL
+
+-- 1. Rights issue
+CREATE TABLE IF NOT EXISTS public.rights_issues
+(
+    id                      uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    stock_id                integer        NOT NULL REFERENCES public.stocks ON DELETE CASCADE,
+    rights_stock_id         integer        REFERENCES public.stocks ON DELETE SET NULL, -- dibuat saat pencatatan
+    ratio_old               integer        NOT NULL CHECK (ratio_old > 0), -- lot saham yang dimiliki ...
+    ratio_new               integer        NOT NULL CHECK (ratio_new > 0), -- ... mendapat lot rights
+    exercise_price          numeric(19, 4) NOT NULL CHECK (exercise_price > 0),
+    cum_session             integer        NOT NULL, -- session_number
+    exercise_start_session  integer        NOT NULL,
+    exercise_end_session    integer        NOT NULL,
+    tradeable               boolean        NOT NULL DEFAULT true,
+    status                  varchar(15)    NOT NULL DEFAULT 'ANNOUNCED'
+        CHECK (status IN ('ANNOUNCED', 'RECORDED', 'EXERCISING', 'COMPLETED', 'CANCELED')),
+    listing_price           numeric(19, 4), -- harga teoritis rights saat mulai diperdagangkan
+    total_rights            bigint         NOT NULL DEFAULT 0,
+    exercised_rights        bigint         NOT NULL DEFAULT 0,
+    lapsed_rights           bigint         NOT NULL DEFAULT 0,
+    created_by              uuid           REFERENCES public.users ON DELETE SET NULL,
+    created_at              timestamp      DEFAULT now(),
+    recorded_at             timestamp,
+    started_at              timestamp,
+    completed_at            timestamp
+);
+
+CREATE INDEX IF NOT EXISTS idx_rights_issues_stock
+    ON public.rights_issues (stock_id, created_at DESC);
+
+-- 2. Hak per user: rights_granted dari pencatatan, pembeli rights tercatat dengan rights_granted = 0
+CREATE TABLE IF NOT EXISTS public.rights_entitlements
+(
+    rights_issue_id   uuid      NOT NULL REFERENCES public.rights_issues ON DELETE CASCADE,
+    user_id           uuid      NOT NULL REFERENCES public.users ON DELETE CASCADE,
+    quantity_held     integer   NOT NULL DEFAULT 0, -- lot saham saat penutupan cum_session
+    rights_granted    integer   NOT NULL DEFAULT 0,
+    rights_exercised  integer   NOT NULL DEFAULT 0,
+    rights_lapsed     integer   NOT NULL DEFAULT 0,
+    updated_at        timestamp DEFAULT now(),
+    PRIMARY KEY (rights_issue_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rights_entitlements_user
+    ON public.rights_entitlements (user_id);
+
+-- 3. Riwayat exercise
+CREATE TABLE IF NOT EXISTS public.rights_exercises
+(
+    id               uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    rights_issue_id  uuid           NOT NULL REFERENCES public.rights_issues ON DELETE CASCADE,
+    user_id          uuid           NOT NULL REFERENCES public.users ON DELETE CASCADE,
+    quantity         integer        NOT NULL CHECK (quantity > 0),
+    amount           numeric(19, 4) NOT NULL,
+    created_at       timestamp      DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_rights_exercises_issue
+    ON public.rights_exercises (rights_issue_id, created_at);
+
+-- Konfirmasi
+SELECT 'Migration completed: rights_issues, rights_entitlements and rights_exercises tables created.' as status;
@@ -0,0 +1,32 @@
+-- Migration: Self-trade prevention (STP) per user
+-- users.stp_mode menentukan apa yang terjadi jika order BUY dan SELL milik user yang sama bertemu:
+--   CANCEL_NEWEST (default) = batalkan order yang lebih baru
+--   CANCEL_OLDEST           = batalkan order yang lebih lama
+--   CANCEL_BOTH             = batalkan keduanya
+--   DECREMENT               = kurangi keduanya sebesar jumlah terkecil
+-- Setiap kejadian dicatat di stp_events sebagai audit.
+-- Jalankan script ini di database PostgreSQL
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS stp_mode character varying(15) DEFAULT 'CANCEL_NEWEST';
+
+ALTER TABLE public.users DROP CONSTRAINT IF EXISTS users_stp_mode_check;
+ALTER TABLE public.users ADD CONSTRAINT users_stp_mode_check
+    CHECK (stp_mode IN ('CANCEL_NEWEST', 'CANCEL_OLDEST', 'CANCEL_BOTH', 'DECREMENT'));
+
+CREATE TABLE IF NOT EXISTS public.stp_events (
+    id bigserial PRIMARY KEY,
+    user_id uuid NOT NULL REFERENCES public.users(id),
+    stock_id integer NOT NULL REFERENCES public.stocks(id),
+    mode character varying(15) NOT NULL,
+    buy_order_id uuid NOT NULL,
+    sell_order_id uuid NOT NULL,
+    buy_action character varying(15) NOT NULL,  -- NONE / CANCELED / DECREMENTED
+    sell_action character varying(15) NOT NULL,
+    quantity bigint DEFAULT 0 NOT NULL,         -- lot yang dikurangi (DECREMENT)
+    created_at timestamp with time zone DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_stp_events_user ON public.stp_events (user_id, created_at DESC);
+
+-- Konfirmasi
+SELECT 'Migration completed: users.stp_mode and stp_events added.' as status;
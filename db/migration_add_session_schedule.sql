@@ -0,0 +1,39 @@
+-- Migration: Jadwal sesi trading otomatis & kalender bursa
+-- market_schedule (satu baris, id = 1) berisi jam setiap fase dalam zona waktu bursa:
+--   PRE_OPEN -> LOCKED -> OPEN (sesi 1) -> BREAK -> OPEN (sesi 2) -> PRE_CLOSE -> CLOSED
+-- break_at/session2_at boleh NULL (tanpa istirahat). Scheduler hanya berjalan jika enabled = true.
+-- manual_*_seconds dipakai untuk sesi yang dibuka manual oleh admin (menggantikan durasi hard-coded).
+-- market_holidays berisi tanggal libur bursa (tidak ada sesi otomatis).
+-- Jalankan script ini di database PostgreSQL
+
+CREATE TABLE IF NOT EXISTS public.market_schedule (
+    id integer PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+    enabled boolean DEFAULT false NOT NULL,
+    timezone character varying(50) DEFAULT 'Asia/Jakarta' NOT NULL,
+    trading_days integer[] DEFAULT '{1,2,3,4,5}' NOT NULL, -- ISO weekday, 1 = Senin
+    pre_open_at time without time zone DEFAULT '08:45' NOT NULL,
+    locked_at time without time zone DEFAULT '08:58' NOT NULL,
+    session1_at time without time zone DEFAULT '09:00' NOT NULL,
+    break_at time without time zone DEFAULT '12:00',
+    session2_at time without time zone DEFAULT '13:30',
+    pre_close_at time without time zone DEFAULT '15:50' NOT NULL,
+    close_at time without time zone DEFAULT '16:00' NOT NULL,
+    manual_pre_open_seconds integer DEFAULT 15 NOT NULL,
+    manual_locked_seconds integer DEFAULT 5 NOT NULL,
+    updated_at timestamp with time zone DEFAULT now()
+);
+
+INSERT INTO public.market_schedule (id) VALUES (1) ON CONFLICT (id) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS public.market_holidays (
+    holiday_date date PRIMARY KEY,
+    description character varying(100),
+    created_at timestamp with time zone DEFAULT now()
+);
+
+-- Sesi yang dibuat scheduler & tanggal bursanya (untuk melanjutkan fase setelah restart)
+ALTER TABLE public.trading_sessions ADD COLUMN IF NOT EXISTS scheduled boolean DEFAULT false NOT NULL;
+ALTER TABLE public.trading_sessions ADD COLUMN IF NOT EXISTS trading_date date;
+
+-- Konfirmasi
+SELECT 'Migration completed: market_schedule, market_holidays and trading_sessions.scheduled added.' as status;
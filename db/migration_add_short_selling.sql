@@ -0,0 +1,100 @@
+-- Migration: Short selling dengan margin dan pencatatan saham pinjaman
+-- User yang mengaktifkan short selling boleh memasang order SELL tanpa memiliki saham (order short).
+-- Order short menahan initial margin (initial_margin_pct dari nilai order) di reserved_rdn.
+-- Saat match, saham dipinjam (dicatat di short_positions, bukan portfolios) dan hasil penjualan
+-- beserta margin menjadi jaminan (collateral). Order BUY menutup posisi short lebih dulu.
+-- Setiap penutupan sesi posisi dinilai dengan harga penutupan (short_marks), biaya pinjam dipotong
+-- dari jaminan, dan posisi di bawah maintenance_margin_pct ditutup paksa (buy-in) di harga penutupan.
+-- Kekurangan yang tidak tertutup jaminan dan saldo tersedia menjadi utang margin (margin call),
+-- ditagih dari saldo tersedia setiap penutupan sesi berikutnya.
+-- Posisi short yang terbuka saat cum-date dividen membayar dividen tersebut (dari jaminan lebih dulu),
+-- karena pembeli saham pinjaman ikut menerima dividen. Rights issue tidak bisa diumumkan selama
+-- masih ada posisi atau order short, dan short sell ditutup sampai rights tercatat.
+-- Jalankan script ini di database PostgreSQL
+
+-- 1. Pengaturan (satu baris)
+CREATE TABLE IF NOT EXISTS public.short_selling_settings
+(
+    id                      integer PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+    is_enabled              boolean      NOT NULL DEFAULT true,
+    initial_margin_pct      numeric(7,4) NOT NULL DEFAULT 50 CHECK (initial_margin_pct > 0),
+    maintenance_margin_pct  numeric(7,4) NOT NULL DEFAULT 30 CHECK (maintenance_margin_pct >= 0),
+    borrow_fee_pct          numeric(7,4) NOT NULL DEFAULT 0.05 CHECK (borrow_fee_pct >= 0), -- per sesi, dari nilai pasar
+    updated_at              timestamp with time zone DEFAULT now()
+);
+
+INSERT INTO public.short_selling_settings (id) VALUES (1) ON CONFLICT (id) DO NOTHING;
+
+-- 2. Opt-in per user dan utang margin (margin call) yang belum dibayar
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS short_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS margin_debt numeric(19,4) NOT NULL DEFAULT 0;
+
+-- 3. Order short dan margin yang ditahannya (persen dari nilai order, ditetapkan saat order dipasang)
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS is_short boolean NOT NULL DEFAULT false;
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS margin_pct numeric(7,4) NOT NULL DEFAULT 0;
+
+-- 4. Posisi short: lot yang dipinjam dan jaminannya
+CREATE TABLE IF NOT EXISTS public.short_positions
+(
+    user_id          uuid           NOT NULL REFERENCES public.users ON DELETE CASCADE,
+    stock_id         integer        NOT NULL REFERENCES public.stocks ON DELETE CASCADE,
+    quantity         bigint         NOT NULL DEFAULT 0 CHECK (quantity >= 0), -- lot yang masih dipinjam
+    avg_short_price  numeric(19,4)  NOT NULL DEFAULT 0,
+    collateral       numeric(19,4)  NOT NULL DEFAULT 0, -- hasil penjualan bersih + margin
+    borrow_fees      numeric(19,4)  NOT NULL DEFAULT 0, -- total biaya pinjam yang sudah dipotong
+    last_price       numeric(19,4),
+    margin_ratio     numeric(12,4), -- (collateral - nilai pasar) / nilai pasar, persen, saat penilaian terakhir
+    opened_at        timestamp with time zone DEFAULT now(),
+    updated_at       timestamp with time zone DEFAULT now(),
+    PRIMARY KEY (user_id, stock_id)
+);
+
+-- 5. Riwayat: penjualan short, penutupan (cover), buy-in dan dividen yang dibayar posisi short
+CREATE TABLE IF NOT EXISTS public.short_fills
+(
+    id               bigserial PRIMARY KEY,
+    trade_id         uuid REFERENCES public.trades(id), -- NULL untuk buy-in
+    order_id         uuid REFERENCES public.orders(id),
+    session_id       integer REFERENCES public.trading_sessions(id),
+    user_id          uuid           NOT NULL REFERENCES public.users ON DELETE CASCADE,
+    stock_id         integer        NOT NULL REFERENCES public.stocks ON DELETE CASCADE,
+    kind             varchar(10)    NOT NULL,
+    quantity         bigint         NOT NULL CHECK (quantity > 0),
+    price            numeric(19,4)  NOT NULL,
+    avg_short_price  numeric(19,4)  NOT NULL,
+    collateral       numeric(19,4)  NOT NULL, -- jaminan yang masuk (SHORT) atau dilepas (COVER / BUY_IN)
+    fee              numeric(19,4)  NOT NULL DEFAULT 0,
+    pnl              numeric(19,4), -- (avg_short_price - price) * lot * 100 - fee, untuk COVER / BUY_IN; -dividen untuk DIVIDEND
+    created_at       timestamp with time zone DEFAULT now()
+);
+
+ALTER TABLE public.short_fills DROP CONSTRAINT IF EXISTS short_fills_kind_check;
+ALTER TABLE public.short_fills ADD CONSTRAINT short_fills_kind_check
+    CHECK (kind IN ('SHORT', 'COVER', 'BUY_IN', 'DIVIDEND'));
+
+CREATE INDEX IF NOT EXISTS idx_short_fills_user ON public.short_fills (user_id, created_at DESC);
+
+-- 6. Penilaian harian (mark to market) setiap penutupan sesi
+CREATE TABLE IF NOT EXISTS public.short_marks
+(
+    session_id    integer        NOT NULL REFERENCES public.trading_sessions(id),
+    user_id       uuid           NOT NULL REFERENCES public.users ON DELETE CASCADE,
+    stock_id      integer        NOT NULL REFERENCES public.stocks ON DELETE CASCADE,
+    quantity      bigint         NOT NULL,
+    price         numeric(19,4)  NOT NULL, -- harga penutupan
+    market_value  numeric(19,4)  NOT NULL,
+    borrow_fee    numeric(19,4)  NOT NULL DEFAULT 0,
+    collateral    numeric(19,4)  NOT NULL, -- setelah biaya pinjam
+    equity        numeric(19,4)  NOT NULL, -- collateral - market_value
+    margin_ratio  numeric(12,4)  NOT NULL,
+    status        varchar(10)    NOT NULL CHECK (status IN ('OK', 'BUY_IN')),
+    debt          numeric(19,4)  NOT NULL DEFAULT 0, -- kekurangan buy-in yang menjadi utang margin
+    created_at    timestamp with time zone DEFAULT now(),
+    PRIMARY KEY (session_id, user_id, stock_id)
+);
+
+ALTER TABLE public.short_marks ADD COLUMN IF NOT EXISTS debt numeric(19,4) NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_short_marks_user ON public.short_marks (user_id, session_id DESC);
+
+SELECT 'Migration completed: short selling settings, short orders, short_positions, short_fills and short_marks added' as status;
@@ -0,0 +1,53 @@
+-- Migration: Fee transaksi dan pajak
+-- fee_schedules: komisi broker (beli/jual), levy bursa dan PPh final penjualan, dalam persen
+-- dari nilai transaksi. Jadwal paling spesifik yang aktif dipakai: saham + tier, saham, tier,
+-- lalu global. Tarif disimpan di order saat order dipasang, sehingga reservasi BUY selalu
+-- menutup fee saat settlement.
+-- trade_fees: rincian gross, fee dan net per sisi setiap trade (bot tidak dikenai fee).
+-- Jalankan script ini di database PostgreSQL
+
+CREATE TABLE IF NOT EXISTS public.fee_schedules (
+    id serial PRIMARY KEY,
+    user_tier character varying(20),               -- NULL = semua tier
+    stock_id integer REFERENCES public.stocks(id), -- NULL = semua saham
+    buy_commission_pct numeric(7,4) NOT NULL DEFAULT 0,
+    sell_commission_pct numeric(7,4) NOT NULL DEFAULT 0,
+    levy_pct numeric(7,4) NOT NULL DEFAULT 0,      -- dikenakan ke pembeli dan penjual
+    sales_tax_pct numeric(7,4) NOT NULL DEFAULT 0, -- hanya penjual
+    is_active boolean NOT NULL DEFAULT true,
+    updated_at timestamp with time zone DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS uq_fee_schedules_scope ON public.fee_schedules ((COALESCE(user_tier, '')), (COALESCE(stock_id, 0)));
+
+-- Jadwal global: beli 0.15% (komisi 0.10% + levy 0.05%), jual 0.25% (+ PPh final 0.10%)
+INSERT INTO public.fee_schedules (user_tier, stock_id, buy_commission_pct, sell_commission_pct, levy_pct, sales_tax_pct)
+SELECT NULL, NULL, 0.10, 0.10, 0.05, 0.10
+WHERE NOT EXISTS (SELECT 1 FROM public.fee_schedules WHERE user_tier IS NULL AND stock_id IS NULL);
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS fee_tier character varying(20) NOT NULL DEFAULT 'REGULAR';
+
+-- Tarif yang berlaku untuk order (order lama: 0)
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS fee_commission_pct numeric(7,4) NOT NULL DEFAULT 0;
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS fee_levy_pct numeric(7,4) NOT NULL DEFAULT 0;
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS fee_tax_pct numeric(7,4) NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS public.trade_fees (
+    trade_id uuid NOT NULL REFERENCES public.trades(id),
+    order_id uuid NOT NULL,
+    user_id uuid NOT NULL REFERENCES public.users(id),
+    side character varying(4) NOT NULL,            -- BUY / SELL
+    gross numeric(19,4) NOT NULL,                  -- harga x lot x 100
+    commission numeric(19,4) NOT NULL DEFAULT 0,
+    levy numeric(19,4) NOT NULL DEFAULT 0,
+    tax numeric(19,4) NOT NULL DEFAULT 0,
+    fee numeric(19,4) NOT NULL DEFAULT 0,
+    net numeric(19,4) NOT NULL,                    -- dibayar pembeli (gross + fee) / diterima penjual (gross - fee)
+    created_at timestamp with time zone DEFAULT now(),
+    PRIMARY KEY (trade_id, side)
+);
+
+CREATE INDEX IF NOT EXISTS idx_trade_fees_order ON public.trade_fees (order_id);
+CREATE INDEX IF NOT EXISTS idx_trade_fees_user ON public.trade_fees (user_id, created_at DESC);
+
+SELECT 'Migration completed: fee_schedules, trade_fees and order fee rates added' as status;
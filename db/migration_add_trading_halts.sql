@@ -0,0 +1,40 @@
+-- Migration: Circuit breaker & trading halt
+-- circuit_breaker_config (satu baris, id = 1): ambang volatility interruption per saham
+-- (volatility_pct dalam volatility_window_sec detik), lama lelang pembukaan kembali, dan
+-- ambang penurunan indeks untuk menghentikan seluruh market.
+-- trading_halts mencatat setiap halt; halt yang resumed_at-nya NULL masih aktif dan
+-- dipulihkan saat server restart. symbol NULL berarti halt seluruh market.
+-- Jalankan script ini di database PostgreSQL (setelah migration_add_auction_allocation.sql)
+
+CREATE TABLE IF NOT EXISTS public.circuit_breaker_config (
+    id integer PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+    enabled boolean NOT NULL DEFAULT true,
+    volatility_pct numeric(6,2) NOT NULL DEFAULT 5,
+    volatility_window_sec integer NOT NULL DEFAULT 60,
+    reopen_auction_sec integer NOT NULL DEFAULT 120,
+    index_drop_pct numeric(6,2) NOT NULL DEFAULT 8,       -- 0 = nonaktif
+    market_halt_sec integer NOT NULL DEFAULT 1800,        -- 0 = sampai di-resume admin
+    updated_at timestamp with time zone DEFAULT now()
+);
+
+INSERT INTO public.circuit_breaker_config (id) VALUES (1) ON CONFLICT (id) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS public.trading_halts (
+    id bigserial PRIMARY KEY,
+    symbol character varying(10),                 -- NULL = seluruh market
+    scope character varying(10) NOT NULL,         -- SYMBOL / MARKET
+    reason character varying(15) NOT NULL,        -- VOLATILITY / INDEX_DROP / MANUAL
+    phase character varying(10) NOT NULL,         -- HALTED / AUCTION / RESUMED
+    detail text,
+    halted_at timestamp with time zone NOT NULL DEFAULT now(),
+    phase_until timestamp with time zone,         -- NULL = sampai di-resume admin
+    resumed_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS idx_trading_halts_active ON public.trading_halts (halted_at) WHERE resumed_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_trading_halts_symbol ON public.trading_halts (symbol, halted_at DESC);
+
+-- Kind lelang baru: REOPENING (lelang pembukaan kembali setelah halt)
+COMMENT ON COLUMN public.auction_reports.kind IS 'OPENING / CLOSING / REOPENING';
+
+SELECT 'Migration completed: circuit breaker & trading halts' as status;
@@ -19,7 +19,7 @@ try {
 }
 
 Write-Host "Pilih opsi pembersihan:" -ForegroundColor Yellow
-Write-Host "  1. Hapus hanya key 'orderbook:*' (AMAN - Session user tidak hilang)" -ForegroundColor Green
+Write-Host "  1. Hapus hanya key 'orderbook:*' dan 'order:*' (AMAN - Session user tidak hilang)" -ForegroundColor Green
 Write-Host "  2. FLUSHDB - Hapus SEMUA data (BAHAYA - Semua data hilang)" -ForegroundColor Red
 Write-Host "  3. Batal / Exit" -ForegroundColor Gray
 Write-Host ""
@@ -31,9 +31,9 @@ switch ($choice) {
         Write-Host ""
         Write-Host "🔍 Scanning key 'orderbook:*'..." -ForegroundColor Yellow
 
-        # Ambil list key orderbook
+        # Ambil list key orderbook (index ZSET) dan detail order (hash per order)
         # Menggunakan array wrapper @() memastikan hasil tetap array walau cuma 1 item
-        $keys = @( & $redisCliPath --scan --pattern "orderbook:*" )
+        $keys = @( & $redisCliPath --scan --pattern "orderbook:*" ) + @( & $redisCliPath --scan --pattern "order:*" )
 
         if ($keys.Count -gt 0) {
             Write-Host "  Ditemukan $($keys.Count) key orderbook." -ForegroundColor Cyan
@@ -0,0 +1,38 @@
+// Command migrate-orderbook converts orderbooks stored as JSON ZSET members
+// (orderbook:<symbol>:<side> -> RedisOrderData JSON) into the order-ID-keyed layout
+// (ZSET of order IDs + order:<id> hashes), in place.
+//
+// Run from the go-backend directory with the backend stopped:
+//
+//	go run ./cmd/migrate-orderbook            # convert
+//	go run ./cmd/migrate-orderbook -dry-run   # report only
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report what would be converted without writing")
+	flag.Parse()
+
+	config.LoadEnv()
+	config.ConnectRedis()
+	defer config.CloseRedis()
+
+	report, err := engine.MigrateLegacyBooks(context.Background(), *dryRun)
+	if err != nil {
+		log.Fatalf("❌ Orderbook migration failed: %v", err)
+	}
+
+	mode := "Converted"
+	if *dryRun {
+		mode = "Would convert"
+	}
+	log.Printf("✅ %s %d orders across %d keys (%d unreadable or exhausted entries)", mode, report.Converted, report.Keys, report.Skipped)
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"time"
 
+	"mbit-backend-go/core/metrics"
+
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -36,6 +38,9 @@ func ConnectDB() {
 	// Connection timeout
 	config.ConnConfig.ConnectTimeout = 10 * time.Second
 
+	// Time every call for /metrics
+	config.ConnConfig.Tracer = dbTracer{}
+
 	// Set statement timeout on connect
 	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
 		_, err := conn.Exec(ctx, "SET statement_timeout = 10000")
@@ -58,10 +63,31 @@ func ConnectDB() {
 
 	log.Println("✅ Database connected successfully with high-throughput pool")
 
+	registerPoolMetrics()
+
 	// Start monitoring goroutine
 	go monitorDB()
 }
 
+// registerPoolMetrics exports the pool counters, read at scrape time
+func registerPoolMetrics() {
+	metrics.Default.GaugeFunc("mbit_db_pool_total_conns", "Connections in the DB pool.", func() float64 {
+		return float64(DB.Stat().TotalConns())
+	})
+	metrics.Default.GaugeFunc("mbit_db_pool_acquired_conns", "DB connections in use.", func() float64 {
+		return float64(DB.Stat().AcquiredConns())
+	})
+	metrics.Default.GaugeFunc("mbit_db_pool_idle_conns", "Idle DB connections.", func() float64 {
+		return float64(DB.Stat().IdleConns())
+	})
+	metrics.Default.CounterFunc("mbit_db_pool_empty_acquire_total", "Acquires that had to wait for a connection.", func() float64 {
+		return float64(DB.Stat().EmptyAcquireCount())
+	})
+	metrics.Default.CounterFunc("mbit_db_pool_acquire_wait_seconds_total", "Total time spent waiting for a connection.", func() float64 {
+		return DB.Stat().AcquireDuration().Seconds()
+	})
+}
+
 func monitorDB() {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
@@ -75,6 +101,10 @@ func monitorDB() {
 
 		log.Printf("📊 DB Pool: Total=%d, Active=%d, Idle=%d, Waiting=%d (%.1f%% utilized)",
 			stats.TotalConns(), stats.AcquiredConns(), stats.IdleConns(), stats.NewConnsCount(), utilization)
+
+		for op, h := range DBLatency.Snapshot() {
+			log.Printf("📊 DB %s: %d calls, avg %.2fms, p95 %.2fms, %d errors", op, h.Count, h.AvgMs, h.P95Ms, DBErrors.With(op).Value())
+		}
 	}
 }
 
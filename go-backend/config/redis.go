@@ -53,6 +53,11 @@ func ConnectRedis() {
 		WriteTimeout: 2 * time.Second,
 	})
 
+	// Time every command for /metrics
+	for _, client := range []*redis.Client{RedisMain, RedisSub, RedisLock} {
+		client.AddHook(redisHook{})
+	}
+
 	// Check Connections
 	if _, err := RedisMain.Ping(Ctx).Result(); err != nil {
 		log.Fatalf("❌ Redis Main connection failed: %v", err)
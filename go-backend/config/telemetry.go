@@ -0,0 +1,113 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"mbit-backend-go/core/metrics"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// Latency of every DB and Redis call, by SQL command / Redis command
+var (
+	DBLatency    = metrics.NewHistogramVec("op", metrics.LatencyBuckets)
+	DBErrors     = metrics.NewCounterVec("op")
+	RedisLatency = metrics.NewHistogramVec("cmd", metrics.LatencyBuckets)
+	RedisErrors  = metrics.NewCounterVec("cmd")
+)
+
+func init() {
+	metrics.Default.HistogramVec("mbit_db_call_seconds", "Latency of DB calls by SQL command.", DBLatency)
+	metrics.Default.CounterVec("mbit_db_errors_total", "Failed DB calls by SQL command.", DBErrors)
+	metrics.Default.HistogramVec("mbit_redis_call_seconds", "Latency of Redis calls by command.", RedisLatency)
+	metrics.Default.CounterVec("mbit_redis_errors_total", "Failed Redis calls by command.", RedisErrors)
+}
+
+type traceKey struct{}
+
+type traceStart struct {
+	op string
+	at time.Time
+}
+
+// dbTracer times every Query/QueryRow/Exec (including BEGIN/COMMIT) and CopyFrom
+type dbTracer struct{}
+
+func (dbTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceStart{op: sqlCommand(data.SQL), at: time.Now()})
+}
+
+func (dbTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	observeDB(ctx, data.Err)
+}
+
+func (dbTracer) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceCopyFromStartData) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceStart{op: "COPY", at: time.Now()})
+}
+
+func (dbTracer) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	observeDB(ctx, data.Err)
+}
+
+func observeDB(ctx context.Context, err error) {
+	start, ok := ctx.Value(traceKey{}).(traceStart)
+	if !ok {
+		return
+	}
+	DBLatency.With(start.op).Since(start.at)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		DBErrors.With(start.op).Inc()
+	}
+}
+
+// sqlCommand is the leading keyword of a statement, e.g. SELECT or UPDATE
+func sqlCommand(sql string) string {
+	fields := strings.Fields(sql)
+	for _, f := range fields {
+		if strings.HasPrefix(f, "--") {
+			continue
+		}
+		op := strings.ToUpper(strings.TrimLeft(f, "("))
+		switch op {
+		case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH", "BEGIN", "COMMIT", "ROLLBACK", "SET":
+			return op
+		}
+		return "OTHER"
+	}
+	return "OTHER"
+}
+
+// redisHook times every Redis command and pipeline
+type redisHook struct{}
+
+func (redisHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		observeRedis(cmd.Name(), start, err)
+		return err
+	}
+}
+
+func (redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		observeRedis("pipeline", start, err)
+		return err
+	}
+}
+
+func observeRedis(cmd string, start time.Time, err error) {
+	cmd = strings.ToLower(cmd)
+	RedisLatency.With(cmd).Since(start)
+	if err != nil && err != redis.Nil {
+		RedisErrors.With(cmd).Inc()
+	}
+}
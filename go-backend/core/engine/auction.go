@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"context"
+	"sort"
+
+	"mbit-backend-go/config"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Call-auction allocation.
+// At the IEP every eligible order on the short side fills completely. On the long side
+// price levels fill best-first; the marginal level that no longer fits is rationed by
+// the session's allocation policy. Every uncrossing is persisted as an auction report.
+
+// Auction allocation policies (trading_sessions.auction_policy)
+const (
+	AuctionPriceTime = "PRICE_TIME" // marginal level filled by time priority
+	AuctionProRata   = "PRO_RATA"   // marginal level shared in proportion to quantity
+)
+
+// IsValidAuctionPolicy reports whether p is a known allocation policy
+func IsValidAuctionPolicy(p string) bool {
+	return p == AuctionPriceTime || p == AuctionProRata
+}
+
+// Auction kinds
+const (
+	AuctionOpening = "OPENING"
+	AuctionClosing = "CLOSING"
+)
+
+// Allocation reasons
+const (
+	allocFull      = "FULL"       // the order's price level fit entirely
+	allocPriceTime = "PRICE_TIME" // rationed at the marginal level by time
+	allocProRata   = "PRO_RATA"   // rationed at the marginal level pro-rata
+	allocNone      = "NONE"       // marginal level exhausted before this order
+)
+
+// AuctionAllocation is what one eligible order was given in an auction
+type AuctionAllocation struct {
+	OrderId   string  `json:"order_id"`
+	UserId    string  `json:"user_id"`
+	Side      string  `json:"side"` // BUY or SELL
+	Price     float64 `json:"price"`
+	Timestamp int64   `json:"timestamp"`
+	Requested int64   `json:"requested_quantity"`
+	Allocated int64   `json:"allocated_quantity"`
+	Filled    int64   `json:"filled_quantity"` // below Allocated only if STP or a settlement error intervened
+	Reason    string  `json:"reason"`
+}
+
+// sortForAuction orders eligible orders by price priority, then time
+func sortForAuction(orders []ParsedOrder, side string) {
+	sort.SliceStable(orders, func(i, j int) bool {
+		if orders[i].Price != orders[j].Price {
+			if side == SideBuy {
+				return orders[i].Price > orders[j].Price
+			}
+			return orders[i].Price < orders[j].Price
+		}
+		return orders[i].Data.Timestamp < orders[j].Data.Timestamp
+	})
+}
+
+// allocate distributes volume lots over orders sorted by sortForAuction
+func allocate(orders []ParsedOrder, side string, volume int64, policy string) []AuctionAllocation {
+	orderType := "BUY"
+	if side == SideSell {
+		orderType = "SELL"
+	}
+
+	allocs := make([]AuctionAllocation, len(orders))
+	for i, o := range orders {
+		allocs[i] = AuctionAllocation{
+			OrderId: o.Data.OrderId, UserId: o.Data.UserId, Side: orderType, Price: o.Price,
+			Timestamp: o.Data.Timestamp, Requested: o.Data.RemainingQuantity, Reason: allocNone,
+		}
+	}
+
+	left := volume
+	for start := 0; start < len(orders) && left > 0; {
+		// One price level
+		end := start
+		var levelQty int64
+		for end < len(orders) && orders[end].Price == orders[start].Price {
+			levelQty += orders[end].Data.RemainingQuantity
+			end++
+		}
+
+		level := allocs[start:end]
+		switch {
+		case levelQty <= left:
+			for i := range level {
+				level[i].Allocated, level[i].Reason = level[i].Requested, allocFull
+			}
+			left -= levelQty
+		case policy == AuctionProRata:
+			allocateProRata(level, left, levelQty)
+			left = 0
+		default:
+			for i := range level {
+				level[i].Allocated = min(level[i].Requested, left)
+				left -= level[i].Allocated
+				if level[i].Allocated > 0 {
+					level[i].Reason = allocPriceTime
+				}
+			}
+		}
+		start = end
+	}
+	return allocs
+}
+
+// allocateProRata shares available lots over a level in proportion to each order's
+// quantity, rounded down; the lots lost to rounding go one by one in time priority
+func allocateProRata(level []AuctionAllocation, available, levelQty int64) {
+	left := available
+	for i := range level {
+		level[i].Allocated = available * level[i].Requested / levelQty
+		left -= level[i].Allocated
+	}
+	for left > 0 {
+		for i := range level {
+			if left > 0 && level[i].Allocated < level[i].Requested {
+				level[i].Allocated++
+				left--
+			}
+		}
+	}
+	for i := range level {
+		if level[i].Allocated > 0 {
+			level[i].Reason = allocProRata
+		}
+	}
+}
+
+// auctionSession is the running session and its allocation policy
+func auctionSession(ctx context.Context) (int, string) {
+	var sessionId int
+	var policy string
+	err := config.DB.QueryRow(ctx, `
+		SELECT id, COALESCE(auction_policy, $1)
+		FROM trading_sessions
+		WHERE status IN ('PRE_OPEN', 'LOCKED', 'OPEN', 'BREAK', 'PRE_CLOSE')
+		ORDER BY id DESC LIMIT 1
+	`, AuctionPriceTime).Scan(&sessionId, &policy)
+	if err != nil {
+		return 0, AuctionPriceTime
+	}
+	return sessionId, policy
+}
+
+// saveAuctionReport persists one uncrossing and every eligible order's allocation
+func saveAuctionReport(ctx context.Context, sessionId int, symbol, kind, policy string, iep *IEPResult, executed int64, allocs []AuctionAllocation) error {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var reportId int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO auction_reports (session_id, stock_id, kind, policy, price, matched_volume, executed_volume, surplus, imbalance_side, tie_break)
+		SELECT NULLIF($1, 0), id, $3, $4, $5, $6, $7, $8, $9, $10 FROM stocks WHERE symbol = $2
+		RETURNING id
+	`, sessionId, symbol, kind, policy, iep.Price, iep.MatchedVolume, executed, iep.Surplus, iep.ImbalanceSide(), iep.TieBreak).Scan(&reportId)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]any, len(allocs))
+	for i, a := range allocs {
+		rows[i] = []any{reportId, a.OrderId, a.UserId, a.Side, a.Price, a.Timestamp, a.Requested, a.Allocated, a.Filled, a.Reason}
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"auction_allocations"},
+		[]string{"report_id", "order_id", "user_id", "side", "price", "order_timestamp", "requested_quantity", "allocated_quantity", "filled_quantity", "reason"},
+		pgx.CopyFromRows(rows))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
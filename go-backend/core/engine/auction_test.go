@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortForAuction(t *testing.T) {
+	orders := func() []ParsedOrder {
+		return []ParsedOrder{
+			order("a", "u1", 100, 1, 0, 3),
+			order("b", "u1", 101, 1, 0, 2),
+			order("c", "u1", 100, 1, 0, 1),
+		}
+	}
+
+	buys := orders()
+	sortForAuction(buys, SideBuy)
+	if got, want := ids(buys), []string{"b", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("buy priority = %v, want %v", got, want)
+	}
+	sells := orders()
+	sortForAuction(sells, SideSell)
+	if got, want := ids(sells), []string{"c", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sell priority = %v, want %v", got, want)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	// Bids in auction priority: one level at 101, the marginal level at 100
+	bids := []ParsedOrder{
+		order("a", "u1", 101, 4, 0, 1),
+		order("b", "u2", 100, 6, 0, 2),
+		order("c", "u3", 100, 3, 0, 3),
+		order("d", "u4", 100, 1, 0, 4),
+	}
+
+	tests := []struct {
+		name        string
+		volume      int64
+		policy      string
+		wantAlloc   []int64
+		wantReasons []string
+	}{
+		{
+			name:        "every level fits",
+			volume:      14,
+			policy:      AuctionPriceTime,
+			wantAlloc:   []int64{4, 6, 3, 1},
+			wantReasons: []string{allocFull, allocFull, allocFull, allocFull},
+		},
+		{
+			name:        "price-time rations the marginal level by time",
+			volume:      11,
+			policy:      AuctionPriceTime,
+			wantAlloc:   []int64{4, 6, 1, 0},
+			wantReasons: []string{allocFull, allocPriceTime, allocPriceTime, allocNone},
+		},
+		{
+			name:        "pro-rata shares the marginal level by quantity",
+			volume:      9,
+			policy:      AuctionProRata,
+			wantAlloc:   []int64{4, 4, 1, 0},
+			wantReasons: []string{allocFull, allocProRata, allocProRata, allocNone},
+		},
+		{
+			name:        "pro-rata rounding leftovers go by time",
+			volume:      12,
+			policy:      AuctionProRata,
+			wantAlloc:   []int64{4, 5, 3, 0},
+			wantReasons: []string{allocFull, allocProRata, allocProRata, allocNone},
+		},
+		{
+			name:        "pro-rata order rounded to nothing gets no allocation",
+			volume:      6,
+			policy:      AuctionProRata,
+			wantAlloc:   []int64{4, 2, 0, 0},
+			wantReasons: []string{allocFull, allocProRata, allocNone, allocNone},
+		},
+		{
+			name:        "best level rationed leaves the rest unfilled",
+			volume:      3,
+			policy:      AuctionPriceTime,
+			wantAlloc:   []int64{3, 0, 0, 0},
+			wantReasons: []string{allocPriceTime, allocNone, allocNone, allocNone},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocs := allocate(bids, SideBuy, tt.volume, tt.policy)
+
+			var gotAlloc []int64
+			var gotReasons []string
+			var total int64
+			for _, a := range allocs {
+				gotAlloc = append(gotAlloc, a.Allocated)
+				gotReasons = append(gotReasons, a.Reason)
+				total += a.Allocated
+				if a.Side != "BUY" {
+					t.Errorf("%s side = %s, want BUY", a.OrderId, a.Side)
+				}
+			}
+			if !reflect.DeepEqual(gotAlloc, tt.wantAlloc) {
+				t.Errorf("allocated = %v, want %v", gotAlloc, tt.wantAlloc)
+			}
+			if !reflect.DeepEqual(gotReasons, tt.wantReasons) {
+				t.Errorf("reasons = %v, want %v", gotReasons, tt.wantReasons)
+			}
+			if total != tt.volume {
+				t.Errorf("total allocated = %d, want the auction volume %d", total, tt.volume)
+			}
+		})
+	}
+}
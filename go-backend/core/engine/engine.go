@@ -2,17 +2,17 @@ package engine
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"sort"
 	"sync"
 	"time"
 
 	"mbit-backend-go/config"
+	"mbit-backend-go/core/fees"
+	"mbit-backend-go/core/ledger"
 	"mbit-backend-go/models"
 
-	"github.com/redis/go-redis/v9"
 	socketio "github.com/zishang520/socket.io/v2/socket"
 )
 
@@ -23,16 +23,63 @@ type MatchingEngine struct {
 	// Processing Queue per symbol (Mutex per symbol)
 	symbolLocks sync.Map // map[string]*sync.Mutex
 
+	// In-memory order books per symbol, persisted write-behind to Redis
+	books     sync.Map // map[string]*OrderBook
+	persister *bookPersister
+
+	// Called after every settled trade (see OnTrade)
+	tradeListeners []TradeListener
+
+	// Circuit breaker and active trading halts (see halt.go)
+	halt *haltState
+
+	// Counters and latency histograms (see stats.go)
+	stats *engineStats
+
 	IoServer *socketio.Server
 }
 
+// TradeListener receives every settled trade. It runs on its own goroutine,
+// outside the symbol lock, so it may place or cancel orders.
+type TradeListener func(symbol string, price float64, qty int64)
+
 var Engine *MatchingEngine
 
 func InitEngine(io *socketio.Server) {
 	Engine = &MatchingEngine{
 		SessionStatus: StatusClosed,
 		IoServer:      io,
+		persister:     newBookPersister(),
+		halt:          newHaltState(),
+		stats:         newEngineStats(),
 	}
+
+	// Convert any JSON-member books left by older versions, then rebuild books
+	// from the Redis snapshot before accepting mutations
+	if report, err := MigrateLegacyBooks(context.Background(), false); err != nil {
+		log.Println("⚠️  Legacy orderbook migration failed:", err)
+	} else if report.Converted > 0 || report.Skipped > 0 {
+		log.Printf("📚 Legacy orderbook migrated (%d converted, %d skipped)", report.Converted, report.Skipped)
+	}
+
+	// Replay trades whose book mutation never reached Redis before restoring from it
+	if report, err := recoverOutboxToRedis(context.Background()); err != nil {
+		log.Println("⚠️  Book outbox recovery failed:", err)
+	} else if report.Replayed > 0 {
+		log.Printf("📚 Book outbox recovered (%d mutations replayed)", report.Replayed)
+	}
+
+	restored, err := Engine.persister.restore(Engine)
+	if err != nil {
+		log.Println("⚠️  Orderbook restore from Redis incomplete:", err)
+	}
+	log.Printf("📚 Orderbook restored from Redis (%d orders)", restored)
+
+	Engine.loadBreakerConfig(context.Background())
+	Engine.restoreHalts(context.Background())
+
+	go Engine.persister.run()
+	go Engine.runIndexMonitor()
 	go Engine.StartStatsLoop()
 }
 
@@ -41,6 +88,104 @@ func (e *MatchingEngine) getSymbolLock(symbol string) *sync.Mutex {
 	return lock.(*sync.Mutex)
 }
 
+func (e *MatchingEngine) bookFor(symbol string) *OrderBook {
+	if book, ok := e.books.Load(symbol); ok {
+		return book.(*OrderBook)
+	}
+	book, _ := e.books.LoadOrStore(symbol, NewOrderBook(symbol))
+	return book.(*OrderBook)
+}
+
+// Book returns the order book for a symbol for reading.
+// Unknown symbols get an empty, unregistered book.
+func (e *MatchingEngine) Book(symbol string) *OrderBook {
+	if book, ok := e.books.Load(symbol); ok {
+		return book.(*OrderBook)
+	}
+	return NewOrderBook(symbol)
+}
+
+// Symbols lists every symbol that has a book in memory
+func (e *MatchingEngine) Symbols() []string {
+	var symbols []string
+	e.books.Range(func(key, _ any) bool {
+		symbols = append(symbols, key.(string))
+		return true
+	})
+	return symbols
+}
+
+// AddOrder places a resting order in the book. It does not trigger matching.
+func (e *MatchingEngine) AddOrder(symbol, side string, data models.RedisOrderData) {
+	o := ParsedOrder{Data: data, Price: data.Price}
+	e.bookFor(symbol).Add(side, o)
+	e.persister.upsert(symbol, side, o)
+}
+
+// RemoveOrder takes an order out of the book, returning its last state
+func (e *MatchingEngine) RemoveOrder(symbol, orderId string) (ParsedOrder, bool) {
+	o, ok := e.bookFor(symbol).Remove(orderId)
+	if ok {
+		e.persister.remove(symbol, orderId)
+	}
+	return o, ok
+}
+
+// ClearBook drops every resting order of a symbol, in memory and in Redis
+func (e *MatchingEngine) ClearBook(symbol string) []ParsedOrder {
+	removed := e.bookFor(symbol).Clear()
+	ids := make([]string, len(removed))
+	for i, o := range removed {
+		ids[i] = o.Data.OrderId
+	}
+	e.persister.clear(symbol, ids)
+	return removed
+}
+
+// RewriteBook passes every resting order of a symbol through fn and puts the result back
+// on the same side with its time priority; orders fn rejects are removed. Used by corporate
+// actions to rescale prices and quantities. The caller holds the symbol lock.
+func (e *MatchingEngine) RewriteBook(symbol string, fn func(side string, o ParsedOrder) (ParsedOrder, bool)) (kept, removed int) {
+	book := e.bookFor(symbol)
+	for _, side := range []string{SideBuy, SideSell} {
+		for _, o := range book.Orders(side) {
+			book.Remove(o.Data.OrderId)
+			e.persister.remove(symbol, o.Data.OrderId)
+
+			next, ok := fn(side, o)
+			if !ok {
+				removed++
+				continue
+			}
+			book.Add(side, next)
+			e.persister.upsert(symbol, side, next)
+			kept++
+		}
+	}
+	return kept, removed
+}
+
+// OnTrade registers a listener for settled trades
+func (e *MatchingEngine) OnTrade(l TradeListener) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tradeListeners = append(e.tradeListeners, l)
+}
+
+// WithSymbolLock runs fn while holding the matching lock of a symbol, so no trade on it
+// settles concurrently. Used to keep DB changes to resting orders and the book in step.
+func (e *MatchingEngine) WithSymbolLock(symbol string, fn func() error) error {
+	lock := e.getSymbolLock(symbol)
+	lock.Lock()
+	defer lock.Unlock()
+	return fn()
+}
+
+// FlushBooks waits until all queued book mutations are written to Redis
+func (e *MatchingEngine) FlushBooks() {
+	e.persister.flush()
+}
+
 func (e *MatchingEngine) Match(symbol string) {
 	// Goroutine to handle matching to not block caller
 	go func() {
@@ -48,13 +193,15 @@ func (e *MatchingEngine) Match(symbol string) {
 		lock.Lock()
 		defer lock.Unlock()
 
-		ctx := context.Background()
+		e.stats.matches.Inc()
+		defer e.stats.matchLatency.Since(time.Now())
 
 		// 1. Check Status
-		if e.SessionStatus == StatusPreOpen || e.SessionStatus == StatusLocked {
+		if IsCallAuction(e.SessionStatus) {
 			// IEP Calculation
 			iep, err := GlobalIEPEngine.CalculateIEP(symbol)
 			if err != nil {
+				e.stats.errors.Inc()
 				log.Println("IEP Error:", err)
 				return
 			}
@@ -66,94 +213,189 @@ func (e *MatchingEngine) Match(symbol string) {
 			return
 		}
 
+		// A halted symbol does not trade; in its re-opening auction it publishes the IEP
+		if h := e.HaltOf(symbol); h != nil {
+			if h.Phase == HaltAuction {
+				iep, err := GlobalIEPEngine.CalculateIEP(symbol)
+				if err != nil {
+					e.stats.errors.Inc()
+					log.Println("IEP Error:", err)
+					return
+				}
+				e.broadcastIEP(symbol, iep)
+			}
+			return
+		}
+
 		// 2. Continuous Matching
-		matchOccurred := true
-		iterations := 0
-		maxIterations := 100
+		e.matchContinuous(symbol)
 
-		for matchOccurred && iterations < maxIterations {
-			matchOccurred = false
-			iterations++
+		// Broadcast Updates
+		e.BroadcastOrderBook(symbol)
+	}()
+}
 
-			// Fetch Top Orders
-			buyQueue, err := config.RedisMain.ZRevRangeWithScores(ctx, "orderbook:"+symbol+":buy", 0, 19).Result()
-			if err != nil {
-				break
-			}
-			sellQueue, err := config.RedisMain.ZRangeWithScores(ctx, "orderbook:"+symbol+":sell", 0, 19).Result()
-			if err != nil {
-				break
-			}
+// matchContinuous crosses the top of book until it no longer crosses, however many
+// resting orders an incoming one takes out; only a halt or a failed match stops it early.
+// Caller must hold the symbol lock.
+func (e *MatchingEngine) matchContinuous(symbol string) {
+	for {
+		e.stats.loopIterations.Inc()
 
-			if len(buyQueue) == 0 || len(sellQueue) == 0 {
-				break
-			}
+		if e.HaltOf(symbol) != nil {
+			break
+		}
 
-			buys := parseOrders(buyQueue)
-			sells := parseOrders(sellQueue)
+		price, traded, ok := e.matchTop(symbol)
+		if !ok {
+			break
+		}
 
-			// Sort (Price desc for buys, asc for sells - already done by ZRange)
-			// Secondary sort by Time Asc
-			sort.Slice(buys, func(i, j int) bool {
-				if buys[i].Price != buys[j].Price {
-					return buys[i].Price > buys[j].Price
-				}
-				return buys[i].Data.Timestamp < buys[j].Data.Timestamp
-			})
-			sort.Slice(sells, func(i, j int) bool {
-				if sells[i].Price != sells[j].Price {
-					return sells[i].Price < sells[j].Price
-				}
-				return sells[i].Data.Timestamp < sells[j].Data.Timestamp
-			})
+		// Volatility interruption stops the loop, the symbol moves to its re-opening auction
+		if traded && e.checkVolatility(symbol, price) {
+			break
+		}
+	}
+}
 
-			if len(buys) == 0 || len(sells) == 0 {
-				break
-			}
+// matchTop resolves the top of book once: a trade, a self-trade prevention or a resync
+// of a stale order. ok is false if the book does not cross or matching failed; traded
+// reports whether a trade was printed at price.
+// Caller must hold the symbol lock.
+func (e *MatchingEngine) matchTop(symbol string) (price float64, traded, ok bool) {
+	book := e.bookFor(symbol)
+
+	// Top of book is already in Price-Time priority
+	topBuy, ok := book.Best(SideBuy)
+	if !ok {
+		return 0, false, false
+	}
+	topSell, ok := book.Best(SideSell)
+	if !ok {
+		return 0, false, false
+	}
+	if topBuy.Price < topSell.Price {
+		return 0, false, false
+	}
 
-			topBuy := buys[0]
-			topSell := sells[0]
+	if isSelfTrade(topBuy, topSell) {
+		if err := e.preventSelfTrade(symbol, topBuy, topSell); err != nil {
+			e.stats.errors.Inc()
+			log.Println("Self-trade prevention failed:", err)
+			return 0, false, false
+		}
+		return 0, false, true
+	}
 
-			if topBuy.Price >= topSell.Price {
-				matchOccurred = true
+	// Price Time Priority execution price
+	execPrice := topBuy.Price
+	if topBuy.Data.Timestamp >= topSell.Data.Timestamp {
+		execPrice = topSell.Price
+	}
 
-				// Price Time Priority execution price
-				execPrice := topBuy.Price
-				if topBuy.Data.Timestamp >= topSell.Data.Timestamp {
-					execPrice = topSell.Price
-				} else {
-					execPrice = topBuy.Price
-				}
+	if err := e.ExecuteTrade(topBuy, topSell, execPrice, symbol); err != nil {
+		e.stats.errors.Inc()
+		var stale *StaleOrderError
+		if errors.As(err, &stale) {
+			// Book entry out of sync with the DB, resync it and keep matching;
+			// stop if the order row could not be read
+			log.Println("Resyncing stale order in book:", stale.OrderId)
+			return 0, false, e.resyncOrder(symbol, stale.OrderId)
+		}
+		log.Println("Trade execution failed:", err)
+		return 0, false, false
+	}
+	return execPrice, true, true
+}
 
-				if err := e.ExecuteTrade(topBuy.Data, topSell.Data, execPrice, symbol, topBuy.Price, topSell.Price, topBuy.Raw, topSell.Raw); err != nil {
-					log.Println("Trade execution failed:", err)
-					break
-				}
+// MatchImmediate runs an IOC/FOK order against the book. The order never rests:
+// whatever is not filled right away is canceled and its reservation released.
+// An FOK order only trades if the book can fill all of it: resting quantity of other
+// users, iceberg reserves included, up to the first order self-trade prevention would
+// stop it at.
+func (e *MatchingEngine) MatchImmediate(symbol, side, timeInForce string, data models.RedisOrderData) {
+	go func() {
+		lock := e.getSymbolLock(symbol)
+		lock.Lock()
+		defer lock.Unlock()
+
+		e.stats.matches.Inc()
+		defer e.stats.matchLatency.Since(time.Now())
+
+		book := e.bookFor(symbol)
+		o := ParsedOrder{Data: data, Price: data.Price}
+		opposite := SideSell
+		if side == SideSell {
+			opposite = SideBuy
+		}
+
+		run := e.SessionStatus == StatusOpen && e.HaltOf(symbol) == nil
+		if run && timeInForce == TIFFOK {
+			mode, err := stpModeOf(context.Background(), config.DB, data.UserId)
+			if err != nil {
+				log.Println("FOK check failed:", err)
 			}
+			// Only CANCEL_OLDEST lets the incoming order go on past the user's own orders
+			run = err == nil && book.Fillable(opposite, o.Price, data.UserId, mode == STPCancelOldest) >= data.RemainingQuantity
 		}
 
-		// Broadcast Updates
+		filled := false
+		if run {
+			// Only held in memory while matching, so it never reaches the Redis snapshot
+			book.Add(side, o)
+			e.sweep(symbol, data.OrderId, timeInForce == TIFFOK)
+			_, resting := book.Remove(data.OrderId)
+			filled = !resting
+		}
+
+		if !filled {
+			e.expireOrder(symbol, data.OrderId, timeInForce)
+		}
 		e.BroadcastOrderBook(symbol)
 	}()
 }
 
-func parseOrders(queue []redis.Z) []ParsedOrder {
-	var orders []ParsedOrder
-	for _, z := range queue {
-		str, ok := z.Member.(string)
-		if !ok { continue }
-		var data models.RedisOrderData
-		if err := json.Unmarshal([]byte(str), &data); err != nil { continue }
-		orders = append(orders, ParsedOrder{
-			Data:  data,
-			Price: z.Score,
-			Raw:   str,
-		})
+// sweep matches an incoming immediate order until it is filled, canceled or no longer
+// crosses; it has no iteration cap. A volatility halt interrupts it, except for an
+// all-or-nothing order, whose last fill price is checked once it is complete.
+// Caller must hold the symbol lock.
+func (e *MatchingEngine) sweep(symbol, orderId string, allOrNothing bool) {
+	book := e.bookFor(symbol)
+	var last float64
+	traded := false
+
+	for {
+		if _, ok := book.Get(orderId); !ok {
+			break
+		}
+		e.stats.loopIterations.Inc()
+
+		price, t, ok := e.matchTop(symbol)
+		if !ok {
+			break
+		}
+		if !t {
+			continue
+		}
+		last, traded = price, true
+		if !allOrNothing && e.checkVolatility(symbol, price) {
+			break
+		}
+	}
+
+	if allOrNothing && traded {
+		e.checkVolatility(symbol, last)
 	}
-	return orders
 }
 
-func (e *MatchingEngine) ExecuteTrade(buy, sell models.RedisOrderData, price float64, symbol string, buyPrice, sellPrice float64, buyRaw, sellRaw string) error {
+func (e *MatchingEngine) ExecuteTrade(buyOrder, sellOrder ParsedOrder, price float64, symbol string) error {
+	// Iceberg orders only trade their visible slice per fill
+	return e.settleTrade(buyOrder, sellOrder, price, symbol, min(buyOrder.Visible(), sellOrder.Visible()))
+}
+
+// settleTrade settles matchQty lots between two orders at price
+func (e *MatchingEngine) settleTrade(buyOrder, sellOrder ParsedOrder, price float64, symbol string, matchQty int64) error {
+	start := time.Now()
 	ctx := context.Background()
 	tx, err := config.DB.Begin(ctx)
 	if err != nil {
@@ -161,10 +403,8 @@ func (e *MatchingEngine) ExecuteTrade(buy, sell models.RedisOrderData, price flo
 	}
 	defer tx.Rollback(ctx)
 
-	matchQty := buy.RemainingQuantity
-	if sell.RemainingQuantity < matchQty {
-		matchQty = sell.RemainingQuantity
-	}
+	buy, sell := buyOrder.Data, sellOrder.Data
+	buyPrice := buyOrder.Price
 
 	buyRem := buy.RemainingQuantity - matchQty
 	sellRem := sell.RemainingQuantity - matchQty
@@ -179,46 +419,77 @@ func (e *MatchingEngine) ExecuteTrade(buy, sell models.RedisOrderData, price flo
 		sellOrderID = &id
 	}
 
-	_, err = tx.Exec(ctx, `
-		INSERT INTO trades (buy_order_id, sell_order_id, stock_id, price, quantity)
-		VALUES ($1, $2, $3, $4, $5)
-	`, buyOrderID, sellOrderID, buy.StockId, price, matchQty)
+	var tradeID string
+	err = tx.QueryRow(ctx, `
+		INSERT INTO trades (buy_order_id, sell_order_id, stock_id, price, quantity, session_id)
+		VALUES ($1, $2, $3, $4, $5, (
+			SELECT id FROM trading_sessions
+			WHERE status IN ('PRE_OPEN', 'LOCKED', 'OPEN', 'BREAK', 'PRE_CLOSE')
+			ORDER BY id DESC LIMIT 1
+		))
+		RETURNING id
+	`, buyOrderID, sellOrderID, buy.StockId, price, matchQty).Scan(&tradeID)
 	if err != nil {
 		return err
 	}
 
 	// 2. Update Orders
+	// The remaining_quantity guard rejects a book entry that no longer matches the DB
+	// (e.g. canceled or filled by a settlement whose book update was lost).
+	// Bot orders have no row and trade free.
+	var buyRates, sellRates fees.Rates
+	var sellShortMargin float64
 	if buyOrderID != nil {
-		status := "MATCHED"
-		if buyRem > 0 { status = "PARTIAL" }
-		_, err = tx.Exec(ctx, "UPDATE orders SET status = $1, remaining_quantity = $2, updated_at = NOW() WHERE id = $3", status, buyRem, *buyOrderID)
-		if err != nil { return err }
+		if buyRates, _, err = fillOrderTx(ctx, tx, buy.OrderId, buy.RemainingQuantity, buyRem); err != nil { return err }
 	}
 	if sellOrderID != nil {
-		status := "MATCHED"
-		if sellRem > 0 { status = "PARTIAL" }
-		_, err = tx.Exec(ctx, "UPDATE orders SET status = $1, remaining_quantity = $2, updated_at = NOW() WHERE id = $3", status, sellRem, *sellOrderID)
-		if err != nil { return err }
+		if sellRates, sellShortMargin, err = fillOrderTx(ctx, tx, sell.OrderId, sell.RemainingQuantity, sellRem); err != nil { return err }
+	}
+
+	// Journal the book mutations in the same transaction, so a crash before the
+	// Redis write can be replayed by RecoverBookOutbox
+	buyOutbox, sellOutbox, err := writeTradeOutbox(ctx, tx, tradeID, symbol, buy.OrderId, buyRem, sell.OrderId, sellRem)
+	if err != nil {
+		return err
 	}
 
 	// 3. Update Portfolios
-	if buyOrderID != nil && price < buyPrice {
-		refund := (buyPrice - price) * float64(matchQty) * 100
-		if refund > 0 {
-			_, err = tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn + $1 WHERE id = $2", refund, buy.UserId)
-			if err != nil { return err }
-		}
+	// The filled lots' reservation leaves reserved_rdn; what it held over the price and
+	// fee actually paid (a better price than the buyer's limit) goes back to its
+	// available balance. The seller receives the value net of its fees.
+	gross := price * float64(matchQty) * 100
+	buyCharge, sellCharge := buyRates.Buy(gross), sellRates.Sell(gross)
+	var refund float64
+	if buyOrderID != nil {
+		reserved := buyRates.Reserve(buyPrice, matchQty)
+		refund = max(reserved-buyCharge.Net, 0)
+		_, err = tx.Exec(ctx, "UPDATE users SET reserved_rdn = reserved_rdn - $1, balance_rdn = balance_rdn + $2 WHERE id = $3", reserved, refund, buy.UserId)
+		if err != nil { return err }
+		if err := insertTradeFee(ctx, tx, tradeID, buy.OrderId, buy.UserId, "BUY", buyCharge); err != nil { return err }
 	}
 
-	if sellOrderID != nil {
-		gain := price * float64(matchQty) * 100
-		_, err = tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn + $1 WHERE id = $2", gain, sell.UserId)
+	if sellOrderID != nil && sellShortMargin > 0 {
+		// A short sale: the proceeds are held as collateral, the lots are borrowed (short.go)
+		if err := insertTradeFee(ctx, tx, tradeID, sell.OrderId, sell.UserId, "SELL", sellCharge); err != nil { return err }
+		if err := shortSaleTx(ctx, tx, tradeID, sell, sellOrder.Price, price, matchQty, sellCharge, sellShortMargin); err != nil { return err }
+	} else if sellOrderID != nil {
+		_, err = tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn + $1 WHERE id = $2", sellCharge.Net, sell.UserId)
 		if err != nil { return err }
-		_, err = tx.Exec(ctx, "UPDATE portfolios SET quantity_owned = quantity_owned - $1 WHERE user_id = $2 AND stock_id = $3", matchQty, sell.UserId, sell.StockId)
+		if err := insertTradeFee(ctx, tx, tradeID, sell.OrderId, sell.UserId, "SELL", sellCharge); err != nil { return err }
+		// The lots leave at the average cost they were bought at; the difference to the
+		// sale price, less the sell fees, is the realized profit of this fill
+		var avgCost float64
+		err = tx.QueryRow(ctx, "UPDATE portfolios SET quantity_owned = quantity_owned - $1, locked_quantity = locked_quantity - $1 WHERE user_id = $2 AND stock_id = $3 RETURNING avg_buy_price", matchQty, sell.UserId, sell.StockId).Scan(&avgCost)
 		if err != nil { return err }
+		if err := insertRealizedPnl(ctx, tx, tradeID, sell.OrderId, sell.UserId, sell.StockId, matchQty, price, avgCost, sellCharge.Fee); err != nil { return err }
 	}
 
+	// A buyer who is short covers its position first; the rest of the lots are bought
+	var covered int64
 	if buyOrderID != nil {
+		if covered, err = coverShortTx(ctx, tx, tradeID, buy, price, matchQty, buyCharge); err != nil { return err }
+	}
+	if buyOrderID != nil && covered < matchQty {
 		q := `
 			INSERT INTO portfolios (user_id, stock_id, quantity_owned, avg_buy_price)
 			VALUES ($1, $2, $3, $4)
@@ -229,95 +500,114 @@ func (e *MatchingEngine) ExecuteTrade(buy, sell models.RedisOrderData, price flo
 			END,
 			quantity_owned = portfolios.quantity_owned + $3
 		`
-		_, err = tx.Exec(ctx, q, buy.UserId, buy.StockId, matchQty, price)
+		_, err = tx.Exec(ctx, q, buy.UserId, buy.StockId, matchQty-covered, price)
 		if err != nil { return err }
 	}
 
-	// 4. Commit
-	if err := tx.Commit(ctx); err != nil {
-		return err
+	// 4. Ledger: the buyer pays from its reservation (the bot from the market account),
+	// and gets back the rest of it; fees go to the exchange in their own journal
+	j := ledger.New(ledger.ReasonTradeSettlement, ledger.RefTrade, tradeID).
+		Cash(ledger.Trader(ledger.AccountReserved, buy.UserId), ledger.Trader(ledger.AccountCash, sell.UserId), gross).
+		Shares(ledger.Trader(ledger.AccountShares, sell.UserId), ledger.Trader(ledger.AccountShares, buy.UserId), buy.StockId, matchQty)
+	if buyOrderID != nil {
+		j.Cash(ledger.Reserved(buy.UserId), ledger.Cash(buy.UserId), refund)
 	}
+	if err := ledger.Post(ctx, tx, j); err != nil { return err }
 
-	// 5. Update Redis
-	pipe := config.RedisMain.Pipeline()
-	pipe.ZRem(ctx, "orderbook:"+symbol+":buy", buyRaw)
-	pipe.ZRem(ctx, "orderbook:"+symbol+":sell", sellRaw)
-
-	if buyRem > 0 {
-		newBuy := buy
-		newBuy.RemainingQuantity = buyRem
-		bytes, _ := json.Marshal(newBuy)
-		pipe.ZAdd(ctx, "orderbook:"+symbol+":buy", redis.Z{Score: buyPrice, Member: string(bytes)})
+	fee := ledger.New(ledger.ReasonFee, ledger.RefTrade, tradeID)
+	if buyOrderID != nil {
+		fee.Cash(ledger.Reserved(buy.UserId), ledger.Fees, buyCharge.Fee)
 	}
-	if sellRem > 0 {
-		newSell := sell
-		newSell.RemainingQuantity = sellRem
-		bytes, _ := json.Marshal(newSell)
-		pipe.ZAdd(ctx, "orderbook:"+symbol+":sell", redis.Z{Score: sellPrice, Member: string(bytes)})
+	if sellOrderID != nil {
+		fee.Cash(ledger.Cash(sell.UserId), ledger.Fees, sellCharge.Fee)
 	}
-	_, err = pipe.Exec(ctx)
+	if err := ledger.Post(ctx, tx, fee); err != nil { return err }
 
-	// 6. Notify
-	if err == nil {
-		e.NotifyTrade(symbol, price, matchQty, buy, sell)
+	// 5. Commit
+	if err := tx.Commit(ctx); err != nil {
+		return err
 	}
+	e.stats.trades.Inc()
+	e.stats.settleLatency.Since(start)
+	e.stats.observeFill(buy.UserId, buy.Timestamp)
+	e.stats.observeFill(sell.UserId, sell.Timestamp)
+
+	// 5. Update Book (Redis snapshot is written behind)
+	e.applyFill(symbol, buy.OrderId, matchQty, buyRem, buyOutbox)
+	e.applyFill(symbol, sell.OrderId, matchQty, sellRem, sellOutbox)
+
+	// 6. Notify
+	buy.RemainingQuantity = buyRem
+	sell.RemainingQuantity = sellRem
+	e.NotifyTrade(symbol, price, matchQty, buy, sell, buyCharge, sellCharge)
 
-	return err
+	return nil
+}
+
+// applyFill updates the in-memory book after a settled trade and queues the Redis write.
+// remaining is the settled quantity; it is persisted even if the order is no longer
+// in memory, so the outbox row always gets marked applied.
+func (e *MatchingEngine) applyFill(symbol, orderId string, qty, remaining int64, outboxIds ...int64) {
+	book := e.bookFor(symbol)
+	if updated, ok := book.Fill(orderId, qty); ok {
+		remaining = updated.Data.RemainingQuantity
+		if remaining > 0 && updated.Data.DisplayQuantity > 0 {
+			// Iceberg slice and queue position may have changed, rewrite the whole order
+			side, _ := book.SideOf(orderId)
+			e.persister.upsert(symbol, side, updated, outboxIds...)
+			return
+		}
+	}
+	if remaining > 0 {
+		e.persister.fill(symbol, orderId, remaining, outboxIds...)
+	} else {
+		e.persister.remove(symbol, orderId, outboxIds...)
+	}
 }
 
 func (e *MatchingEngine) broadcastIEP(symbol string, iep *IEPResult) {
 	if e.IoServer != nil {
-		e.IoServer.To(socketio.Room(symbol)).Emit("iep_update", iep)
+		e.IoServer.To(socketio.Room(symbol)).Emit("iep_update", e.IEPPayload(symbol, iep))
 	}
 }
 
-func (e *MatchingEngine) BroadcastOrderBook(symbol string) {
-	if e.IoServer == nil {
-		return
+// IEPPayload is the auction state published on iep_update and GET /market/iep.
+// iep is nil when the book does not cross; the curves are still included.
+func (e *MatchingEngine) IEPPayload(symbol string, iep *IEPResult) map[string]interface{} {
+	payload := map[string]interface{}{
+		"symbol":             symbol,
+		"status":             e.SessionStatus,
+		"iep":                nil,
+		"volume":             0,
+		"surplus":            0,
+		"imbalance_side":     "NONE",
+		"unmatched_quantity": 0,
+		"tie_break":          nil,
+	}
+	if iep == nil {
+		buyCurve, sellCurve := GlobalIEPEngine.Curves(symbol)
+		payload["buy_curve"], payload["sell_curve"] = buyCurve, sellCurve
+		return payload
 	}
 
-	ctx := context.Background()
-	buyQueue, _ := config.RedisMain.ZRevRangeWithScores(ctx, "orderbook:"+symbol+":buy", 0, 49).Result()
-	sellQueue, _ := config.RedisMain.ZRangeWithScores(ctx, "orderbook:"+symbol+":sell", 0, 49).Result()
-
-	aggregate := func(queue []redis.Z) []map[string]interface{} {
-		var res []map[string]interface{}
-		if len(queue) == 0 { return res }
+	payload["iep"] = iep.Price
+	payload["volume"] = iep.MatchedVolume
+	payload["surplus"] = iep.Surplus
+	payload["imbalance_side"] = iep.ImbalanceSide()
+	payload["unmatched_quantity"] = max(iep.Surplus, -iep.Surplus)
+	payload["tie_break"] = iep.TieBreak
+	payload["buy_curve"], payload["sell_curve"] = iep.BuyCurve, iep.SellCurve
+	return payload
+}
 
-		type Level struct {
-			Price    float64
-			TotalQty int64
-			Count    int
-		}
-		var current *Level
-
-		for _, z := range queue {
-			str, ok := z.Member.(string)
-			if !ok { continue }
-			var data models.RedisOrderData
-			if err := json.Unmarshal([]byte(str), &data); err != nil { continue }
-			if data.RemainingQuantity <= 0 { continue }
-
-			if current == nil || current.Price != z.Score {
-				if current != nil {
-					res = append(res, map[string]interface{}{"price": current.Price, "totalQty": current.TotalQty, "count": current.Count})
-				}
-				current = &Level{Price: z.Score, TotalQty: 0, Count: 0}
-			}
-			current.TotalQty += data.RemainingQuantity
-			current.Count++
-		}
-		if current != nil {
-			res = append(res, map[string]interface{}{"price": current.Price, "totalQty": current.TotalQty, "count": current.Count})
-		}
-		return res
+func (e *MatchingEngine) BroadcastOrderBook(symbol string) {
+	if e.IoServer == nil {
+		return
 	}
 
-	bids := aggregate(buyQueue)
-	asks := aggregate(sellQueue)
-
-	if len(bids) > 20 { bids = bids[:20] }
-	if len(asks) > 20 { asks = asks[:20] }
+	book := e.Book(symbol)
+	bids := book.Depth(SideBuy, 20)
+	asks := book.Depth(SideSell, 20)
 
 	e.IoServer.To(socketio.Room(symbol)).Emit("orderbook_update", map[string]interface{}{
 		"symbol":    symbol,
@@ -327,7 +617,14 @@ func (e *MatchingEngine) BroadcastOrderBook(symbol string) {
 	})
 }
 
-func (e *MatchingEngine) NotifyTrade(symbol string, price float64, qty int64, buyOrder, sellOrder models.RedisOrderData) {
+func (e *MatchingEngine) NotifyTrade(symbol string, price float64, qty int64, buyOrder, sellOrder models.RedisOrderData, buyCharge, sellCharge fees.Charge) {
+	e.mu.Lock()
+	listeners := e.tradeListeners
+	e.mu.Unlock()
+	for _, l := range listeners {
+		go l(symbol, price, qty)
+	}
+
 	if e.IoServer == nil { return }
 
 	ts := time.Now().UnixMilli()
@@ -358,12 +655,14 @@ func (e *MatchingEngine) NotifyTrade(symbol string, price float64, qty int64, bu
 
 		e.IoServer.To(socketio.Room("user:"+buyOrder.UserId)).Emit("order_matched", map[string]interface{}{
 			"type": "BUY", "symbol": symbol, "price": price, "quantity": qty,
-			"message": fmt.Sprintf("Beli %s: %d lot @ Rp%.0f (%s)", symbol, qty, price, status),
+			"gross": buyCharge.Gross, "fee": buyCharge.Fee, "net": buyCharge.Net, "fees": buyCharge,
+			"message": fmt.Sprintf("Beli %s: %d lot @ Rp%.0f (%s), total Rp%.0f termasuk fee Rp%.0f", symbol, qty, price, status, buyCharge.Net, buyCharge.Fee),
 		})
 
 		e.IoServer.To(socketio.Room("user:"+buyOrder.UserId)).Emit("order_status", map[string]interface{}{
 			"order_id": buyOrder.OrderId, "status": status, "price": price,
 			"matched_quantity": qty, "remaining_quantity": buyOrder.RemainingQuantity,
+			"gross": buyCharge.Gross, "fee": buyCharge.Fee, "net": buyCharge.Net,
 			"symbol": symbol, "type": "BUY", "timestamp": ts,
 		})
 	}
@@ -374,17 +673,26 @@ func (e *MatchingEngine) NotifyTrade(symbol string, price float64, qty int64, bu
 
 		e.IoServer.To(socketio.Room("user:"+sellOrder.UserId)).Emit("order_matched", map[string]interface{}{
 			"type": "SELL", "symbol": symbol, "price": price, "quantity": qty,
-			"message": fmt.Sprintf("Jual %s: %d lot @ Rp%.0f (%s)", symbol, qty, price, status),
+			"gross": sellCharge.Gross, "fee": sellCharge.Fee, "net": sellCharge.Net, "fees": sellCharge,
+			"message": fmt.Sprintf("Jual %s: %d lot @ Rp%.0f (%s), diterima Rp%.0f setelah fee Rp%.0f", symbol, qty, price, status, sellCharge.Net, sellCharge.Fee),
 		})
 
 		e.IoServer.To(socketio.Room("user:"+sellOrder.UserId)).Emit("order_status", map[string]interface{}{
 			"order_id": sellOrder.OrderId, "status": status, "price": price,
 			"matched_quantity": qty, "remaining_quantity": sellOrder.RemainingQuantity,
+			"gross": sellCharge.Gross, "fee": sellCharge.Fee, "net": sellCharge.Net,
 			"symbol": symbol, "type": "SELL", "timestamp": ts,
 		})
 	}
 }
 
-func (e *MatchingEngine) StartStatsLoop() {
-	// Log stats every minute
+// NotifyOrderStatus sends an order_status event to the order owner
+func (e *MatchingEngine) NotifyOrderStatus(userId string, status map[string]interface{}) {
+	if e.IoServer == nil || userId == "SYSTEM_BOT" {
+		return
+	}
+	if _, ok := status["timestamp"]; !ok {
+		status["timestamp"] = time.Now().UnixMilli()
+	}
+	e.IoServer.To(socketio.Room("user:"+userId)).Emit("order_status", status)
 }
@@ -0,0 +1,576 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"mbit-backend-go/config"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Circuit breaker and trading halts.
+// A symbol whose price moves volatility_pct within volatility_window_sec is interrupted:
+// continuous matching stops and it re-opens through a short call auction. A drop of the
+// market index past index_drop_pct halts the whole market. Admins can halt and resume
+// a symbol or the market by hand. Active halts are kept in trading_halts, so a restart
+// resumes them.
+
+// Halt scopes
+const (
+	HaltScopeSymbol = "SYMBOL"
+	HaltScopeMarket = "MARKET"
+)
+
+// Halt phases
+const (
+	HaltHalted  = "HALTED"  // no orders accepted, no matching
+	HaltAuction = "AUCTION" // re-opening call auction: orders accepted, IEP published
+	HaltResumed = "RESUMED" // only broadcast, a resumed halt is no longer active
+)
+
+// Halt reasons
+const (
+	HaltVolatility = "VOLATILITY"
+	HaltIndexDrop  = "INDEX_DROP"
+	HaltManual     = "MANUAL"
+)
+
+// AuctionReopening is the auction that ends a halt
+const AuctionReopening = "REOPENING"
+
+// Halt is an active trading halt. Symbol is empty for a market-wide halt.
+type Halt struct {
+	ID         int64      `json:"id"`
+	Symbol     string     `json:"symbol,omitempty"`
+	Scope      string     `json:"scope"`
+	Reason     string     `json:"reason"`
+	Phase      string     `json:"phase"`
+	Detail     string     `json:"detail"`
+	HaltedAt   time.Time  `json:"halted_at"`
+	PhaseUntil *time.Time `json:"phase_until"` // nil = until resumed by an admin
+
+	timer *time.Timer
+}
+
+// BreakerConfig is the circuit breaker configuration (circuit_breaker_config)
+type BreakerConfig struct {
+	Enabled             bool    `json:"enabled"`
+	VolatilityPct       float64 `json:"volatility_pct"`        // price move that interrupts a symbol
+	VolatilityWindowSec int     `json:"volatility_window_sec"` // ... within this many seconds
+	ReopenAuctionSec    int     `json:"reopen_auction_sec"`    // length of the re-opening call auction
+	IndexDropPct        float64 `json:"index_drop_pct"`        // market-wide halt threshold, 0 disables
+	MarketHaltSec       int     `json:"market_halt_sec"`       // market halt length, 0 = until resumed by an admin
+}
+
+var defaultBreakerConfig = BreakerConfig{
+	Enabled: true, VolatilityPct: 5, VolatilityWindowSec: 60, ReopenAuctionSec: 120,
+	IndexDropPct: 8, MarketHaltSec: 1800,
+}
+
+type pricePoint struct {
+	at    time.Time
+	price float64
+}
+
+// haltState holds the halts of the engine. Market-wide halt is keyed by "".
+type haltState struct {
+	mu             sync.RWMutex
+	config         BreakerConfig
+	halts          map[string]*Halt
+	prices         map[string][]pricePoint // recent trade prices per symbol
+	indexChange    float64                 // last computed index change in percent
+	indexTriggered bool                    // index halt already fired this session
+}
+
+func newHaltState() *haltState {
+	return &haltState{config: defaultBreakerConfig, halts: map[string]*Halt{}, prices: map[string][]pricePoint{}}
+}
+
+// BreakerConfig returns the circuit breaker configuration in use
+func (e *MatchingEngine) BreakerConfig() BreakerConfig {
+	e.halt.mu.RLock()
+	defer e.halt.mu.RUnlock()
+	return e.halt.config
+}
+
+// UpdateBreakerConfig validates, stores and applies a circuit breaker configuration
+func (e *MatchingEngine) UpdateBreakerConfig(ctx context.Context, cfg BreakerConfig) error {
+	if cfg.VolatilityPct <= 0 || cfg.VolatilityWindowSec <= 0 {
+		return fmt.Errorf("volatility_pct dan volatility_window_sec harus lebih dari 0")
+	}
+	if cfg.ReopenAuctionSec < 0 || cfg.MarketHaltSec < 0 || cfg.IndexDropPct < 0 {
+		return fmt.Errorf("reopen_auction_sec, market_halt_sec dan index_drop_pct tidak boleh negatif")
+	}
+
+	_, err := config.DB.Exec(ctx, `
+		INSERT INTO circuit_breaker_config (id, enabled, volatility_pct, volatility_window_sec, reopen_auction_sec, index_drop_pct, market_halt_sec, updated_at)
+		VALUES (1, $1, $2, $3, $4, $5, $6, NOW())
+		ON CONFLICT (id) DO UPDATE SET
+			enabled = EXCLUDED.enabled, volatility_pct = EXCLUDED.volatility_pct,
+			volatility_window_sec = EXCLUDED.volatility_window_sec, reopen_auction_sec = EXCLUDED.reopen_auction_sec,
+			index_drop_pct = EXCLUDED.index_drop_pct, market_halt_sec = EXCLUDED.market_halt_sec, updated_at = NOW()
+	`, cfg.Enabled, cfg.VolatilityPct, cfg.VolatilityWindowSec, cfg.ReopenAuctionSec, cfg.IndexDropPct, cfg.MarketHaltSec)
+	if err != nil {
+		return err
+	}
+
+	e.halt.mu.Lock()
+	e.halt.config = cfg
+	e.halt.mu.Unlock()
+	return nil
+}
+
+// loadBreakerConfig reads circuit_breaker_config, keeping the defaults if it has no row
+func (e *MatchingEngine) loadBreakerConfig(ctx context.Context) {
+	cfg := defaultBreakerConfig
+	err := config.DB.QueryRow(ctx, `
+		SELECT enabled, volatility_pct, volatility_window_sec, reopen_auction_sec, index_drop_pct, market_halt_sec
+		FROM circuit_breaker_config WHERE id = 1
+	`).Scan(&cfg.Enabled, &cfg.VolatilityPct, &cfg.VolatilityWindowSec, &cfg.ReopenAuctionSec, &cfg.IndexDropPct, &cfg.MarketHaltSec)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Println("⚠️  Circuit breaker config not loaded, using defaults:", err)
+	}
+
+	e.halt.mu.Lock()
+	e.halt.config = cfg
+	e.halt.mu.Unlock()
+}
+
+// HaltOf returns the halt a symbol is under, market-wide first, or nil
+func (e *MatchingEngine) HaltOf(symbol string) *Halt {
+	e.halt.mu.RLock()
+	defer e.halt.mu.RUnlock()
+	if h, ok := e.halt.halts[""]; ok {
+		c := *h
+		return &c
+	}
+	if h, ok := e.halt.halts[symbol]; ok {
+		c := *h
+		return &c
+	}
+	return nil
+}
+
+// Halts lists the active halts
+func (e *MatchingEngine) Halts() []Halt {
+	e.halt.mu.RLock()
+	defer e.halt.mu.RUnlock()
+	halts := make([]Halt, 0, len(e.halt.halts))
+	for _, h := range e.halt.halts {
+		halts = append(halts, *h)
+	}
+	return halts
+}
+
+// IndexChange is the last computed change of the market index against the previous close, in percent
+func (e *MatchingEngine) IndexChange() float64 {
+	e.halt.mu.RLock()
+	defer e.halt.mu.RUnlock()
+	return e.halt.indexChange
+}
+
+// HaltTrading halts a symbol, or the whole market if symbol is empty, until resumed
+func (e *MatchingEngine) HaltTrading(symbol, reason, detail string) (*Halt, error) {
+	return e.startHalt(symbol, reason, detail, HaltHalted, 0)
+}
+
+// startHalt registers a halt in the given phase. A positive duration ends the phase by
+// itself: HALTED moves on to the re-opening auction, AUCTION uncrosses and resumes.
+func (e *MatchingEngine) startHalt(symbol, reason, detail, phase string, duration time.Duration) (*Halt, error) {
+	scope := HaltScopeSymbol
+	if symbol == "" {
+		scope = HaltScopeMarket
+	}
+
+	h := &Halt{Symbol: symbol, Scope: scope, Reason: reason, Phase: phase, Detail: detail, HaltedAt: time.Now()}
+	if duration > 0 {
+		until := h.HaltedAt.Add(duration)
+		h.PhaseUntil = &until
+	}
+
+	e.halt.mu.Lock()
+	if _, ok := e.halt.halts[symbol]; ok {
+		e.halt.mu.Unlock()
+		return nil, fmt.Errorf("trading %s sudah dihentikan", haltTarget(symbol))
+	}
+	e.halt.halts[symbol] = h
+	delete(e.halt.prices, symbol)
+	e.halt.mu.Unlock()
+
+	var id int64
+	err := config.DB.QueryRow(context.Background(), `
+		INSERT INTO trading_halts (symbol, scope, reason, phase, detail, halted_at, phase_until)
+		VALUES (NULLIF($1, ''), $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, symbol, scope, reason, phase, detail, h.HaltedAt, h.PhaseUntil).Scan(&id)
+	if err != nil {
+		// The halt stays in effect in memory; it just will not survive a restart
+		log.Println("Trading halt not persisted:", err)
+	}
+
+	e.halt.mu.Lock()
+	h.ID = id
+	snapshot := *h
+	e.halt.mu.Unlock()
+
+	e.schedulePhaseEnd(symbol, &snapshot)
+	log.Printf("⛔ Trading halt %s: %s (%s) %s", haltTarget(symbol), reason, phase, detail)
+	e.broadcastHalt(&snapshot)
+	return &snapshot, nil
+}
+
+// ResumeTrading ends a halt through the re-opening call auction. A halt already in its
+// auction is uncrossed right away.
+func (e *MatchingEngine) ResumeTrading(symbol string) error {
+	e.halt.mu.Lock()
+	h, ok := e.halt.halts[symbol]
+	if !ok {
+		e.halt.mu.Unlock()
+		return fmt.Errorf("trading %s tidak sedang dihentikan", haltTarget(symbol))
+	}
+	phase := h.Phase
+	e.halt.mu.Unlock()
+
+	if phase == HaltAuction {
+		go e.reopen(symbol)
+		return nil
+	}
+	e.enterReopenAuction(symbol)
+	return nil
+}
+
+// enterReopenAuction moves a halt into its re-opening call auction
+func (e *MatchingEngine) enterReopenAuction(symbol string) {
+	e.halt.mu.Lock()
+	h, ok := e.halt.halts[symbol]
+	if !ok || h.Phase != HaltHalted {
+		e.halt.mu.Unlock()
+		return
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.Phase = HaltAuction
+	h.PhaseUntil = nil
+	if sec := e.halt.config.ReopenAuctionSec; sec > 0 {
+		until := time.Now().Add(time.Duration(sec) * time.Second)
+		h.PhaseUntil = &until
+	}
+	snapshot := *h
+	e.halt.mu.Unlock()
+
+	if snapshot.PhaseUntil == nil {
+		go e.reopen(symbol)
+		return
+	}
+
+	e.persistHalt(&snapshot, false)
+	e.schedulePhaseEnd(symbol, &snapshot)
+	e.broadcastHalt(&snapshot)
+
+	// Resting orders now form the auction, publish the IEP
+	for _, s := range e.haltedSymbols(symbol) {
+		e.Match(s)
+	}
+}
+
+// reopen uncrosses the re-opening auction, lifts the halt and resumes continuous matching
+func (e *MatchingEngine) reopen(symbol string) {
+	e.halt.mu.RLock()
+	_, ok := e.halt.halts[symbol]
+	e.halt.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	// The halt stays registered while uncrossing, so the auction is recorded as REOPENING
+	// and no continuous matching slips in between
+	symbols := e.haltedSymbols(symbol)
+	if e.SessionStatus == StatusOpen {
+		for _, s := range symbols {
+			e.WithSymbolLock(s, func() error {
+				if iep, err := GlobalIEPEngine.ExecuteIEP(s, e); err != nil {
+					log.Printf("Re-opening auction %s failed: %v", s, err)
+				} else if iep != nil {
+					log.Printf("🔔 Re-opening %s at %.2f (%d lots)", s, iep.Price, iep.MatchedVolume)
+				}
+				return nil
+			})
+		}
+	}
+
+	e.halt.mu.Lock()
+	h, ok := e.halt.halts[symbol]
+	if !ok {
+		e.halt.mu.Unlock()
+		return
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	delete(e.halt.halts, symbol)
+	h.Phase = HaltResumed
+	h.PhaseUntil = nil
+	snapshot := *h
+	e.halt.mu.Unlock()
+
+	e.persistHalt(&snapshot, true)
+	log.Printf("✅ Trading resumed %s", haltTarget(symbol))
+	e.broadcastHalt(&snapshot)
+
+	for _, s := range symbols {
+		e.Match(s)
+	}
+}
+
+// haltedSymbols are the symbols a halt covers that are not under a halt of their own
+func (e *MatchingEngine) haltedSymbols(symbol string) []string {
+	if symbol != "" {
+		return []string{symbol}
+	}
+	e.halt.mu.RLock()
+	defer e.halt.mu.RUnlock()
+	var symbols []string
+	for _, s := range e.Symbols() {
+		if _, own := e.halt.halts[s]; !own {
+			symbols = append(symbols, s)
+		}
+	}
+	return symbols
+}
+
+// schedulePhaseEnd arms the timer that ends the current phase of a halt
+func (e *MatchingEngine) schedulePhaseEnd(symbol string, h *Halt) {
+	if h.PhaseUntil == nil {
+		return
+	}
+	phase := h.Phase
+	timer := time.AfterFunc(time.Until(*h.PhaseUntil), func() {
+		if phase == HaltHalted {
+			e.enterReopenAuction(symbol)
+		} else {
+			e.reopen(symbol)
+		}
+	})
+
+	e.halt.mu.Lock()
+	if cur, ok := e.halt.halts[symbol]; ok && cur.HaltedAt.Equal(h.HaltedAt) {
+		cur.timer = timer
+	} else {
+		timer.Stop()
+	}
+	e.halt.mu.Unlock()
+}
+
+// persistHalt writes the phase of a halt, and its end if resumed
+func (e *MatchingEngine) persistHalt(h *Halt, resumed bool) {
+	if h.ID == 0 {
+		return
+	}
+	_, err := config.DB.Exec(context.Background(), `
+		UPDATE trading_halts
+		SET phase = $2, phase_until = $3, resumed_at = CASE WHEN $4 THEN NOW() ELSE resumed_at END
+		WHERE id = $1
+	`, h.ID, h.Phase, h.PhaseUntil, resumed)
+	if err != nil {
+		log.Println("Trading halt not persisted:", err)
+	}
+}
+
+// ClearHalts lifts every halt without an auction, e.g. when the session closes
+func (e *MatchingEngine) ClearHalts() {
+	e.halt.mu.Lock()
+	halts := e.halt.halts
+	e.halt.halts = map[string]*Halt{}
+	e.halt.prices = map[string][]pricePoint{}
+	e.halt.indexTriggered = false
+	e.halt.mu.Unlock()
+
+	for _, h := range halts {
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+		h.Phase = HaltResumed
+		h.PhaseUntil = nil
+		e.persistHalt(h, true)
+		e.broadcastHalt(h)
+	}
+}
+
+// restoreHalts reloads the halts that were active when the engine stopped
+func (e *MatchingEngine) restoreHalts(ctx context.Context) {
+	rows, err := config.DB.Query(ctx, `
+		SELECT id, COALESCE(symbol, ''), scope, reason, phase, COALESCE(detail, ''), halted_at, phase_until
+		FROM trading_halts WHERE resumed_at IS NULL
+	`)
+	if err != nil {
+		log.Println("⚠️  Trading halts not restored:", err)
+		return
+	}
+	var halts []*Halt
+	for rows.Next() {
+		h := &Halt{}
+		if err := rows.Scan(&h.ID, &h.Symbol, &h.Scope, &h.Reason, &h.Phase, &h.Detail, &h.HaltedAt, &h.PhaseUntil); err != nil {
+			log.Println("⚠️  Trading halt skipped:", err)
+			continue
+		}
+		halts = append(halts, h)
+	}
+	rows.Close()
+
+	// Overdue phases end shortly after start-up, once the session status is restored
+	soon := time.Now().Add(10 * time.Second)
+	e.halt.mu.Lock()
+	for _, h := range halts {
+		if h.PhaseUntil != nil && h.PhaseUntil.Before(soon) {
+			h.PhaseUntil = &soon
+		}
+		e.halt.halts[h.Symbol] = h
+		if h.Reason == HaltIndexDrop {
+			e.halt.indexTriggered = true
+		}
+	}
+	e.halt.mu.Unlock()
+
+	for _, h := range halts {
+		e.schedulePhaseEnd(h.Symbol, h)
+	}
+	if len(halts) > 0 {
+		log.Printf("⛔ %d trading halt(s) restored", len(halts))
+	}
+}
+
+// checkVolatility records a continuous-trading price and interrupts the symbol if it moved
+// volatility_pct within the window. Returns true if the symbol got halted.
+// Caller must hold the symbol lock.
+func (e *MatchingEngine) checkVolatility(symbol string, price float64) bool {
+	now := time.Now()
+
+	e.halt.mu.Lock()
+	cfg := e.halt.config
+	if !cfg.Enabled || cfg.VolatilityPct <= 0 {
+		e.halt.mu.Unlock()
+		return false
+	}
+	cutoff := now.Add(-time.Duration(cfg.VolatilityWindowSec) * time.Second)
+	window := e.halt.prices[symbol]
+	start := 0
+	for start < len(window) && window[start].at.Before(cutoff) {
+		start++
+	}
+	window = append(window[start:], pricePoint{at: now, price: price})
+	e.halt.prices[symbol] = window
+
+	lo, hi := price, price
+	for _, p := range window {
+		lo, hi = math.Min(lo, p.price), math.Max(hi, p.price)
+	}
+	e.halt.mu.Unlock()
+
+	var move, ref float64
+	if up := (price - lo) / lo * 100; up >= cfg.VolatilityPct {
+		move, ref = up, lo
+	} else if down := (hi - price) / hi * 100; down >= cfg.VolatilityPct {
+		move, ref = -down, hi
+	} else {
+		return false
+	}
+
+	detail := fmt.Sprintf("Harga bergerak %.2f%% (%.2f -> %.2f) dalam %d detik", move, ref, price, cfg.VolatilityWindowSec)
+	_, err := e.startHalt(symbol, HaltVolatility, detail, HaltAuction, time.Duration(max(cfg.ReopenAuctionSec, 1))*time.Second)
+	return err == nil
+}
+
+// runIndexMonitor recomputes the market index while the market is open and halts the
+// whole market once it has dropped index_drop_pct below the previous close
+func (e *MatchingEngine) runIndexMonitor() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if e.SessionStatus != StatusOpen {
+			continue
+		}
+		change, err := marketIndexChange(context.Background())
+		if err != nil {
+			log.Println("Market index failed:", err)
+			continue
+		}
+
+		e.halt.mu.Lock()
+		e.halt.indexChange = change
+		cfg := e.halt.config
+		_, halted := e.halt.halts[""]
+		trigger := cfg.Enabled && cfg.IndexDropPct > 0 && change <= -cfg.IndexDropPct && !halted && !e.halt.indexTriggered
+		if trigger {
+			e.halt.indexTriggered = true
+		}
+		e.halt.mu.Unlock()
+
+		if trigger {
+			detail := fmt.Sprintf("Indeks turun %.2f%% dari penutupan sebelumnya", -change)
+			e.startHalt("", HaltIndexDrop, detail, HaltHalted, time.Duration(cfg.MarketHaltSec)*time.Second)
+		}
+	}
+}
+
+// marketIndexChange is the change of the market index against the previous close, in percent.
+// The index weighs each stock's last price of the session by its shares (max_shares,
+// equal weight if unset).
+func marketIndexChange(ctx context.Context) (float64, error) {
+	var ratio float64
+	err := config.DB.QueryRow(ctx, `
+		SELECT COALESCE(
+			SUM(COALESCE(lt.price, d.prev_close) * w.weight) / NULLIF(SUM(d.prev_close * w.weight), 0), 1)
+		FROM daily_stock_data d
+		JOIN trading_sessions ts ON d.session_id = ts.id
+		JOIN stocks s ON d.stock_id = s.id
+		CROSS JOIN LATERAL (SELECT CASE WHEN s.max_shares > 0 THEN s.max_shares ELSE 1 END AS weight) w
+		LEFT JOIN LATERAL (
+			SELECT t.price FROM trades t
+			WHERE t.stock_id = d.stock_id AND t.executed_at >= ts.started_at
+			ORDER BY t.executed_at DESC LIMIT 1
+		) lt ON true
+		WHERE ts.id = (SELECT MAX(id) FROM trading_sessions WHERE status = 'OPEN')
+	`).Scan(&ratio)
+	if err != nil {
+		return 0, err
+	}
+	return (ratio - 1) * 100, nil
+}
+
+// broadcastHalt tells every client about a halt changing phase
+func (e *MatchingEngine) broadcastHalt(h *Halt) {
+	if e.IoServer == nil {
+		return
+	}
+	var symbol interface{}
+	if h.Symbol != "" {
+		symbol = h.Symbol
+	}
+	var until interface{}
+	if h.PhaseUntil != nil {
+		until = h.PhaseUntil.UnixMilli()
+	}
+	e.IoServer.Emit("trading_halt", map[string]interface{}{
+		"symbol":      symbol,
+		"scope":       h.Scope,
+		"reason":      h.Reason,
+		"phase":       h.Phase,
+		"detail":      h.Detail,
+		"halted_at":   h.HaltedAt.UnixMilli(),
+		"phase_until": until,
+		"timestamp":   time.Now().UnixMilli(),
+	})
+}
+
+func haltTarget(symbol string) string {
+	if symbol == "" {
+		return "market"
+	}
+	return symbol
+}
@@ -2,6 +2,8 @@ package engine
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"math"
 	"sort"
 
@@ -11,158 +13,199 @@ import (
 type IEPEngine struct{}
 
 func (e *IEPEngine) CalculateIEP(symbol string) (*IEPResult, error) {
-	ctx := context.Background()
-
-	// 1. Fetch Orderbook
-	buyQueueRaw, err := config.RedisMain.ZRangeWithScores(ctx, "orderbook:"+symbol+":buy", 0, -1).Result()
-	if err != nil {
-		return nil, err
-	}
-	sellQueueRaw, err := config.RedisMain.ZRangeWithScores(ctx, "orderbook:"+symbol+":sell", 0, -1).Result()
-	if err != nil {
-		return nil, err
-	}
+	// 1. Snapshot Orderbook
+	book := Engine.Book(symbol)
+	buys := book.Orders(SideBuy)
+	sells := book.Orders(SideSell)
 
-	if len(buyQueueRaw) == 0 || len(sellQueueRaw) == 0 {
+	if len(buys) == 0 || len(sells) == 0 {
 		return nil, nil
 	}
 
-	// 2. Parse
-	buys := parseOrders(buyQueueRaw)
-	sells := parseOrders(sellQueueRaw)
+	// 2. Cumulative curves over every price level
+	buyCurve, sellCurve := auctionCurves(buys, sells)
 
-	// 3. Unique Price Levels
-	prices := make(map[float64]bool)
-	for _, o := range buys {
-		prices[o.Price] = true
-	}
-	for _, o := range sells {
-		prices[o.Price] = true
+	var candidates []IEPResult
+	for i := range buyCurve {
+		cumBuy, cumSell := buyCurve[i].Quantity, sellCurve[i].Quantity
+		matched := min(cumBuy, cumSell)
+		if matched > 0 {
+			candidates = append(candidates, IEPResult{
+				Price:         buyCurve[i].Price,
+				MatchedVolume: matched,
+				Surplus:       cumBuy - cumSell,
+			})
+		}
 	}
 
-	if len(prices) == 0 {
+	if len(candidates) == 0 {
 		return nil, nil
 	}
 
-	sortedPrices := make([]float64, 0, len(prices))
-	for p := range prices {
-		sortedPrices = append(sortedPrices, p)
-	}
-	sort.Float64s(sortedPrices)
+	// 3. Tie-break chain
+	best := selectIEP(candidates, func() (float64, bool) { return referencePrice(symbol) })
+	best.BuyCurve, best.SellCurve = buyCurve, sellCurve
+	return best, nil
+}
 
-	// 4. Aggregate Volume
+// Curves returns the cumulative bid/ask curves of a symbol's book
+func (e *IEPEngine) Curves(symbol string) ([]CurvePoint, []CurvePoint) {
+	book := Engine.Book(symbol)
+	return auctionCurves(book.Orders(SideBuy), book.Orders(SideSell))
+}
+
+// auctionCurves returns, for every price in the book in ascending order, the bid
+// quantity willing to buy at that price (bids >= p) and the ask quantity willing to
+// sell at it (asks <= p). The auction uses the full quantity, icebergs included.
+func auctionCurves(buys, sells []ParsedOrder) ([]CurvePoint, []CurvePoint) {
 	buyVolByPrice := make(map[float64]int64)
 	for _, o := range buys {
 		buyVolByPrice[o.Price] += o.Data.RemainingQuantity
 	}
-
 	sellVolByPrice := make(map[float64]int64)
 	for _, o := range sells {
 		sellVolByPrice[o.Price] += o.Data.RemainingQuantity
 	}
 
-	var candidates []IEPResult
-
-	for _, p := range sortedPrices {
-		var cumBuy, cumSell int64
-
-		// Buy: Price >= p
-		for bp, vol := range buyVolByPrice {
-			if bp >= p {
-				cumBuy += vol
-			}
+	// Unique Price Levels
+	var prices []float64
+	for p := range buyVolByPrice {
+		prices = append(prices, p)
+	}
+	for p := range sellVolByPrice {
+		if _, ok := buyVolByPrice[p]; !ok {
+			prices = append(prices, p)
 		}
+	}
+	sort.Float64s(prices)
+
+	buyCurve := make([]CurvePoint, len(prices))
+	sellCurve := make([]CurvePoint, len(prices))
+	var cumSell int64
+	for i, p := range prices {
+		cumSell += sellVolByPrice[p]
+		sellCurve[i] = CurvePoint{Price: p, Quantity: cumSell}
+	}
+	var cumBuy int64
+	for i := len(prices) - 1; i >= 0; i-- {
+		cumBuy += buyVolByPrice[prices[i]]
+		buyCurve[i] = CurvePoint{Price: prices[i], Quantity: cumBuy}
+	}
+	return buyCurve, sellCurve
+}
 
-		// Sell: Price <= p
-		for sp, vol := range sellVolByPrice {
-			if sp <= p {
-				cumSell += vol
+// selectIEP applies the exchange tie-break chain to the crossing prices:
+// max volume, then min surplus, then market pressure, then the reference price.
+// reference is only looked up when the last rule is needed.
+func selectIEP(candidates []IEPResult, reference func() (float64, bool)) *IEPResult {
+	keep := func(better func(a, b IEPResult) bool) {
+		best := candidates[:1]
+		for _, c := range candidates[1:] {
+			switch {
+			case better(c, best[0]):
+				best = []IEPResult{c}
+			case !better(best[0], c):
+				best = append(best, c)
 			}
 		}
-
-		matched := int64(math.Min(float64(cumBuy), float64(cumSell)))
-		if matched > 0 {
-			candidates = append(candidates, IEPResult{
-				Price:         p,
-				MatchedVolume: matched,
-				Surplus:       cumBuy - cumSell,
-			})
-		}
+		candidates = best
+	}
+	pick := func(rule string) *IEPResult {
+		c := candidates[0]
+		c.TieBreak = rule
+		return &c
 	}
 
-	if len(candidates) == 0 {
-		return nil, nil
+	// Maximum executable volume
+	keep(func(a, b IEPResult) bool { return a.MatchedVolume > b.MatchedVolume })
+	if len(candidates) == 1 {
+		return pick(IEPTieBreakVolume)
 	}
 
-	// 5. Select Best Price
-	// Sort by Volume Desc
-	sort.Slice(candidates, func(i, j int) bool {
-		return candidates[i].MatchedVolume > candidates[j].MatchedVolume
-	})
+	// Minimum surplus
+	abs := func(v int64) int64 { return max(v, -v) }
+	keep(func(a, b IEPResult) bool { return abs(a.Surplus) < abs(b.Surplus) })
+	if len(candidates) == 1 {
+		return pick(IEPTieBreakSurplus)
+	}
 
-	maxVol := candidates[0].MatchedVolume
-	// Filter max vol
-	var bestCandidates []IEPResult
+	// Market pressure: buy surplus everywhere pushes the price up, sell surplus down
+	allBuy, allSell := true, true
 	for _, c := range candidates {
-		if c.MatchedVolume == maxVol {
-			bestCandidates = append(bestCandidates, c)
-		}
+		allBuy = allBuy && c.Surplus > 0
+		allSell = allSell && c.Surplus < 0
 	}
-
-	if len(bestCandidates) == 1 {
-		return &bestCandidates[0], nil
+	if allBuy {
+		keep(func(a, b IEPResult) bool { return a.Price > b.Price })
+		return pick(IEPTieBreakPressure)
 	}
-
-	// Sort by Min Absolute Surplus
-	sort.Slice(bestCandidates, func(i, j int) bool {
-		return math.Abs(float64(bestCandidates[i].Surplus)) < math.Abs(float64(bestCandidates[j].Surplus))
-	})
-
-	minSurplus := math.Abs(float64(bestCandidates[0].Surplus))
-	var surplusCandidates []IEPResult
-	for _, c := range bestCandidates {
-		if math.Abs(float64(c.Surplus)) == minSurplus {
-			surplusCandidates = append(surplusCandidates, c)
-		}
+	if allSell {
+		keep(func(a, b IEPResult) bool { return a.Price < b.Price })
+		return pick(IEPTieBreakPressure)
 	}
 
-	if len(surplusCandidates) == 1 {
-		return &surplusCandidates[0], nil
+	// Closest to the reference price (previous close); the higher price if equidistant
+	ref, ok := reference()
+	if !ok {
+		// No reference: the middle of the remaining range
+		ref = (candidates[0].Price + candidates[len(candidates)-1].Price) / 2
 	}
+	keep(func(a, b IEPResult) bool {
+		da, db := math.Abs(a.Price-ref), math.Abs(b.Price-ref)
+		return da < db || (da == db && a.Price > b.Price)
+	})
+	return pick(IEPTieBreakReference)
+}
 
-	// Sort by Closeness to Prev Close (TODO: Fetch Prev Close)
-	// For now, pick first (lowest price usually due to earlier sort if distinct)
-	// Actually sortedPrices was asc.
-	return &surplusCandidates[0], nil
+// referencePrice is the previous close of the symbol's latest session
+func referencePrice(symbol string) (float64, bool) {
+	var prevClose float64
+	err := config.DB.QueryRow(context.Background(), `
+		SELECT d.prev_close
+		FROM daily_stock_data d
+		JOIN stocks s ON d.stock_id = s.id
+		WHERE s.symbol = $1
+		ORDER BY d.session_id DESC LIMIT 1
+	`, symbol).Scan(&prevClose)
+	if err != nil {
+		return 0, false
+	}
+	return prevClose, true
 }
 
-// Function to EXECUTE the IEP match (Call Auction)
-func (e *IEPEngine) ExecuteIEP(symbol string, engine *MatchingEngine) error {
+// Function to EXECUTE the IEP match (Call Auction).
+// Returns the auction price with the volume actually executed, or nil if the book did not cross.
+// The caller must hold the symbol lock.
+func (e *IEPEngine) ExecuteIEP(symbol string, engine *MatchingEngine) (*IEPResult, error) {
 	iep, err := e.CalculateIEP(symbol)
 	if err != nil || iep == nil {
-		return nil
+		return nil, nil
 	}
+	executed := *iep
+	executed.MatchedVolume = 0
 
-	// Iterate orders and match at IEP Price
 	ctx := context.Background()
+	sessionId, policy := auctionSession(ctx)
+	kind := AuctionOpening
+	if engine.SessionStatus == StatusPreClose {
+		kind = AuctionClosing
+	} else if h := engine.HaltOf(symbol); h != nil && h.Phase == HaltAuction {
+		kind = AuctionReopening
+	}
 
-	// Need to fetch again to be sure of state or reuse if we lock?
-	// The caller should have locked the symbol.
-	// We assume we are inside the lock.
-
-	// In Call Auction, all Buy orders with Price >= IEP and Sell orders with Price <= IEP are matched at IEP.
-
+	// In Call Auction, all Buy orders with Price >= IEP and Sell orders with Price <= IEP are eligible.
 	// 1. Fetch
-	buyQueueRaw, _ := config.RedisMain.ZRevRangeWithScores(ctx, "orderbook:"+symbol+":buy", 0, -1).Result()
-	sellQueueRaw, _ := config.RedisMain.ZRangeWithScores(ctx, "orderbook:"+symbol+":sell", 0, -1).Result()
-
-	buys := parseOrders(buyQueueRaw) // Descending Price
-	sells := parseOrders(sellQueueRaw) // Ascending Price
+	book := engine.Book(symbol)
+	buys := book.Orders(SideBuy)
+	sells := book.Orders(SideSell)
 
 	// 2. Filter eligible
+	// The auction matches the full quantity of iceberg orders, so the copies handed to
+	// settleTrade drop the display size (the book itself keeps it)
 	var eligibleBuys []ParsedOrder
 	for _, b := range buys {
 		if b.Price >= iep.Price {
+			b.Data.DisplayQuantity = 0
 			eligibleBuys = append(eligibleBuys, b)
 		}
 	}
@@ -170,50 +213,77 @@ func (e *IEPEngine) ExecuteIEP(symbol string, engine *MatchingEngine) error {
 	var eligibleSells []ParsedOrder
 	for _, s := range sells {
 		if s.Price <= iep.Price {
+			s.Data.DisplayQuantity = 0
 			eligibleSells = append(eligibleSells, s)
 		}
 	}
 
-	// 3. Match Loop
+	// 3. Allocate the auction volume: price, then time (or pro-rata at the marginal level)
+	sortForAuction(eligibleBuys, SideBuy)
+	sortForAuction(eligibleSells, SideSell)
+	buyAllocs := allocate(eligibleBuys, SideBuy, iep.MatchedVolume, policy)
+	sellAllocs := allocate(eligibleSells, SideSell, iep.MatchedVolume, policy)
+
+	// 4. Match Loop: pair the allocations in priority order
 	bIdx, sIdx := 0, 0
 	for bIdx < len(eligibleBuys) && sIdx < len(eligibleSells) {
+		bAlloc, sAlloc := &buyAllocs[bIdx], &sellAllocs[sIdx]
+		if bAlloc.Filled >= bAlloc.Allocated {
+			bIdx++
+			continue
+		}
+		if sAlloc.Filled >= sAlloc.Allocated {
+			sIdx++
+			continue
+		}
 		buy := eligibleBuys[bIdx]
 		sell := eligibleSells[sIdx]
 
-		// Execute at IEP Price
-		if err := engine.ExecuteTrade(buy.Data, sell.Data, iep.Price, symbol, buy.Price, sell.Price, buy.Raw, sell.Raw); err != nil {
-			// Log error?
-			break
+		if isSelfTrade(buy, sell) {
+			if err := engine.preventSelfTrade(symbol, buy, sell); err != nil {
+				engine.stats.errors.Inc()
+				break
+			}
+			// Pick up what prevention left of both orders; a canceled order keeps
+			// what it already filled and gives up the rest of its allocation
+			if cur, ok := book.Get(buy.Data.OrderId); ok {
+				eligibleBuys[bIdx].Data.RemainingQuantity = cur.Data.RemainingQuantity
+				bAlloc.Allocated = min(bAlloc.Allocated, bAlloc.Filled+cur.Data.RemainingQuantity)
+			} else {
+				bAlloc.Allocated = bAlloc.Filled
+			}
+			if cur, ok := book.Get(sell.Data.OrderId); ok {
+				eligibleSells[sIdx].Data.RemainingQuantity = cur.Data.RemainingQuantity
+				sAlloc.Allocated = min(sAlloc.Allocated, sAlloc.Filled+cur.Data.RemainingQuantity)
+			} else {
+				sAlloc.Allocated = sAlloc.Filled
+			}
+			continue
 		}
 
-		// Check remaining to advance index
-		// Since ExecuteTrade modifies the order in DB and Redis,
-		// but `buy` and `sell` structs here are stale copies of Data.RemainingQuantity.
-		// However, ExecuteTrade logic uses the passed struct data.
-		// Wait, ExecuteTrade logic calculates matchQty based on passed struct.
-		// It returns nil on success.
-		// We need to update our local state to know if we advanced.
-
-		matchQty := buy.Data.RemainingQuantity
-		if sell.Data.RemainingQuantity < matchQty {
-			matchQty = sell.Data.RemainingQuantity
+		// Execute at IEP Price
+		matchQty := min(bAlloc.Allocated-bAlloc.Filled, sAlloc.Allocated-sAlloc.Filled)
+		if err := engine.settleTrade(buy, sell, iep.Price, symbol, matchQty); err != nil {
+			engine.stats.errors.Inc()
+			log.Printf("Auction %s trade failed: %v", symbol, err)
+			break
 		}
 
-		buy.Data.RemainingQuantity -= matchQty
-		sell.Data.RemainingQuantity -= matchQty
-
-		eligibleBuys[bIdx] = buy
-		eligibleSells[sIdx] = sell
-
-		if buy.Data.RemainingQuantity <= 0 {
-			bIdx++
-		}
-		if sell.Data.RemainingQuantity <= 0 {
-			sIdx++
-		}
+		// settleTrade works from the remaining quantity passed in, so keep the copies current
+		eligibleBuys[bIdx].Data.RemainingQuantity -= matchQty
+		eligibleSells[sIdx].Data.RemainingQuantity -= matchQty
+		bAlloc.Filled += matchQty
+		sAlloc.Filled += matchQty
+		executed.MatchedVolume += matchQty
 	}
 
-	return nil
+	// The fills are committed by now: the auction is returned with the error, so the
+	// caller still sees what traded
+	if err := saveAuctionReport(ctx, sessionId, symbol, kind, policy, iep, executed.MatchedVolume, append(buyAllocs, sellAllocs...)); err != nil {
+		engine.stats.auctionReportErrors.Inc()
+		return &executed, fmt.Errorf("auction report %s: %w", symbol, err)
+	}
+	return &executed, nil
 }
 
 var GlobalIEPEngine = &IEPEngine{}
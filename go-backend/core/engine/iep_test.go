@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectIEP(t *testing.T) {
+	noReference := func() (float64, bool) { return 0, false }
+	reference := func(p float64) func() (float64, bool) {
+		return func() (float64, bool) { return p, true }
+	}
+
+	tests := []struct {
+		name       string
+		candidates []IEPResult
+		reference  func() (float64, bool)
+		wantPrice  float64
+		wantRule   string
+	}{
+		{
+			name: "single candidate",
+			candidates: []IEPResult{
+				{Price: 100, MatchedVolume: 5, Surplus: 2},
+			},
+			reference: noReference,
+			wantPrice: 100,
+			wantRule:  IEPTieBreakVolume,
+		},
+		{
+			name: "maximum volume",
+			candidates: []IEPResult{
+				{Price: 99, MatchedVolume: 5, Surplus: 0},
+				{Price: 100, MatchedVolume: 8, Surplus: 6},
+				{Price: 101, MatchedVolume: 6, Surplus: -1},
+			},
+			reference: noReference,
+			wantPrice: 100,
+			wantRule:  IEPTieBreakVolume,
+		},
+		{
+			name: "minimum surplus",
+			candidates: []IEPResult{
+				{Price: 99, MatchedVolume: 8, Surplus: 4},
+				{Price: 100, MatchedVolume: 8, Surplus: -2},
+				{Price: 101, MatchedVolume: 8, Surplus: -3},
+			},
+			reference: noReference,
+			wantPrice: 100,
+			wantRule:  IEPTieBreakSurplus,
+		},
+		{
+			name: "buy pressure takes the highest price",
+			candidates: []IEPResult{
+				{Price: 99, MatchedVolume: 8, Surplus: 2},
+				{Price: 100, MatchedVolume: 8, Surplus: 2},
+				{Price: 98, MatchedVolume: 8, Surplus: 5},
+			},
+			reference: noReference,
+			wantPrice: 100,
+			wantRule:  IEPTieBreakPressure,
+		},
+		{
+			name: "sell pressure takes the lowest price",
+			candidates: []IEPResult{
+				{Price: 99, MatchedVolume: 8, Surplus: -2},
+				{Price: 100, MatchedVolume: 8, Surplus: -2},
+			},
+			reference: noReference,
+			wantPrice: 99,
+			wantRule:  IEPTieBreakPressure,
+		},
+		{
+			name: "closest to the reference",
+			candidates: []IEPResult{
+				{Price: 99, MatchedVolume: 8, Surplus: 2},
+				{Price: 100, MatchedVolume: 8, Surplus: -2},
+				{Price: 101, MatchedVolume: 8, Surplus: 2},
+			},
+			reference: reference(101),
+			wantPrice: 101,
+			wantRule:  IEPTieBreakReference,
+		},
+		{
+			name: "equidistant from the reference takes the higher price",
+			candidates: []IEPResult{
+				{Price: 99, MatchedVolume: 8, Surplus: 2},
+				{Price: 101, MatchedVolume: 8, Surplus: -2},
+			},
+			reference: reference(100),
+			wantPrice: 101,
+			wantRule:  IEPTieBreakReference,
+		},
+		{
+			name: "no reference takes the middle of the range",
+			candidates: []IEPResult{
+				{Price: 98, MatchedVolume: 8, Surplus: 2},
+				{Price: 100, MatchedVolume: 8, Surplus: -2},
+				{Price: 104, MatchedVolume: 8, Surplus: 2},
+			},
+			reference: noReference,
+			wantPrice: 100,
+			wantRule:  IEPTieBreakReference,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectIEP(tt.candidates, tt.reference)
+			if got.Price != tt.wantPrice || got.TieBreak != tt.wantRule {
+				t.Errorf("selectIEP() = %v by %s, want %v by %s", got.Price, got.TieBreak, tt.wantPrice, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestSelectIEPLooksUpReferenceLast(t *testing.T) {
+	called := false
+	selectIEP([]IEPResult{
+		{Price: 99, MatchedVolume: 8, Surplus: 1},
+		{Price: 100, MatchedVolume: 8, Surplus: 3},
+	}, func() (float64, bool) {
+		called = true
+		return 0, false
+	})
+	if called {
+		t.Error("reference looked up although the surplus rule decided")
+	}
+}
+
+func TestAuctionCurves(t *testing.T) {
+	buys := []ParsedOrder{
+		order("b1", "u1", 101, 3, 0, 1),
+		order("b2", "u1", 100, 2, 0, 2),
+		order("b3", "u1", 100, 10, 4, 3), // iceberg counts in full
+	}
+	sells := []ParsedOrder{
+		order("s1", "u2", 99, 4, 0, 1),
+		order("s2", "u2", 101, 5, 0, 2),
+	}
+	buyCurve, sellCurve := auctionCurves(buys, sells)
+
+	wantBuy := []CurvePoint{{99, 15}, {100, 15}, {101, 3}}
+	wantSell := []CurvePoint{{99, 4}, {100, 4}, {101, 9}}
+	if !reflect.DeepEqual(buyCurve, wantBuy) {
+		t.Errorf("buy curve = %v, want %v", buyCurve, wantBuy)
+	}
+	if !reflect.DeepEqual(sellCurve, wantSell) {
+		t.Errorf("sell curve = %v, want %v", sellCurve, wantSell)
+	}
+}
@@ -0,0 +1,389 @@
+package engine
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Side keys, matching the Redis key suffix orderbook:<symbol>:<side>
+const (
+	SideBuy  = "buy"
+	SideSell = "sell"
+)
+
+// SideKey maps an order type (BUY/SELL) to its book side
+func SideKey(orderType string) string {
+	if orderType == "BUY" {
+		return SideBuy
+	}
+	return SideSell
+}
+
+// PriceLevel is a FIFO queue of orders resting at the same price
+type PriceLevel struct {
+	Price    float64
+	TotalQty int64      // visible quantity
+	fullQty  int64      // remaining quantity including hidden iceberg reserves
+	orders   *list.List // of *ParsedOrder, oldest first
+}
+
+// DepthLevel is the aggregated view of a price level
+type DepthLevel struct {
+	Price    float64 `json:"price"`
+	TotalQty int64   `json:"totalQty"`
+	Count    int     `json:"count"`
+}
+
+type bookSide struct {
+	desc   bool // bids are best-first descending, asks ascending
+	levels map[float64]*PriceLevel
+	prices []float64 // sorted best-first
+}
+
+func newBookSide(desc bool) *bookSide {
+	return &bookSide{desc: desc, levels: make(map[float64]*PriceLevel)}
+}
+
+func (s *bookSide) better(a, b float64) bool {
+	if s.desc {
+		return a > b
+	}
+	return a < b
+}
+
+func (s *bookSide) level(price float64, create bool) *PriceLevel {
+	if lvl, ok := s.levels[price]; ok {
+		return lvl
+	}
+	if !create {
+		return nil
+	}
+	lvl := &PriceLevel{Price: price, orders: list.New()}
+	s.levels[price] = lvl
+
+	i := sort.Search(len(s.prices), func(i int) bool { return !s.better(s.prices[i], price) })
+	s.prices = append(s.prices, 0)
+	copy(s.prices[i+1:], s.prices[i:])
+	s.prices[i] = price
+	return lvl
+}
+
+func (s *bookSide) dropLevel(price float64) {
+	delete(s.levels, price)
+	i := sort.Search(len(s.prices), func(i int) bool { return !s.better(s.prices[i], price) })
+	if i < len(s.prices) && s.prices[i] == price {
+		s.prices = append(s.prices[:i], s.prices[i+1:]...)
+	}
+}
+
+type bookEntry struct {
+	side  *bookSide
+	level *PriceLevel
+	elem  *list.Element
+}
+
+// OrderBook is the in-process price-level book for a single symbol.
+// It is the source of truth for matching; Redis only holds a write-behind snapshot.
+type OrderBook struct {
+	Symbol string
+
+	mu    sync.RWMutex
+	bids  *bookSide
+	asks  *bookSide
+	index map[string]*bookEntry // orderId -> position
+}
+
+func NewOrderBook(symbol string) *OrderBook {
+	return &OrderBook{
+		Symbol: symbol,
+		bids:   newBookSide(true),
+		asks:   newBookSide(false),
+		index:  make(map[string]*bookEntry),
+	}
+}
+
+func (b *OrderBook) side(side string) *bookSide {
+	if side == SideBuy {
+		return b.bids
+	}
+	return b.asks
+}
+
+// insert places the order in its level by timestamp (normally an append).
+func (b *OrderBook) insert(side string, o ParsedOrder) {
+	s := b.side(side)
+	lvl := s.level(o.Price, true)
+
+	po := &ParsedOrder{Data: o.Data, Price: o.Price}
+	if d := &po.Data; d.DisplayQuantity > 0 && (d.VisibleQuantity <= 0 || d.VisibleQuantity > d.RemainingQuantity) {
+		d.VisibleQuantity = min(d.DisplayQuantity, d.RemainingQuantity)
+	}
+	var elem *list.Element
+	for e := lvl.orders.Back(); e != nil; e = e.Prev() {
+		if e.Value.(*ParsedOrder).Data.Timestamp <= po.Data.Timestamp {
+			elem = lvl.orders.InsertAfter(po, e)
+			break
+		}
+	}
+	if elem == nil {
+		elem = lvl.orders.PushFront(po)
+	}
+	lvl.TotalQty += po.Visible()
+	lvl.fullQty += po.Data.RemainingQuantity
+	b.index[po.Data.OrderId] = &bookEntry{side: s, level: lvl, elem: elem}
+}
+
+func (b *OrderBook) remove(entry *bookEntry) *ParsedOrder {
+	po := entry.elem.Value.(*ParsedOrder)
+	entry.level.orders.Remove(entry.elem)
+	entry.level.TotalQty -= po.Visible()
+	entry.level.fullQty -= po.Data.RemainingQuantity
+	if entry.level.orders.Len() == 0 {
+		entry.side.dropLevel(entry.level.Price)
+	}
+	delete(b.index, po.Data.OrderId)
+	return po
+}
+
+// Add inserts a new resting order. An existing order with the same ID is replaced.
+func (b *OrderBook) Add(side string, o ParsedOrder) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if entry, ok := b.index[o.Data.OrderId]; ok {
+		b.remove(entry)
+	}
+	b.insert(side, o)
+}
+
+// Remove takes an order out of the book and returns its last known state
+func (b *OrderBook) Remove(orderId string) (ParsedOrder, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.index[orderId]
+	if !ok {
+		return ParsedOrder{}, false
+	}
+	return *b.remove(entry), true
+}
+
+// Get returns a copy of a resting order
+func (b *OrderBook) Get(orderId string) (ParsedOrder, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	entry, ok := b.index[orderId]
+	if !ok {
+		return ParsedOrder{}, false
+	}
+	return *entry.elem.Value.(*ParsedOrder), true
+}
+
+// SideOf returns the side an order rests on
+func (b *OrderBook) SideOf(orderId string) (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	entry, ok := b.index[orderId]
+	if !ok {
+		return "", false
+	}
+	if entry.side == b.bids {
+		return SideBuy, true
+	}
+	return SideSell, true
+}
+
+// Fill reduces the remaining quantity of a resting order, removing it once exhausted.
+// An iceberg whose visible slice is used up is replenished from its hidden reserve
+// and moved to the back of its price level with a new timestamp.
+// Returns the updated order state and false if the order was not in the book.
+func (b *OrderBook) Fill(orderId string, qty int64) (ParsedOrder, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.index[orderId]
+	if !ok {
+		return ParsedOrder{}, false
+	}
+	po := entry.elem.Value.(*ParsedOrder)
+	if qty > po.Data.RemainingQuantity {
+		qty = po.Data.RemainingQuantity
+	}
+	visible := po.Visible()
+	po.Data.RemainingQuantity -= qty
+	if po.Data.DisplayQuantity > 0 {
+		po.Data.VisibleQuantity = max(po.Data.VisibleQuantity-qty, 0)
+	}
+	entry.level.TotalQty -= visible - po.Visible()
+	entry.level.fullQty -= qty
+
+	if po.Data.RemainingQuantity > 0 && po.Data.DisplayQuantity > 0 && po.Data.VisibleQuantity == 0 {
+		b.replenish(entry, po)
+	}
+
+	res := *po
+	if po.Data.RemainingQuantity <= 0 {
+		b.remove(entry)
+	}
+	return res, true
+}
+
+// replenish shows the next iceberg slice and sends the order to the back of its level
+func (b *OrderBook) replenish(entry *bookEntry, po *ParsedOrder) {
+	lvl := entry.level
+	ts := time.Now().UnixMilli()
+	if back := lvl.orders.Back(); back != nil {
+		ts = max(ts, back.Value.(*ParsedOrder).Data.Timestamp)
+	}
+
+	lvl.orders.Remove(entry.elem)
+	po.Data.Timestamp = ts
+	po.Data.VisibleQuantity = min(po.Data.DisplayQuantity, po.Data.RemainingQuantity)
+	entry.elem = lvl.orders.PushBack(po)
+	lvl.TotalQty += po.Data.VisibleQuantity
+}
+
+// Best returns the order with the highest priority on a side
+func (b *OrderBook) Best(side string) (ParsedOrder, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	s := b.side(side)
+	if len(s.prices) == 0 {
+		return ParsedOrder{}, false
+	}
+	front := s.levels[s.prices[0]].orders.Front()
+	return *front.Value.(*ParsedOrder), true
+}
+
+// Orders returns every resting order on a side in priority order
+func (b *OrderBook) Orders(side string) []ParsedOrder {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	s := b.side(side)
+	var res []ParsedOrder
+	for _, p := range s.prices {
+		for e := s.levels[p].orders.Front(); e != nil; e = e.Next() {
+			res = append(res, *e.Value.(*ParsedOrder))
+		}
+	}
+	return res
+}
+
+// Depth aggregates up to maxLevels price levels on a side
+func (b *OrderBook) Depth(side string, maxLevels int) []DepthLevel {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	s := b.side(side)
+	res := []DepthLevel{}
+	for _, p := range s.prices {
+		if len(res) >= maxLevels {
+			break
+		}
+		lvl := s.levels[p]
+		if lvl.TotalQty <= 0 {
+			continue
+		}
+		res = append(res, DepthLevel{Price: p, TotalQty: lvl.TotalQty, Count: lvl.orders.Len()})
+	}
+	return res
+}
+
+// Crossing sums the quantity on a side that is marketable against a limit price:
+// asks at or below it, or bids at or above it. Hidden iceberg reserves are included.
+func (b *OrderBook) Crossing(side string, limit float64) int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	s := b.side(side)
+	var total int64
+	for _, p := range s.prices {
+		if s.better(limit, p) {
+			break
+		}
+		total += s.levels[p].fullQty
+	}
+	return total
+}
+
+// Fillable sums the quantity an incoming order of userId at a limit price can trade
+// against on a side, walking it in priority order. The user's own orders are never
+// traded: with skipOwn they are passed over (self-trade prevention cancels them),
+// otherwise the walk stops at the first one (self-trade prevention ends the incoming
+// order there). Hidden iceberg reserves are included.
+func (b *OrderBook) Fillable(side string, limit float64, userId string, skipOwn bool) int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	s := b.side(side)
+	var total int64
+	for _, p := range s.prices {
+		if s.better(limit, p) {
+			break
+		}
+		for e := s.levels[p].orders.Front(); e != nil; e = e.Next() {
+			o := e.Value.(*ParsedOrder)
+			if o.Data.UserId == userId && userId != "SYSTEM_BOT" {
+				if skipOwn {
+					continue
+				}
+				return total
+			}
+			total += o.Data.RemainingQuantity
+		}
+	}
+	return total
+}
+
+// Queue returns the FIFO queue resting at a price on a side
+func (b *OrderBook) Queue(side string, price float64) []ParsedOrder {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	lvl := b.side(side).level(price, false)
+	if lvl == nil {
+		return nil
+	}
+	var res []ParsedOrder
+	for e := lvl.orders.Front(); e != nil; e = e.Next() {
+		res = append(res, *e.Value.(*ParsedOrder))
+	}
+	return res
+}
+
+// Len returns the number of resting orders on a side
+func (b *OrderBook) Len(side string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	n := 0
+	for _, lvl := range b.side(side).levels {
+		n += lvl.orders.Len()
+	}
+	return n
+}
+
+// Clear drops every order and returns what was removed
+func (b *OrderBook) Clear() []ParsedOrder {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var res []ParsedOrder
+	for _, s := range []*bookSide{b.bids, b.asks} {
+		for _, lvl := range s.levels {
+			for e := lvl.orders.Front(); e != nil; e = e.Next() {
+				res = append(res, *e.Value.(*ParsedOrder))
+			}
+		}
+	}
+	b.bids = newBookSide(true)
+	b.asks = newBookSide(false)
+	b.index = make(map[string]*bookEntry)
+	return res
+}
@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+
+	"mbit-backend-go/models"
+)
+
+// order builds a resting order; display > 0 makes it an iceberg
+func order(id, user string, price float64, qty, display, ts int64) ParsedOrder {
+	return ParsedOrder{
+		Price: price,
+		Data: models.RedisOrderData{
+			OrderId: id, UserId: user, Price: price, Quantity: qty, RemainingQuantity: qty,
+			DisplayQuantity: display, Timestamp: ts,
+		},
+	}
+}
+
+func ids(orders []ParsedOrder) []string {
+	res := []string{}
+	for _, o := range orders {
+		res = append(res, o.Data.OrderId)
+	}
+	return res
+}
+
+func TestOrderBookPriority(t *testing.T) {
+	tests := []struct {
+		name   string
+		side   string
+		orders []ParsedOrder
+		want   []string
+	}{
+		{
+			name: "bids best price first",
+			side: SideBuy,
+			orders: []ParsedOrder{
+				order("a", "u1", 100, 1, 0, 1),
+				order("b", "u1", 102, 1, 0, 2),
+				order("c", "u1", 101, 1, 0, 3),
+			},
+			want: []string{"b", "c", "a"},
+		},
+		{
+			name: "asks best price first",
+			side: SideSell,
+			orders: []ParsedOrder{
+				order("a", "u1", 100, 1, 0, 1),
+				order("b", "u1", 102, 1, 0, 2),
+				order("c", "u1", 101, 1, 0, 3),
+			},
+			want: []string{"a", "c", "b"},
+		},
+		{
+			name: "time priority within a level",
+			side: SideBuy,
+			orders: []ParsedOrder{
+				order("late", "u1", 100, 1, 0, 30),
+				order("early", "u1", 100, 1, 0, 10),
+				order("mid", "u1", 100, 1, 0, 20),
+			},
+			want: []string{"early", "mid", "late"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewOrderBook("TEST")
+			for _, o := range tt.orders {
+				b.Add(tt.side, o)
+			}
+			if got := ids(b.Orders(tt.side)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Orders() = %v, want %v", got, tt.want)
+			}
+			if best, _ := b.Best(tt.side); best.Data.OrderId != tt.want[0] {
+				t.Errorf("Best() = %s, want %s", best.Data.OrderId, tt.want[0])
+			}
+		})
+	}
+}
+
+func TestOrderBookAddReplaces(t *testing.T) {
+	b := NewOrderBook("TEST")
+	b.Add(SideBuy, order("a", "u1", 100, 5, 0, 1))
+	b.Add(SideBuy, order("a", "u1", 101, 3, 0, 2))
+
+	if n := b.Len(SideBuy); n != 1 {
+		t.Fatalf("Len() = %d, want 1", n)
+	}
+	want := []DepthLevel{{Price: 101, TotalQty: 3, Count: 1}}
+	if got := b.Depth(SideBuy, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("Depth() = %v, want %v", got, want)
+	}
+}
+
+func TestOrderBookFill(t *testing.T) {
+	tests := []struct {
+		name          string
+		fill          int64
+		wantRemaining int64
+		wantInBook    bool
+		wantDepth     []DepthLevel
+	}{
+		{"partial", 3, 7, true, []DepthLevel{{Price: 100, TotalQty: 12, Count: 2}}},
+		{"exact", 10, 0, false, []DepthLevel{{Price: 100, TotalQty: 5, Count: 1}}},
+		{"capped at remaining", 15, 0, false, []DepthLevel{{Price: 100, TotalQty: 5, Count: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewOrderBook("TEST")
+			b.Add(SideSell, order("a", "u1", 100, 10, 0, 1))
+			b.Add(SideSell, order("b", "u2", 100, 5, 0, 2))
+
+			got, ok := b.Fill("a", tt.fill)
+			if !ok {
+				t.Fatal("Fill() did not find the order")
+			}
+			if got.Data.RemainingQuantity != tt.wantRemaining {
+				t.Errorf("remaining = %d, want %d", got.Data.RemainingQuantity, tt.wantRemaining)
+			}
+			if _, in := b.Get("a"); in != tt.wantInBook {
+				t.Errorf("in book = %v, want %v", in, tt.wantInBook)
+			}
+			if depth := b.Depth(SideSell, 10); !reflect.DeepEqual(depth, tt.wantDepth) {
+				t.Errorf("Depth() = %v, want %v", depth, tt.wantDepth)
+			}
+		})
+	}
+
+	if _, ok := NewOrderBook("TEST").Fill("missing", 1); ok {
+		t.Error("Fill() of a missing order reported ok")
+	}
+}
+
+func TestOrderBookRemove(t *testing.T) {
+	b := NewOrderBook("TEST")
+	b.Add(SideBuy, order("a", "u1", 100, 4, 0, 1))
+	b.Add(SideBuy, order("b", "u1", 99, 6, 0, 2))
+
+	got, ok := b.Remove("a")
+	if !ok || got.Data.RemainingQuantity != 4 {
+		t.Fatalf("Remove() = %+v, %v", got.Data, ok)
+	}
+	if _, ok := b.Remove("a"); ok {
+		t.Error("second Remove() reported ok")
+	}
+	want := []DepthLevel{{Price: 99, TotalQty: 6, Count: 1}}
+	if depth := b.Depth(SideBuy, 10); !reflect.DeepEqual(depth, want) {
+		t.Errorf("Depth() = %v, want %v", depth, want)
+	}
+	if q := b.Queue(SideBuy, 100); q != nil {
+		t.Errorf("Queue() of a dropped level = %v, want nil", q)
+	}
+}
+
+func TestOrderBookIceberg(t *testing.T) {
+	tests := []struct {
+		name        string
+		fills       []int64
+		wantVisible int64
+		wantRemain  int64
+		wantQueue   []string // level 100 after the fills
+		wantDepth   int64
+	}{
+		{"slice shown on add", nil, 3, 10, []string{"ice", "plain"}, 5},
+		{"partial slice keeps priority", []int64{2}, 1, 8, []string{"ice", "plain"}, 3},
+		{"exhausted slice replenishes at the back", []int64{3}, 3, 7, []string{"plain", "ice"}, 5},
+		{"last slice is the remainder", []int64{3, 3, 3}, 1, 1, []string{"plain", "ice"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewOrderBook("TEST")
+			b.Add(SideSell, order("ice", "u1", 100, 10, 3, 1))
+			b.Add(SideSell, order("plain", "u2", 100, 2, 0, 2))
+
+			for _, q := range tt.fills {
+				b.Fill("ice", q)
+			}
+			got, _ := b.Get("ice")
+			if got.Visible() != tt.wantVisible || got.Data.RemainingQuantity != tt.wantRemain {
+				t.Errorf("visible/remaining = %d/%d, want %d/%d",
+					got.Visible(), got.Data.RemainingQuantity, tt.wantVisible, tt.wantRemain)
+			}
+			if q := ids(b.Queue(SideSell, 100)); !reflect.DeepEqual(q, tt.wantQueue) {
+				t.Errorf("Queue() = %v, want %v", q, tt.wantQueue)
+			}
+			if depth := b.Depth(SideSell, 1); depth[0].TotalQty != tt.wantDepth {
+				t.Errorf("visible depth = %d, want %d", depth[0].TotalQty, tt.wantDepth)
+			}
+			if crossing := b.Crossing(SideSell, 100); crossing != tt.wantRemain+2 {
+				t.Errorf("Crossing() = %d, want %d including the hidden reserve", crossing, tt.wantRemain+2)
+			}
+		})
+	}
+}
+
+func TestOrderBookFillable(t *testing.T) {
+	b := NewOrderBook("TEST")
+	b.Add(SideSell, order("a", "u2", 100, 2, 0, 1))
+	b.Add(SideSell, order("own", "u1", 101, 3, 0, 2))
+	b.Add(SideSell, order("ice", "u3", 101, 10, 2, 3))
+	b.Add(SideSell, order("far", "u2", 105, 4, 0, 4))
+
+	tests := []struct {
+		name    string
+		limit   float64
+		userId  string
+		skipOwn bool
+		want    int64
+	}{
+		{"below the best ask", 99, "u9", false, 0},
+		{"limit bounds the walk", 101, "u9", false, 15},
+		{"whole side", 105, "u9", false, 19},
+		{"stops at own order", 105, "u1", false, 2},
+		{"skips own order", 105, "u1", true, 16},
+		{"bot is never self-trading", 105, "SYSTEM_BOT", false, 19},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.Fillable(SideSell, tt.limit, tt.userId, tt.skipOwn); got != tt.want {
+				t.Errorf("Fillable() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"mbit-backend-go/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Write-behind persistence of the in-memory books.
+// Mutations are queued and flushed to Redis in pipelined batches by a single goroutine,
+// so the matching path never waits on Redis.
+//
+// Storage layout (see store.go):
+//   orderbook:<symbol>:<side>  ZSET  member = orderId, score = price
+//   order:<orderId>            HASH  order fields
+
+type bookOpKind int
+
+const (
+	opUpsert bookOpKind = iota
+	opFill
+	opRemove
+	opClear
+	opFlush
+)
+
+const persistBatchSize = 512
+
+type bookOp struct {
+	kind      bookOpKind
+	symbol    string
+	side      string
+	order     ParsedOrder
+	orderId   string
+	remaining int64
+	orderIds  []string
+	outboxIds []int64 // book_outbox rows to mark applied once written
+	done      chan struct{}
+}
+
+type bookPersister struct {
+	ops chan bookOp
+}
+
+func newBookPersister() *bookPersister {
+	return &bookPersister{ops: make(chan bookOp, 10000)}
+}
+
+func (p *bookPersister) run() {
+	ctx := context.Background()
+	for op := range p.ops {
+		pipe := config.RedisMain.Pipeline()
+		var waiters []chan struct{}
+		var outboxIds []int64
+		p.apply(ctx, pipe, op, &waiters, &outboxIds)
+
+	drain:
+		for pipe.Len() < persistBatchSize {
+			select {
+			case next := <-p.ops:
+				p.apply(ctx, pipe, next, &waiters, &outboxIds)
+			default:
+				break drain
+			}
+		}
+
+		if pipe.Len() > 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				// Outbox rows stay unapplied and are replayed by recovery
+				log.Println("Orderbook snapshot write failed:", err)
+				outboxIds = nil
+			}
+		}
+		if len(outboxIds) > 0 {
+			if _, err := config.DB.Exec(ctx, "UPDATE book_outbox SET applied_at = NOW() WHERE id = ANY($1)", outboxIds); err != nil {
+				log.Println("Failed to mark book outbox applied:", err)
+			}
+		}
+		for _, w := range waiters {
+			close(w)
+		}
+	}
+}
+
+func (p *bookPersister) apply(ctx context.Context, pipe redis.Pipeliner, op bookOp, waiters *[]chan struct{}, outboxIds *[]int64) {
+	*outboxIds = append(*outboxIds, op.outboxIds...)
+
+	switch op.kind {
+	case opUpsert:
+		writeOrder(ctx, pipe, op.symbol, op.side, op.order)
+	case opFill:
+		fillOrder(ctx, pipe, op.orderId, op.remaining)
+	case opRemove:
+		deleteOrder(ctx, pipe, op.symbol, op.orderId)
+	case opClear:
+		pipe.Del(ctx, bookKey(op.symbol, SideBuy), bookKey(op.symbol, SideSell))
+		for _, id := range op.orderIds {
+			pipe.Del(ctx, orderKey(id))
+		}
+	case opFlush:
+		*waiters = append(*waiters, op.done)
+	}
+}
+
+func (p *bookPersister) upsert(symbol, side string, o ParsedOrder, outboxIds ...int64) {
+	p.ops <- bookOp{kind: opUpsert, symbol: symbol, side: side, order: o, outboxIds: outboxIds}
+}
+
+func (p *bookPersister) fill(symbol, orderId string, remaining int64, outboxIds ...int64) {
+	p.ops <- bookOp{kind: opFill, symbol: symbol, orderId: orderId, remaining: remaining, outboxIds: outboxIds}
+}
+
+func (p *bookPersister) remove(symbol, orderId string, outboxIds ...int64) {
+	p.ops <- bookOp{kind: opRemove, symbol: symbol, orderId: orderId, outboxIds: outboxIds}
+}
+
+func (p *bookPersister) clear(symbol string, orderIds []string) {
+	p.ops <- bookOp{kind: opClear, symbol: symbol, orderIds: orderIds}
+}
+
+// flush blocks until every mutation queued before it has been written
+func (p *bookPersister) flush() {
+	done := make(chan struct{})
+	p.ops <- bookOp{kind: opFlush, done: done}
+	<-done
+}
+
+// restore rebuilds the in-memory books from the Redis snapshot.
+// Must run before the persister goroutine starts.
+func (p *bookPersister) restore(e *MatchingEngine) (int, error) {
+	ctx := context.Background()
+	restored := 0
+
+	iter := config.RedisMain.Scan(ctx, 0, "orderbook:*", 500).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		parts := strings.Split(key, ":")
+		if len(parts) != 3 || (parts[2] != SideBuy && parts[2] != SideSell) {
+			continue
+		}
+		symbol, side := parts[1], parts[2]
+
+		orders, err := loadSide(ctx, symbol, side)
+		if err != nil {
+			return restored, err
+		}
+
+		book := e.bookFor(symbol)
+		for _, o := range orders {
+			book.Add(side, o)
+			restored++
+		}
+	}
+	return restored, iter.Err()
+}
@@ -0,0 +1,571 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/models"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	socketio "github.com/zishang520/socket.io/v2/socket"
+)
+
+// Order book reconciliation.
+// Every resting order in the in-memory book and in the Redis snapshot is checked against
+// its row in orders (status, remaining_quantity, price, side), and every live LIMIT DAY/GTC
+// order of the session must be in the book. SYSTEM_BOT orders have no row; they are checked
+// against the in-memory book and flagged when no session or stock is left for them.
+// In repair mode the in-memory book is corrected from the DB and Redis follows it.
+
+// Reconcile triggers
+const (
+	ReconcileManual    = "MANUAL"
+	ReconcileScheduled = "SCHEDULED"
+)
+
+// Where an issue was found
+const (
+	SourceMemory = "MEMORY"
+	SourceRedis  = "REDIS"
+)
+
+// Issue kinds
+const (
+	IssueNotFound    = "ORDER_NOT_FOUND"    // user order without a row in orders
+	IssueNotLive     = "STATUS_MISMATCH"    // order row is no longer PENDING/PARTIAL
+	IssueSymbol      = "SYMBOL_MISMATCH"    // order belongs to another stock
+	IssueSide        = "SIDE_MISMATCH"      // resting on the wrong side
+	IssuePrice       = "PRICE_MISMATCH"     // resting at another price
+	IssueRemaining   = "REMAINING_MISMATCH" // remaining quantity differs
+	IssueMissing     = "MISSING_FROM_BOOK"  // live order (or bot order) not in the book
+	IssueDangling    = "DANGLING_INDEX"     // Redis index entry without its order hash
+	IssueOrphanedBot = "ORPHANED_BOT"       // bot order with no session or active stock
+	IssueCrossed     = "CROSSED_BOOK"       // best bid >= best ask during continuous trading
+)
+
+// reconcileGrace skips orders changed in the last seconds: PlaceOrder commits the row
+// before the order reaches the book
+const reconcileGrace = 10 * time.Second
+
+// BookIssue is one inconsistency found by Reconcile
+type BookIssue struct {
+	Symbol   string `json:"symbol"`
+	OrderId  string `json:"order_id,omitempty"`
+	Side     string `json:"side,omitempty"`
+	Source   string `json:"source"`
+	Kind     string `json:"kind"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+// BookSummary counts the orders checked for one symbol
+type BookSummary struct {
+	Symbol     string `json:"symbol"`
+	MemoryBuy  int    `json:"memory_buy"`
+	MemorySell int    `json:"memory_sell"`
+	RedisBuy   int    `json:"redis_buy"`
+	RedisSell  int    `json:"redis_sell"`
+	LiveOrders int    `json:"live_db_orders"`
+}
+
+// ReconcileReport is the outcome of one reconciliation run
+type ReconcileReport struct {
+	ID         int64         `json:"id,omitempty"`
+	Trigger    string        `json:"trigger"`
+	Repair     bool          `json:"repair"`
+	Healthy    bool          `json:"healthy"`
+	Repaired   int           `json:"repaired"`
+	Books      []BookSummary `json:"books"`
+	Issues     []BookIssue   `json:"issues"`
+	StartedAt  time.Time     `json:"started_at"`
+	DurationMs int64         `json:"duration_ms"`
+}
+
+// sidedOrder is a resting order with the side it rests on
+type sidedOrder struct {
+	side  string
+	order ParsedOrder
+}
+
+// orderRow is what the DB says about an order
+type orderRow struct {
+	symbol  string
+	side    string
+	status  string
+	live    bool // PENDING/PARTIAL LIMIT DAY/GTC of the running session
+	settled bool // not changed within reconcileGrace
+	order   ParsedOrder
+}
+
+// Reconcile checks the books of the given symbols (all if empty). With repair, every
+// issue that can be fixed is fixed and marked repaired.
+func (e *MatchingEngine) Reconcile(ctx context.Context, trigger string, repair bool, symbols ...string) (*ReconcileReport, error) {
+	report := &ReconcileReport{Trigger: trigger, Repair: repair, Books: []BookSummary{}, Issues: []BookIssue{}, StartedAt: time.Now()}
+
+	sessionId, _ := auctionSession(ctx)
+	sessionActive := sessionId != 0 && e.SessionStatus != StatusClosed
+
+	activeStocks, err := activeStockSymbols(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(symbols) == 0 {
+		if symbols, err = e.reconcileSymbols(ctx, sessionId); err != nil {
+			return nil, err
+		}
+	}
+
+	var crossed []string
+	for _, symbol := range symbols {
+		var issues []BookIssue
+		var summary BookSummary
+		err := e.WithSymbolLock(symbol, func() error {
+			var err error
+			issues, summary, err = e.reconcileSymbol(ctx, symbol, sessionId, sessionActive, activeStocks[symbol], repair)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", symbol, err)
+		}
+		report.Books = append(report.Books, summary)
+		report.Issues = append(report.Issues, issues...)
+		for _, is := range issues {
+			if is.Kind == IssueCrossed && repair {
+				crossed = append(crossed, symbol)
+			}
+		}
+	}
+
+	// Crossed books are repaired by letting continuous matching run
+	for _, symbol := range crossed {
+		e.Match(symbol)
+	}
+
+	for _, is := range report.Issues {
+		if is.Repaired {
+			report.Repaired++
+		}
+	}
+	report.Healthy = len(report.Issues) == 0
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+
+	e.saveReconcileReport(ctx, report)
+	if trigger == ReconcileScheduled && !report.Healthy {
+		e.alertAdmins(report)
+	}
+	return report, nil
+}
+
+// reconcileSymbols is every symbol with a book in memory, in Redis or with live orders
+func (e *MatchingEngine) reconcileSymbols(ctx context.Context, sessionId int) ([]string, error) {
+	seen := map[string]bool{}
+	for _, s := range e.Symbols() {
+		seen[s] = true
+	}
+
+	iter := config.RedisMain.Scan(ctx, 0, "orderbook:*", 500).Iterator()
+	for iter.Next(ctx) {
+		parts := strings.Split(iter.Val(), ":")
+		if len(parts) == 3 && (parts[2] == SideBuy || parts[2] == SideSell) {
+			seen[parts[1]] = true
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err := config.DB.Query(ctx, `
+		SELECT DISTINCT s.symbol FROM orders o JOIN stocks s ON o.stock_id = s.id
+		WHERE o.session_id = $1 AND o.status IN ('PENDING', 'PARTIAL')
+	`, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		seen[s] = true
+	}
+	rows.Close()
+
+	symbols := make([]string, 0, len(seen))
+	for s := range seen {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+	return symbols, nil
+}
+
+// reconcileSymbol checks one symbol. Caller must hold the symbol lock.
+func (e *MatchingEngine) reconcileSymbol(ctx context.Context, symbol string, sessionId int, sessionActive, stockActive, repair bool) ([]BookIssue, BookSummary, error) {
+	summary := BookSummary{Symbol: symbol}
+	var issues []BookIssue
+	flag := func(id, side, source, kind, detail string, fix func()) {
+		is := BookIssue{Symbol: symbol, OrderId: id, Side: side, Source: source, Kind: kind, Detail: detail}
+		if repair && fix != nil {
+			fix()
+			is.Repaired = true
+		}
+		issues = append(issues, is)
+	}
+
+	// Let queued writes land so the snapshot is comparable with memory
+	e.persister.flush()
+
+	book := e.bookFor(symbol)
+	memory := map[string]sidedOrder{}
+	for _, side := range []string{SideBuy, SideSell} {
+		for _, o := range book.Orders(side) {
+			memory[o.Data.OrderId] = sidedOrder{side, o}
+		}
+	}
+	summary.MemoryBuy, summary.MemorySell = book.Len(SideBuy), book.Len(SideSell)
+
+	snapshot, dangling, err := readRedisBook(ctx, symbol)
+	if err != nil {
+		return nil, summary, err
+	}
+	for _, so := range snapshot {
+		if so.side == SideBuy {
+			summary.RedisBuy++
+		} else {
+			summary.RedisSell++
+		}
+	}
+	for _, d := range dangling {
+		flag(d.order.Data.OrderId, d.side, SourceRedis, IssueDangling, "Index tanpa hash order", func() {
+			e.persister.remove(symbol, d.order.Data.OrderId)
+		})
+	}
+
+	var ids []string
+	for id, so := range memory {
+		if so.order.Data.UserId != "SYSTEM_BOT" {
+			ids = append(ids, id)
+		}
+	}
+	for id, so := range snapshot {
+		if _, ok := memory[id]; !ok && so.order.Data.UserId != "SYSTEM_BOT" {
+			ids = append(ids, id)
+		}
+	}
+	rows, err := loadOrderRows(ctx, symbol, sessionId, ids)
+	if err != nil {
+		return nil, summary, err
+	}
+
+	// drop takes an order out of memory and Redis
+	drop := func(id string) func() {
+		return func() {
+			if _, ok := e.RemoveOrder(symbol, id); !ok {
+				e.persister.remove(symbol, id)
+			}
+		}
+	}
+	// restore puts the expected state into memory and Redis
+	restore := func(want sidedOrder, moved bool) func() {
+		return func() {
+			if moved {
+				e.RemoveOrder(symbol, want.order.Data.OrderId)
+			}
+			e.AddOrder(symbol, want.side, want.order.Data)
+		}
+	}
+
+	checked := map[string]bool{}
+	check := func(id string) {
+		if checked[id] {
+			return
+		}
+		checked[id] = true
+		mem, inMemory := memory[id]
+		red, inRedis := snapshot[id]
+		cur := mem
+		if !inMemory {
+			cur = red
+		}
+		source := sourceOf(inMemory, inRedis)
+
+		// Bot orders: memory is the reference
+		if cur.order.Data.UserId == "SYSTEM_BOT" {
+			switch {
+			case !sessionActive || !stockActive:
+				reason := "tidak ada sesi aktif"
+				if sessionActive {
+					reason = "saham tidak aktif"
+				}
+				flag(id, cur.side, source, IssueOrphanedBot, "Order bot tertinggal, "+reason, drop(id))
+			case !inMemory:
+				flag(id, red.side, SourceRedis, IssueOrphanedBot, "Order bot hanya ada di snapshot Redis", func() {
+					e.persister.remove(symbol, id)
+				})
+			case !inRedis:
+				flag(id, mem.side, SourceRedis, IssueMissing, "Order bot belum tersimpan di Redis", restore(mem, false))
+			default:
+				for _, d := range diffOrder(red, mem) {
+					flag(id, red.side, SourceRedis, d.kind, d.detail, restore(mem, false))
+				}
+			}
+			return
+		}
+
+		row, ok := rows[id]
+		switch {
+		case !ok:
+			flag(id, cur.side, source, IssueNotFound, "Order tidak ada di database", drop(id))
+			return
+		case row.symbol != symbol:
+			flag(id, cur.side, source, IssueSymbol, fmt.Sprintf("Order milik saham %s", row.symbol), drop(id))
+			return
+		case !row.settled:
+			return
+		case row.status != "PENDING" && row.status != "PARTIAL":
+			flag(id, cur.side, source, IssueNotLive, fmt.Sprintf("Status order di database %s", row.status), drop(id))
+			return
+		case !row.live || !sessionActive:
+			flag(id, cur.side, source, IssueNotLive, "Order bukan order LIMIT DAY/GTC sesi berjalan", drop(id))
+			return
+		}
+
+		want := sidedOrder{row.side, row.order}
+		if inMemory {
+			// Keep the queue position and iceberg slice of the resting order
+			want.order.Data.Timestamp = mem.order.Data.Timestamp
+			want.order.Data.VisibleQuantity = mem.order.Data.VisibleQuantity
+		}
+		var diffs []orderDiff
+		if inMemory {
+			for _, d := range diffOrder(mem, want) {
+				d.source = SourceMemory
+				diffs = append(diffs, d)
+			}
+		}
+		if inRedis {
+			for _, d := range diffOrder(red, want) {
+				d.source = SourceRedis
+				diffs = append(diffs, d)
+			}
+		}
+		for _, d := range diffs {
+			flag(id, want.side, d.source, d.kind, d.detail, restore(want, d.kind == IssueSide))
+		}
+		if !inMemory || !inRedis {
+			flag(id, want.side, sourceOf(!inMemory, !inRedis), IssueMissing, "Order aktif tidak ada di orderbook", restore(want, false))
+		}
+	}
+
+	for id := range memory {
+		check(id)
+	}
+	for id := range snapshot {
+		check(id)
+	}
+	for id, row := range rows {
+		if !row.live || row.symbol != symbol {
+			continue
+		}
+		summary.LiveOrders++
+		if row.settled && sessionActive && !checked[id] {
+			want := sidedOrder{row.side, row.order}
+			flag(id, row.side, sourceOf(true, true), IssueMissing, "Order aktif tidak ada di orderbook", restore(want, false))
+		}
+	}
+
+	// Crossing is expected while orders are collected for an auction or during a halt
+	if e.SessionStatus == StatusOpen && e.HaltOf(symbol) == nil {
+		bid, okBid := book.Best(SideBuy)
+		ask, okAsk := book.Best(SideSell)
+		if okBid && okAsk && bid.Price >= ask.Price {
+			flag("", "", SourceMemory, IssueCrossed, fmt.Sprintf("Bid %.2f >= offer %.2f", bid.Price, ask.Price), func() {})
+		}
+	}
+
+	if repair && len(issues) > 0 {
+		e.persister.flush()
+		e.BroadcastOrderBook(symbol)
+	}
+	return issues, summary, nil
+}
+
+type orderDiff struct {
+	source, kind, detail string
+}
+
+// diffOrder lists how a resting order differs from what it should be
+func diffOrder(got, want sidedOrder) []orderDiff {
+	var diffs []orderDiff
+	if got.side != want.side {
+		diffs = append(diffs, orderDiff{kind: IssueSide, detail: fmt.Sprintf("Sisi %s, seharusnya %s", got.side, want.side)})
+	}
+	if got.order.Price != want.order.Price {
+		diffs = append(diffs, orderDiff{kind: IssuePrice, detail: fmt.Sprintf("Harga %.2f, seharusnya %.2f", got.order.Price, want.order.Price)})
+	}
+	if got.order.Data.RemainingQuantity != want.order.Data.RemainingQuantity {
+		diffs = append(diffs, orderDiff{kind: IssueRemaining, detail: fmt.Sprintf("Sisa %d lot, seharusnya %d lot", got.order.Data.RemainingQuantity, want.order.Data.RemainingQuantity)})
+	}
+	return diffs
+}
+
+func sourceOf(memory, redis bool) string {
+	switch {
+	case memory && redis:
+		return SourceMemory + "," + SourceRedis
+	case memory:
+		return SourceMemory
+	}
+	return SourceRedis
+}
+
+// readRedisBook reads both sides of a symbol from the Redis snapshot. Index entries
+// whose order hash is gone are returned separately.
+func readRedisBook(ctx context.Context, symbol string) (map[string]sidedOrder, []sidedOrder, error) {
+	orders := map[string]sidedOrder{}
+	var dangling []sidedOrder
+	for _, side := range []string{SideBuy, SideSell} {
+		entries, err := config.RedisMain.ZRangeWithScores(ctx, bookKey(symbol, side), 0, -1).Result()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		pipe := config.RedisMain.Pipeline()
+		cmds := make([]*redis.MapStringStringCmd, len(entries))
+		for i, z := range entries {
+			cmds[i] = pipe.HGetAll(ctx, orderKey(z.Member.(string)))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, nil, err
+		}
+
+		for i, z := range entries {
+			id := z.Member.(string)
+			data, ok := parseOrderFields(cmds[i].Val())
+			if !ok {
+				dangling = append(dangling, sidedOrder{side, ParsedOrder{Data: models.RedisOrderData{OrderId: id}, Price: z.Score}})
+				continue
+			}
+			orders[id] = sidedOrder{side, ParsedOrder{Data: data, Price: z.Score}}
+		}
+	}
+	return orders, dangling, nil
+}
+
+// loadOrderRows loads the given orders plus every live order of the symbol in the session
+func loadOrderRows(ctx context.Context, symbol string, sessionId int, ids []string) (map[string]orderRow, error) {
+	var uuids []string
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err == nil {
+			uuids = append(uuids, id)
+		}
+	}
+
+	rows, err := config.DB.Query(ctx, `
+		SELECT o.id, s.symbol, o.user_id, o.stock_id, o.type, o.price, o.quantity, o.remaining_quantity, o.status,
+			COALESCE(o.priority_at, o.created_at), o.avg_price_at_order, o.price_type, o.time_in_force,
+			COALESCE(o.display_quantity, 0),
+			o.session_id = $3 AND o.status IN ('PENDING', 'PARTIAL') AND o.remaining_quantity > 0
+				AND o.price_type = 'LIMIT' AND o.time_in_force IN ('DAY', 'GTC'),
+			COALESCE(o.updated_at, o.created_at) < NOW() - make_interval(secs => $4)
+		FROM orders o
+		JOIN stocks s ON o.stock_id = s.id
+		WHERE o.id = ANY($1::uuid[])
+			OR (s.symbol = $2 AND o.session_id = $3 AND o.status IN ('PENDING', 'PARTIAL'))
+	`, uuids, symbol, sessionId, reconcileGrace.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[string]orderRow{}
+	for rows.Next() {
+		var r orderRow
+		var orderType string
+		var ts time.Time
+		d := &r.order.Data
+		if err := rows.Scan(&d.OrderId, &r.symbol, &d.UserId, &d.StockId, &orderType, &d.Price, &d.Quantity, &d.RemainingQuantity, &r.status,
+			&ts, &d.AvgPriceAtOrder, &d.PriceType, &d.TimeInForce, &d.DisplayQuantity, &r.live, &r.settled); err != nil {
+			return nil, err
+		}
+		d.Timestamp = ts.UnixMilli()
+		r.order.Price = d.Price
+		r.side = SideKey(orderType)
+		result[d.OrderId] = r
+	}
+	return result, rows.Err()
+}
+
+func activeStockSymbols(ctx context.Context) (map[string]bool, error) {
+	rows, err := config.DB.Query(ctx, "SELECT symbol FROM stocks WHERE is_active = true")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	active := map[string]bool{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		active[s] = true
+	}
+	return active, rows.Err()
+}
+
+// saveReconcileReport keeps the run in orderbook_reconcile_runs
+func (e *MatchingEngine) saveReconcileReport(ctx context.Context, report *ReconcileReport) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	err = config.DB.QueryRow(ctx, `
+		INSERT INTO orderbook_reconcile_runs (trigger, repair, healthy, symbols, issues, repaired, report, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`, report.Trigger, report.Repair, report.Healthy, len(report.Books), len(report.Issues), report.Repaired, body, report.StartedAt).Scan(&report.ID)
+	if err != nil {
+		log.Println("Reconcile report not saved:", err)
+	}
+}
+
+// alertAdmins tells the admin room about a run that found issues
+func (e *MatchingEngine) alertAdmins(report *ReconcileReport) {
+	byKind := map[string]int{}
+	var symbols []string
+	seen := map[string]bool{}
+	for _, is := range report.Issues {
+		byKind[is.Kind]++
+		if !seen[is.Symbol] {
+			seen[is.Symbol] = true
+			symbols = append(symbols, is.Symbol)
+		}
+	}
+	log.Printf("⚠️  Orderbook integrity: %d issue(s) in %v (repaired %d)", len(report.Issues), symbols, report.Repaired)
+
+	if e.IoServer == nil {
+		return
+	}
+	e.IoServer.To(socketio.Room("admin")).Emit("orderbook_integrity_alert", map[string]interface{}{
+		"run_id":    report.ID,
+		"trigger":   report.Trigger,
+		"repair":    report.Repair,
+		"issues":    len(report.Issues),
+		"repaired":  report.Repaired,
+		"by_kind":   byKind,
+		"symbols":   symbols,
+		"timestamp": time.Now().UnixMilli(),
+	})
+}
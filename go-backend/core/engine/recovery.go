@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"mbit-backend-go/config"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Book outbox.
+// ExecuteTrade journals the settled remaining quantity of both orders into book_outbox
+// inside the trade transaction. The persister marks rows applied once the Redis write
+// succeeds, so any row left unapplied is a book mutation that may never have reached Redis.
+
+// StaleOrderError is returned by ExecuteTrade when a book entry no longer matches
+// its order row (not live anymore, or a different remaining quantity)
+type StaleOrderError struct {
+	OrderId string
+}
+
+func (e *StaleOrderError) Error() string {
+	return "order " + e.OrderId + " is out of sync with the book"
+}
+
+// OutboxEntry is the state an order is recovered to
+type OutboxEntry struct {
+	Symbol            string  `json:"symbol"`
+	OrderId           string  `json:"orderId"`
+	Side              string  `json:"side"`
+	RemainingQuantity int64   `json:"remainingQuantity"`
+	Action            string  `json:"action"` // "fill" or "remove"
+	OutboxIds         []int64 `json:"outboxIds"`
+}
+
+// RecoveryReport lists the book mutations replayed from the outbox
+type RecoveryReport struct {
+	Replayed int           `json:"replayed"`
+	Entries  []OutboxEntry `json:"entries"`
+}
+
+func writeTradeOutbox(ctx context.Context, tx pgx.Tx, tradeID, symbol, buyOrderId string, buyRem int64, sellOrderId string, sellRem int64) (int64, int64, error) {
+	q := `
+		INSERT INTO book_outbox (trade_id, symbol, order_id, side, remaining_quantity)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+	var buyID, sellID int64
+	if err := tx.QueryRow(ctx, q, tradeID, symbol, buyOrderId, SideBuy, buyRem).Scan(&buyID); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.QueryRow(ctx, q, tradeID, symbol, sellOrderId, SideSell, sellRem).Scan(&sellID); err != nil {
+		return 0, 0, err
+	}
+	return buyID, sellID, nil
+}
+
+// pendingOutbox resolves every order with unapplied outbox rows to its current settled state.
+// User orders follow the orders table; bot orders (no DB row) follow their latest outbox row.
+func pendingOutbox(ctx context.Context) ([]OutboxEntry, error) {
+	rows, err := config.DB.Query(ctx, `
+		WITH pending AS (
+			SELECT order_id, array_agg(id ORDER BY id) AS ids
+			FROM book_outbox
+			WHERE applied_at IS NULL
+			GROUP BY order_id
+		)
+		SELECT DISTINCT ON (b.order_id)
+			b.symbol, b.order_id, b.side,
+			CASE
+				WHEN o.id IS NULL THEN b.remaining_quantity
+				WHEN o.status IN ('PENDING', 'PARTIAL') THEN o.remaining_quantity
+				ELSE 0
+			END,
+			p.ids
+		FROM book_outbox b
+		JOIN pending p ON p.order_id = b.order_id
+		LEFT JOIN orders o ON o.id::text = b.order_id
+		ORDER BY b.order_id, b.id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []OutboxEntry
+	for rows.Next() {
+		var en OutboxEntry
+		if err := rows.Scan(&en.Symbol, &en.OrderId, &en.Side, &en.RemainingQuantity, &en.OutboxIds); err != nil {
+			return nil, err
+		}
+		en.Action = "fill"
+		if en.RemainingQuantity <= 0 {
+			en.Action = "remove"
+		}
+		entries = append(entries, en)
+	}
+	return entries, rows.Err()
+}
+
+func markOutboxApplied(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := config.DB.Exec(ctx, "UPDATE book_outbox SET applied_at = NOW() WHERE id = ANY($1)", ids)
+	return err
+}
+
+// recoverOutboxToRedis replays pending outbox rows straight into Redis.
+// Used at boot, before the books are restored from Redis and the persister starts.
+func recoverOutboxToRedis(ctx context.Context) (*RecoveryReport, error) {
+	entries, err := pendingOutbox(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &RecoveryReport{Entries: []OutboxEntry{}}
+	if len(entries) == 0 {
+		return report, nil
+	}
+
+	pipe := config.RedisMain.Pipeline()
+	var ids []int64
+	for _, en := range entries {
+		if en.RemainingQuantity > 0 {
+			fillOrder(ctx, pipe, en.OrderId, en.RemainingQuantity)
+		} else {
+			deleteOrder(ctx, pipe, en.Symbol, en.OrderId)
+		}
+		ids = append(ids, en.OutboxIds...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	if err := markOutboxApplied(ctx, ids); err != nil {
+		return nil, err
+	}
+
+	report.Replayed = len(entries)
+	report.Entries = entries
+	return report, nil
+}
+
+// RecoverBook replays pending outbox rows on a running engine.
+// Each symbol is locked so no trade settles while its orders are resynced;
+// the in-memory book is corrected first and Redis follows through the persister.
+func (e *MatchingEngine) RecoverBook(ctx context.Context) (*RecoveryReport, error) {
+	entries, err := pendingOutbox(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &RecoveryReport{Entries: []OutboxEntry{}}
+
+	for _, en := range entries {
+		lock := e.getSymbolLock(en.Symbol)
+		lock.Lock()
+		book := e.bookFor(en.Symbol)
+		cur, inBook := book.Get(en.OrderId)
+		switch {
+		case en.RemainingQuantity <= 0:
+			book.Remove(en.OrderId)
+			e.persister.remove(en.Symbol, en.OrderId, en.OutboxIds...)
+		case inBook:
+			if cur.Data.RemainingQuantity > en.RemainingQuantity {
+				cur, _ = book.Fill(en.OrderId, cur.Data.RemainingQuantity-en.RemainingQuantity)
+			}
+			e.persister.upsert(en.Symbol, en.Side, cur, en.OutboxIds...)
+		default:
+			e.persister.fill(en.Symbol, en.OrderId, en.RemainingQuantity, en.OutboxIds...)
+		}
+		lock.Unlock()
+		report.Entries = append(report.Entries, en)
+	}
+
+	e.persister.flush()
+	report.Replayed = len(report.Entries)
+
+	for _, symbol := range symbolsOf(report.Entries) {
+		e.BroadcastOrderBook(symbol)
+	}
+	return report, nil
+}
+
+// resyncOrder brings a single book entry in line with its order row. It reports false
+// if the order row could not be read; the entry is then left as it is.
+// Caller must hold the symbol lock.
+func (e *MatchingEngine) resyncOrder(symbol, orderId string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var status string
+	var remaining int64
+	err := config.DB.QueryRow(ctx, "SELECT status, remaining_quantity FROM orders WHERE id = $1", orderId).Scan(&status, &remaining)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Resync of order %s failed: %v", orderId, err)
+		return false
+	}
+	if err == pgx.ErrNoRows || (status != "PENDING" && status != "PARTIAL") || remaining <= 0 {
+		e.RemoveOrder(symbol, orderId)
+		return true
+	}
+
+	book := e.bookFor(symbol)
+	cur, ok := book.Get(orderId)
+	side, _ := book.SideOf(orderId)
+	if !ok {
+		return true
+	}
+	cur.Data.RemainingQuantity = remaining
+	book.Add(side, cur)
+	e.persister.upsert(symbol, side, cur)
+	return true
+}
+
+func symbolsOf(entries []OutboxEntry) []string {
+	seen := make(map[string]bool)
+	var symbols []string
+	for _, en := range entries {
+		if !seen[en.Symbol] {
+			seen[en.Symbol] = true
+			symbols = append(symbols, en.Symbol)
+		}
+	}
+	return symbols
+}
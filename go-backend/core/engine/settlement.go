@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"context"
+	"log"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/fees"
+	"mbit-backend-go/core/ledger"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CanceledOrder is what is left of an order after cancelOrderTx
+type CanceledOrder struct {
+	OrderId           string
+	UserId            string
+	StockId           int
+	Type              string
+	Price             float64
+	RemainingQuantity int64
+	Refund            float64
+	Rates             fees.Rates
+	Short             bool    // short SELL order, holding margin instead of locked lots
+	MarginPct         float64 // initial margin of a short order
+}
+
+// release returns the reservation of lots of a live order: reserved RDN for BUY, the
+// margin of a short SELL, locked shares for any other SELL
+func (o *CanceledOrder) release(ctx context.Context, tx pgx.Tx, lots int64) error {
+	switch {
+	case o.Type == "BUY":
+		o.Refund = o.Rates.Reserve(o.Price, lots)
+		return ledger.ReleaseCash(ctx, tx, o.UserId, o.OrderId, o.Refund)
+	case o.Short:
+		o.Refund = ledger.ShortMargin(o.Price, lots, o.MarginPct)
+		return ledger.ReleaseCash(ctx, tx, o.UserId, o.OrderId, o.Refund)
+	default:
+		return ledger.LockShares(ctx, tx, o.UserId, o.StockId, -lots)
+	}
+}
+
+// cancelOrderTx cancels a live order inside tx and releases its reservation
+// (reserved RDN for BUY, margin for a short SELL, locked shares for SELL).
+// Returns false if the order is not live anymore.
+func cancelOrderTx(ctx context.Context, tx pgx.Tx, orderId string) (*CanceledOrder, bool, error) {
+	var o CanceledOrder
+	var status string
+	err := tx.QueryRow(ctx, `
+		SELECT id, user_id, stock_id, type, price, remaining_quantity, status, fee_commission_pct, fee_levy_pct, fee_tax_pct,
+			is_short, margin_pct
+		FROM orders WHERE id = $1
+		FOR UPDATE
+	`, orderId).Scan(&o.OrderId, &o.UserId, &o.StockId, &o.Type, &o.Price, &o.RemainingQuantity, &status,
+		&o.Rates.CommissionPct, &o.Rates.LevyPct, &o.Rates.TaxPct, &o.Short, &o.MarginPct)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if status != "PENDING" && status != "PARTIAL" {
+		return nil, false, nil
+	}
+
+	if err := o.release(ctx, tx, o.RemainingQuantity); err != nil {
+		return nil, false, err
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE orders SET status = 'CANCELED', updated_at = NOW() WHERE id = $1", orderId); err != nil {
+		return nil, false, err
+	}
+	return &o, true, nil
+}
+
+// CancelOrderTx cancels a live order inside tx for another subsystem (see cancelOrderTx).
+// The caller removes it from the book after committing.
+func CancelOrderTx(ctx context.Context, tx pgx.Tx, orderId string) (*CanceledOrder, bool, error) {
+	return cancelOrderTx(ctx, tx, orderId)
+}
+
+// expireOrder cancels the unfilled remainder of an IOC/FOK order and tells its owner
+func (e *MatchingEngine) expireOrder(symbol, orderId, timeInForce string) {
+	ctx := context.Background()
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		log.Println("Expire order failed:", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	o, ok, err := cancelOrderTx(ctx, tx, orderId)
+	if err != nil {
+		log.Println("Expire order failed:", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println("Expire order failed:", err)
+		return
+	}
+
+	e.NotifyOrderStatus(o.UserId, map[string]interface{}{
+		"order_id": o.OrderId, "status": "CANCELED", "price": o.Price,
+		"matched_quantity": 0, "remaining_quantity": o.RemainingQuantity,
+		"symbol": symbol, "type": o.Type, "time_in_force": timeInForce,
+	})
+}
+
+// decrementOrderTx takes qty lots off a live order without trading them and releases
+// their reservation. The order must keep a positive remaining quantity; use cancelOrderTx
+// to take all of it. quantity keeps what the user ordered, the lots taken off are in
+// stp_events. Returns false if the order is not live anymore.
+func decrementOrderTx(ctx context.Context, tx pgx.Tx, orderId string, qty int64) (*CanceledOrder, bool, error) {
+	o := CanceledOrder{OrderId: orderId}
+	err := tx.QueryRow(ctx, `
+		UPDATE orders
+		SET remaining_quantity = remaining_quantity - $2, updated_at = NOW(),
+			display_quantity = CASE WHEN display_quantity >= remaining_quantity - $2 THEN NULL ELSE display_quantity END
+		WHERE id = $1 AND status IN ('PENDING', 'PARTIAL') AND remaining_quantity > $2
+		RETURNING user_id, stock_id, type, price, remaining_quantity, fee_commission_pct, fee_levy_pct, fee_tax_pct, is_short, margin_pct
+	`, orderId, qty).Scan(&o.UserId, &o.StockId, &o.Type, &o.Price, &o.RemainingQuantity, &o.Rates.CommissionPct, &o.Rates.LevyPct, &o.Rates.TaxPct,
+		&o.Short, &o.MarginPct)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	if err := o.release(ctx, tx, qty); err != nil {
+		return nil, false, err
+	}
+	return &o, true, nil
+}
+
+// fillOrderTx applies a fill to an order row and returns its fee rates, and the initial
+// margin of a short SELL order (0 for any other order). The remaining_quantity guard
+// turns a stale book entry into a StaleOrderError.
+func fillOrderTx(ctx context.Context, tx pgx.Tx, orderId string, remaining, newRemaining int64) (fees.Rates, float64, error) {
+	status := "MATCHED"
+	if newRemaining > 0 {
+		status = "PARTIAL"
+	}
+	var r fees.Rates
+	var shortMargin float64
+	err := tx.QueryRow(ctx, `
+		UPDATE orders SET status = $1, remaining_quantity = $2, updated_at = NOW()
+		WHERE id = $3 AND status IN ('PENDING', 'PARTIAL') AND remaining_quantity = $4
+		RETURNING fee_commission_pct, fee_levy_pct, fee_tax_pct, CASE WHEN is_short THEN margin_pct ELSE 0 END::float8
+	`, status, newRemaining, orderId, remaining).Scan(&r.CommissionPct, &r.LevyPct, &r.TaxPct, &shortMargin)
+	if err == pgx.ErrNoRows {
+		return r, 0, &StaleOrderError{OrderId: orderId}
+	}
+	return r, shortMargin, err
+}
+
+// insertTradeFee records one side's gross, fees and net amount of a trade
+func insertTradeFee(ctx context.Context, tx pgx.Tx, tradeId, orderId, userId, side string, c fees.Charge) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO trade_fees (trade_id, order_id, user_id, side, gross, commission, levy, tax, fee, net)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, tradeId, orderId, userId, side, c.Gross, c.Commission, c.Levy, c.Tax, c.Fee, c.Net)
+	return err
+}
+
+// insertRealizedPnl records the profit of selling lots at price against their average
+// cost. pnl is net of the sell fees; buy fees were paid when the lots were bought.
+func insertRealizedPnl(ctx context.Context, tx pgx.Tx, tradeId, orderId, userId string, stockId int, lots int64, price, avgCost, fee float64) error {
+	gross := (price - avgCost) * float64(lots) * 100
+	_, err := tx.Exec(ctx, `
+		INSERT INTO realized_pnl (trade_id, order_id, user_id, stock_id, quantity, sell_price, avg_cost, gross_pnl, fee, pnl)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, tradeId, orderId, userId, stockId, lots, price, avgCost, gross, fee, gross-fee)
+	return err
+}
@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"context"
+	"math"
+
+	"mbit-backend-go/core/fees"
+	"mbit-backend-go/core/ledger"
+	"mbit-backend-go/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Short sale settlement.
+// A short SELL order sells lots the user borrowed: they are owed in short_positions, not
+// taken out of portfolios. The sale proceeds (net of fees) and the initial margin the
+// order reserved become the position's collateral. A BUY fill of a user who is short
+// covers the position first; the covered lots are returned to the lender and their share
+// of the collateral goes back to the available balance.
+
+// shortSaleTx settles lots of a short SELL order sold at price. orderPrice is the order's
+// limit, which its margin reservation was made at.
+func shortSaleTx(ctx context.Context, tx pgx.Tx, tradeId string, o models.RedisOrderData, orderPrice, price float64, lots int64, c fees.Charge, marginPct float64) error {
+	margin := ledger.ShortMargin(orderPrice, lots, marginPct)
+	collateral := c.Net + margin
+
+	if _, err := tx.Exec(ctx, "UPDATE users SET reserved_rdn = reserved_rdn - $1 WHERE id = $2", margin, o.UserId); err != nil {
+		return err
+	}
+
+	// A position that was closed starts over
+	var avg float64
+	err := tx.QueryRow(ctx, `
+		INSERT INTO short_positions (user_id, stock_id, quantity, avg_short_price, collateral)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, stock_id) DO UPDATE SET
+			avg_short_price = (short_positions.avg_short_price * short_positions.quantity + EXCLUDED.avg_short_price * EXCLUDED.quantity)
+				/ (short_positions.quantity + EXCLUDED.quantity),
+			quantity = short_positions.quantity + EXCLUDED.quantity,
+			collateral = short_positions.collateral + EXCLUDED.collateral,
+			borrow_fees = CASE WHEN short_positions.quantity = 0 THEN 0 ELSE short_positions.borrow_fees END,
+			opened_at = CASE WHEN short_positions.quantity = 0 THEN NOW() ELSE short_positions.opened_at END,
+			updated_at = NOW()
+		RETURNING avg_short_price
+	`, o.UserId, o.StockId, lots, price, collateral).Scan(&avg)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO short_fills (trade_id, order_id, session_id, user_id, stock_id, kind, quantity, price, avg_short_price, collateral, fee)
+		VALUES ($1, $2, (SELECT session_id FROM trades WHERE id = $1), $3, $4, 'SHORT', $5, $6, $7, $8, $9)
+	`, tradeId, o.OrderId, o.UserId, o.StockId, lots, price, avg, collateral, c.Fee)
+	if err != nil {
+		return err
+	}
+
+	// The sold lots are borrowed first, so the trade journal moves them out of SHARES
+	return ledger.Post(ctx, tx, ledger.New(ledger.ReasonShortSale, ledger.RefTrade, tradeId).
+		Shares(ledger.Short(o.UserId), ledger.Shares(o.UserId), o.StockId, lots).
+		Cash(ledger.Cash(o.UserId), ledger.Margin(o.UserId), c.Net).
+		Cash(ledger.Reserved(o.UserId), ledger.Margin(o.UserId), margin))
+}
+
+// coverShortTx covers the buyer's short position in the stock with up to lots bought at
+// price, and returns how many lots it covered. c is the buyer's charge for all the lots.
+func coverShortTx(ctx context.Context, tx pgx.Tx, tradeId string, o models.RedisOrderData, price float64, lots int64, c fees.Charge) (int64, error) {
+	var owed int64
+	var avg, collateral float64
+	err := tx.QueryRow(ctx, `
+		SELECT quantity, avg_short_price::float8, collateral::float8
+		FROM short_positions
+		WHERE user_id = $1 AND stock_id = $2 AND quantity > 0
+		FOR UPDATE
+	`, o.UserId, o.StockId).Scan(&owed, &avg, &collateral)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	covered := min(lots, owed)
+	release := collateral
+	if covered < owed {
+		release = roundAmount(collateral * float64(covered) / float64(owed))
+	}
+	fee := roundAmount(c.Fee * float64(covered) / float64(lots))
+	pnl := (avg-price)*float64(covered)*100 - fee
+
+	if _, err := tx.Exec(ctx, "UPDATE short_positions SET quantity = quantity - $1, collateral = collateral - $2, updated_at = NOW() WHERE user_id = $3 AND stock_id = $4", covered, release, o.UserId, o.StockId); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn + $1 WHERE id = $2", release, o.UserId); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO short_fills (trade_id, order_id, session_id, user_id, stock_id, kind, quantity, price, avg_short_price, collateral, fee, pnl)
+		VALUES ($1, $2, (SELECT session_id FROM trades WHERE id = $1), $3, $4, 'COVER', $5, $6, $7, $8, $9, $10)
+	`, tradeId, o.OrderId, o.UserId, o.StockId, covered, price, avg, release, fee, pnl)
+	if err != nil {
+		return 0, err
+	}
+
+	// The trade journal delivers the lots to SHARES; the covered ones go back to the lender
+	err = ledger.Post(ctx, tx, ledger.New(ledger.ReasonShortCover, ledger.RefTrade, tradeId).
+		Shares(ledger.Shares(o.UserId), ledger.Short(o.UserId), o.StockId, covered).
+		Cash(ledger.Margin(o.UserId), ledger.Cash(o.UserId), release))
+	return covered, err
+}
+
+// roundAmount keeps amounts at the numeric(19,4) precision of the balance columns
+func roundAmount(amount float64) float64 {
+	return math.Round(amount*10000) / 10000
+}
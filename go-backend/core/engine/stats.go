@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"log"
+	"time"
+
+	"mbit-backend-go/core/metrics"
+)
+
+// engineStats are the matching engine's counters and latency histograms
+type engineStats struct {
+	matches             metrics.Counter // Match/MatchImmediate runs
+	trades              metrics.Counter // settled trades, auctions included
+	errors              metrics.Counter // failed settlements, STP and IEP errors
+	loopIterations      metrics.Counter // iterations of the continuous matching loop
+	auctionReportErrors metrics.Counter // auctions that executed without a persisted allocation report
+
+	matchLatency  *metrics.Histogram // time a matching run holds the symbol lock
+	settleLatency *metrics.Histogram // settlement transaction of one trade
+	orderToFill   *metrics.Histogram // from an order's priority timestamp to each of its fills
+}
+
+func newEngineStats() *engineStats {
+	s := &engineStats{
+		matchLatency:  metrics.NewHistogram(metrics.LatencyBuckets),
+		settleLatency: metrics.NewHistogram(metrics.LatencyBuckets),
+		orderToFill:   metrics.NewHistogram(metrics.WaitBuckets),
+	}
+
+	r := metrics.Default
+	r.Counter("mbit_engine_matches_total", "Matching runs.", &s.matches)
+	r.Counter("mbit_engine_trades_total", "Settled trades.", &s.trades)
+	r.Counter("mbit_engine_errors_total", "Failed settlements, self-trade prevention and IEP errors.", &s.errors)
+	r.Counter("mbit_engine_match_loop_iterations_total", "Iterations of the continuous matching loop.", &s.loopIterations)
+	r.Counter("mbit_engine_auction_report_errors_total", "Auctions whose allocation report could not be saved.", &s.auctionReportErrors)
+	r.Histogram("mbit_engine_match_seconds", "Time a matching run holds the symbol lock.", s.matchLatency)
+	r.Histogram("mbit_engine_settle_seconds", "Settlement transaction of one trade.", s.settleLatency)
+	r.Histogram("mbit_engine_order_to_fill_seconds", "Time from order placement (priority timestamp) to each fill.", s.orderToFill)
+	return s
+}
+
+// observeFill records how long a user order waited for a fill
+func (s *engineStats) observeFill(userId string, timestamp int64) {
+	if userId == "SYSTEM_BOT" || timestamp <= 0 {
+		return
+	}
+	s.orderToFill.Since(time.UnixMilli(timestamp))
+}
+
+// EngineStats is a snapshot of the engine counters
+type EngineStats struct {
+	MatchesProcessed    int64                     `json:"matchesProcessed"`
+	TradesExecuted      int64                     `json:"tradesExecuted"`
+	Errors              int64                     `json:"errors"`
+	LoopIterations      int64                     `json:"matchLoopIterations"`
+	AuctionReportErrors int64                     `json:"auctionReportErrors"`
+	MatchLatency        metrics.HistogramSnapshot `json:"matchLatency"`
+	SettleLatency       metrics.HistogramSnapshot `json:"settleLatency"`
+	OrderToFill         metrics.HistogramSnapshot `json:"orderToFill"`
+}
+
+// Stats returns the current engine counters
+func (e *MatchingEngine) Stats() EngineStats {
+	return EngineStats{
+		MatchesProcessed:    e.stats.matches.Value(),
+		TradesExecuted:      e.stats.trades.Value(),
+		Errors:              e.stats.errors.Value(),
+		LoopIterations:      e.stats.loopIterations.Value(),
+		AuctionReportErrors: e.stats.auctionReportErrors.Value(),
+		MatchLatency:        e.stats.matchLatency.Snapshot(),
+		SettleLatency:       e.stats.settleLatency.Snapshot(),
+		OrderToFill:         e.stats.orderToFill.Snapshot(),
+	}
+}
+
+// StartStatsLoop logs the engine counters every minute
+func (e *MatchingEngine) StartStatsLoop() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	var lastTrades int64
+	for range ticker.C {
+		s := e.Stats()
+		log.Printf("📊 Engine: %d matches, %d trades (%.1f TPS), %d errors, match p95 %.2fms, settle p95 %.2fms, order-to-fill p50 %.0fms",
+			s.MatchesProcessed, s.TradesExecuted, float64(s.TradesExecuted-lastTrades)/60, s.Errors,
+			s.MatchLatency.P95Ms, s.SettleLatency.P95Ms, s.OrderToFill.P50Ms)
+		lastTrades = s.TradesExecuted
+	}
+}
@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Order-ID-keyed Redis storage.
+// Each resting order lives in its own hash, and the side ZSET only indexes order IDs by price,
+// so cancel, amend and partial fills touch a single key instead of rewriting a JSON member.
+
+func bookKey(symbol, side string) string {
+	return "orderbook:" + symbol + ":" + side
+}
+
+func orderKey(orderId string) string {
+	return "order:" + orderId
+}
+
+func orderFields(symbol, side string, o ParsedOrder) map[string]interface{} {
+	d := o.Data
+	fields := map[string]interface{}{
+		"orderId":            d.OrderId,
+		"userId":             d.UserId,
+		"stockId":            d.StockId,
+		"symbol":             symbol,
+		"side":               side,
+		"price":              o.Price,
+		"quantity":           d.Quantity,
+		"timestamp":          d.Timestamp,
+		"remaining_quantity": d.RemainingQuantity,
+	}
+	if d.AvgPriceAtOrder != nil {
+		fields["avg_price_at_order"] = *d.AvgPriceAtOrder
+	}
+	if d.PriceType != "" {
+		fields["price_type"] = d.PriceType
+	}
+	if d.TimeInForce != "" {
+		fields["time_in_force"] = d.TimeInForce
+	}
+	if d.DisplayQuantity > 0 {
+		fields["display_quantity"] = d.DisplayQuantity
+		fields["visible_quantity"] = d.VisibleQuantity
+	}
+	return fields
+}
+
+func parseOrderFields(fields map[string]string) (models.RedisOrderData, bool) {
+	var d models.RedisOrderData
+	if fields["orderId"] == "" {
+		return d, false
+	}
+	d.OrderId = fields["orderId"]
+	d.UserId = fields["userId"]
+	d.StockId, _ = strconv.Atoi(fields["stockId"])
+	d.Price, _ = strconv.ParseFloat(fields["price"], 64)
+	d.Quantity, _ = strconv.ParseInt(fields["quantity"], 10, 64)
+	d.Timestamp, _ = strconv.ParseInt(fields["timestamp"], 10, 64)
+	d.RemainingQuantity, _ = strconv.ParseInt(fields["remaining_quantity"], 10, 64)
+	if v, ok := fields["avg_price_at_order"]; ok {
+		if avg, err := strconv.ParseFloat(v, 64); err == nil {
+			d.AvgPriceAtOrder = &avg
+		}
+	}
+	d.PriceType = fields["price_type"]
+	d.TimeInForce = fields["time_in_force"]
+	d.DisplayQuantity, _ = strconv.ParseInt(fields["display_quantity"], 10, 64)
+	d.VisibleQuantity, _ = strconv.ParseInt(fields["visible_quantity"], 10, 64)
+	return d, true
+}
+
+func writeOrder(ctx context.Context, pipe redis.Pipeliner, symbol, side string, o ParsedOrder) {
+	pipe.HSet(ctx, orderKey(o.Data.OrderId), orderFields(symbol, side, o))
+	pipe.ZAdd(ctx, bookKey(symbol, side), redis.Z{Score: o.Price, Member: o.Data.OrderId})
+}
+
+// fillScript updates the remaining quantity only if the order is still stored,
+// so replaying a fill never resurrects a removed order
+const fillScript = `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return redis.call('HSET', KEYS[1], 'remaining_quantity', ARGV[1])
+end
+return 0`
+
+func fillOrder(ctx context.Context, pipe redis.Pipeliner, orderId string, remaining int64) {
+	pipe.Eval(ctx, fillScript, []string{orderKey(orderId)}, remaining)
+}
+
+func deleteOrder(ctx context.Context, pipe redis.Pipeliner, symbol, orderId string) {
+	// The side is not needed: ZREM on the other side is a no-op
+	pipe.ZRem(ctx, bookKey(symbol, SideBuy), orderId)
+	pipe.ZRem(ctx, bookKey(symbol, SideSell), orderId)
+	pipe.Del(ctx, orderKey(orderId))
+}
+
+// loadSide reads every order of one side from Redis.
+// Index entries whose hash is missing or exhausted are dropped.
+func loadSide(ctx context.Context, symbol, side string) ([]ParsedOrder, error) {
+	key := bookKey(symbol, side)
+	entries, err := config.RedisMain.ZRangeWithScores(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := config.RedisMain.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(entries))
+	for i, z := range entries {
+		cmds[i] = pipe.HGetAll(ctx, orderKey(z.Member.(string)))
+	}
+	if len(entries) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, err
+		}
+	}
+
+	var orders []ParsedOrder
+	var stale []interface{}
+	for i, z := range entries {
+		data, ok := parseOrderFields(cmds[i].Val())
+		if !ok || data.RemainingQuantity <= 0 {
+			stale = append(stale, z.Member)
+			continue
+		}
+		orders = append(orders, ParsedOrder{Data: data, Price: z.Score})
+	}
+	if len(stale) > 0 {
+		config.RedisMain.ZRem(ctx, key, stale...)
+	}
+	return orders, nil
+}
+
+// MigrationReport summarises a legacy orderbook conversion
+type MigrationReport struct {
+	Keys      int `json:"keys"`
+	Converted int `json:"converted"`
+	Skipped   int `json:"skipped"`
+}
+
+// MigrateLegacyBooks converts orderbook ZSETs whose members are JSON-encoded RedisOrderData
+// into the order-ID-keyed layout, in place. Already converted entries are left alone,
+// so it is safe to run repeatedly. With dryRun nothing is written.
+func MigrateLegacyBooks(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{}
+
+	iter := config.RedisMain.Scan(ctx, 0, "orderbook:*", 500).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		parts := strings.Split(key, ":")
+		if len(parts) != 3 || (parts[2] != SideBuy && parts[2] != SideSell) {
+			continue
+		}
+		symbol, side := parts[1], parts[2]
+		report.Keys++
+
+		entries, err := config.RedisMain.ZRangeWithScores(ctx, key, 0, -1).Result()
+		if err != nil {
+			return report, err
+		}
+
+		pipe := config.RedisMain.TxPipeline()
+		for _, z := range entries {
+			member, ok := z.Member.(string)
+			if !ok || !strings.HasPrefix(member, "{") {
+				continue
+			}
+
+			var data models.RedisOrderData
+			if err := json.Unmarshal([]byte(member), &data); err != nil || data.OrderId == "" || data.RemainingQuantity <= 0 {
+				// Unreadable or exhausted legacy entry, nothing to carry over
+				pipe.ZRem(ctx, key, member)
+				report.Skipped++
+				continue
+			}
+
+			pipe.ZRem(ctx, key, member)
+			writeOrder(ctx, pipe, symbol, side, ParsedOrder{Data: data, Price: z.Score})
+			report.Converted++
+		}
+
+		if dryRun || pipe.Len() == 0 {
+			pipe.Discard()
+			continue
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return report, err
+		}
+	}
+	return report, iter.Err()
+}
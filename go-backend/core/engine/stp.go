@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"mbit-backend-go/config"
+
+	"github.com/jackc/pgx/v5"
+
+	socketio "github.com/zishang520/socket.io/v2/socket"
+)
+
+// Self-trade prevention.
+// When the top of book pairs two orders of the same user, no trade is printed;
+// the user's STP mode (users.stp_mode) decides what happens to the orders instead.
+
+// STP modes
+const (
+	STPCancelNewest = "CANCEL_NEWEST" // cancel the incoming (newer) order, default
+	STPCancelOldest = "CANCEL_OLDEST" // cancel the resting (older) order
+	STPCancelBoth   = "CANCEL_BOTH"
+	STPDecrement    = "DECREMENT" // reduce both by the smaller quantity, canceling the smaller one
+)
+
+// IsValidSTPMode reports whether m is a known STP mode
+func IsValidSTPMode(m string) bool {
+	switch m {
+	case STPCancelNewest, STPCancelOldest, STPCancelBoth, STPDecrement:
+		return true
+	}
+	return false
+}
+
+// STP actions recorded per order
+const (
+	stpNone        = "NONE"
+	stpCanceled    = "CANCELED"
+	stpDecremented = "DECREMENTED"
+)
+
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// stpModeOf returns the user's STP mode
+func stpModeOf(ctx context.Context, q querier, userId string) (string, error) {
+	var mode string
+	err := q.QueryRow(ctx, "SELECT COALESCE(stp_mode, $2) FROM users WHERE id = $1", userId, STPCancelNewest).Scan(&mode)
+	return mode, err
+}
+
+func isSelfTrade(buy, sell ParsedOrder) bool {
+	return buy.Data.UserId == sell.Data.UserId && buy.Data.UserId != "SYSTEM_BOT"
+}
+
+// preventSelfTrade resolves a crossing pair owned by the same user instead of trading it.
+// Caller must hold the symbol lock.
+func (e *MatchingEngine) preventSelfTrade(symbol string, buy, sell ParsedOrder) error {
+	ctx := context.Background()
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	userId := buy.Data.UserId
+	mode, err := stpModeOf(ctx, tx, userId)
+	if err != nil {
+		return err
+	}
+
+	newestIsBuy := buy.Data.Timestamp >= sell.Data.Timestamp
+	var cancelBuy, cancelSell bool
+	var decQty int64
+	switch mode {
+	case STPCancelOldest:
+		cancelBuy, cancelSell = !newestIsBuy, newestIsBuy
+	case STPCancelBoth:
+		cancelBuy, cancelSell = true, true
+	case STPDecrement:
+		decQty = min(buy.Data.RemainingQuantity, sell.Data.RemainingQuantity)
+	default:
+		mode = STPCancelNewest
+		cancelBuy, cancelSell = newestIsBuy, !newestIsBuy
+	}
+	if decQty > 0 {
+		// The smaller order is used up entirely, which is a cancel
+		cancelBuy = buy.Data.RemainingQuantity == decQty
+		cancelSell = sell.Data.RemainingQuantity == decQty
+	}
+
+	// Apply to one order: cancel, decrement or leave it. live=false means the DB
+	// no longer has it as a live order, so it only needs to leave the book.
+	apply := func(o ParsedOrder, cancel bool) (action string, live bool, err error) {
+		switch {
+		case cancel:
+			_, live, err = cancelOrderTx(ctx, tx, o.Data.OrderId)
+			return stpCanceled, live, err
+		case decQty > 0:
+			_, live, err = decrementOrderTx(ctx, tx, o.Data.OrderId, decQty)
+			return stpDecremented, live, err
+		}
+		return stpNone, true, nil
+	}
+
+	buyAction, buyLive, err := apply(buy, cancelBuy)
+	if err != nil {
+		return err
+	}
+	sellAction, sellLive, err := apply(sell, cancelSell)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO stp_events (user_id, stock_id, mode, buy_order_id, sell_order_id, buy_action, sell_action, quantity)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, userId, buy.Data.StockId, mode, buy.Data.OrderId, sell.Data.OrderId, buyAction, sellAction, decQty)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// Book follows the DB
+	settle := func(o ParsedOrder, action string, live bool) {
+		switch {
+		case !live || action == stpCanceled:
+			e.RemoveOrder(symbol, o.Data.OrderId)
+		case action == stpDecremented:
+			e.applyFill(symbol, o.Data.OrderId, decQty, o.Data.RemainingQuantity-decQty)
+		}
+	}
+	settle(buy, buyAction, buyLive)
+	settle(sell, sellAction, sellLive)
+
+	e.notifySelfTrade(symbol, mode, buy, sell, buyAction, sellAction, decQty)
+	return nil
+}
+
+func (e *MatchingEngine) notifySelfTrade(symbol, mode string, buy, sell ParsedOrder, buyAction, sellAction string, qty int64) {
+	if e.IoServer == nil {
+		return
+	}
+	userId := buy.Data.UserId
+
+	e.IoServer.To(socketio.Room("user:"+userId)).Emit("self_trade_prevented", map[string]interface{}{
+		"symbol": symbol, "mode": mode,
+		"buy_order_id": buy.Data.OrderId, "buy_action": buyAction,
+		"sell_order_id": sell.Data.OrderId, "sell_action": sellAction,
+		"quantity":  qty,
+		"message":   "Order Anda tidak dipertemukan dengan order Anda sendiri (self-trade prevention)",
+		"timestamp": time.Now().UnixMilli(),
+	})
+
+	for _, o := range []struct {
+		order  ParsedOrder
+		action string
+		side   string
+	}{{buy, buyAction, "BUY"}, {sell, sellAction, "SELL"}} {
+		if o.action != stpCanceled {
+			continue
+		}
+		e.NotifyOrderStatus(userId, map[string]interface{}{
+			"order_id": o.order.Data.OrderId, "status": "CANCELED", "price": o.order.Price,
+			"matched_quantity": 0, "remaining_quantity": o.order.Data.RemainingQuantity,
+			"symbol": symbol, "type": o.side, "reason": "STP",
+		})
+	}
+}
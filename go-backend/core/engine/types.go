@@ -7,19 +7,76 @@ import (
 type ParsedOrder struct {
 	Data  models.RedisOrderData
 	Price float64
-	Raw   string
+}
+
+// Visible is the quantity shown in depth and matched in continuous trading.
+// Iceberg orders only expose their current slice; the rest stays hidden.
+func (o ParsedOrder) Visible() int64 {
+	if o.Data.DisplayQuantity > 0 {
+		return o.Data.VisibleQuantity
+	}
+	return o.Data.RemainingQuantity
 }
 
 type IEPResult struct {
 	Price         float64
 	MatchedVolume int64
-	Surplus       int64
+	Surplus       int64        // cumulative bid - cumulative ask at Price
+	TieBreak      string       // rule that picked Price (IEPTieBreak*)
+	BuyCurve      []CurvePoint // cumulative bid quantity at or above each price, ascending price
+	SellCurve     []CurvePoint // cumulative ask quantity at or below each price, ascending price
 }
 
+// CurvePoint is one price of a cumulative auction curve
+type CurvePoint struct {
+	Price    float64 `json:"price"`
+	Quantity int64   `json:"quantity"`
+}
+
+// ImbalanceSide is the side left with unmatched quantity at the IEP
+func (r *IEPResult) ImbalanceSide() string {
+	switch {
+	case r.Surplus > 0:
+		return "BUY"
+	case r.Surplus < 0:
+		return "SELL"
+	}
+	return "NONE"
+}
+
+// IEP tie-break rules, applied in this order
+const (
+	IEPTieBreakVolume    = "VOLUME"    // highest executable volume
+	IEPTieBreakSurplus   = "SURPLUS"   // lowest unmatched quantity
+	IEPTieBreakPressure  = "PRESSURE"  // surplus all on one side: highest price (buy) or lowest (sell)
+	IEPTieBreakReference = "REFERENCE" // closest to the previous close, higher price if equidistant
+)
+
 // SessionStatus enum
 const (
-	StatusClosed  = "CLOSED"
-	StatusPreOpen = "PRE_OPEN"
-	StatusLocked  = "LOCKED"
-	StatusOpen    = "OPEN"
+	StatusClosed   = "CLOSED"
+	StatusPreOpen  = "PRE_OPEN"
+	StatusLocked   = "LOCKED"
+	StatusOpen     = "OPEN"
+	StatusBreak    = "BREAK"     // between session 1 and 2, no matching and no new orders
+	StatusPreClose = "PRE_CLOSE" // closing call auction, orders queue for the close
+)
+
+// IsCallAuction reports whether orders are collected for an auction instead of matched continuously
+func IsCallAuction(status string) bool {
+	return status == StatusPreOpen || status == StatusLocked || status == StatusPreClose
+}
+
+// Order price types
+const (
+	PriceTypeLimit  = "LIMIT"
+	PriceTypeMarket = "MARKET"
+)
+
+// Time in force
+const (
+	TIFDay = "DAY" // canceled at session close
+	TIFGTC = "GTC" // carried over to the next session until filled or canceled
+	TIFIOC = "IOC" // fill what is available immediately, cancel the rest
+	TIFFOK = "FOK" // fill completely immediately or cancel entirely
 )
@@ -0,0 +1,101 @@
+package fees
+
+import (
+	"context"
+	"math"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Trading fees and taxes.
+// A fee schedule row gives broker commission, exchange levy and final sales tax as a
+// percent of the trade value. The most specific active row wins: stock and tier, then
+// stock, then tier, then global. An order's rates are resolved when it is placed and
+// stored on it, so a BUY reservation always covers the fee charged at settlement.
+
+// DefaultTier is the fee tier of new users
+const DefaultTier = "REGULAR"
+
+// Rates are the fee rates of one order side, in percent of the trade value
+type Rates struct {
+	CommissionPct float64 `json:"commission_pct"`
+	LevyPct       float64 `json:"levy_pct"`
+	TaxPct        float64 `json:"tax_pct"` // final sales tax, SELL only
+}
+
+// Pct is the total rate
+func (r Rates) Pct() float64 {
+	return r.CommissionPct + r.LevyPct + r.TaxPct
+}
+
+// Charge is the fee breakdown of one side of a trade
+type Charge struct {
+	Gross      float64 `json:"gross"`
+	Commission float64 `json:"commission"`
+	Levy       float64 `json:"levy"`
+	Tax        float64 `json:"tax"`
+	Fee        float64 `json:"fee"`
+	Net        float64 `json:"net"` // paid by the buyer, received by the seller
+}
+
+func (r Rates) charge(gross float64) Charge {
+	c := Charge{
+		Gross:      round(gross),
+		Commission: round(gross * r.CommissionPct / 100),
+		Levy:       round(gross * r.LevyPct / 100),
+		Tax:        round(gross * r.TaxPct / 100),
+	}
+	c.Fee = c.Commission + c.Levy + c.Tax
+	return c
+}
+
+// Buy is what a buyer pays for gross: gross plus fees
+func (r Rates) Buy(gross float64) Charge {
+	c := r.charge(gross)
+	c.Net = c.Gross + c.Fee
+	return c
+}
+
+// Sell is what a seller receives for gross: gross minus fees
+func (r Rates) Sell(gross float64) Charge {
+	c := r.charge(gross)
+	c.Net = c.Gross - c.Fee
+	return c
+}
+
+// Reserve is the cash a BUY order must hold for lots at price, fees included
+func (r Rates) Reserve(price float64, lots int64) float64 {
+	return r.Buy(price * float64(lots) * 100).Net
+}
+
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Resolve returns the rates of a user's order side ("BUY" or "SELL") on a stock.
+// Without a matching schedule the order trades free.
+func Resolve(ctx context.Context, q querier, userId string, stockId int, orderType string) (Rates, error) {
+	var r Rates
+	err := q.QueryRow(ctx, `
+		SELECT
+			CASE WHEN $3 = 'BUY' THEN f.buy_commission_pct ELSE f.sell_commission_pct END::float8,
+			f.levy_pct::float8,
+			CASE WHEN $3 = 'SELL' THEN f.sales_tax_pct ELSE 0 END::float8
+		FROM fee_schedules f
+		JOIN users u ON u.id = $1
+		WHERE f.is_active
+			AND (f.stock_id IS NULL OR f.stock_id = $2)
+			AND (f.user_tier IS NULL OR f.user_tier = u.fee_tier)
+		ORDER BY (f.stock_id IS NOT NULL) DESC, (f.user_tier IS NOT NULL) DESC
+		LIMIT 1
+	`, userId, stockId, orderType).Scan(&r.CommissionPct, &r.LevyPct, &r.TaxPct)
+	if err == pgx.ErrNoRows {
+		return Rates{}, nil
+	}
+	return r, err
+}
+
+// round keeps amounts at the numeric(19,4) precision of the balance columns
+func round(amount float64) float64 {
+	return math.Round(amount*10000) / 10000
+}
@@ -0,0 +1,59 @@
+package ledger
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Order reservations.
+// A BUY order moves its cost from users.balance_rdn (available) to users.reserved_rdn
+// until it trades or is canceled; so does an IPO subscription until it is allotted.
+// A SELL order locks its lots in portfolios.locked_quantity; the lots stay in
+// quantity_owned until they trade. A short SELL order has no lots to lock and reserves
+// its initial margin instead.
+
+// ReserveCash moves amount from the user's available balance to reserved_rdn
+func ReserveCash(ctx context.Context, tx pgx.Tx, userId, orderId string, amount float64) error {
+	return reserve(ctx, tx, userId, amount, New(ReasonOrderReserve, RefOrder, orderId))
+}
+
+// ReleaseCash returns amount of an order's reservation to the available balance
+func ReleaseCash(ctx context.Context, tx pgx.Tx, userId, orderId string, amount float64) error {
+	return reserve(ctx, tx, userId, -amount, New(ReasonOrderRefund, RefOrder, orderId))
+}
+
+// ShortMargin is the initial margin a short SELL order holds for lots at price
+func ShortMargin(price float64, lots int64, marginPct float64) float64 {
+	return round(price * float64(lots) * 100 * marginPct / 100)
+}
+
+// ReserveIPO holds the payment of an IPO subscription
+func ReserveIPO(ctx context.Context, tx pgx.Tx, userId, subscriptionId string, amount float64) error {
+	return reserve(ctx, tx, userId, amount, New(ReasonIPOSubscription, RefIPO, subscriptionId))
+}
+
+// ReleaseIPO returns amount of an IPO subscription's payment to the available balance
+func ReleaseIPO(ctx context.Context, tx pgx.Tx, userId, subscriptionId string, amount float64) error {
+	return reserve(ctx, tx, userId, -amount, New(ReasonIPORefund, RefIPO, subscriptionId))
+}
+
+// reserve moves amount from available to reserved (negative: back) and journals it
+func reserve(ctx context.Context, tx pgx.Tx, userId string, amount float64, j *Journal) error {
+	if amount == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn - $1, reserved_rdn = reserved_rdn + $1 WHERE id = $2", amount, userId); err != nil {
+		return err
+	}
+	return Post(ctx, tx, j.Cash(Cash(userId), Reserved(userId), amount))
+}
+
+// LockShares adds lots to the user's locked quantity of a stock; negative lots unlock
+func LockShares(ctx context.Context, tx pgx.Tx, userId string, stockId int, lots int64) error {
+	if lots == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx, "UPDATE portfolios SET locked_quantity = locked_quantity + $1 WHERE user_id = $2 AND stock_id = $3", lots, userId, stockId)
+	return err
+}
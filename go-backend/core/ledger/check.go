@@ -0,0 +1,174 @@
+package ledger
+
+import (
+	"context"
+	"time"
+
+	"mbit-backend-go/config"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Discrepancy is a stored balance that differs from what the ledger (or, for
+// reservations, the open orders) derives
+type Discrepancy struct {
+	UserId   string  `json:"user_id"`
+	Username string  `json:"username"`
+	Account  string  `json:"account"`
+	Symbol   string  `json:"symbol,omitempty"`
+	Source   string  `json:"source"` // LEDGER or ORDERS
+	Expected float64 `json:"expected"`
+	Actual   float64 `json:"actual"`
+	Diff     float64 `json:"diff"`
+}
+
+// Discrepancy sources and the non-ledger LOCKED account
+const (
+	SourceLedger  = "LEDGER"
+	SourceOrders  = "ORDERS"
+	AccountLocked = "LOCKED" // portfolios.locked_quantity
+)
+
+// CheckReport is the result of comparing every balance against the ledger
+type CheckReport struct {
+	Healthy            bool          `json:"healthy"`
+	Discrepancies      []Discrepancy `json:"discrepancies"`
+	UnbalancedJournals []int64       `json:"unbalanced_journals"`
+	CheckedAt          time.Time     `json:"checked_at"`
+	DurationMs         int64         `json:"duration_ms"`
+}
+
+// Stored balance vs ledger sum or open orders, per account
+var checkQueries = []struct {
+	account, source string
+	sql             string
+}{
+	{AccountCash, SourceLedger, `
+		WITH l AS (SELECT user_id, SUM(amount) AS amount FROM ledger_entries WHERE account = 'CASH' GROUP BY user_id)
+		SELECT u.id::text, u.username, '', COALESCE(l.amount, 0)::float8, COALESCE(u.balance_rdn, 0)::float8
+		FROM users u LEFT JOIN l ON l.user_id = u.id
+		WHERE ABS(COALESCE(l.amount, 0) - COALESCE(u.balance_rdn, 0)) > 0.0001
+	`},
+	{AccountReserved, SourceLedger, `
+		WITH l AS (SELECT user_id, SUM(amount) AS amount FROM ledger_entries WHERE account = 'RESERVED' GROUP BY user_id)
+		SELECT u.id::text, u.username, '', COALESCE(l.amount, 0)::float8, u.reserved_rdn::float8
+		FROM users u LEFT JOIN l ON l.user_id = u.id
+		WHERE ABS(COALESCE(l.amount, 0) - u.reserved_rdn) > 0.0001
+	`},
+	{AccountReserved, SourceOrders, `
+		WITH o AS (
+			SELECT user_id, SUM(amount) AS amount FROM (
+				SELECT user_id, price * remaining_quantity * 100 * (1 + (fee_commission_pct + fee_levy_pct + fee_tax_pct) / 100) AS amount
+				FROM orders WHERE type = 'BUY' AND status IN ('PENDING', 'PARTIAL')
+				UNION ALL
+				SELECT user_id, price * remaining_quantity * 100 * margin_pct / 100
+				FROM orders WHERE type = 'SELL' AND is_short AND status IN ('PENDING', 'PARTIAL')
+				UNION ALL
+				SELECT user_id, reserved_amount FROM ipo_subscriptions WHERE status = 'PENDING'
+			) r
+			GROUP BY user_id
+		)
+		SELECT u.id::text, u.username, '', COALESCE(o.amount, 0)::float8, u.reserved_rdn::float8
+		FROM users u LEFT JOIN o ON o.user_id = u.id
+		WHERE ABS(COALESCE(o.amount, 0) - u.reserved_rdn) > 0.0001
+	`},
+	{AccountShares, SourceLedger, `
+		WITH l AS (SELECT user_id, stock_id, SUM(amount) AS amount FROM ledger_entries WHERE account = 'SHARES' GROUP BY user_id, stock_id)
+		SELECT u.id::text, u.username, s.symbol, COALESCE(l.amount, 0)::float8, COALESCE(p.quantity_owned, 0)::float8
+		FROM l FULL JOIN portfolios p ON p.user_id = l.user_id AND p.stock_id = l.stock_id
+		JOIN users u ON u.id = COALESCE(l.user_id, p.user_id)
+		JOIN stocks s ON s.id = COALESCE(l.stock_id, p.stock_id)
+		WHERE COALESCE(l.amount, 0) <> COALESCE(p.quantity_owned, 0)
+	`},
+	{AccountLocked, SourceOrders, `
+		WITH o AS (
+			SELECT user_id, stock_id, SUM(remaining_quantity) AS qty
+			FROM orders WHERE type = 'SELL' AND NOT is_short AND status IN ('PENDING', 'PARTIAL')
+			GROUP BY user_id, stock_id
+		)
+		SELECT u.id::text, u.username, s.symbol, COALESCE(o.qty, 0)::float8, COALESCE(p.locked_quantity, 0)::float8
+		FROM o FULL JOIN portfolios p ON p.user_id = o.user_id AND p.stock_id = o.stock_id
+		JOIN users u ON u.id = COALESCE(o.user_id, p.user_id)
+		JOIN stocks s ON s.id = COALESCE(o.stock_id, p.stock_id)
+		WHERE COALESCE(o.qty, 0) <> COALESCE(p.locked_quantity, 0)
+	`},
+	{AccountMargin, SourceLedger, `
+		WITH l AS (SELECT user_id, SUM(amount) AS amount FROM ledger_entries WHERE account = 'MARGIN' GROUP BY user_id),
+		sp AS (SELECT user_id, SUM(collateral) AS amount FROM short_positions GROUP BY user_id)
+		SELECT u.id::text, u.username, '', COALESCE(l.amount, 0)::float8, COALESCE(sp.amount, 0)::float8
+		FROM l FULL JOIN sp ON sp.user_id = l.user_id
+		JOIN users u ON u.id = COALESCE(l.user_id, sp.user_id)
+		WHERE ABS(COALESCE(l.amount, 0) - COALESCE(sp.amount, 0)) > 0.0001
+	`},
+	{AccountShort, SourceLedger, `
+		WITH l AS (SELECT user_id, stock_id, -SUM(amount) AS amount FROM ledger_entries WHERE account = 'SHORT' GROUP BY user_id, stock_id)
+		SELECT u.id::text, u.username, s.symbol, COALESCE(l.amount, 0)::float8, COALESCE(sp.quantity, 0)::float8
+		FROM l FULL JOIN short_positions sp ON sp.user_id = l.user_id AND sp.stock_id = l.stock_id
+		JOIN users u ON u.id = COALESCE(l.user_id, sp.user_id)
+		JOIN stocks s ON s.id = COALESCE(l.stock_id, sp.stock_id)
+		WHERE COALESCE(l.amount, 0) <> COALESCE(sp.quantity, 0)
+	`},
+	{AccountDebt, SourceLedger, `
+		WITH l AS (SELECT user_id, -SUM(amount) AS amount FROM ledger_entries WHERE account = 'DEBT' GROUP BY user_id)
+		SELECT u.id::text, u.username, '', COALESCE(l.amount, 0)::float8, u.margin_debt::float8
+		FROM users u LEFT JOIN l ON l.user_id = u.id
+		WHERE ABS(COALESCE(l.amount, 0) - u.margin_debt) > 0.0001
+	`},
+}
+
+// Check compares users.balance_rdn/reserved_rdn and portfolios against the ledger and
+// the open orders, and looks for journals that do not balance. It reads one snapshot.
+func Check(ctx context.Context) (*CheckReport, error) {
+	start := time.Now()
+	tx, err := config.DB.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	report := &CheckReport{Discrepancies: []Discrepancy{}, UnbalancedJournals: []int64{}, CheckedAt: start}
+	for _, q := range checkQueries {
+		rows, err := tx.Query(ctx, q.sql)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			d := Discrepancy{Account: q.account, Source: q.source}
+			if err := rows.Scan(&d.UserId, &d.Username, &d.Symbol, &d.Expected, &d.Actual); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			d.Diff = round(d.Actual - d.Expected)
+			report.Discrepancies = append(report.Discrepancies, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT DISTINCT journal_id FROM ledger_entries
+		GROUP BY journal_id, stock_id
+		HAVING ABS(SUM(amount)) > 0.0001
+		ORDER BY journal_id LIMIT 100
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		report.UnbalancedJournals = append(report.UnbalancedJournals, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report.Healthy = len(report.Discrepancies) == 0 && len(report.UnbalancedJournals) == 0
+	report.DurationMs = time.Since(start).Milliseconds()
+	return report, nil
+}
@@ -0,0 +1,184 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Double-entry ledger for RDN cash and shares.
+// Every balance change posts a journal whose entries sum to zero per asset, in the
+// same transaction as the balance update. Cash amounts are in rupiah, share amounts
+// in lots; an entry with stock_id NULL is cash.
+
+// Accounts
+const (
+	AccountCash     = "CASH"     // user's available RDN balance (users.balance_rdn)
+	AccountReserved = "RESERVED" // user's cash held by open BUY orders and the margin of short SELL orders
+	AccountShares   = "SHARES"   // user's shares of one stock (portfolios.quantity_owned)
+	AccountMarket   = "MARKET"   // SYSTEM_BOT, the counterparty of bot trades
+	AccountExternal = "EXTERNAL" // money and shares entering or leaving the simulation
+	AccountFees     = "FEES"     // fees collected by the exchange
+	AccountMargin   = "MARGIN"   // user's cash held as short sale collateral (short_positions.collateral)
+	AccountShort    = "SHORT"    // lots a user borrowed and sold short, as a negative balance (short_positions.quantity)
+	AccountDebt     = "DEBT"     // user's unpaid margin call, as a negative balance (users.margin_debt)
+)
+
+// Reason codes
+const (
+	ReasonOrderReserve       = "ORDER_RESERVE"
+	ReasonOrderRefund        = "ORDER_REFUND"
+	ReasonTradeSettlement    = "TRADE_SETTLEMENT"
+	ReasonFee                = "FEE"
+	ReasonAdminAdjustment    = "ADMIN_ADJUSTMENT"
+	ReasonDividend           = "DIVIDEND"
+	ReasonOpeningBalance     = "OPENING_BALANCE"
+	ReasonIPOSubscription    = "IPO_SUBSCRIPTION"
+	ReasonIPORefund          = "IPO_REFUND"
+	ReasonIPOAllotment       = "IPO_ALLOTMENT"
+	ReasonCorporateAction    = "CORPORATE_ACTION"
+	ReasonRightsDistribution = "RIGHTS_DISTRIBUTION"
+	ReasonRightsExercise     = "RIGHTS_EXERCISE"
+	ReasonRightsLapse        = "RIGHTS_LAPSE"
+	ReasonShortSale          = "SHORT_SALE"
+	ReasonShortCover         = "SHORT_COVER"
+	ReasonShortBorrowFee     = "SHORT_BORROW_FEE"
+	ReasonShortBuyIn         = "SHORT_BUY_IN"
+	ReasonShortDividend      = "SHORT_DIVIDEND"
+	ReasonMarginCallPayment  = "MARGIN_CALL_PAYMENT"
+)
+
+// Reference types
+const (
+	RefOrder           = "ORDER"
+	RefTrade           = "TRADE"
+	RefSession         = "SESSION"
+	RefAdmin           = "ADMIN"
+	RefUser            = "USER"
+	RefDividend        = "DIVIDEND"
+	RefIPO             = "IPO" // ref_id is the subscription
+	RefCorporateAction = "CORPORATE_ACTION"
+	RefRights          = "RIGHTS" // ref_id is the rights issue
+)
+
+// Account is one ledger account; UserId is empty for system accounts
+type Account struct {
+	Kind   string
+	UserId string
+}
+
+func Cash(userId string) Account     { return Account{AccountCash, userId} }
+func Reserved(userId string) Account { return Account{AccountReserved, userId} }
+func Shares(userId string) Account   { return Account{AccountShares, userId} }
+func Margin(userId string) Account   { return Account{AccountMargin, userId} }
+func Short(userId string) Account    { return Account{AccountShort, userId} }
+func Debt(userId string) Account     { return Account{AccountDebt, userId} }
+
+var (
+	Market   = Account{Kind: AccountMarket}
+	External = Account{Kind: AccountExternal}
+	Fees     = Account{Kind: AccountFees}
+)
+
+// Trader is the user's account of the given kind, or Market for the bot
+func Trader(kind, userId string) Account {
+	if userId == "SYSTEM_BOT" {
+		return Market
+	}
+	return Account{kind, userId}
+}
+
+type entry struct {
+	account Account
+	stockId int // 0 = cash
+	amount  float64
+}
+
+// Journal collects the entries of one posting
+type Journal struct {
+	Reason  string
+	RefType string
+	RefId   string
+	Memo    string
+	entries []entry
+}
+
+func New(reason, refType, refId string) *Journal {
+	return &Journal{Reason: reason, RefType: refType, RefId: refId}
+}
+
+// Cash moves amount rupiah from one account to another. A negative amount moves
+// the other way.
+func (j *Journal) Cash(from, to Account, amount float64) *Journal {
+	return j.move(from, to, 0, round(amount))
+}
+
+// Shares moves lots of a stock from one account to another
+func (j *Journal) Shares(from, to Account, stockId int, lots int64) *Journal {
+	return j.move(from, to, stockId, float64(lots))
+}
+
+func (j *Journal) move(from, to Account, stockId int, amount float64) *Journal {
+	if amount == 0 || from == to {
+		return j
+	}
+	j.entries = append(j.entries,
+		entry{from, stockId, -amount},
+		entry{to, stockId, amount},
+	)
+	return j
+}
+
+// Empty reports whether the journal moves nothing
+func (j *Journal) Empty() bool {
+	return len(j.entries) == 0
+}
+
+// Post writes the journal in tx. Empty journals are skipped.
+func Post(ctx context.Context, tx pgx.Tx, j *Journal) error {
+	if j.Empty() {
+		return nil
+	}
+
+	sums := map[int]float64{}
+	n := len(j.entries)
+	accounts, users := make([]string, n), make([]string, n)
+	stocks, amounts := make([]int32, n), make([]float64, n)
+	for i, e := range j.entries {
+		sums[e.stockId] += e.amount
+		accounts[i], users[i] = e.account.Kind, e.account.UserId
+		stocks[i], amounts[i] = int32(e.stockId), e.amount
+	}
+	for stockId, sum := range sums {
+		if math.Abs(sum) > 0.00005 {
+			return fmt.Errorf("ledger: journal %s tidak seimbang (stock %d, selisih %.4f)", j.Reason, stockId, sum)
+		}
+	}
+
+	_, err := tx.Exec(ctx, `
+		WITH j AS (
+			INSERT INTO ledger_journals (reason, ref_type, ref_id, memo)
+			VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''))
+			RETURNING id
+		)
+		INSERT INTO ledger_entries (journal_id, account, user_id, stock_id, amount)
+		SELECT j.id, e.account, NULLIF(e.user_id, '')::uuid, NULLIF(e.stock_id, 0), e.amount
+		FROM j, unnest($5::text[], $6::text[], $7::int[], $8::float8[]) AS e(account, user_id, stock_id, amount)
+	`, j.Reason, j.RefType, j.RefId, j.Memo, accounts, users, stocks, amounts)
+	if err != nil {
+		return fmt.Errorf("ledger: %w", err)
+	}
+	return nil
+}
+
+// round keeps amounts at the numeric(19,4) precision of the balance columns
+func round(amount float64) float64 {
+	return math.Round(amount*10000) / 10000
+}
+
+// OpenAccount posts the starting RDN balance a new user was created with
+func OpenAccount(ctx context.Context, tx pgx.Tx, userId string, balance float64) error {
+	return Post(ctx, tx, New(ReasonOpeningBalance, RefUser, userId).Cash(External, Cash(userId), balance))
+}
@@ -0,0 +1,288 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lock-free counters and latency histograms, exposed as JSON snapshots
+// (admin stats) and in the Prometheus text format (/metrics).
+
+// Bucket upper bounds in seconds
+var (
+	LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	WaitBuckets    = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600, 14400}
+)
+
+// Counter is a monotonically increasing count
+type Counter struct {
+	v atomic.Int64
+}
+
+func (c *Counter) Inc()         { c.v.Add(1) }
+func (c *Counter) Add(n int64)  { c.v.Add(n) }
+func (c *Counter) Value() int64 { return c.v.Load() }
+
+// Histogram counts observed durations into fixed buckets
+type Histogram struct {
+	buckets  []float64
+	counts   []atomic.Int64 // per bucket, the last one is +Inf
+	count    atomic.Int64
+	sumNanos atomic.Int64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]atomic.Int64, len(buckets)+1)}
+}
+
+// Observe records one duration
+func (h *Histogram) Observe(d time.Duration) {
+	d = max(d, 0)
+	i := sort.SearchFloat64s(h.buckets, d.Seconds())
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sumNanos.Add(int64(d))
+}
+
+// Since records the time elapsed since start
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+// HistogramSnapshot summarizes a histogram. Quantiles are bucket upper bounds.
+type HistogramSnapshot struct {
+	Count int64   `json:"count"`
+	AvgMs float64 `json:"avg_ms"`
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+	P99Ms float64 `json:"p99_ms"`
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{Count: h.count.Load()}
+	if s.Count == 0 {
+		return s
+	}
+	s.AvgMs = float64(h.sumNanos.Load()) / float64(s.Count) / 1e6
+	s.P50Ms = h.quantile(0.50) * 1000
+	s.P95Ms = h.quantile(0.95) * 1000
+	s.P99Ms = h.quantile(0.99) * 1000
+	return s
+}
+
+func (h *Histogram) quantile(q float64) float64 {
+	rank := int64(math.Ceil(q * float64(h.count.Load())))
+	var cum int64
+	for i := range h.buckets {
+		cum += h.counts[i].Load()
+		if cum >= rank {
+			return h.buckets[i]
+		}
+	}
+	return h.buckets[len(h.buckets)-1]
+}
+
+// HistogramVec is a histogram per value of one label
+type HistogramVec struct {
+	label   string
+	buckets []float64
+	mu      sync.RWMutex
+	byValue map[string]*Histogram
+}
+
+func NewHistogramVec(label string, buckets []float64) *HistogramVec {
+	return &HistogramVec{label: label, buckets: buckets, byValue: map[string]*Histogram{}}
+}
+
+// With returns the histogram of a label value, creating it on first use
+func (v *HistogramVec) With(value string) *Histogram {
+	v.mu.RLock()
+	h, ok := v.byValue[value]
+	v.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok = v.byValue[value]; !ok {
+		h = NewHistogram(v.buckets)
+		v.byValue[value] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) Snapshot() map[string]HistogramSnapshot {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	snap := make(map[string]HistogramSnapshot, len(v.byValue))
+	for value, h := range v.byValue {
+		snap[value] = h.Snapshot()
+	}
+	return snap
+}
+
+func (v *HistogramVec) values() []string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	values := make([]string, 0, len(v.byValue))
+	for value := range v.byValue {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// CounterVec is a counter per value of one label
+type CounterVec struct {
+	label   string
+	mu      sync.RWMutex
+	byValue map[string]*Counter
+}
+
+func NewCounterVec(label string) *CounterVec {
+	return &CounterVec{label: label, byValue: map[string]*Counter{}}
+}
+
+func (v *CounterVec) With(value string) *Counter {
+	v.mu.RLock()
+	c, ok := v.byValue[value]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.byValue[value]; !ok {
+		c = &Counter{}
+		v.byValue[value] = c
+	}
+	return c
+}
+
+func (v *CounterVec) Snapshot() map[string]int64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	snap := make(map[string]int64, len(v.byValue))
+	for value, c := range v.byValue {
+		snap[value] = c.Value()
+	}
+	return snap
+}
+
+// Registry lists the metrics exported on /metrics
+type Registry struct {
+	mu      sync.Mutex
+	entries []entry
+}
+
+type entry struct {
+	name, help, kind string
+	metric           any
+}
+
+// Default is the registry served by /metrics
+var Default = &Registry{}
+
+func (r *Registry) add(name, help, kind string, metric any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, e := range r.entries {
+		if e.name == name {
+			r.entries[i] = entry{name, help, kind, metric}
+			return
+		}
+	}
+	r.entries = append(r.entries, entry{name, help, kind, metric})
+}
+
+func (r *Registry) Counter(name, help string, c *Counter) { r.add(name, help, "counter", c) }
+func (r *Registry) CounterVec(name, help string, v *CounterVec) {
+	r.add(name, help, "counter", v)
+}
+func (r *Registry) Histogram(name, help string, h *Histogram) { r.add(name, help, "histogram", h) }
+func (r *Registry) HistogramVec(name, help string, v *HistogramVec) {
+	r.add(name, help, "histogram", v)
+}
+
+// GaugeFunc exports a value read at scrape time
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) { r.add(name, help, "gauge", fn) }
+
+// CounterFunc exports a monotonic total kept elsewhere, read at scrape time
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.add(name, help, "counter", fn)
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition format
+func (r *Registry) WritePrometheus(w io.Writer) {
+	r.mu.Lock()
+	entries := append([]entry(nil), r.entries...)
+	r.mu.Unlock()
+
+	for _, e := range entries {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", e.name, e.help, e.name, e.kind)
+		switch m := e.metric.(type) {
+		case *Counter:
+			fmt.Fprintf(w, "%s %d\n", e.name, m.Value())
+		case *CounterVec:
+			snap := m.Snapshot()
+			values := make([]string, 0, len(snap))
+			for value := range snap {
+				values = append(values, value)
+			}
+			sort.Strings(values)
+			for _, value := range values {
+				fmt.Fprintf(w, "%s{%s=%q} %d\n", e.name, m.label, value, snap[value])
+			}
+		case *Histogram:
+			writeHistogram(w, e.name, "", m)
+		case *HistogramVec:
+			for _, value := range m.values() {
+				writeHistogram(w, e.name, fmt.Sprintf("%s=%q,", m.label, value), m.With(value))
+			}
+		case func() float64:
+			fmt.Fprintf(w, "%s %s\n", e.name, formatFloat(m()))
+		}
+	}
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *Histogram) {
+	var cum int64
+	for i, le := range h.buckets {
+		cum += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(le), cum)
+	}
+	cum += h.counts[len(h.buckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, cum)
+
+	braces := ""
+	if labels != "" {
+		braces = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces, formatFloat(time.Duration(h.sumNanos.Load()).Seconds()))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces, cum)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func init() {
+	Default.GaugeFunc("mbit_goroutines", "Number of goroutines.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	Default.GaugeFunc("mbit_heap_alloc_bytes", "Bytes of allocated heap objects.", func() float64 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return float64(m.HeapAlloc)
+	})
+}
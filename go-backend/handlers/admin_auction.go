@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+type SetAuctionPolicyRequest struct {
+	Policy string `json:"auction_policy"` // PRICE_TIME or PRO_RATA
+}
+
+// SetAuctionPolicy changes the allocation policy for the running session's auctions
+func SetAuctionPolicy(c *fiber.Ctx) error {
+	var req SetAuctionPolicyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := services.GlobalSessionService.SetAuctionPolicy(req.Policy); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Kebijakan alokasi lelang berhasil diubah", "auction_policy": req.Policy})
+}
+
+type AuctionReport struct {
+	ID             int64                      `json:"id"`
+	SessionID      *int                       `json:"session_id"`
+	Symbol         string                     `json:"symbol"`
+	Kind           string                     `json:"kind"`
+	Policy         string                     `json:"policy"`
+	Price          float64                    `json:"price"`
+	MatchedVolume  int64                      `json:"matched_volume"`
+	ExecutedVolume int64                      `json:"executed_volume"`
+	Surplus        int64                      `json:"surplus"`
+	ImbalanceSide  string                     `json:"imbalance_side"`
+	TieBreak       *string                    `json:"tie_break"`
+	CreatedAt      time.Time                  `json:"created_at"`
+	Allocations    []engine.AuctionAllocation `json:"allocations,omitempty"`
+}
+
+const auctionReportColumns = `
+	r.id, r.session_id, s.symbol, r.kind, r.policy, r.price, r.matched_volume, r.executed_volume,
+	r.surplus, r.imbalance_side, r.tie_break, r.created_at
+`
+
+func scanAuctionReport(row pgx.Row, r *AuctionReport) error {
+	return row.Scan(&r.ID, &r.SessionID, &r.Symbol, &r.Kind, &r.Policy, &r.Price, &r.MatchedVolume, &r.ExecutedVolume,
+		&r.Surplus, &r.ImbalanceSide, &r.TieBreak, &r.CreatedAt)
+}
+
+// GetAuctionReports lists call-auction uncrossings, newest first
+func GetAuctionReports(c *fiber.Ctx) error {
+	symbol := c.Query("symbol")
+	sessionId := c.QueryInt("session_id", 0)
+	limit := c.QueryInt("limit", 100)
+
+	query := `SELECT ` + auctionReportColumns + `
+		FROM auction_reports r
+		JOIN stocks s ON r.stock_id = s.id
+		WHERE 1=1
+	`
+	args := []interface{}{}
+	argCounter := 1
+
+	if symbol != "" {
+		query += fmt.Sprintf(" AND s.symbol = $%d", argCounter)
+		args = append(args, symbol)
+		argCounter++
+	}
+	if sessionId > 0 {
+		query += fmt.Sprintf(" AND r.session_id = $%d", argCounter)
+		args = append(args, sessionId)
+		argCounter++
+	}
+
+	query += fmt.Sprintf(" ORDER BY r.created_at DESC LIMIT $%d", argCounter)
+	args = append(args, limit)
+
+	rows, err := config.DB.Query(context.Background(), query, args...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	reports := []AuctionReport{}
+	for rows.Next() {
+		var r AuctionReport
+		if err := scanAuctionReport(rows, &r); err == nil {
+			reports = append(reports, r)
+		}
+	}
+	return c.JSON(reports)
+}
+
+// GetAuctionReport returns one auction with the allocation of every eligible order
+func GetAuctionReport(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "ID tidak valid"})
+	}
+
+	ctx := context.Background()
+	var r AuctionReport
+	row := config.DB.QueryRow(ctx, `SELECT `+auctionReportColumns+`
+		FROM auction_reports r
+		JOIN stocks s ON r.stock_id = s.id
+		WHERE r.id = $1
+	`, id)
+	if err := scanAuctionReport(row, &r); err != nil {
+		if err == pgx.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Laporan lelang tidak ditemukan"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	rows, err := config.DB.Query(ctx, `
+		SELECT order_id, user_id, side, price, order_timestamp, requested_quantity, allocated_quantity, filled_quantity, reason
+		FROM auction_allocations
+		WHERE report_id = $1
+		ORDER BY side, id
+	`, id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	r.Allocations = []engine.AuctionAllocation{}
+	for rows.Next() {
+		var a engine.AuctionAllocation
+		if err := rows.Scan(&a.OrderId, &a.UserId, &a.Side, &a.Price, &a.Timestamp, &a.Requested, &a.Allocated, &a.Filled, &a.Reason); err == nil {
+			r.Allocations = append(r.Allocations, a)
+		}
+	}
+	return c.JSON(r)
+}
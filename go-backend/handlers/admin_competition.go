@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type CompetitionRequest struct {
+	Name           string  `json:"name"`
+	StartSession   int     `json:"start_session"` // session_number
+	EndSession     int     `json:"end_session"`
+	InitialCapital float64 `json:"initial_capital"`
+	ExcludeSystem  *bool   `json:"exclude_system"` // default true
+}
+
+// CreateCompetition adds a competition
+func CreateCompetition(c *fiber.Ctx) error {
+	var req CompetitionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	exclude := req.ExcludeSystem == nil || *req.ExcludeSystem
+
+	comp, err := services.GlobalCompetitionService.Create(context.Background(), c.Locals("userId").(string),
+		req.Name, req.StartSession, req.EndSession, req.InitialCapital, exclude)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(fiber.Map{"message": "Kompetisi berhasil dibuat", "competition": comp})
+}
+
+// DeleteCompetition removes a competition with its participants and snapshots
+func DeleteCompetition(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "ID tidak valid"})
+	}
+	if err := services.GlobalCompetitionService.Delete(context.Background(), id); err != nil {
+		if err == services.ErrCompetitionNotFound {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Kompetisi berhasil dihapus"})
+}
+
+// AddCompetitionParticipants enrolls users in a competition
+func AddCompetitionParticipants(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "ID tidak valid"})
+	}
+	var req struct {
+		UserIDs []string `json:"user_ids"`
+		All     bool     `json:"all"` // every USER account
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	added, err := services.GlobalCompetitionService.AddParticipants(context.Background(), id, req.UserIDs, req.All)
+	if err != nil {
+		if err == services.ErrCompetitionNotFound {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Peserta berhasil ditambahkan", "added": added})
+}
+
+// RemoveCompetitionParticipant removes a user from a competition
+func RemoveCompetitionParticipant(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "ID tidak valid"})
+	}
+	if err := services.GlobalCompetitionService.RemoveParticipant(context.Background(), id, c.Params("userId")); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Peserta berhasil dihapus"})
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type CorporateActionRequest struct {
+	Symbol     string `json:"symbol"`
+	ActionType string `json:"action_type"` // SPLIT, REVERSE_SPLIT or BONUS
+	RatioOld   int64  `json:"ratio_old"`
+	RatioNew   int64  `json:"ratio_new"` // for BONUS, the bonus shares per ratio_old held
+	Memo       string `json:"memo"`
+}
+
+// ApplyCorporateAction splits, reverse splits or issues bonus shares of a stock.
+// Only while the market is closed.
+func ApplyCorporateAction(c *fiber.Ctx) error {
+	var req CorporateActionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	a, err := services.GlobalCorporateActionService.Apply(context.Background(), c.Locals("userId").(string), services.CorporateActionParams{
+		Symbol:     req.Symbol,
+		ActionType: req.ActionType,
+		RatioOld:   req.RatioOld,
+		RatioNew:   req.RatioNew,
+		Memo:       req.Memo,
+	})
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(fiber.Map{"message": "Corporate action berhasil dijalankan", "action": a})
+}
+
+// GetCorporateActionHolders returns an action with every holder's adjustment
+func GetCorporateActionHolders(c *fiber.Ctx) error {
+	ctx := context.Background()
+	a, err := services.GlobalCorporateActionService.Get(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	holders, err := services.GlobalCorporateActionService.Holders(ctx, a.ID, "")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"action": a, "holders": holders})
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type DeclareDividendRequest struct {
+	Symbol            string   `json:"symbol"`
+	DividendPerShare  float64  `json:"dividend_per_share"`
+	CumSession        int      `json:"cum_session"` // session_number
+	ExSession         *int     `json:"ex_session"`  // default cum_session + 1
+	PaySession        int      `json:"pay_session"`
+	WithholdingTaxPct *float64 `json:"withholding_tax_pct"` // default 10
+}
+
+// DeclareDividend announces a cash dividend
+func DeclareDividend(c *fiber.Ctx) error {
+	var req DeclareDividendRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	d, err := services.GlobalDividendService.Declare(context.Background(), c.Locals("userId").(string), req.Symbol,
+		req.DividendPerShare, req.CumSession, req.ExSession, req.PaySession, req.WithholdingTaxPct)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(fiber.Map{"message": "Dividen berhasil diumumkan", "dividend": d})
+}
+
+// GetDividendAllocations returns a dividend with every holder's entitlement
+func GetDividendAllocations(c *fiber.Ctx) error {
+	ctx := context.Background()
+	d, err := services.GlobalDividendService.Get(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	items, err := services.GlobalDividendService.Allocations(ctx, d.ID, "")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"dividend": d, "allocations": items})
+}
+
+// CancelDividend withdraws a dividend that has not been paid
+func CancelDividend(c *fiber.Ctx) error {
+	err := services.GlobalDividendService.Cancel(context.Background(), c.Params("id"))
+	switch err {
+	case nil:
+		return c.JSON(fiber.Map{"message": "Dividen berhasil dibatalkan"})
+	case services.ErrDividendNotFound:
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	case services.ErrDividendPaid:
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+}
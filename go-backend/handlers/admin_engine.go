@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"mbit-backend-go/config"
 	"mbit-backend-go/core/engine"
+	"mbit-backend-go/services"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -127,7 +128,7 @@ func InitSession(c *fiber.Ctx) error {
 	}
 	if err := c.BodyParser(&req); err != nil { return c.Status(400).JSON(fiber.Map{"error": "Invalid request"}) }
 
-	ara, arb := calculateLimits(req.PrevClose)
+	ara, arb := services.CalculateLimits(req.PrevClose)
 
 	// Tick size logic
 	// < 200: 1
@@ -149,13 +150,26 @@ func InitSession(c *fiber.Ctx) error {
 
 // GetEngineStats
 func GetEngineStats(c *fiber.Ctx) error {
-	// Dummy stats for now, real stats would need atomic counters in engine
+	stats := engine.Engine.Stats()
+	halts := engine.Engine.Halts()
 	return c.JSON(fiber.Map{
-		"matchesProcessed": 0,
-		"tradesExecuted": 0,
-		"errors": 0,
-		"circuitBroken": 0,
-		"activeSymbols": []string{},
+		"matchesProcessed": stats.MatchesProcessed,
+		"tradesExecuted": stats.TradesExecuted,
+		"errors": stats.Errors,
+		"matchLoopIterations": stats.LoopIterations,
+		"latency": fiber.Map{
+			"match": stats.MatchLatency,
+			"settle": stats.SettleLatency,
+			"orderToFill": stats.OrderToFill,
+			"db": config.DBLatency.Snapshot(),
+			"redis": config.RedisLatency.Snapshot(),
+		},
+		"dbErrors": config.DBErrors.Snapshot(),
+		"redisErrors": config.RedisErrors.Snapshot(),
+		"circuitBroken": len(halts),
+		"halts": halts,
+		"marketIndexChange": engine.Engine.IndexChange(),
+		"activeSymbols": engine.Engine.Symbols(),
 	})
 }
 
@@ -176,29 +190,147 @@ func HealthCheck(c *fiber.Ctx) error {
 	})
 }
 
-// ValidateOrderbook
+// ValidateOrderbook reconciles the book of a symbol (or every book) in dry-run mode
 func ValidateOrderbook(c *fiber.Ctx) error {
 	symbol := c.Query("symbol")
-	if symbol == "" { return c.Status(400).JSON(fiber.Map{"error": "Symbol required"}) }
 
-	// Count redis orders
-	buyCount, _ := config.RedisMain.ZCard(context.Background(), "orderbook:"+symbol+":buy").Result()
-	sellCount, _ := config.RedisMain.ZCard(context.Background(), "orderbook:"+symbol+":sell").Result()
+	var symbols []string
+	if symbol != "" {
+		symbols = []string{symbol}
+	}
+	report, err := engine.Engine.Reconcile(context.Background(), engine.ReconcileManual, false, symbols...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal validasi orderbook: " + err.Error()})
+	}
 
+	var buys, sells int
+	for _, b := range report.Books {
+		buys += b.RedisBuy
+		sells += b.RedisSell
+	}
 	return c.JSON(fiber.Map{
 		"success": true,
 		"symbol": symbol,
-		"healthy": true,
-		"totalBuyOrders": buyCount,
-		"totalSellOrders": sellCount,
-		"issues": fiber.Map{"buy": []string{}, "sell": []string{}},
+		"healthy": report.Healthy,
+		"totalBuyOrders": buys,
+		"totalSellOrders": sells,
+		"issues": report.Issues,
+		"report": report,
 	})
 }
 
-// ResetCircuit
+// ReconcileOrderbook runs the reconciler, in repair mode if requested
+func ReconcileOrderbook(c *fiber.Ctx) error {
+	var req struct {
+		Symbol string `json:"symbol"`
+		Repair bool   `json:"repair"`
+	}
+	c.BodyParser(&req)
+
+	var symbols []string
+	if req.Symbol != "" {
+		symbols = []string{req.Symbol}
+	}
+	report, err := engine.Engine.Reconcile(context.Background(), engine.ReconcileManual, req.Repair, symbols...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal rekonsiliasi orderbook: " + err.Error()})
+	}
+	return c.JSON(report)
+}
+
+// GetReconcileRuns lists past reconciliation runs, newest first
+func GetReconcileRuns(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 50)
+	query := `
+		SELECT id, trigger, repair, healthy, symbols, issues, repaired, created_at
+		FROM orderbook_reconcile_runs
+		WHERE 1=1
+	`
+	args := []interface{}{}
+	argCounter := 1
+
+	if c.Query("unhealthy") == "true" {
+		query += " AND healthy = false"
+	}
+	if trigger := c.Query("trigger"); trigger != "" {
+		query += fmt.Sprintf(" AND trigger = $%d", argCounter)
+		args = append(args, trigger)
+		argCounter++
+	}
+	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d", argCounter)
+	args = append(args, limit)
+
+	rows, err := config.DB.Query(context.Background(), query, args...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type ReconcileRun struct {
+		ID        int64     `json:"id"`
+		Trigger   string    `json:"trigger"`
+		Repair    bool      `json:"repair"`
+		Healthy   bool      `json:"healthy"`
+		Symbols   int       `json:"symbols"`
+		Issues    int       `json:"issues"`
+		Repaired  int       `json:"repaired"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	runs := []ReconcileRun{}
+	for rows.Next() {
+		var r ReconcileRun
+		if err := rows.Scan(&r.ID, &r.Trigger, &r.Repair, &r.Healthy, &r.Symbols, &r.Issues, &r.Repaired, &r.CreatedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		runs = append(runs, r)
+	}
+	return c.JSON(runs)
+}
+
+// GetReconcileRun returns the full report of one run
+func GetReconcileRun(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "ID tidak valid"})
+	}
+
+	var body []byte
+	err = config.DB.QueryRow(context.Background(), "SELECT report FROM orderbook_reconcile_runs WHERE id = $1", id).Scan(&body)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Laporan rekonsiliasi tidak ditemukan"})
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(body)
+}
+
+// ResetCircuit resumes the halt of a symbol, or every active halt if no symbol is given
 func ResetCircuit(c *fiber.Ctx) error {
-	// No circuit breaker logic implemented yet in Go, just mock
-	return c.JSON(fiber.Map{"success": true, "message": "Circuit breaker reset"})
+	var req struct { Symbol string `json:"symbol"` }
+	c.BodyParser(&req)
+
+	targets := []string{req.Symbol}
+	if req.Symbol == "" {
+		targets = nil
+		for _, h := range engine.Engine.Halts() {
+			targets = append(targets, h.Symbol)
+		}
+	}
+
+	resumed := []string{}
+	for _, symbol := range targets {
+		if err := engine.Engine.ResumeTrading(symbol); err != nil {
+			if req.Symbol != "" {
+				return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+			}
+			continue
+		}
+		if symbol == "" {
+			symbol = "MARKET"
+		}
+		resumed = append(resumed, symbol)
+	}
+	return c.JSON(fiber.Map{"success": true, "message": "Circuit breaker reset", "resumed": resumed})
 }
 
 // ForceBroadcast
@@ -210,3 +342,16 @@ func ForceBroadcast(c *fiber.Ctx) error {
 	}
 	return c.JSON(fiber.Map{"success": true, "message": "Broadcast sent"})
 }
+
+// RecoverOrderbook replays book mutations of settled trades that never reached Redis
+func RecoverOrderbook(c *fiber.Ctx) error {
+	report, err := engine.Engine.RecoverBook(context.Background())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal recovery orderbook: " + err.Error()})
+	}
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"replayed": report.Replayed,
+		"entries":  report.Entries,
+	})
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/fees"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type FeeScheduleRequest struct {
+	UserTier          string  `json:"user_tier"` // empty = every tier
+	Symbol            string  `json:"symbol"`    // empty = every stock
+	BuyCommissionPct  float64 `json:"buy_commission_pct"`
+	SellCommissionPct float64 `json:"sell_commission_pct"`
+	LevyPct           float64 `json:"levy_pct"`
+	SalesTaxPct       float64 `json:"sales_tax_pct"`
+	IsActive          *bool   `json:"is_active"`
+}
+
+type FeeSchedule struct {
+	ID                int       `json:"id"`
+	UserTier          *string   `json:"user_tier"`
+	Symbol            *string   `json:"symbol"`
+	BuyCommissionPct  float64   `json:"buy_commission_pct"`
+	SellCommissionPct float64   `json:"sell_commission_pct"`
+	LevyPct           float64   `json:"levy_pct"`
+	SalesTaxPct       float64   `json:"sales_tax_pct"`
+	IsActive          bool      `json:"is_active"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+var feeTierPattern = regexp.MustCompile(`^[A-Z0-9_]{1,20}$`)
+
+// GetFeeSchedules lists every fee schedule, most general first
+func GetFeeSchedules(c *fiber.Ctx) error {
+	rows, err := config.DB.Query(context.Background(), `
+		SELECT f.id, f.user_tier, s.symbol, f.buy_commission_pct::float8, f.sell_commission_pct::float8,
+			f.levy_pct::float8, f.sales_tax_pct::float8, f.is_active, f.updated_at
+		FROM fee_schedules f
+		LEFT JOIN stocks s ON s.id = f.stock_id
+		ORDER BY (f.stock_id IS NOT NULL), (f.user_tier IS NOT NULL), s.symbol, f.user_tier
+	`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	schedules := []FeeSchedule{}
+	for rows.Next() {
+		var f FeeSchedule
+		if err := rows.Scan(&f.ID, &f.UserTier, &f.Symbol, &f.BuyCommissionPct, &f.SellCommissionPct, &f.LevyPct, &f.SalesTaxPct, &f.IsActive, &f.UpdatedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		schedules = append(schedules, f)
+	}
+	return c.JSON(schedules)
+}
+
+// UpsertFeeSchedule creates or replaces the schedule of a tier/stock combination.
+// New rates apply to orders placed afterwards.
+func UpsertFeeSchedule(c *fiber.Ctx) error {
+	var req FeeScheduleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	req.UserTier = strings.ToUpper(strings.TrimSpace(req.UserTier))
+	req.Symbol = strings.ToUpper(strings.TrimSpace(req.Symbol))
+
+	if req.UserTier != "" && !feeTierPattern.MatchString(req.UserTier) {
+		return c.Status(400).JSON(fiber.Map{"error": "Tier hanya boleh huruf besar, angka dan _ (maks. 20)"})
+	}
+	for _, pct := range []float64{req.BuyCommissionPct, req.SellCommissionPct, req.LevyPct, req.SalesTaxPct} {
+		if pct < 0 || pct > 10 {
+			return c.Status(400).JSON(fiber.Map{"error": "Tarif fee harus antara 0 dan 10 persen"})
+		}
+	}
+	active := req.IsActive == nil || *req.IsActive
+
+	ctx := context.Background()
+	var stockId *int
+	if req.Symbol != "" {
+		var id int
+		if err := config.DB.QueryRow(ctx, "SELECT id FROM stocks WHERE symbol = $1", req.Symbol).Scan(&id); err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Saham tidak ditemukan"})
+		}
+		stockId = &id
+	}
+
+	var id int
+	err := config.DB.QueryRow(ctx, `
+		INSERT INTO fee_schedules (user_tier, stock_id, buy_commission_pct, sell_commission_pct, levy_pct, sales_tax_pct, is_active)
+		VALUES (NULLIF($1, ''), $2, $3, $4, $5, $6, $7)
+		ON CONFLICT ((COALESCE(user_tier, '')), (COALESCE(stock_id, 0))) DO UPDATE SET
+			buy_commission_pct = EXCLUDED.buy_commission_pct,
+			sell_commission_pct = EXCLUDED.sell_commission_pct,
+			levy_pct = EXCLUDED.levy_pct,
+			sales_tax_pct = EXCLUDED.sales_tax_pct,
+			is_active = EXCLUDED.is_active,
+			updated_at = NOW()
+		RETURNING id
+	`, req.UserTier, stockId, req.BuyCommissionPct, req.SellCommissionPct, req.LevyPct, req.SalesTaxPct, active).Scan(&id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Jadwal fee berhasil disimpan", "id": id})
+}
+
+// DeleteFeeSchedule removes a tier or stock specific schedule
+func DeleteFeeSchedule(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "ID tidak valid"})
+	}
+
+	tag, err := config.DB.Exec(context.Background(),
+		"DELETE FROM fee_schedules WHERE id = $1 AND (user_tier IS NOT NULL OR stock_id IS NOT NULL)", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Jadwal fee tidak ditemukan (jadwal global tidak bisa dihapus)"})
+	}
+	return c.JSON(fiber.Map{"message": "Jadwal fee berhasil dihapus"})
+}
+
+// SetUserFeeTier moves a user to another fee tier
+func SetUserFeeTier(c *fiber.Ctx) error {
+	var req struct {
+		Tier string `json:"tier"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	req.Tier = strings.ToUpper(strings.TrimSpace(req.Tier))
+	if req.Tier == "" {
+		req.Tier = fees.DefaultTier
+	}
+	if !feeTierPattern.MatchString(req.Tier) {
+		return c.Status(400).JSON(fiber.Map{"error": "Tier hanya boleh huruf besar, angka dan _ (maks. 20)"})
+	}
+
+	tag, err := config.DB.Exec(context.Background(), "UPDATE users SET fee_tier = $1 WHERE id = $2", req.Tier, c.Params("userId"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "User tidak ditemukan"})
+	}
+	return c.JSON(fiber.Map{"message": "Tier fee user berhasil diperbarui", "tier": req.Tier})
+}
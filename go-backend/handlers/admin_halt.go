@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type HaltRequest struct {
+	Symbol string `json:"symbol"` // empty halts the whole market
+	Detail string `json:"detail"`
+}
+
+// GetTradingHalts lists the active trading halts
+func GetTradingHalts(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"halts":             engine.Engine.Halts(),
+		"marketIndexChange": engine.Engine.IndexChange(),
+	})
+}
+
+// HaltTrading halts a symbol, or the whole market, until resumed by an admin
+func HaltTrading(c *fiber.Ctx) error {
+	var req HaltRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	req.Symbol = strings.ToUpper(strings.TrimSpace(req.Symbol))
+
+	if req.Symbol != "" {
+		var exists bool
+		if err := config.DB.QueryRow(context.Background(), "SELECT EXISTS(SELECT 1 FROM stocks WHERE symbol = $1)", req.Symbol).Scan(&exists); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !exists {
+			return c.Status(404).JSON(fiber.Map{"error": "Saham tidak ditemukan"})
+		}
+	}
+	if req.Detail == "" {
+		req.Detail = "Dihentikan oleh admin"
+	}
+
+	halt, err := engine.Engine.HaltTrading(req.Symbol, engine.HaltManual, req.Detail)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Trading berhasil dihentikan", "halt": halt})
+}
+
+// ResumeTrading lifts a halt through the re-opening call auction
+func ResumeTrading(c *fiber.Ctx) error {
+	var req HaltRequest
+	c.BodyParser(&req)
+	req.Symbol = strings.ToUpper(strings.TrimSpace(req.Symbol))
+
+	if err := engine.Engine.ResumeTrading(req.Symbol); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{
+		"message":            "Trading dibuka kembali melalui lelang",
+		"reopen_auction_sec": engine.Engine.BreakerConfig().ReopenAuctionSec,
+	})
+}
+
+// GetHaltHistory lists past and active halts, newest first
+func GetHaltHistory(c *fiber.Ctx) error {
+	symbol := c.Query("symbol")
+	reason := c.Query("reason")
+	limit := c.QueryInt("limit", 100)
+
+	query := `
+		SELECT id, COALESCE(symbol, ''), scope, reason, phase, COALESCE(detail, ''), halted_at, resumed_at
+		FROM trading_halts
+		WHERE 1=1
+	`
+	args := []interface{}{}
+	argCounter := 1
+
+	if symbol != "" {
+		query += fmt.Sprintf(" AND symbol = $%d", argCounter)
+		args = append(args, symbol)
+		argCounter++
+	}
+	if reason != "" {
+		query += fmt.Sprintf(" AND reason = $%d", argCounter)
+		args = append(args, reason)
+		argCounter++
+	}
+	query += fmt.Sprintf(" ORDER BY halted_at DESC LIMIT $%d", argCounter)
+	args = append(args, limit)
+
+	rows, err := config.DB.Query(context.Background(), query, args...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type HaltRecord struct {
+		ID        int64      `json:"id"`
+		Symbol    string     `json:"symbol"`
+		Scope     string     `json:"scope"`
+		Reason    string     `json:"reason"`
+		Phase     string     `json:"phase"`
+		Detail    string     `json:"detail"`
+		HaltedAt  time.Time  `json:"halted_at"`
+		ResumedAt *time.Time `json:"resumed_at"`
+	}
+
+	halts := []HaltRecord{}
+	for rows.Next() {
+		var h HaltRecord
+		if err := rows.Scan(&h.ID, &h.Symbol, &h.Scope, &h.Reason, &h.Phase, &h.Detail, &h.HaltedAt, &h.ResumedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		halts = append(halts, h)
+	}
+	return c.JSON(halts)
+}
+
+// GetCircuitBreakerConfig returns the circuit breaker thresholds
+func GetCircuitBreakerConfig(c *fiber.Ctx) error {
+	return c.JSON(engine.Engine.BreakerConfig())
+}
+
+// UpdateCircuitBreakerConfig replaces the circuit breaker thresholds
+func UpdateCircuitBreakerConfig(c *fiber.Ctx) error {
+	cfg := engine.Engine.BreakerConfig()
+	if err := c.BodyParser(&cfg); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := engine.Engine.UpdateBreakerConfig(context.Background(), cfg); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Konfigurasi circuit breaker berhasil disimpan", "config": cfg})
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type CreateIPORequest struct {
+	Symbol            string  `json:"symbol"`
+	Name              string  `json:"name"` // required for a new stock
+	OfferingPrice     float64 `json:"offering_price"`
+	TotalShares       int64   `json:"total_shares"`        // lots
+	OfferStartSession int     `json:"offer_start_session"` // session_number
+	OfferEndSession   int     `json:"offer_end_session"`
+	ListingSession    int     `json:"listing_session"`
+	AllocationMethod  string  `json:"allocation_method"` // PRO_RATA (default) or LOTTERY
+}
+
+// CreateIPO opens an offering
+func CreateIPO(c *fiber.Ctx) error {
+	var req CreateIPORequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	ipo, err := services.GlobalIPOService.Create(context.Background(), c.Locals("userId").(string), services.CreateIPOParams{
+		Symbol:            req.Symbol,
+		Name:              req.Name,
+		OfferingPrice:     req.OfferingPrice,
+		TotalShares:       req.TotalShares,
+		OfferStartSession: req.OfferStartSession,
+		OfferEndSession:   req.OfferEndSession,
+		ListingSession:    req.ListingSession,
+		AllocationMethod:  req.AllocationMethod,
+	})
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(fiber.Map{"message": "IPO berhasil dibuat", "ipo": ipo})
+}
+
+// GetIPOSubscriptions returns an offering with every booking
+func GetIPOSubscriptions(c *fiber.Ctx) error {
+	ctx := context.Background()
+	ipo, err := services.GlobalIPOService.Get(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	subs, err := services.GlobalIPOService.Subscriptions(ctx, ipo.ID, "")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"ipo": ipo, "subscriptions": subs})
+}
+
+// CancelIPO withdraws an offering before allotment and refunds the subscribers
+func CancelIPO(c *fiber.Ctx) error {
+	err := services.GlobalIPOService.Cancel(context.Background(), c.Params("id"))
+	switch err {
+	case nil:
+		return c.JSON(fiber.Map{"message": "IPO berhasil dibatalkan"})
+	case services.ErrIPONotFound:
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	case services.ErrIPONotCancelable:
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+}
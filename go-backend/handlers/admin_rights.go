@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type AnnounceRightsRequest struct {
+	Symbol               string  `json:"symbol"`
+	RatioOld             int64   `json:"ratio_old"` // lots held ...
+	RatioNew             int64   `json:"ratio_new"` // ... earn this many lots of rights
+	ExercisePrice        float64 `json:"exercise_price"`
+	CumSession           int     `json:"cum_session"`            // session_number
+	ExerciseStartSession int     `json:"exercise_start_session"` // default cum_session + 1
+	ExerciseEndSession   int     `json:"exercise_end_session"`
+	Tradeable            *bool   `json:"tradeable"` // default true
+}
+
+// AnnounceRightsIssue declares a rights issue
+func AnnounceRightsIssue(c *fiber.Ctx) error {
+	var req AnnounceRightsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	tradeable := true
+	if req.Tradeable != nil {
+		tradeable = *req.Tradeable
+	}
+
+	r, err := services.GlobalRightsService.Announce(context.Background(), c.Locals("userId").(string), services.AnnounceRightsParams{
+		Symbol:               req.Symbol,
+		RatioOld:             req.RatioOld,
+		RatioNew:             req.RatioNew,
+		ExercisePrice:        req.ExercisePrice,
+		CumSession:           req.CumSession,
+		ExerciseStartSession: req.ExerciseStartSession,
+		ExerciseEndSession:   req.ExerciseEndSession,
+		Tradeable:            tradeable,
+	})
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(fiber.Map{"message": "Rights issue berhasil diumumkan", "rights_issue": r})
+}
+
+// GetRightsEntitlements returns a rights issue with every holder's rights
+func GetRightsEntitlements(c *fiber.Ctx) error {
+	ctx := context.Background()
+	r, err := services.GlobalRightsService.Get(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	items, err := services.GlobalRightsService.Entitlements(ctx, r.ID, "")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"rights_issue": r, "entitlements": items})
+}
+
+// CancelRightsIssue withdraws a rights issue before its holders are recorded
+func CancelRightsIssue(c *fiber.Ctx) error {
+	err := services.GlobalRightsService.Cancel(context.Background(), c.Params("id"))
+	switch err {
+	case nil:
+		return c.JSON(fiber.Map{"message": "Rights issue berhasil dibatalkan"})
+	case services.ErrRightsNotFound:
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	case services.ErrRightsNotCancelable:
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetSessionSchedule returns the trading schedule and upcoming holidays (public)
+func GetSessionSchedule(c *fiber.Ctx) error {
+	ctx := context.Background()
+	schedule, err := services.GlobalSessionService.GetSchedule(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	holidays, err := services.GlobalSessionService.ListHolidays(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"schedule": schedule, "holidays": holidays})
+}
+
+func UpdateSessionSchedule(c *fiber.Ctx) error {
+	var req services.SessionSchedule
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	schedule, err := services.GlobalSessionService.UpdateSchedule(req)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Jadwal sesi berhasil diperbarui", "schedule": schedule})
+}
+
+func AddMarketHoliday(c *fiber.Ctx) error {
+	var req services.MarketHoliday
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := services.GlobalSessionService.AddHoliday(req.Date, req.Description); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Hari libur berhasil ditambahkan", "holiday": req})
+}
+
+func RemoveMarketHoliday(c *fiber.Ctx) error {
+	if err := services.GlobalSessionService.RemoveHoliday(c.Params("date")); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Hari libur berhasil dihapus"})
+}
+
+type SetSessionPhaseRequest struct {
+	Status string `json:"status"` // BREAK, OPEN or PRE_CLOSE
+}
+
+// SetSessionPhase moves a manually opened session between its trading phases
+func SetSessionPhase(c *fiber.Ctx) error {
+	var req SetSessionPhaseRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := services.GlobalSessionService.SetPhase(req.Status); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Fase sesi berhasil diubah", "status": req.Status})
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetShortSettings returns the short selling settings
+func GetShortSettings(c *fiber.Ctx) error {
+	st, err := services.GlobalShortService.Settings(context.Background())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(st)
+}
+
+type UpdateShortSettingsRequest struct {
+	IsEnabled            *bool    `json:"is_enabled"`
+	InitialMarginPct     *float64 `json:"initial_margin_pct"`
+	MaintenanceMarginPct *float64 `json:"maintenance_margin_pct"`
+	BorrowFeePct         *float64 `json:"borrow_fee_pct"` // per session
+}
+
+// UpdateShortSettings changes the short selling settings; omitted fields are kept
+func UpdateShortSettings(c *fiber.Ctx) error {
+	var req UpdateShortSettingsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	st, err := services.GlobalShortService.UpdateSettings(context.Background(), services.ShortSettingsParams{
+		IsEnabled:            req.IsEnabled,
+		InitialMarginPct:     req.InitialMarginPct,
+		MaintenanceMarginPct: req.MaintenanceMarginPct,
+		BorrowFeePct:         req.BorrowFeePct,
+	})
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Pengaturan short selling berhasil diubah", "settings": st})
+}
+
+// GetShortMarks returns every user's mark to market (?session_id=), weakest margin first
+func GetShortMarks(c *fiber.Ctx) error {
+	marks, err := services.GlobalShortService.Marks(context.Background(), "", c.QueryInt("session_id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(marks)
+}
@@ -3,6 +3,8 @@ package handlers
 import (
 	"context"
 	"mbit-backend-go/config"
+	"mbit-backend-go/core/ledger"
+	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -168,6 +170,11 @@ func IssueShares(c *fiber.Ctx) error {
 
 	if err != nil { return c.Status(500).JSON(fiber.Map{"error": err.Error()}) }
 
+	sid, _ := strconv.Atoi(stockId)
+	j := ledger.New(ledger.ReasonAdminAdjustment, ledger.RefAdmin, c.Locals("userId").(string)).Shares(ledger.External, ledger.Shares(req.UserID), sid, req.Quantity)
+	j.Memo = "Penerbitan saham"
+	if err := ledger.Post(ctx, tx, j); err != nil { return c.Status(500).JSON(fiber.Map{"error": err.Error()}) }
+
 	if err := tx.Commit(ctx); err != nil { return c.Status(500).JSON(fiber.Map{"error": err.Error()}) }
 
 	// Get updated portfolio
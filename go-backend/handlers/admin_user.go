@@ -2,8 +2,11 @@ package handlers
 
 import (
 	"context"
+	"fmt"
 	"mbit-backend-go/config"
+	"mbit-backend-go/core/ledger"
 	"mbit-backend-go/models"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -27,8 +30,15 @@ func CreateAdmin(c *fiber.Ctx) error {
 
 	hashed, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 
+	ctx := context.Background()
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback(ctx)
+
 	var user models.User
-	err := config.DB.QueryRow(context.Background(), `
+	err = tx.QueryRow(ctx, `
 		INSERT INTO users (username, full_name, password_hash, role)
 		VALUES ($1, $2, $3, 'ADMIN')
 		RETURNING id, username, full_name, balance_rdn, role, created_at
@@ -39,6 +49,12 @@ func CreateAdmin(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
+	if err := ledger.OpenAccount(ctx, tx, user.ID, user.BalanceRDN); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	return c.Status(201).JSON(fiber.Map{
 		"message": "Admin created",
@@ -57,12 +73,22 @@ func GetAllUsers(c *fiber.Ctx) error {
 			JOIN daily_stock_data d ON p.stock_id = d.stock_id
 			WHERE d.session_id = (SELECT id FROM trading_sessions ORDER BY id DESC LIMIT 1)
 			GROUP BY p.user_id
+		),
+		short_values AS (
+			SELECT
+				sp.user_id,
+				SUM(sp.collateral - sp.quantity * 100 * COALESCE(d.close_price, d.prev_close, sp.avg_short_price)) as short_equity
+			FROM short_positions sp
+			LEFT JOIN daily_stock_data d ON sp.stock_id = d.stock_id
+				AND d.session_id = (SELECT id FROM trading_sessions ORDER BY id DESC LIMIT 1)
+			GROUP BY sp.user_id
 		)
 		SELECT
 			u.id, u.username, u.full_name, u.balance_rdn, u.role, u.created_at,
-			(u.balance_rdn + COALESCE(sv.stock_equity, 0)) as equity
+			(u.balance_rdn + u.reserved_rdn - u.margin_debt + COALESCE(sv.stock_equity, 0) + COALESCE(shv.short_equity, 0)) as equity
 		FROM users u
 		LEFT JOIN stock_values sv ON u.id = sv.user_id
+		LEFT JOIN short_values shv ON u.id = shv.user_id
 		ORDER BY u.created_at DESC
 	`
 	rows, err := config.DB.Query(context.Background(), query)
@@ -136,12 +162,29 @@ func AdjustUserBalance(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	_, err := config.DB.Exec(context.Background(), "UPDATE users SET balance_rdn = balance_rdn + $1 WHERE id = $2", req.Amount, userId)
+	ctx := context.Background()
+	tx, err := config.DB.Begin(ctx)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
+	defer tx.Rollback(ctx)
 
-	// Could log transaction ledger if exists, but not in current minimal scope
+	tag, err := tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn + $1 WHERE id = $2", req.Amount, userId)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "User tidak ditemukan"})
+	}
+
+	j := ledger.New(ledger.ReasonAdminAdjustment, ledger.RefAdmin, c.Locals("userId").(string)).Cash(ledger.External, ledger.Cash(userId), req.Amount)
+	j.Memo = req.Reason
+	if err := ledger.Post(ctx, tx, j); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	return c.JSON(fiber.Map{"message": "Balance updated"})
 }
@@ -180,13 +223,16 @@ func AdjustUserPortfolio(c *fiber.Ctx) error {
 			return c.Status(400).JSON(fiber.Map{"error": "Melebihi max shares"})
 		}
 	} else if req.Amount < 0 {
-		// Validate user has enough to remove
-		var owned int64
-		err = tx.QueryRow(ctx, "SELECT quantity_owned FROM portfolios WHERE user_id = $1 AND stock_id = $2", userId, stockId).Scan(&owned)
-		if err == pgx.ErrNoRows { owned = 0 }
+		// Validate user has enough to remove; lots in open SELL orders stay
+		var owned, locked int64
+		err = tx.QueryRow(ctx, "SELECT quantity_owned, locked_quantity FROM portfolios WHERE user_id = $1 AND stock_id = $2 FOR UPDATE", userId, stockId).Scan(&owned, &locked)
+		if err == pgx.ErrNoRows { owned, locked = 0, 0 }
 		if owned + req.Amount < 0 {
 			return c.Status(400).JSON(fiber.Map{"error": "User tidak memiliki cukup saham"})
 		}
+		if owned - locked + req.Amount < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("%d lot sedang terkunci di order jual", locked)})
+		}
 	}
 
 	// Update
@@ -198,6 +244,11 @@ func AdjustUserPortfolio(c *fiber.Ctx) error {
 	`, userId, stockId, req.Amount)
 	if err != nil { return c.Status(500).JSON(fiber.Map{"error": err.Error()}) }
 
+	sid, _ := strconv.Atoi(stockId)
+	j := ledger.New(ledger.ReasonAdminAdjustment, ledger.RefAdmin, c.Locals("userId").(string)).Shares(ledger.External, ledger.Shares(userId), sid, req.Amount)
+	j.Memo = req.Reason
+	if err := ledger.Post(ctx, tx, j); err != nil { return c.Status(500).JSON(fiber.Map{"error": err.Error()}) }
+
 	if err := tx.Commit(ctx); err != nil { return c.Status(500).JSON(fiber.Map{"error": err.Error()}) }
 
 	// Fetch new quantity
@@ -216,3 +267,22 @@ func AdjustUserPortfolio(c *fiber.Ctx) error {
 		"reason": req.Reason,
 	})
 }
+
+// GetUserLedger returns a user's ledger statement
+func GetUserLedger(c *fiber.Ctx) error {
+	return ledgerStatement(c, c.Params("userId"))
+}
+
+// GetUserAnalytics returns a user's realized P&L and trading performance
+func GetUserAnalytics(c *fiber.Ctx) error {
+	return performanceAnalytics(c, c.Params("userId"))
+}
+
+// CheckLedger compares every stored balance against the ledger
+func CheckLedger(c *fiber.Ctx) error {
+	report, err := ledger.Check(context.Background())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(report)
+}
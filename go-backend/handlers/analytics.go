@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"mbit-backend-go/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SessionPnL is one trading session of a user's P&L series
+type SessionPnL struct {
+	SessionID     int     `json:"session_id"`
+	SessionNumber int     `json:"session_number"`
+	Date          string  `json:"date"`
+	RealizedPnL   float64 `json:"realized_pnl"` // against average cost, before fees
+	Fees          float64 `json:"fees"`         // buy and sell fees paid in the session
+	NetPnL        float64 `json:"net_pnl"`
+	CumulativePnL float64 `json:"cumulative_pnl"`
+	Turnover      float64 `json:"turnover"`
+	Trades        int     `json:"trades"`
+}
+
+// StockPnL is one stock's contribution to a user's P&L
+type StockPnL struct {
+	Symbol      string  `json:"symbol"`
+	RealizedPnL float64 `json:"realized_pnl"`
+	Fees        float64 `json:"fees"`
+	NetPnL      float64 `json:"net_pnl"`
+	Turnover    float64 `json:"turnover"`
+	Trades      int     `json:"trades"`
+}
+
+// GetAnalytics returns the user's realized P&L and trading performance
+func GetAnalytics(c *fiber.Ctx) error {
+	return performanceAnalytics(c, c.Locals("userId").(string))
+}
+
+// The user's fills, both sides, with the session they traded in. Fees are only known
+// for trades settled since trade_fees exists.
+const analyticsFills = `
+	fills AS (
+		SELECT t.id, t.session_id, t.stock_id, t.price * t.quantity * 100 AS gross, COALESCE(f.fee, 0) AS fee
+		FROM trades t
+		JOIN orders o ON o.id = t.buy_order_id
+		LEFT JOIN trade_fees f ON f.trade_id = t.id AND f.side = 'BUY'
+		WHERE o.user_id = $1 AND t.session_id IN (SELECT id FROM s)
+		UNION ALL
+		SELECT t.id, t.session_id, t.stock_id, t.price * t.quantity * 100, COALESCE(f.fee, 0)
+		FROM trades t
+		JOIN orders o ON o.id = t.sell_order_id
+		LEFT JOIN trade_fees f ON f.trade_id = t.id AND f.side = 'SELL'
+		WHERE o.user_id = $1 AND t.session_id IN (SELECT id FROM s)
+	),
+	pnl AS (
+		SELECT r.order_id, r.stock_id, t.session_id, r.gross_pnl, r.pnl
+		FROM realized_pnl r
+		JOIN trades t ON t.id = r.trade_id
+		WHERE r.user_id = $1 AND t.session_id IN (SELECT id FROM s)
+	)
+`
+
+// performanceAnalytics builds the per-session P&L series, win rate, turnover, max
+// drawdown and per-stock contribution of a user. from/to filter sessions by date.
+func performanceAnalytics(c *fiber.Ctx, userId string) error {
+	sessions := "SELECT id, session_number, COALESCE(trading_date, started_at::date) AS date FROM trading_sessions WHERE 1=1"
+	args := []interface{}{userId}
+	argCounter := 2
+
+	if from := c.Query("from"); from != "" {
+		if _, err := time.Parse("2006-01-02", from); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Format tanggal from harus YYYY-MM-DD"})
+		}
+		sessions += fmt.Sprintf(" AND COALESCE(trading_date, started_at::date) >= $%d::date", argCounter)
+		args = append(args, from)
+		argCounter++
+	}
+	if to := c.Query("to"); to != "" {
+		if _, err := time.Parse("2006-01-02", to); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Format tanggal to harus YYYY-MM-DD"})
+		}
+		sessions += fmt.Sprintf(" AND COALESCE(trading_date, started_at::date) <= $%d::date", argCounter)
+		args = append(args, to)
+		argCounter++
+	}
+	with := "WITH s AS (" + sessions + ")," + analyticsFills
+
+	ctx := context.Background()
+	var exists bool
+	if err := config.DB.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userId).Scan(&exists); err != nil || !exists {
+		return c.Status(404).JSON(fiber.Map{"error": "User tidak ditemukan"})
+	}
+
+	// 1. Series, one row per session in the range
+	rows, err := config.DB.Query(ctx, with+`
+		SELECT s.id, s.session_number, s.date::text,
+			COALESCE((SELECT SUM(gross_pnl) FROM pnl WHERE pnl.session_id = s.id), 0)::float8,
+			COALESCE((SELECT SUM(fee) FROM fills WHERE fills.session_id = s.id), 0)::float8,
+			COALESCE((SELECT SUM(gross) FROM fills WHERE fills.session_id = s.id), 0)::float8,
+			(SELECT COUNT(*) FROM fills WHERE fills.session_id = s.id)
+		FROM s
+		ORDER BY s.id
+	`, args...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil analitik"})
+	}
+	defer rows.Close()
+
+	series := []SessionPnL{}
+	var realized, totalFees, turnover, cumulative, peak, drawdown float64
+	var trades int
+	var drawdownSession *int
+	for rows.Next() {
+		var p SessionPnL
+		if err := rows.Scan(&p.SessionID, &p.SessionNumber, &p.Date, &p.RealizedPnL, &p.Fees, &p.Turnover, &p.Trades); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		p.NetPnL = round2(p.RealizedPnL - p.Fees)
+		cumulative += p.NetPnL
+		p.CumulativePnL = round2(cumulative)
+
+		// Drawdown is measured on the cumulative net P&L, from its highest point so far
+		peak = math.Max(peak, cumulative)
+		if peak-cumulative > drawdown {
+			drawdown = peak - cumulative
+			id := p.SessionID
+			drawdownSession = &id
+		}
+
+		realized += p.RealizedPnL
+		totalFees += p.Fees
+		turnover += p.Turnover
+		trades += p.Trades
+		series = append(series, p)
+	}
+	rows.Close()
+
+	// 2. Win rate over closed SELL orders: an order wins if its fills made a net profit
+	var wins, losses, sellOrders int
+	err = config.DB.QueryRow(ctx, with+`
+		SELECT COUNT(*) FILTER (WHERE pnl > 0), COUNT(*) FILTER (WHERE pnl < 0), COUNT(*)
+		FROM (SELECT order_id, SUM(pnl) AS pnl FROM pnl GROUP BY order_id) o
+	`, args...).Scan(&wins, &losses, &sellOrders)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil analitik"})
+	}
+	var winRate float64
+	if sellOrders > 0 {
+		winRate = round2(float64(wins) / float64(sellOrders) * 100)
+	}
+
+	// 3. Contribution per stock, best first
+	rows, err = config.DB.Query(ctx, with+`
+		SELECT st.symbol, COALESCE(p.realized, 0)::float8, f.fees::float8, f.turnover::float8, f.trades
+		FROM (SELECT stock_id, SUM(fee) AS fees, SUM(gross) AS turnover, COUNT(*) AS trades FROM fills GROUP BY stock_id) f
+		LEFT JOIN (SELECT stock_id, SUM(gross_pnl) AS realized FROM pnl GROUP BY stock_id) p ON p.stock_id = f.stock_id
+		JOIN stocks st ON st.id = f.stock_id
+		ORDER BY COALESCE(p.realized, 0) - f.fees DESC, st.symbol
+	`, args...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil analitik"})
+	}
+	defer rows.Close()
+
+	stocks := []StockPnL{}
+	for rows.Next() {
+		var s StockPnL
+		if err := rows.Scan(&s.Symbol, &s.RealizedPnL, &s.Fees, &s.Turnover, &s.Trades); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		s.NetPnL = round2(s.RealizedPnL - s.Fees)
+		stocks = append(stocks, s)
+	}
+	rows.Close()
+
+	// 4. Unrealized P&L of the positions held now, at the same price as GET /portfolio
+	var unrealized float64
+	err = config.DB.QueryRow(ctx, `
+		SELECT COALESCE(SUM((COALESCE(d.close_price, d.prev_close, 1000) - p.avg_buy_price) * p.quantity_owned * 100), 0)::float8
+		FROM portfolios p
+		LEFT JOIN daily_stock_data d ON d.stock_id = p.stock_id AND d.session_id = (SELECT id FROM trading_sessions WHERE status IN ('OPEN', 'LOCKED', 'PRE_OPEN', 'BREAK', 'PRE_CLOSE') ORDER BY id DESC LIMIT 1)
+		WHERE p.user_id = $1 AND p.quantity_owned > 0
+	`, userId).Scan(&unrealized)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil analitik"})
+	}
+
+	return c.JSON(fiber.Map{
+		"summary": fiber.Map{
+			"realized_pnl":         round2(realized),
+			"fees":                 round2(totalFees),
+			"net_pnl":              round2(realized - totalFees),
+			"unrealized_pnl":       round2(unrealized),
+			"turnover":             round2(turnover),
+			"trades":               trades,
+			"sell_orders":          sellOrders,
+			"wins":                 wins,
+			"losses":               losses,
+			"win_rate":             winRate,
+			"max_drawdown":         round2(drawdown),
+			"max_drawdown_session": drawdownSession,
+		},
+		"series": series,
+		"stocks": stocks,
+	})
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
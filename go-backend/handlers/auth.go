@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"mbit-backend-go/config"
+	"mbit-backend-go/core/ledger"
 	"mbit-backend-go/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -42,13 +43,20 @@ func Register(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to hash password"})
 	}
 
+	ctx := context.Background()
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Registrasi gagal: " + err.Error()})
+	}
+	defer tx.Rollback(ctx)
+
 	var user models.User
 	query := `
 		INSERT INTO users (username, full_name, password_hash, role)
 		VALUES ($1, $2, $3, 'USER')
 		RETURNING id, username, full_name, balance_rdn, role, created_at, updated_at
 	`
-	err = config.DB.QueryRow(context.Background(), query, req.Username, req.FullName, string(hashedPassword)).
+	err = tx.QueryRow(ctx, query, req.Username, req.FullName, string(hashedPassword)).
 		Scan(&user.ID, &user.Username, &user.FullName, &user.BalanceRDN, &user.Role, &user.CreatedAt, &user.UpdatedAt)
 
 	if err != nil {
@@ -61,6 +69,14 @@ func Register(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Registrasi gagal: " + err.Error()})
 	}
 
+	// Starting balance from the column default
+	if err := ledger.OpenAccount(ctx, tx, user.ID, user.BalanceRDN); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Registrasi gagal: " + err.Error()})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Registrasi gagal: " + err.Error()})
+	}
+
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"message": "User registered",
 		"user":    user,
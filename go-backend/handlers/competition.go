@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"strconv"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetCompetitions lists every competition, newest first
+func GetCompetitions(c *fiber.Ctx) error {
+	items, err := services.GlobalCompetitionService.List(context.Background())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil kompetisi"})
+	}
+	return c.JSON(items)
+}
+
+// GetLeaderboard ranks the participants of a competition (the running one by default)
+func GetLeaderboard(c *fiber.Ctx) error {
+	ctx := context.Background()
+
+	var comp *services.Competition
+	var err error
+	if id := c.QueryInt("competition_id"); id > 0 {
+		comp, err = services.GlobalCompetitionService.Get(ctx, id)
+	} else {
+		comp, err = services.GlobalCompetitionService.Current(ctx)
+	}
+	if err == services.ErrCompetitionNotFound || err == services.ErrNoCompetition {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var exclude *bool
+	if v := c.Query("exclude_system"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "exclude_system harus true atau false"})
+		}
+		exclude = &b
+	}
+
+	lb, err := services.GlobalCompetitionService.Leaderboard(ctx, comp, exclude)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(lb)
+}
+
+// GetCompetitionHistory returns the per-session equity snapshots of a competition
+func GetCompetitionHistory(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "ID tidak valid"})
+	}
+	ctx := context.Background()
+	if _, err := services.GlobalCompetitionService.Get(ctx, id); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	rows, err := services.GlobalCompetitionService.History(ctx, id, c.Query("user_id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(rows)
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type ConditionalOrderRequest struct {
+	Symbol       string   `json:"symbol"`
+	Kind         string   `json:"kind"` // STOP_MARKET, STOP_LIMIT, TAKE_PROFIT
+	Type         string   `json:"type"` // BUY, SELL
+	TriggerPrice float64  `json:"trigger_price"`
+	LimitPrice   *float64 `json:"limit_price"`
+	Quantity     int64    `json:"quantity"`
+	TimeInForce  string   `json:"time_in_force"` // DAY (default) or GTC, for the limit order placed on trigger
+}
+
+func PlaceConditionalOrder(c *fiber.Ctx) error {
+	var req ConditionalOrderRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	userId := c.Locals("userId").(string)
+
+	co, err := services.GlobalConditionalService.Create(userId, req.Symbol, req.Kind, req.Type, req.TriggerPrice, req.LimitPrice, req.Quantity, req.TimeInForce)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Order bersyarat berhasil dibuat",
+		"order":   co,
+	})
+}
+
+func GetConditionalOrders(c *fiber.Ctx) error {
+	userId := c.Locals("userId").(string)
+
+	items, err := services.GlobalConditionalService.List(userId)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil order bersyarat"})
+	}
+
+	return c.JSON(items)
+}
+
+func CancelConditionalOrder(c *fiber.Ctx) error {
+	userId := c.Locals("userId").(string)
+
+	if err := services.GlobalConditionalService.Cancel(userId, c.Params("id")); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"message": "Order bersyarat berhasil dibatalkan"})
+}
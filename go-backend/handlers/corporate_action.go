@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetCorporateActions lists applied splits and bonus issues (?symbol=)
+func GetCorporateActions(c *fiber.Ctx) error {
+	items, err := services.GlobalCorporateActionService.List(context.Background(), c.Query("symbol"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil data corporate action"})
+	}
+	return c.JSON(items)
+}
+
+// GetMyCorporateActions returns how corporate actions changed the user's holdings
+func GetMyCorporateActions(c *fiber.Ctx) error {
+	items, err := services.GlobalCorporateActionService.Holders(context.Background(), "", c.Locals("userId").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil riwayat corporate action"})
+	}
+	for i := range items {
+		items[i].Username = ""
+	}
+	return c.JSON(items)
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetDividends lists announced and past dividends (?symbol=&status=)
+func GetDividends(c *fiber.Ctx) error {
+	items, err := services.GlobalDividendService.List(context.Background(), c.Query("symbol"), c.Query("status"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil data dividen"})
+	}
+	return c.JSON(items)
+}
+
+// GetDividendHistory returns the user's dividend entitlements and payments
+func GetDividendHistory(c *fiber.Ctx) error {
+	userId := c.Locals("userId").(string)
+
+	items, err := services.GlobalDividendService.Allocations(context.Background(), "", userId)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil riwayat dividen"})
+	}
+	var received float64
+	for i := range items {
+		items[i].Username = ""
+		if items[i].PaidAt != nil {
+			received += items[i].NetAmount
+		}
+	}
+	return c.JSON(fiber.Map{
+		"total_received": received,
+		"dividends":      items,
+	})
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetIPOs lists offerings (?status=)
+func GetIPOs(c *fiber.Ctx) error {
+	items, err := services.GlobalIPOService.List(context.Background(), c.Query("status"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil data IPO"})
+	}
+	return c.JSON(items)
+}
+
+// GetIPO returns an offering with the user's own subscription
+func GetIPO(c *fiber.Ctx) error {
+	ctx := context.Background()
+	ipo, err := services.GlobalIPOService.Get(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	subs, err := services.GlobalIPOService.Subscriptions(ctx, ipo.ID, c.Locals("userId").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	var mine *services.IPOSubscription
+	if len(subs) > 0 {
+		mine = &subs[0]
+		mine.Username = ""
+	}
+	return c.JSON(fiber.Map{"ipo": ipo, "subscription": mine})
+}
+
+// SubscribeIPO books lots of an offering, or changes the booking
+func SubscribeIPO(c *fiber.Ctx) error {
+	var req struct {
+		Quantity int64 `json:"quantity"` // lots
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	sub, err := services.GlobalIPOService.Subscribe(context.Background(), c.Locals("userId").(string), c.Params("id"), req.Quantity)
+	if err == services.ErrIPONotFound {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	sub.Username = ""
+	return c.JSON(fiber.Map{"message": "Pemesanan IPO berhasil", "subscription": sub})
+}
+
+// CancelIPOSubscription withdraws the user's booking while the offering is open
+func CancelIPOSubscription(c *fiber.Ctx) error {
+	err := services.GlobalIPOService.Unsubscribe(context.Background(), c.Locals("userId").(string), c.Params("id"))
+	if err == services.ErrIPONotFound {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Pemesanan IPO berhasil dibatalkan"})
+}
+
+// GetMyIPOSubscriptions returns the user's bookings and allotments
+func GetMyIPOSubscriptions(c *fiber.Ctx) error {
+	items, err := services.GlobalIPOService.Subscriptions(context.Background(), "", c.Locals("userId").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil pemesanan IPO"})
+	}
+	for i := range items {
+		items[i].Username = ""
+	}
+	return c.JSON(items)
+}
@@ -2,16 +2,12 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"sort"
 
 	"mbit-backend-go/config"
 	"mbit-backend-go/core/engine"
-	"mbit-backend-go/models"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/redis/go-redis/v9"
 )
 
 // GetStocks returns list of all stocks
@@ -141,58 +137,10 @@ func GetOrderBook(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Symbol harus diisi"})
 	}
 
-	getDepth := func(side string) ([]map[string]interface{}, error) {
-		key := fmt.Sprintf("orderbook:%s:%s", symbol, side)
-		var results []redis.Z
-		var err error
-
-		if side == "buy" {
-			results, err = config.RedisMain.ZRevRangeWithScores(context.Background(), key, 0, 19).Result()
-		} else {
-			results, err = config.RedisMain.ZRangeWithScores(context.Background(), key, 0, 19).Result()
-		}
-
-		if err != nil {
-			return nil, err
-		}
-
-		// Aggregate by price to hide individual orders (Security & Frontend Req)
-		type AggregatedLevel struct {
-			Price    float64 `json:"price"`
-			TotalQty int64   `json:"totalQty"`
-			Count    int     `json:"count"`
-		}
-
-		// Actually, let's just loop and aggregate sequentially since Redis result is sorted.
-		var finalDepth []map[string]interface{}
-		if len(results) > 0 {
-			var current *AggregatedLevel
-
-			for _, z := range results {
-				var data models.RedisOrderData
-				str, ok := z.Member.(string)
-				if !ok { continue }
-				if err := json.Unmarshal([]byte(str), &data); err != nil || data.RemainingQuantity <= 0 { continue }
-
-				if current == nil || current.Price != z.Score {
-					if current != nil {
-						finalDepth = append(finalDepth, map[string]interface{}{"price": current.Price, "totalQty": current.TotalQty, "count": current.Count})
-					}
-					current = &AggregatedLevel{Price: z.Score, TotalQty: 0, Count: 0}
-				}
-				current.TotalQty += data.RemainingQuantity
-				current.Count++
-			}
-			if current != nil {
-				finalDepth = append(finalDepth, map[string]interface{}{"price": current.Price, "totalQty": current.TotalQty, "count": current.Count})
-			}
-		}
-
-		return finalDepth, nil
-	}
-
-	buyDepth, _ := getDepth("buy")
-	sellDepth, _ := getDepth("sell")
+	// Aggregated by price to hide individual orders (Security & Frontend Req)
+	book := engine.Engine.Book(symbol)
+	buyDepth := book.Depth(engine.SideBuy, 20)
+	sellDepth := book.Depth(engine.SideSell, 20)
 
 	return c.JSON(fiber.Map{
 		"symbol": symbol,
@@ -367,31 +315,24 @@ func GetOrderQueue(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Price parameter required"})
 	}
 
-	ctx := context.Background()
-
-	// Check Buy
-	buyRes, _ := config.RedisMain.ZRangeByScore(ctx, "orderbook:"+symbol+":buy", &redis.ZRangeBy{
-		Min: fmt.Sprintf("%f", price),
-		Max: fmt.Sprintf("%f", price),
-	}).Result()
-
-	// Check Sell
-	sellRes, _ := config.RedisMain.ZRangeByScore(ctx, "orderbook:"+symbol+":sell", &redis.ZRangeBy{
-		Min: fmt.Sprintf("%f", price),
-		Max: fmt.Sprintf("%f", price),
-	}).Result()
+	book := engine.Engine.Book(symbol)
 
 	var queue []map[string]interface{}
 
-	parse := func(strs []string, side string) {
-		for _, s := range strs {
-			var data models.RedisOrderData
-			if err := json.Unmarshal([]byte(s), &data); err == nil && data.RemainingQuantity > 0 {
+	parse := func(orders []engine.ParsedOrder, side string) {
+		for _, o := range orders {
+			data := o.Data
+			if data.RemainingQuantity > 0 {
+				// Iceberg orders only reveal their current slice
+				quantity := data.Quantity
+				if data.DisplayQuantity > 0 {
+					quantity = data.DisplayQuantity
+				}
 				queue = append(queue, map[string]interface{}{
 					"orderId": data.OrderId,
 					"userId": data.UserId,
-					"quantity": data.Quantity,
-					"remaining_quantity": data.RemainingQuantity,
+					"quantity": quantity,
+					"remaining_quantity": o.Visible(),
 					"timestamp": data.Timestamp,
 					"side": side,
 				})
@@ -399,8 +340,8 @@ func GetOrderQueue(c *fiber.Ctx) error {
 		}
 	}
 
-	parse(buyRes, "BUY")
-	parse(sellRes, "SELL")
+	parse(book.Queue(engine.SideBuy, price), "BUY")
+	parse(book.Queue(engine.SideSell, price), "SELL")
 
 	// Sort by timestamp ASC
 	sort.Slice(queue, func(i, j int) bool {
@@ -414,46 +355,28 @@ func GetOrderQueue(c *fiber.Ctx) error {
 	})
 }
 
-// GetIEP returns Indicative Equilibrium Price
+// GetIEP returns Indicative Equilibrium Price with the auction imbalance and curves
 func GetIEP(c *fiber.Ctx) error {
 	symbol := c.Params("symbol")
 
-	// Check session status
-	if engine.Engine.SessionStatus == engine.StatusOpen || engine.Engine.SessionStatus == engine.StatusClosed {
-		 return c.JSON(fiber.Map{
-			 "symbol": symbol,
-			 "iep": nil,
-			 "volume": 0,
-			 "surplus": 0,
-			 "status": engine.Engine.SessionStatus,
-		 })
-	}
-
-	iep, err := engine.GlobalIEPEngine.CalculateIEP(symbol)
-	if err != nil {
-		// Log error but return null iep
+	// Check session status; a symbol in its re-opening auction publishes its IEP too
+	h := engine.Engine.HaltOf(symbol)
+	reopening := engine.Engine.SessionStatus == engine.StatusOpen && h != nil && h.Phase == engine.HaltAuction
+	if !engine.IsCallAuction(engine.Engine.SessionStatus) && !reopening {
 		return c.JSON(fiber.Map{
-			"symbol": symbol,
-			"iep": nil,
-			"volume": 0,
+			"symbol":  symbol,
+			"iep":     nil,
+			"volume":  0,
 			"surplus": 0,
-			"status": engine.Engine.SessionStatus,
+			"status":  engine.Engine.SessionStatus,
 		})
 	}
 
-	res := fiber.Map{
-		"symbol": symbol,
-		"status": engine.Engine.SessionStatus,
-	}
-	if iep != nil {
-		res["iep"] = iep.Price
-		res["volume"] = iep.MatchedVolume
-		res["surplus"] = iep.Surplus
-	} else {
-		res["iep"] = nil
-		res["volume"] = 0
-		res["surplus"] = 0
+	iep, err := engine.GlobalIEPEngine.CalculateIEP(symbol)
+	if err != nil {
+		// Log error but return null iep
+		iep = nil
 	}
 
-	return c.JSON(res)
+	return c.JSON(engine.Engine.IEPPayload(symbol, iep))
 }
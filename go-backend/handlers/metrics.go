@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/subtle"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/metrics"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Metrics serves every registered metric in the Prometheus text format.
+// If METRICS_TOKEN is set, scrapers must send it as a Bearer token.
+func Metrics(c *fiber.Ctx) error {
+	if token := config.GetEnv("METRICS_TOKEN", ""); token != "" {
+		auth := c.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+	}
+
+	var buf bytes.Buffer
+	metrics.Default.WritePrometheus(&buf)
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	return c.Send(buf.Bytes())
+}
@@ -2,19 +2,24 @@ package handlers
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"mbit-backend-go/config"
+	"mbit-backend-go/core/fees"
 	"mbit-backend-go/services"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 type PlaceOrderRequest struct {
-	Symbol   string  `json:"symbol"`
-	Type     string  `json:"type"`
-	Price    float64 `json:"price"`
-	Quantity int64   `json:"quantity"`
+	Symbol          string  `json:"symbol"`
+	Type            string  `json:"type"`
+	PriceType       string  `json:"price_type"`       // LIMIT (default) or MARKET
+	TimeInForce     string  `json:"time_in_force"`    // DAY (default), GTC, IOC, FOK; MARKET defaults to IOC
+	Price           float64 `json:"price"`            // ignored for MARKET
+	Quantity        int64   `json:"quantity"`
+	DisplayQuantity int64   `json:"display_quantity"` // iceberg: lots shown at a time (LIMIT DAY/GTC only)
 }
 
 func PlaceOrder(c *fiber.Ctx) error {
@@ -25,14 +30,19 @@ func PlaceOrder(c *fiber.Ctx) error {
 
 	userId := c.Locals("userId").(string)
 
-	order, err := services.GlobalOrderService.PlaceOrder(userId, req.Symbol, req.Type, req.Price, req.Quantity)
+	order, err := services.GlobalOrderService.PlaceOrder(userId, req.Symbol, req.Type, req.PriceType, req.TimeInForce, req.Price, req.Quantity, req.DisplayQuantity)
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
 
 	return c.JSON(fiber.Map{
-		"message": "Order " + req.Type + " berhasil ditempatkan", // Match Node response
-		"orderId": order.ID,
+		"message":          "Order " + req.Type + " berhasil ditempatkan", // Match Node response
+		"orderId":          order.ID,
+		"price":            order.Price,
+		"price_type":       order.PriceType,
+		"time_in_force":    order.TimeInForce,
+		"display_quantity": order.DisplayQuantity,
+		"is_short":         order.IsShort,
 	})
 }
 
@@ -47,7 +57,39 @@ func CancelOrder(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"message": "Order berhasil dibatalkan"})
 }
 
-// GetOrderHistory returns all matched/canceled/rejected orders
+type AmendOrderRequest struct {
+	Price    float64 `json:"price"`    // new limit price, 0 keeps the current one
+	Quantity int64   `json:"quantity"` // new total quantity in lots, 0 keeps the current one
+}
+
+func AmendOrder(c *fiber.Ctx) error {
+	var req AmendOrderRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.Price < 0 || req.Quantity < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Harga dan jumlah tidak boleh negatif"})
+	}
+
+	userId := c.Locals("userId").(string)
+	orderId := c.Params("id")
+
+	order, err := services.GlobalOrderService.AmendOrder(userId, orderId, req.Price, req.Quantity)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":            "Order berhasil diubah",
+		"orderId":            order.ID,
+		"price":              order.Price,
+		"quantity":           order.Quantity,
+		"remaining_quantity": order.RemainingQty,
+	})
+}
+
+// GetOrderHistory returns all matched/canceled/rejected orders, plus conditional orders
+// that never placed one (ARMED, TRIGGERED, REJECTED or CANCELED)
 func GetOrderHistory(c *fiber.Ctx) error {
 	userId := c.Locals("userId").(string)
 
@@ -63,11 +105,84 @@ func GetOrderHistory(c *fiber.Ctx) error {
 			o.remaining_quantity,
 			o.status,
 			o.created_at,
-			o.avg_price_at_order
+			o.avg_price_at_order,
+			o.price_type,
+			o.time_in_force,
+			c.id,
+			c.kind,
+			o.display_quantity,
+			o.is_short,
+			COALESCE(stp.qty, 0),
+			COALESCE(f.gross, 0)::float8,
+			COALESCE(f.fee, 0)::float8,
+			COALESCE(f.net, 0)::float8,
+			r.pnl::float8,
+			c.status,
+			c.reject_reason,
+			c.trigger_price::float8
 		FROM orders o
 		JOIN stocks s ON o.stock_id = s.id
+		LEFT JOIN conditional_orders c ON c.order_id = o.id
+		LEFT JOIN (
+			SELECT order_id, SUM(gross) AS gross, SUM(fee) AS fee, SUM(net) AS net
+			FROM trade_fees
+			WHERE user_id = $1
+			GROUP BY order_id
+		) f ON f.order_id = o.id
+		LEFT JOIN (
+			SELECT order_id, SUM(pnl) AS pnl
+			FROM (
+				SELECT order_id, pnl FROM realized_pnl WHERE user_id = $1
+				UNION ALL
+				SELECT order_id, pnl FROM short_fills WHERE user_id = $1 AND kind = 'COVER'
+			) p
+			GROUP BY order_id
+		) r ON r.order_id = o.id
+		LEFT JOIN (
+			SELECT order_id, SUM(quantity) AS qty
+			FROM (
+				SELECT buy_order_id AS order_id, quantity FROM stp_events WHERE user_id = $1 AND buy_action = 'DECREMENTED'
+				UNION ALL
+				SELECT sell_order_id, quantity FROM stp_events WHERE user_id = $1 AND sell_action = 'DECREMENTED'
+			) d
+			GROUP BY order_id
+		) stp ON stp.order_id = o.id
 		WHERE o.user_id = $1
-		ORDER BY o.created_at DESC
+
+		UNION ALL
+
+		-- Conditional orders that never placed an order: ARMED, or TRIGGERED/REJECTED/CANCELED
+		SELECT
+			c.id,
+			s.symbol,
+			NULL,
+			c.type,
+			COALESCE(c.limit_price, 0),
+			COALESCE(c.limit_price, 0),
+			c.quantity,
+			c.quantity,
+			c.status,
+			c.created_at,
+			NULL,
+			CASE WHEN c.limit_price IS NULL THEN 'MARKET' ELSE 'LIMIT' END,
+			c.time_in_force,
+			c.id,
+			c.kind,
+			NULL,
+			false,
+			0,
+			0,
+			0,
+			0,
+			NULL,
+			c.status,
+			c.reject_reason,
+			c.trigger_price::float8
+		FROM conditional_orders c
+		JOIN stocks s ON c.stock_id = s.id
+		WHERE c.user_id = $1 AND c.order_id IS NULL
+
+		ORDER BY created_at DESC
 	`
 	rows, err := config.DB.Query(context.Background(), query, userId)
 	if err != nil {
@@ -87,6 +202,19 @@ func GetOrderHistory(c *fiber.Ctx) error {
 		RemainingQty     int64     `json:"remaining_quantity"`
 		MatchedQty       int64     `json:"matched_quantity"`
 		Status           string    `json:"status"`
+		PriceType        string    `json:"price_type"`
+		TimeInForce      string    `json:"time_in_force"`
+		ConditionalID    *string   `json:"conditional_id,omitempty"`   // set if placed by a triggered conditional order
+		ConditionalKind  *string   `json:"conditional_kind,omitempty"`
+		ConditionalState *string   `json:"conditional_status,omitempty"` // ARMED, TRIGGERED, PLACED, REJECTED or CANCELED
+		RejectReason     *string   `json:"reject_reason,omitempty"`
+		TriggerPrice     *float64  `json:"trigger_price,omitempty"`
+		DisplayQuantity  *int64    `json:"display_quantity,omitempty"` // iceberg orders
+		IsShort          bool      `json:"is_short"`
+		STPReducedQty    int64     `json:"stp_reduced_quantity"` // taken off by self-trade prevention (DECREMENT)
+		GrossAmount      float64   `json:"gross_amount"`               // traded value of the filled lots
+		FeeAmount        float64   `json:"fee_amount"`
+		NetAmount        float64   `json:"net_amount"`                 // paid (BUY) or received (SELL)
 		CreatedAt        time.Time `json:"created_at"`
 		ProfitLoss       *float64  `json:"profit_loss,omitempty"`
 	}
@@ -94,16 +222,23 @@ func GetOrderHistory(c *fiber.Ctx) error {
 	var history []OrderHistoryItem
 	for rows.Next() {
 		var o OrderHistoryItem
-		var avgPrice *float64
+		var avgPrice, realized *float64
 		if err := rows.Scan(
 			&o.ID, &o.Symbol, &o.SessionID, &o.Type, &o.TargetPrice, &o.ExecutionPrice,
 			&o.Quantity, &o.RemainingQty, &o.Status, &o.CreatedAt, &avgPrice,
+			&o.PriceType, &o.TimeInForce, &o.ConditionalID, &o.ConditionalKind, &o.DisplayQuantity, &o.IsShort, &o.STPReducedQty,
+			&o.GrossAmount, &o.FeeAmount, &o.NetAmount, &realized,
+			&o.ConditionalState, &o.RejectReason, &o.TriggerPrice,
 		); err == nil {
 			o.Price = o.ExecutionPrice
-			o.MatchedQty = o.Quantity - o.RemainingQty
+			o.MatchedQty = o.Quantity - o.RemainingQty - o.STPReducedQty
 
-			// Calculate PnL for SELL orders
-			if o.Type == "SELL" && avgPrice != nil && o.MatchedQty > 0 {
+			// PnL of SELL orders: realized per fill at settlement, estimated from the
+			// order price for fills older than realized_pnl. BUY orders that covered a
+			// short position realize its PnL; short sales realize none until covered.
+			if realized != nil {
+				o.ProfitLoss = realized
+			} else if o.Type == "SELL" && !o.IsShort && avgPrice != nil && o.MatchedQty > 0 {
 				pl := (o.ExecutionPrice - *avgPrice) * float64(o.MatchedQty) * 100 // 100 shares/lot
 				o.ProfitLoss = &pl
 			}
@@ -129,9 +264,23 @@ func GetActiveOrders(c *fiber.Ctx) error {
 			o.quantity,
 			o.remaining_quantity,
 			o.status,
-			o.created_at
+			o.created_at,
+			o.price_type,
+			o.time_in_force,
+			o.display_quantity,
+			o.is_short,
+			COALESCE(stp.qty, 0)
 		FROM orders o
 		JOIN stocks s ON o.stock_id = s.id
+		LEFT JOIN (
+			SELECT order_id, SUM(quantity) AS qty
+			FROM (
+				SELECT buy_order_id AS order_id, quantity FROM stp_events WHERE user_id = $1 AND buy_action = 'DECREMENTED'
+				UNION ALL
+				SELECT sell_order_id, quantity FROM stp_events WHERE user_id = $1 AND sell_action = 'DECREMENTED'
+			) d
+			GROUP BY order_id
+		) stp ON stp.order_id = o.id
 		WHERE o.user_id = $1 AND o.status IN ('PENDING', 'PARTIAL')
 		ORDER BY o.created_at DESC
 	`
@@ -152,6 +301,11 @@ func GetActiveOrders(c *fiber.Ctx) error {
 		RemainingQty     int64     `json:"remaining_quantity"`
 		MatchedQty       int64     `json:"matched_quantity"`
 		Status           string    `json:"status"`
+		PriceType        string    `json:"price_type"`
+		TimeInForce      string    `json:"time_in_force"`
+		DisplayQuantity  *int64    `json:"display_quantity,omitempty"` // iceberg orders
+		IsShort          bool      `json:"is_short"`
+		STPReducedQty    int64     `json:"stp_reduced_quantity"` // taken off by self-trade prevention (DECREMENT)
 		CreatedAt        time.Time `json:"created_at"`
 		ExecutionPrice   float64   `json:"execution_price"` // For compatibility
 	}
@@ -162,12 +316,46 @@ func GetActiveOrders(c *fiber.Ctx) error {
 		if err := rows.Scan(
 			&o.ID, &o.Symbol, &o.SessionID, &o.Type, &o.TargetPrice, &o.Price,
 			&o.Quantity, &o.RemainingQty, &o.Status, &o.CreatedAt,
+			&o.PriceType, &o.TimeInForce, &o.DisplayQuantity, &o.IsShort, &o.STPReducedQty,
 		); err == nil {
 			o.ExecutionPrice = o.Price
-			o.MatchedQty = o.Quantity - o.RemainingQty
+			o.MatchedQty = o.Quantity - o.RemainingQty - o.STPReducedQty
 			active = append(active, o)
 		}
 	}
 
 	return c.JSON(active)
 }
+
+// GetOrderFees returns the fee rates the user's next BUY and SELL orders on a stock
+// would be charged
+func GetOrderFees(c *fiber.Ctx) error {
+	userId := c.Locals("userId").(string)
+	symbol := strings.ToUpper(c.Query("symbol"))
+	ctx := context.Background()
+
+	var stockId int
+	var tier string
+	err := config.DB.QueryRow(ctx, `
+		SELECT s.id, u.fee_tier FROM stocks s, users u WHERE s.symbol = $1 AND u.id = $2
+	`, symbol, userId).Scan(&stockId, &tier)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Saham tidak ditemukan"})
+	}
+
+	buy, err := fees.Resolve(ctx, config.DB, userId, stockId, "BUY")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	sell, err := fees.Resolve(ctx, config.DB, userId, stockId, "SELL")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"symbol": symbol,
+		"tier":   tier,
+		"buy":    buy,
+		"sell":   sell,
+	})
+}
@@ -2,9 +2,13 @@ package handlers
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"mbit-backend-go/config"
+	"mbit-backend-go/core/ledger"
 	"mbit-backend-go/models"
+	"mbit-backend-go/services"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
@@ -16,8 +20,8 @@ func GetPortfolio(c *fiber.Ctx) error {
 
 	// Fetch User Balance & Name
 	var fullName string
-	var balanceRdn float64
-	err := config.DB.QueryRow(context.Background(), "SELECT full_name, balance_rdn FROM users WHERE id = $1", userId).Scan(&fullName, &balanceRdn)
+	var balanceRdn, reservedRdn, marginDebt float64
+	err := config.DB.QueryRow(context.Background(), "SELECT full_name, balance_rdn, reserved_rdn, margin_debt FROM users WHERE id = $1", userId).Scan(&fullName, &balanceRdn, &reservedRdn, &marginDebt)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "User not found"})
 	}
@@ -28,11 +32,12 @@ func GetPortfolio(c *fiber.Ctx) error {
 			p.stock_id,
 			s.symbol,
 			p.quantity_owned,
+			p.locked_quantity,
 			p.avg_buy_price,
 			COALESCE(d.close_price, d.prev_close, 1000) as current_price
 		FROM portfolios p
 		JOIN stocks s ON p.stock_id = s.id
-		LEFT JOIN daily_stock_data d ON s.id = d.stock_id AND d.session_id = (SELECT id FROM trading_sessions WHERE status IN ('OPEN', 'LOCKED', 'PRE_OPEN') ORDER BY id DESC LIMIT 1)
+		LEFT JOIN daily_stock_data d ON s.id = d.stock_id AND d.session_id = (SELECT id FROM trading_sessions WHERE status IN ('OPEN', 'LOCKED', 'PRE_OPEN', 'BREAK', 'PRE_CLOSE') ORDER BY id DESC LIMIT 1)
 		WHERE p.user_id = $1 AND p.quantity_owned > 0
 	`
 
@@ -51,12 +56,15 @@ func GetPortfolio(c *fiber.Ctx) error {
 			&item.StockID,
 			&item.Symbol,
 			&item.Quantity,
+			&item.LockedQty,
 			&item.AveragePrice,
 			&item.CurrentPrice,
 		); err != nil {
 			continue
 		}
 
+		item.AvailableQty = item.Quantity - item.LockedQty
+
 		// Calculate Unrealized P/L: (Current Price - Avg Buy Price) * Lots * 100 (shares per lot)
 		item.UnrealizedPL = (item.CurrentPrice - item.AveragePrice) * float64(item.Quantity) * 100
 
@@ -67,9 +75,171 @@ func GetPortfolio(c *fiber.Ctx) error {
 		portfolio = []models.PortfolioItem{}
 	}
 
+	shorts, err := services.GlobalShortService.Positions(context.Background(), userId)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil portfolio"})
+	}
+	var collateral float64
+	for _, sp := range shorts {
+		collateral += sp.Collateral
+	}
+
 	return c.JSON(fiber.Map{
 		"full_name":   fullName,
-		"balance_rdn": balanceRdn,
-		"stocks":      portfolio,
+		"balance_rdn": balanceRdn, // available
+		"cash": fiber.Map{
+			"total":       balanceRdn + reservedRdn,
+			"available":   balanceRdn,
+			"reserved":    reservedRdn,
+			"collateral":  collateral, // held by short positions
+			"margin_debt": marginDebt, // unpaid margin call
+		},
+		"stocks": portfolio,
+		"shorts": shorts,
+	})
+}
+
+// GetLedger returns the user's ledger statement
+func GetLedger(c *fiber.Ctx) error {
+	return ledgerStatement(c, c.Locals("userId").(string))
+}
+
+// ledgerStatement lists a user's ledger entries, newest first, with the account
+// balance after each entry. Filters: account, symbol, reason, from/to (YYYY-MM-DD).
+func ledgerStatement(c *fiber.Ctx, userId string) error {
+	limit := c.QueryInt("limit", 100)
+	offset := c.QueryInt("offset", 0)
+
+	// The running balance is taken over all entries before filtering
+	query := `
+		SELECT id, journal_id, reason, ref_type, ref_id, memo, account, symbol, amount, balance_after, created_at
+		FROM (
+			SELECT e.id, e.journal_id, j.reason, COALESCE(j.ref_type, '') AS ref_type, COALESCE(j.ref_id, '') AS ref_id,
+				COALESCE(j.memo, '') AS memo, e.account, COALESCE(s.symbol, '') AS symbol, e.amount::float8 AS amount,
+				(SUM(e.amount) OVER (PARTITION BY e.account, e.stock_id ORDER BY e.id))::float8 AS balance_after,
+				j.created_at
+			FROM ledger_entries e
+			JOIN ledger_journals j ON j.id = e.journal_id
+			LEFT JOIN stocks s ON s.id = e.stock_id
+			WHERE e.user_id = $1
+		) x
+		WHERE 1=1
+	`
+	args := []interface{}{userId}
+	argCounter := 2
+
+	if account := c.Query("account"); account != "" {
+		query += fmt.Sprintf(" AND account = $%d", argCounter)
+		args = append(args, account)
+		argCounter++
+	}
+	if symbol := c.Query("symbol"); symbol != "" {
+		query += fmt.Sprintf(" AND symbol = $%d", argCounter)
+		args = append(args, symbol)
+		argCounter++
+	}
+	if reason := c.Query("reason"); reason != "" {
+		query += fmt.Sprintf(" AND reason = $%d", argCounter)
+		args = append(args, reason)
+		argCounter++
+	}
+	if from := c.Query("from"); from != "" {
+		if _, err := time.Parse("2006-01-02", from); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Format tanggal from harus YYYY-MM-DD"})
+		}
+		query += fmt.Sprintf(" AND created_at >= $%d::date", argCounter)
+		args = append(args, from)
+		argCounter++
+	}
+	if to := c.Query("to"); to != "" {
+		if _, err := time.Parse("2006-01-02", to); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Format tanggal to harus YYYY-MM-DD"})
+		}
+		query += fmt.Sprintf(" AND created_at < $%d::date + 1", argCounter)
+		args = append(args, to)
+		argCounter++
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", argCounter, argCounter+1)
+	args = append(args, limit, offset)
+
+	ctx := context.Background()
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil ledger"})
+	}
+	defer rows.Close()
+
+	type LedgerEntry struct {
+		ID           int64     `json:"id"`
+		JournalID    int64     `json:"journal_id"`
+		Reason       string    `json:"reason"`
+		RefType      string    `json:"ref_type"`
+		RefID        string    `json:"ref_id"`
+		Memo         string    `json:"memo"`
+		Account      string    `json:"account"`
+		Symbol       string    `json:"symbol,omitempty"`
+		Amount       float64   `json:"amount"`
+		BalanceAfter float64   `json:"balance_after"`
+		CreatedAt    time.Time `json:"created_at"`
+	}
+
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.ID, &e.JournalID, &e.Reason, &e.RefType, &e.RefID, &e.Memo, &e.Account, &e.Symbol, &e.Amount, &e.BalanceAfter, &e.CreatedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil ledger"})
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+
+	// Current balances as derived from the ledger
+	balances := fiber.Map{"cash": 0.0, "reserved": 0.0, "margin": 0.0, "debt": 0.0}
+	shares := map[string]int64{}
+	shorts := map[string]int64{}
+	rows, err = config.DB.Query(ctx, `
+		SELECT e.account, COALESCE(s.symbol, ''), SUM(e.amount)::float8
+		FROM ledger_entries e
+		LEFT JOIN stocks s ON s.id = e.stock_id
+		WHERE e.user_id = $1
+		GROUP BY e.account, s.symbol
+	`, userId)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil ledger"})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var account, symbol string
+		var amount float64
+		if err := rows.Scan(&account, &symbol, &amount); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil ledger"})
+		}
+		switch account {
+		case ledger.AccountCash:
+			balances["cash"] = amount
+		case ledger.AccountReserved:
+			balances["reserved"] = amount
+		case ledger.AccountShares:
+			if amount != 0 {
+				shares[symbol] = int64(amount)
+			}
+		case ledger.AccountMargin:
+			balances["margin"] = amount
+		case ledger.AccountDebt:
+			balances["debt"] = -amount
+		case ledger.AccountShort:
+			if amount != 0 {
+				shorts[symbol] = -int64(amount)
+			}
+		}
+	}
+	balances["shares"] = shares
+	balances["shorts"] = shorts
+
+	return c.JSON(fiber.Map{
+		"balances": balances,
+		"entries":  entries,
+		"limit":    limit,
+		"offset":   offset,
 	})
 }
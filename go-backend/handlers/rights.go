@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetRightsIssues lists rights issues (?symbol=&status=)
+func GetRightsIssues(c *fiber.Ctx) error {
+	items, err := services.GlobalRightsService.List(context.Background(), c.Query("symbol"), c.Query("status"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil data rights issue"})
+	}
+	return c.JSON(items)
+}
+
+// GetRightsIssue returns a rights issue with the user's own rights
+func GetRightsIssue(c *fiber.Ctx) error {
+	ctx := context.Background()
+	r, err := services.GlobalRightsService.Get(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	mine, err := services.GlobalRightsService.Entitlement(ctx, r.ID, c.Locals("userId").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if mine != nil {
+		mine.Username = ""
+	}
+	return c.JSON(fiber.Map{"rights_issue": r, "entitlement": mine})
+}
+
+// ExerciseRights converts lots of rights into new shares at the exercise price
+func ExerciseRights(c *fiber.Ctx) error {
+	var req struct {
+		Quantity int64 `json:"quantity"` // lots of rights
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	e, err := services.GlobalRightsService.Exercise(context.Background(), c.Locals("userId").(string), c.Params("id"), req.Quantity)
+	if err == services.ErrRightsNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if e != nil {
+		e.Username = ""
+	}
+	return c.JSON(fiber.Map{"message": "Exercise rights berhasil", "entitlement": e})
+}
+
+// GetMyRights returns the user's rights across issues
+func GetMyRights(c *fiber.Ctx) error {
+	items, err := services.GlobalRightsService.Entitlements(context.Background(), "", c.Locals("userId").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil data rights"})
+	}
+	for i := range items {
+		items[i].Username = ""
+	}
+	return c.JSON(items)
+}
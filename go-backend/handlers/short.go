@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+
+	"mbit-backend-go/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetShortSelling returns whether the user opted in to short selling and the margin rules
+func GetShortSelling(c *fiber.Ctx) error {
+	ctx := context.Background()
+	enabled, err := services.GlobalShortService.Enabled(ctx, c.Locals("userId").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	st, err := services.GlobalShortService.Settings(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"enabled": enabled, "settings": st})
+}
+
+// UpdateShortSelling opts the user in or out of short selling
+func UpdateShortSelling(c *fiber.Ctx) error {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Enabled == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := services.GlobalShortService.SetEnabled(context.Background(), c.Locals("userId").(string), *req.Enabled); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	msg := "Short selling berhasil dinonaktifkan"
+	if *req.Enabled {
+		msg = "Short selling berhasil diaktifkan"
+	}
+	return c.JSON(fiber.Map{"message": msg, "enabled": *req.Enabled})
+}
+
+// GetMyShortPositions returns the user's open short positions at the current price
+func GetMyShortPositions(c *fiber.Ctx) error {
+	positions, err := services.GlobalShortService.Positions(context.Background(), c.Locals("userId").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil posisi short"})
+	}
+	return c.JSON(positions)
+}
+
+// GetMyShortHistory returns the user's short sales, covers and buy-ins, newest first
+func GetMyShortHistory(c *fiber.Ctx) error {
+	fills, err := services.GlobalShortService.Fills(context.Background(), c.Locals("userId").(string))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil riwayat short"})
+	}
+	return c.JSON(fills)
+}
+
+// GetMyShortMarks returns the user's mark to market history (?session_id=)
+func GetMyShortMarks(c *fiber.Ctx) error {
+	marks, err := services.GlobalShortService.Marks(context.Background(), c.Locals("userId").(string), c.QueryInt("session_id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Gagal mengambil data mark to market"})
+	}
+	for i := range marks {
+		marks[i].Username = ""
+	}
+	return c.JSON(marks)
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetSTPMode returns the user's self-trade prevention mode
+func GetSTPMode(c *fiber.Ctx) error {
+	userId := c.Locals("userId").(string)
+
+	var mode string
+	err := config.DB.QueryRow(context.Background(), "SELECT COALESCE(stp_mode, $2) FROM users WHERE id = $1", userId, engine.STPCancelNewest).Scan(&mode)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"stp_mode": mode})
+}
+
+type UpdateSTPModeRequest struct {
+	Mode string `json:"stp_mode"` // CANCEL_NEWEST, CANCEL_OLDEST, CANCEL_BOTH, DECREMENT
+}
+
+// UpdateSTPMode sets the user's self-trade prevention mode.
+// Applies to the next self-match, including orders already resting.
+func UpdateSTPMode(c *fiber.Ctx) error {
+	var req UpdateSTPModeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if !engine.IsValidSTPMode(req.Mode) {
+		return c.Status(400).JSON(fiber.Map{"error": "Mode STP tidak valid (CANCEL_NEWEST/CANCEL_OLDEST/CANCEL_BOTH/DECREMENT)"})
+	}
+
+	userId := c.Locals("userId").(string)
+	if _, err := config.DB.Exec(context.Background(), "UPDATE users SET stp_mode = $1 WHERE id = $2", req.Mode, userId); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Mode STP berhasil diubah", "stp_mode": req.Mode})
+}
+
+// GetSTPEvents returns the user's prevented self-trades, newest first
+func GetSTPEvents(c *fiber.Ctx) error {
+	userId := c.Locals("userId").(string)
+
+	rows, err := config.DB.Query(context.Background(), `
+		SELECT e.id, s.symbol, e.mode, e.buy_order_id, e.sell_order_id, e.buy_action, e.sell_action, e.quantity, e.created_at
+		FROM stp_events e
+		JOIN stocks s ON e.stock_id = s.id
+		WHERE e.user_id = $1
+		ORDER BY e.created_at DESC
+		LIMIT 100
+	`, userId)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type STPEvent struct {
+		ID          int64     `json:"id"`
+		Symbol      string    `json:"symbol"`
+		Mode        string    `json:"mode"`
+		BuyOrderID  string    `json:"buy_order_id"`
+		SellOrderID string    `json:"sell_order_id"`
+		BuyAction   string    `json:"buy_action"`
+		SellAction  string    `json:"sell_action"`
+		Quantity    int64     `json:"quantity"`
+		CreatedAt   time.Time `json:"created_at"`
+	}
+
+	events := []STPEvent{}
+	for rows.Next() {
+		var ev STPEvent
+		if err := rows.Scan(&ev.ID, &ev.Symbol, &ev.Mode, &ev.BuyOrderID, &ev.SellOrderID, &ev.BuyAction, &ev.SellAction, &ev.Quantity, &ev.CreatedAt); err == nil {
+			events = append(events, ev)
+		}
+	}
+	return c.JSON(events)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -56,6 +57,20 @@ func main() {
 			}
 		})
 
+		// Admin dashboards receive operational alerts (e.g. orderbook integrity)
+		socket.On("join_admin", func(data ...any) {
+			if len(data) == 0 {
+				return
+			}
+			token, _ := data[0].(string)
+			claims, err := middleware.ParseToken(token)
+			if err != nil || claims["role"] != "ADMIN" {
+				socket.Emit("admin_error", map[string]interface{}{"error": "Admin access required"})
+				return
+			}
+			socket.Join(socketio.Room("admin"))
+		})
+
 		socket.On("disconnect", func(args ...any) {
 			log.Printf("🔌 Client disconnected: %s", socket.Id())
 		})
@@ -63,14 +78,26 @@ func main() {
 
 	// Initialize Matching Engine with IO
 	engine.InitEngine(io)
+	services.GlobalConditionalService.Start()
 
 	// Start Cron
 	c := cron.New()
 	c.AddFunc("*/1 * * * *", func() {
 		services.GlobalMarketService.GenerateOneMinuteCandles()
 	})
+	services.GlobalSessionService.Start(c)
+	services.GlobalCompetitionService.Start(c)
+
+	// Orderbook integrity check (report only unless ORDERBOOK_RECONCILE_REPAIR=true)
+	reconcileRepair := config.GetEnv("ORDERBOOK_RECONCILE_REPAIR", "false") == "true"
+	c.AddFunc("@every "+config.GetEnv("ORDERBOOK_RECONCILE_INTERVAL", "5m"), func() {
+		if _, err := engine.Engine.Reconcile(context.Background(), engine.ReconcileScheduled, reconcileRepair); err != nil {
+			log.Println("Orderbook reconcile failed:", err)
+		}
+	})
 	c.Start()
 	log.Println("⏰ Market Data Scheduler Started (every 1 minute)")
+	log.Println("⏰ Session Scheduler Started (every 5 seconds)")
 
 	// 3. Fiber App
 	app := fiber.New(fiber.Config{
@@ -102,6 +129,9 @@ func main() {
 		})
 	})
 
+	// Prometheus scrape endpoint
+	app.Get("/metrics", handlers.Metrics)
+
 	// Socket.IO Handler (Adapter for Fiber)
 	app.All("/socket.io/*", adaptor.HTTPHandler(io.ServeHandler(nil)))
 
@@ -122,6 +152,7 @@ func main() {
 	market.Get("/market/depth/:symbol", handlers.GetOrderBook) // Alias legacy
 	market.Get("/market/stocks/:symbol/orderbook", handlers.GetOrderBook) // Standard
 	market.Get("/session", handlers.GetSessionStatus) // Public Session Status
+	market.Get("/session/schedule", handlers.GetSessionSchedule)
 
 	// New Market Data Routes
 	market.Get("/market/candles/:symbol", handlers.GetCandles)
@@ -129,10 +160,36 @@ func main() {
 	market.Get("/market/daily-data/:symbol", handlers.GetDailyDataBySymbol)
 	market.Get("/market/queue/:symbol", handlers.GetOrderQueue)
 	market.Get("/market/iep/:symbol", handlers.GetIEP)
+	market.Get("/market/halts", handlers.GetTradingHalts)
 
 	// Protected Routes
 	protected := app.Group("/api", middleware.AuthMiddleware)
 	protected.Get("/portfolio", handlers.GetPortfolio) // /api/portfolio
+	protected.Get("/portfolio/ledger", handlers.GetLedger)
+	protected.Get("/portfolio/analytics", handlers.GetAnalytics)
+	protected.Get("/portfolio/dividends", handlers.GetDividendHistory)
+	protected.Get("/dividends", handlers.GetDividends)
+	protected.Get("/portfolio/corporate-actions", handlers.GetMyCorporateActions)
+	protected.Get("/corporate-actions", handlers.GetCorporateActions)
+	protected.Get("/portfolio/ipos", handlers.GetMyIPOSubscriptions)
+	protected.Get("/ipos", handlers.GetIPOs)
+	protected.Get("/ipos/:id", handlers.GetIPO)
+	protected.Post("/ipos/:id/subscribe", handlers.SubscribeIPO)
+	protected.Delete("/ipos/:id/subscribe", handlers.CancelIPOSubscription)
+	protected.Get("/portfolio/rights", handlers.GetMyRights)
+	protected.Get("/rights", handlers.GetRightsIssues)
+	protected.Get("/rights/:id", handlers.GetRightsIssue)
+	protected.Post("/rights/:id/exercise", handlers.ExerciseRights)
+	protected.Get("/short-selling", handlers.GetShortSelling)
+	protected.Put("/short-selling", handlers.UpdateShortSelling)
+	protected.Get("/portfolio/shorts", handlers.GetMyShortPositions)
+	protected.Get("/portfolio/shorts/history", handlers.GetMyShortHistory)
+	protected.Get("/portfolio/shorts/marks", handlers.GetMyShortMarks)
+
+	// Competition Routes
+	protected.Get("/leaderboard", handlers.GetLeaderboard)
+	protected.Get("/competitions", handlers.GetCompetitions)
+	protected.Get("/competitions/:id/history", handlers.GetCompetitionHistory)
 
 	// Watchlist Routes
 	protected.Get("/portfolio/watchlist", handlers.GetWatchlist)
@@ -141,8 +198,16 @@ func main() {
 
 	// Order Routes
 	orders := app.Group("/api/orders", middleware.AuthMiddleware, tradingLimiter)
+	orders.Post("/conditional", handlers.PlaceConditionalOrder)
+	orders.Get("/conditional", handlers.GetConditionalOrders)
+	orders.Delete("/conditional/:id", handlers.CancelConditionalOrder)
+	orders.Get("/stp-mode", handlers.GetSTPMode)
+	orders.Put("/stp-mode", handlers.UpdateSTPMode)
+	orders.Get("/stp-events", handlers.GetSTPEvents)
+	orders.Get("/fees", handlers.GetOrderFees)
 	orders.Post("/", handlers.PlaceOrder)
 	orders.Delete("/:id", handlers.CancelOrder)
+	orders.Patch("/:id", handlers.AmendOrder)
 	// New Order History Routes
 	orders.Get("/history", handlers.GetOrderHistory)
 	orders.Get("/active", handlers.GetActiveOrders)
@@ -151,6 +216,13 @@ func main() {
 	admin := app.Group("/api/admin", middleware.AuthMiddleware, middleware.AdminAuthMiddleware)
 	admin.Post("/session/open", handlers.OpenSession)
 	admin.Post("/session/close", handlers.CloseSession)
+	admin.Post("/session/phase", handlers.SetSessionPhase)
+	admin.Put("/session/auction-policy", handlers.SetAuctionPolicy)
+	admin.Get("/auctions", handlers.GetAuctionReports)
+	admin.Get("/auctions/:id", handlers.GetAuctionReport)
+	admin.Put("/session/schedule", handlers.UpdateSessionSchedule)
+	admin.Post("/session/holidays", handlers.AddMarketHoliday)
+	admin.Delete("/session/holidays/:date", handlers.RemoveMarketHoliday)
 	admin.Post("/init-session", handlers.InitSession)
 
 	// New Admin Stock Management
@@ -161,6 +233,31 @@ func main() {
 	// New Admin User Management
 	admin.Put("/users/:userId/balance", handlers.AdjustUserBalance)
 	admin.Put("/users/:userId/portfolio/:stockId", handlers.AdjustUserPortfolio)
+	admin.Get("/users/:userId/ledger", handlers.GetUserLedger)
+	admin.Get("/users/:userId/analytics", handlers.GetUserAnalytics)
+	admin.Get("/ledger/check", handlers.CheckLedger)
+	admin.Put("/users/:userId/fee-tier", handlers.SetUserFeeTier)
+	admin.Get("/fees", handlers.GetFeeSchedules)
+	admin.Put("/fees", handlers.UpsertFeeSchedule)
+	admin.Delete("/fees/:id", handlers.DeleteFeeSchedule)
+	admin.Post("/ipos", handlers.CreateIPO)
+	admin.Get("/ipos/:id", handlers.GetIPOSubscriptions)
+	admin.Delete("/ipos/:id", handlers.CancelIPO)
+	admin.Post("/corporate-actions", handlers.ApplyCorporateAction)
+	admin.Get("/corporate-actions/:id", handlers.GetCorporateActionHolders)
+	admin.Post("/rights", handlers.AnnounceRightsIssue)
+	admin.Get("/rights/:id", handlers.GetRightsEntitlements)
+	admin.Delete("/rights/:id", handlers.CancelRightsIssue)
+	admin.Get("/short-selling", handlers.GetShortSettings)
+	admin.Put("/short-selling", handlers.UpdateShortSettings)
+	admin.Get("/short-selling/marks", handlers.GetShortMarks)
+	admin.Post("/dividends", handlers.DeclareDividend)
+	admin.Get("/dividends/:id", handlers.GetDividendAllocations)
+	admin.Delete("/dividends/:id", handlers.CancelDividend)
+	admin.Post("/competitions", handlers.CreateCompetition)
+	admin.Delete("/competitions/:id", handlers.DeleteCompetition)
+	admin.Post("/competitions/:id/participants", handlers.AddCompetitionParticipants)
+	admin.Delete("/competitions/:id/participants/:userId", handlers.RemoveCompetitionParticipant)
 
 	// New Admin Inspection & Engine
 	admin.Get("/orders", handlers.GetAllOrders)
@@ -168,8 +265,17 @@ func main() {
 	admin.Get("/engine/stats", handlers.GetEngineStats)
 	admin.Get("/health", handlers.HealthCheck)
 	admin.Get("/orderbook/validate", handlers.ValidateOrderbook)
+	admin.Post("/orderbook/reconcile", handlers.ReconcileOrderbook)
+	admin.Get("/orderbook/reconcile/runs", handlers.GetReconcileRuns)
+	admin.Get("/orderbook/reconcile/runs/:id", handlers.GetReconcileRun)
 	admin.Post("/engine/reset-circuit", handlers.ResetCircuit)
+	admin.Get("/halts", handlers.GetHaltHistory)
+	admin.Post("/halts", handlers.HaltTrading)
+	admin.Post("/halts/resume", handlers.ResumeTrading)
+	admin.Get("/circuit-breaker", handlers.GetCircuitBreakerConfig)
+	admin.Put("/circuit-breaker", handlers.UpdateCircuitBreakerConfig)
 	admin.Post("/engine/force-broadcast", handlers.ForceBroadcast)
+	admin.Post("/engine/recover", handlers.RecoverOrderbook)
 
 	// Legacy endpoint compatibility for Admin Orderbook
 	admin.Get("/orderbook/:symbol", handlers.GetOrderBook)
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"strings"
 	"time"
 
@@ -23,7 +24,20 @@ func AuthMiddleware(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid Authorization Header Format"})
 	}
 
-	tokenStr := parts[1]
+	claims, err := ParseToken(parts[1])
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Set userId and role in locals
+	c.Locals("userId", claims["userId"])
+	c.Locals("role", claims["role"])
+
+	return c.Next()
+}
+
+// ParseToken validates a JWT and returns its claims
+func ParseToken(tokenStr string) (jwt.MapClaims, error) {
 	secret := config.GetEnv("JWT_SECRET", "rahasiakitabersama123") // Default fallback if not in env
 
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
@@ -34,19 +48,14 @@ func AuthMiddleware(c *fiber.Ctx) error {
 	})
 
 	if err != nil || !token.Valid {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or Expired Token"})
+		return nil, errors.New("Invalid or Expired Token")
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid Token Claims"})
+		return nil, errors.New("Invalid Token Claims")
 	}
-
-	// Set userId and role in locals
-	c.Locals("userId", claims["userId"])
-	c.Locals("role", claims["role"])
-
-	return c.Next()
+	return claims, nil
 }
 
 // AdminAuthMiddleware ensures the user has ADMIN role
@@ -44,6 +44,10 @@ type Order struct {
 	RemainingQty    int64     `json:"remaining_quantity" db:"remaining_quantity"`
 	Status          string    `json:"status" db:"status"`
 	AvgPriceAtOrder *float64  `json:"avg_price_at_order,omitempty" db:"avg_price_at_order"`
+	PriceType       string    `json:"price_type" db:"price_type"`       // LIMIT, MARKET
+	TimeInForce     string    `json:"time_in_force" db:"time_in_force"` // DAY, GTC, IOC, FOK
+	DisplayQuantity *int64    `json:"display_quantity,omitempty" db:"display_quantity"` // iceberg orders only
+	IsShort         bool      `json:"is_short" db:"is_short"` // SELL of borrowed lots
 	CreatedAt       time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt       time.Time `json:"updated_at" db:"updated_at"`
 }
@@ -65,6 +69,8 @@ type PortfolioItem struct {
 	StockID      int       `json:"stock_id" db:"stock_id"` // int
 	Symbol       string    `json:"symbol"`
 	Quantity     int64     `json:"quantity" db:"quantity_owned"`
+	LockedQty    int64     `json:"locked_quantity" db:"locked_quantity"` // in open SELL orders
+	AvailableQty int64     `json:"available_quantity"`
 	AveragePrice float64   `json:"average_price" db:"avg_buy_price"`
 	CurrentPrice float64   `json:"current_price"`
 	UnrealizedPL float64   `json:"unrealized_pl"`
@@ -80,6 +86,10 @@ type RedisOrderData struct {
 	Timestamp         int64   `json:"timestamp"` // ms timestamp
 	RemainingQuantity int64   `json:"remaining_quantity"`
 	AvgPriceAtOrder   *float64 `json:"avg_price_at_order,omitempty"`
+	PriceType         string   `json:"price_type,omitempty"`
+	TimeInForce       string   `json:"time_in_force,omitempty"`
+	DisplayQuantity   int64    `json:"display_quantity,omitempty"` // iceberg slice size, 0 = fully visible
+	VisibleQuantity   int64    `json:"visible_quantity,omitempty"` // current iceberg slice
 }
 
 // MarketSession represents session state
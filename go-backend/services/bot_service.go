@@ -2,7 +2,6 @@ package services
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"math"
@@ -10,10 +9,10 @@ import (
 	"time"
 
 	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
 	"mbit-backend-go/models"
 
 	"github.com/google/uuid"
-	"github.com/redis/go-redis/v9"
 )
 
 type BotService struct{}
@@ -159,15 +158,9 @@ func (s *BotService) PopulateOrderbook(symbol string, options BotOptions) (*Popu
 
 	// 3a. Count existing bot sell orders
 	totalBotSellLot := int64(0)
-	existingSellOrders, err := config.RedisMain.ZRange(ctx, "orderbook:"+symbol+":sell", 0, -1).Result()
-	if err == nil {
-		for _, orderStr := range existingSellOrders {
-			var order models.RedisOrderData
-			if json.Unmarshal([]byte(orderStr), &order) == nil {
-				if order.UserId == "SYSTEM_BOT" { // Simplified check
-					totalBotSellLot += order.RemainingQuantity
-				}
-			}
+	for _, order := range engine.Engine.Book(symbol).Orders(engine.SideSell) {
+		if order.Data.UserId == "SYSTEM_BOT" { // Simplified check
+			totalBotSellLot += order.Data.RemainingQuantity
 		}
 	}
 
@@ -255,9 +248,8 @@ func (s *BotService) PopulateOrderbook(symbol string, options BotOptions) (*Popu
 	}
 	SellLimitReached:
 
-	// 7. Insert to Redis
+	// 7. Insert to Book
 	inserted := 0
-	pipeline := config.RedisMain.Pipeline()
 
 	for _, order := range orders {
 		orderID := fmt.Sprintf("BOT-%s-%s", order.Type, uuid.New().String())
@@ -271,25 +263,11 @@ func (s *BotService) PopulateOrderbook(symbol string, options BotOptions) (*Popu
 			Timestamp:         timestamp + rand.Int63n(1000),
 		}
 
-		jsonData, _ := json.Marshal(redisData)
-		key := fmt.Sprintf("orderbook:%s:%s", symbol, func() string {
-			if order.Type == "BUY" { return "buy" }
-			return "sell"
-		}())
-
-		pipeline.ZAdd(ctx, key, redis.Z{Score: order.Price, Member: jsonData})
+		engine.Engine.AddOrder(symbol, engine.SideKey(order.Type), redisData)
 		inserted++
 	}
 
-	if inserted > 0 {
-		_, err = pipeline.Exec(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("redis pipeline error: %v", err)
-		}
-	}
-
-	// Update supply info for result
-	supplyInfo.CirculatingShares = supplyInfo.CirculatingShares // unchanged actually
+	// Supply info is unchanged by bot orders
 	// But we might want to return updated sell stats
 
 	// Create a new supply info for result that includes the bot sell lots info
@@ -349,32 +327,18 @@ func (s *BotService) ClearBotOrders(symbol string) (*ClearResult, error) {
 
 	if symbol != "" {
 		// Clear specific
-		pipeline := config.RedisMain.Pipeline()
 		removed := 0
+		book := engine.Engine.Book(symbol)
 
-		for _, side := range []string{"buy", "sell"} {
-			key := fmt.Sprintf("orderbook:%s:%s", symbol, side)
-			orders, err := config.RedisMain.ZRange(ctx, key, 0, -1).Result()
-			if err != nil { continue }
-
-			for _, orderStr := range orders {
-				var order models.RedisOrderData
-				if json.Unmarshal([]byte(orderStr), &order) == nil {
-					if order.UserId == "SYSTEM_BOT" {
-						pipeline.ZRem(ctx, key, orderStr)
-						removed++
-					}
+		for _, side := range []string{engine.SideBuy, engine.SideSell} {
+			for _, order := range book.Orders(side) {
+				if order.Data.UserId == "SYSTEM_BOT" {
+					engine.Engine.RemoveOrder(symbol, order.Data.OrderId)
+					removed++
 				}
 			}
 		}
 
-		if removed > 0 {
-			_, err := pipeline.Exec(ctx)
-			if err != nil {
-				return nil, err
-			}
-		}
-
 		return &ClearResult{
 			Success:       true,
 			Symbol:        symbol,
@@ -404,25 +368,20 @@ func (s *BotService) ClearBotOrders(symbol string) (*ClearResult, error) {
 }
 
 func (s *BotService) GetOrderbookStats(symbol string) (*OrderbookStats, error) {
-	ctx := context.Background()
-
-	buyOrders, err := config.RedisMain.ZRange(ctx, "orderbook:"+symbol+":buy", 0, -1).Result()
-	if err != nil { return nil, err }
-	sellOrders, err := config.RedisMain.ZRange(ctx, "orderbook:"+symbol+":sell", 0, -1).Result()
-	if err != nil { return nil, err }
+	book := engine.Engine.Book(symbol)
+	buyOrders := book.Orders(engine.SideBuy)
+	sellOrders := book.Orders(engine.SideSell)
 
 	stats := &OrderbookStats{Symbol: symbol}
 
-	process := func(orders []string, sideStats *OrderbookSideStats) {
-		for _, orderStr := range orders {
+	process := func(orders []engine.ParsedOrder, sideStats *OrderbookSideStats) {
+		for _, order := range orders {
 			sideStats.Total++
-			var order models.RedisOrderData
-			if json.Unmarshal([]byte(orderStr), &order) != nil { continue }
 
-			lot := order.RemainingQuantity
+			lot := order.Data.RemainingQuantity
 			sideStats.TotalLot += lot
 
-			if order.UserId == "SYSTEM_BOT" {
+			if order.Data.UserId == "SYSTEM_BOT" {
 				sideStats.Bot++
 				sideStats.BotLot += lot
 			} else {
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"log"
+	"math"
+
+	"mbit-backend-go/core/engine"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Closing price sources, in order of preference
+const (
+	CloseSourceAuction = "AUCTION" // closing call auction traded
+	CloseSourceVWAP    = "VWAP"    // VWAP of the last close_vwap_minutes of trades
+	CloseSourceLast    = "LAST"    // last trade of the session
+	CloseSourcePrev    = "PREV"    // no trades, previous close carried over
+)
+
+type ClosingPrice struct {
+	Symbol string  `json:"symbol"`
+	Open   float64 `json:"open"`
+	High   float64 `json:"high"`
+	Low    float64 `json:"low"`
+	Close  float64 `json:"close"`
+	Volume int64   `json:"volume"`
+	Source string  `json:"source"`
+}
+
+type CloseResult struct {
+	CanceledOrders int            `json:"canceledOrders"`
+	ClosingPrices  []ClosingPrice `json:"closingPrices"`
+}
+
+// settleClosingPrices writes open/high/low/close/volume of every stock of the session
+// into daily_stock_data. Must run in the closing transaction, after the closing auction.
+// A stock missing from auctions still closes at its auction price if the session has a
+// closing auction report that traded: a close retried after a rollback finds the book
+// already uncrossed.
+func settleClosingPrices(ctx context.Context, tx pgx.Tx, sessionId int, auctions map[string]*engine.IEPResult, vwapMinutes int) ([]ClosingPrice, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT s.symbol, d.prev_close,
+			MIN(t.price), MAX(t.price), COALESCE(SUM(t.quantity), 0),
+			(ARRAY_AGG(t.price ORDER BY t.executed_at, t.id))[1],
+			(ARRAY_AGG(t.price ORDER BY t.executed_at DESC, t.id DESC))[1],
+			SUM(t.price * t.quantity) FILTER (WHERE t.executed_at >= NOW() - make_interval(mins => $2))
+				/ NULLIF(SUM(t.quantity) FILTER (WHERE t.executed_at >= NOW() - make_interval(mins => $2)), 0),
+			ar.price
+		FROM daily_stock_data d
+		JOIN stocks s ON d.stock_id = s.id
+		JOIN trading_sessions ts ON d.session_id = ts.id
+		LEFT JOIN trades t ON t.stock_id = d.stock_id AND t.executed_at >= ts.started_at
+		LEFT JOIN LATERAL (
+			SELECT price FROM auction_reports
+			WHERE session_id = d.session_id AND stock_id = d.stock_id AND kind = $3 AND executed_volume > 0
+			ORDER BY id DESC LIMIT 1
+		) ar ON true
+		WHERE d.session_id = $1
+		GROUP BY s.symbol, d.prev_close, ar.price
+	`, sessionId, vwapMinutes, engine.AuctionClosing)
+	if err != nil {
+		return nil, err
+	}
+
+	var prices []ClosingPrice
+	for rows.Next() {
+		var cp ClosingPrice
+		var prevClose float64
+		var low, high, first, last, vwap, auction *float64
+		if err := rows.Scan(&cp.Symbol, &prevClose, &low, &high, &cp.Volume, &first, &last, &vwap, &auction); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		switch {
+		case auctions[cp.Symbol] != nil:
+			cp.Close, cp.Source = auctions[cp.Symbol].Price, CloseSourceAuction
+		case auction != nil:
+			cp.Close, cp.Source = *auction, CloseSourceAuction
+		case vwap != nil:
+			cp.Close, cp.Source = roundToTick(*vwap), CloseSourceVWAP
+		case last != nil:
+			cp.Close, cp.Source = *last, CloseSourceLast
+		default:
+			cp.Close, cp.Source = prevClose, CloseSourcePrev
+		}
+
+		cp.Open, cp.High, cp.Low = cp.Close, cp.Close, cp.Close
+		if first != nil {
+			cp.Open, cp.High, cp.Low = *first, *high, *low
+		}
+		prices = append(prices, cp)
+	}
+	rows.Close()
+
+	for _, cp := range prices {
+		_, err := tx.Exec(ctx, `
+			UPDATE daily_stock_data d
+			SET open_price = $3, high_price = $4, low_price = $5, close_price = $6, volume = $7, close_source = $8
+			FROM stocks s
+			WHERE d.stock_id = s.id AND s.symbol = $2 AND d.session_id = $1
+		`, sessionId, cp.Symbol, cp.Open, cp.High, cp.Low, cp.Close, cp.Volume, cp.Source)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("🔔 Close %s: %.2f (%s) O=%.2f H=%.2f L=%.2f V=%d", cp.Symbol, cp.Close, cp.Source, cp.Open, cp.High, cp.Low, cp.Volume)
+	}
+	return prices, nil
+}
+
+// tickSize is the price fraction for a price (see isValidTickSize)
+func tickSize(price float64) float64 {
+	switch {
+	case price < 200:
+		return 1
+	case price < 500:
+		return 2
+	case price < 2000:
+		return 5
+	case price < 5000:
+		return 10
+	}
+	return 25
+}
+
+// roundToTick rounds a computed price (e.g. a VWAP) to the nearest valid price
+func roundToTick(price float64) float64 {
+	tick := tickSize(price)
+	return math.Round(price/tick) * tick
+}
@@ -0,0 +1,665 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/robfig/cron/v3"
+)
+
+// Trading competitions.
+// A competition runs from its start to its end session (by session_number). When a
+// session closes, every running competition snapshots its participants' equity: RDN
+// (available and reserved) plus holdings marked at the session's close_price. Each
+// participant's baseline equity is recorded when the start session opens, or when they
+// join a running competition. The leaderboard ranks participants by return on their
+// baseline, live while the competition runs and from the last snapshot once it is
+// finished. The initial capital is informational only.
+
+// Competition statuses, derived from the sessions
+const (
+	CompetitionUpcoming = "UPCOMING"
+	CompetitionActive   = "ACTIVE"
+	CompetitionFinished = "FINISHED"
+)
+
+var (
+	ErrCompetitionNotFound = errors.New("Kompetisi tidak ditemukan")
+	ErrCompetitionFinished = errors.New("Kompetisi sudah selesai")
+	ErrNoCompetition       = errors.New("Belum ada kompetisi")
+)
+
+type Competition struct {
+	ID             int       `json:"id"`
+	Name           string    `json:"name"`
+	StartSession   int       `json:"start_session"`
+	EndSession     int       `json:"end_session"`
+	InitialCapital float64   `json:"initial_capital"`
+	ExcludeSystem  bool      `json:"exclude_system"`
+	Status         string    `json:"status"`
+	Participants   int       `json:"participants"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Standing is one participant's place on the leaderboard
+type Standing struct {
+	Rank      int     `json:"rank"`
+	PrevRank  *int    `json:"prev_rank"` // rank at the previous snapshot
+	UserID    string  `json:"user_id"`
+	Username  string  `json:"username"`
+	FullName  string  `json:"full_name"`
+	Baseline  float64 `json:"baseline_equity"` // current equity until the competition starts
+	Cash      float64 `json:"cash"`
+	Holdings  float64 `json:"holdings"`
+	Equity    float64 `json:"equity"`
+	ReturnPct float64 `json:"return_pct"`
+
+	role string
+}
+
+type Leaderboard struct {
+	Competition   Competition `json:"competition"`
+	Live          bool        `json:"live"`           // current prices, not a session snapshot
+	SessionNumber *int        `json:"session_number"` // snapshot session when not live
+	Standings     []Standing  `json:"standings"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+// SnapshotRow is one participant's equity at the close of a session
+type SnapshotRow struct {
+	SessionNumber int     `json:"session_number"`
+	UserID        string  `json:"user_id"`
+	Username      string  `json:"username"`
+	Equity        float64 `json:"equity"`
+	ReturnPct     float64 `json:"return_pct"`
+	Rank          *int    `json:"rank"`
+}
+
+type CompetitionService struct{}
+
+var GlobalCompetitionService = &CompetitionService{}
+
+// Start broadcasts the live leaderboards every minute while the market is open
+func (s *CompetitionService) Start(c *cron.Cron) {
+	c.AddFunc("@every 1m", func() {
+		if engine.Engine.SessionStatus == engine.StatusOpen {
+			s.broadcastActive(context.Background())
+		}
+	})
+}
+
+// competitionSelect derives the status from the latest and the last closed session
+const competitionSelect = `
+	SELECT c.id, c.name, c.start_session, c.end_session, c.initial_capital::float8, c.exclude_system,
+		CASE
+			WHEN COALESCE(ts.last_closed, 0) >= c.end_session THEN 'FINISHED'
+			WHEN COALESCE(ts.latest, 0) >= c.start_session THEN 'ACTIVE'
+			ELSE 'UPCOMING'
+		END AS status,
+		(SELECT COUNT(*) FROM competition_participants p WHERE p.competition_id = c.id) AS participants,
+		c.created_at
+	FROM competitions c
+	CROSS JOIN (
+		SELECT MAX(session_number) AS latest, MAX(session_number) FILTER (WHERE status = 'CLOSED') AS last_closed
+		FROM trading_sessions
+	) ts
+`
+
+func scanCompetition(row pgx.Row) (*Competition, error) {
+	var c Competition
+	err := row.Scan(&c.ID, &c.Name, &c.StartSession, &c.EndSession, &c.InitialCapital, &c.ExcludeSystem, &c.Status, &c.Participants, &c.CreatedAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrCompetitionNotFound
+	}
+	return &c, err
+}
+
+func (s *CompetitionService) List(ctx context.Context) ([]Competition, error) {
+	rows, err := config.DB.Query(ctx, competitionSelect+" ORDER BY c.id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Competition{}
+	for rows.Next() {
+		c, err := scanCompetition(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *c)
+	}
+	return items, rows.Err()
+}
+
+func (s *CompetitionService) Get(ctx context.Context, id int) (*Competition, error) {
+	return scanCompetition(config.DB.QueryRow(ctx, competitionSelect+" WHERE c.id = $1", id))
+}
+
+// Current is the latest running competition, or the latest one if none runs
+func (s *CompetitionService) Current(ctx context.Context) (*Competition, error) {
+	c, err := scanCompetition(config.DB.QueryRow(ctx, "SELECT * FROM ("+competitionSelect+") x ORDER BY (x.status = 'ACTIVE') DESC, x.id DESC LIMIT 1"))
+	if err == ErrCompetitionNotFound {
+		return nil, ErrNoCompetition
+	}
+	return c, err
+}
+
+// Create adds a competition. It cannot start before the running (or next) session.
+func (s *CompetitionService) Create(ctx context.Context, adminId, name string, startSession, endSession int, initialCapital float64, excludeSystem bool) (*Competition, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("Nama kompetisi wajib diisi")
+	}
+	if initialCapital <= 0 {
+		return nil, errors.New("Modal awal harus lebih dari 0")
+	}
+	if endSession < startSession {
+		return nil, errors.New("Sesi akhir tidak boleh sebelum sesi awal")
+	}
+
+	var first int
+	err := config.DB.QueryRow(ctx, `
+		SELECT COALESCE(MAX(session_number) FILTER (WHERE status <> 'CLOSED'), MAX(session_number) + 1, 1)
+		FROM trading_sessions
+	`).Scan(&first)
+	if err != nil {
+		return nil, err
+	}
+	if startSession < first {
+		return nil, fmt.Errorf("Sesi awal paling cepat sesi %d", first)
+	}
+
+	var id int
+	err = config.DB.QueryRow(ctx, `
+		INSERT INTO competitions (name, start_session, end_session, initial_capital, exclude_system, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, name, startSession, endSession, initialCapital, excludeSystem, adminId).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+// Delete removes a competition with its participants and snapshots
+func (s *CompetitionService) Delete(ctx context.Context, id int) error {
+	tag, err := config.DB.Exec(ctx, "DELETE FROM competitions WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrCompetitionNotFound
+	}
+	return nil
+}
+
+// AddParticipants enrolls users, or every USER account with all. Returns how many joined.
+func (s *CompetitionService) AddParticipants(ctx context.Context, id int, userIds []string, all bool) (int64, error) {
+	c, err := s.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if c.Status == CompetitionFinished {
+		return 0, ErrCompetitionFinished
+	}
+
+	query := `
+		INSERT INTO competition_participants (competition_id, user_id)
+		SELECT $1, id FROM users WHERE id = ANY($2::uuid[])
+		ON CONFLICT DO NOTHING
+	`
+	args := []interface{}{id, userIds}
+	if all {
+		query = `
+			INSERT INTO competition_participants (competition_id, user_id)
+			SELECT $1, id FROM users WHERE role = 'USER'
+			ON CONFLICT DO NOTHING
+		`
+		args = args[:1]
+	} else if len(userIds) == 0 {
+		return 0, errors.New("user_ids wajib diisi")
+	}
+
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	// Late joiners start from their equity now
+	if c.Status == CompetitionActive {
+		var latest int
+		if err := tx.QueryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM trading_sessions").Scan(&latest); err != nil {
+			return 0, err
+		}
+		if err := recordBaselines(ctx, tx, c, latest); err != nil {
+			return 0, err
+		}
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
+
+// StartSession records the baseline equity of the participants of every competition
+// running in a session that is opening, at the previous close. Runs in the session
+// open transaction, after the session's daily data exists.
+func (s *CompetitionService) StartSession(ctx context.Context, tx pgx.Tx, sessionId, sessionNumber int) error {
+	rows, err := tx.Query(ctx, competitionSelect+" WHERE c.start_session <= $1 AND c.end_session >= $1", sessionNumber)
+	if err != nil {
+		return err
+	}
+	var running []*Competition
+	for rows.Next() {
+		c, err := scanCompetition(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		running = append(running, c)
+	}
+	rows.Close()
+
+	for _, c := range running {
+		if err := recordBaselines(ctx, tx, c, sessionId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordBaselines sets the baseline of the participants who have none to their equity
+// at the prices known up to sessionId
+func recordBaselines(ctx context.Context, tx pgx.Tx, c *Competition, sessionId int) error {
+	standings, err := equities(ctx, tx, c, sessionId)
+	if err != nil {
+		return err
+	}
+	for _, st := range standings {
+		_, err := tx.Exec(ctx, `
+			UPDATE competition_participants SET baseline_equity = $3
+			WHERE competition_id = $1 AND user_id = $2 AND baseline_equity IS NULL
+		`, c.ID, st.UserID, st.Equity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *CompetitionService) RemoveParticipant(ctx context.Context, id int, userId string) error {
+	tag, err := config.DB.Exec(ctx, "DELETE FROM competition_participants WHERE competition_id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.New("Peserta tidak ditemukan")
+	}
+	return nil
+}
+
+type rowsQuerier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// equities marks every participant's holdings at the latest price known up to sessionId
+// and computes their return on their baseline
+func equities(ctx context.Context, q rowsQuerier, c *Competition, sessionId int) ([]Standing, error) {
+	rows, err := q.Query(ctx, `
+		SELECT u.id::text, u.username, u.full_name, COALESCE(u.role, 'USER'), cp.baseline_equity::float8,
+			(COALESCE(u.balance_rdn, 0) + u.reserved_rdn - u.margin_debt)::float8,
+			(COALESCE(SUM(p.quantity_owned * 100 * px.price), 0) + (
+				-- short positions count at their collateral less the value of the lots owed
+				SELECT COALESCE(SUM(sp.collateral - sp.quantity * 100 * COALESCE(spx.price, sp.avg_short_price)), 0)
+				FROM short_positions sp
+				LEFT JOIN LATERAL (
+					SELECT COALESCE(d.close_price, d.prev_close) AS price
+					FROM daily_stock_data d
+					WHERE d.stock_id = sp.stock_id AND d.session_id <= $2
+					ORDER BY d.session_id DESC LIMIT 1
+				) spx ON true
+				WHERE sp.user_id = u.id AND (sp.quantity > 0 OR sp.collateral <> 0)
+			))::float8
+		FROM competition_participants cp
+		JOIN users u ON u.id = cp.user_id
+		LEFT JOIN portfolios p ON p.user_id = u.id AND p.quantity_owned > 0
+		LEFT JOIN LATERAL (
+			SELECT COALESCE(d.close_price, d.prev_close, 0) AS price
+			FROM daily_stock_data d
+			WHERE d.stock_id = p.stock_id AND d.session_id <= $2
+			ORDER BY d.session_id DESC LIMIT 1
+		) px ON true
+		WHERE cp.competition_id = $1
+		GROUP BY u.id, cp.baseline_equity
+	`, c.ID, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var standings []Standing
+	for rows.Next() {
+		var st Standing
+		var baseline *float64
+		if err := rows.Scan(&st.UserID, &st.Username, &st.FullName, &st.role, &baseline, &st.Cash, &st.Holdings); err != nil {
+			return nil, err
+		}
+		st.Equity = st.Cash + st.Holdings
+		st.Baseline = st.Equity
+		if baseline != nil {
+			st.Baseline = *baseline
+		}
+		if st.Baseline > 0 {
+			st.ReturnPct = round4((st.Equity - st.Baseline) / st.Baseline * 100)
+		}
+		standings = append(standings, st)
+	}
+	return standings, rows.Err()
+}
+
+// isSystemAccount is an admin or the market bot
+func isSystemAccount(username, role string) bool {
+	return role == "ADMIN" || username == "SYSTEM_BOT"
+}
+
+// rank sorts by return and numbers the standings; equal returns share a rank.
+// System accounts are dropped when excluded.
+func rank(standings []Standing, excludeSystem bool) []Standing {
+	ranked := []Standing{}
+	for _, st := range standings {
+		if excludeSystem && isSystemAccount(st.Username, st.role) {
+			continue
+		}
+		ranked = append(ranked, st)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].ReturnPct != ranked[j].ReturnPct {
+			return ranked[i].ReturnPct > ranked[j].ReturnPct
+		}
+		return ranked[i].Username < ranked[j].Username
+	})
+	for i := range ranked {
+		ranked[i].Rank = i + 1
+		if i > 0 && ranked[i].ReturnPct == ranked[i-1].ReturnPct {
+			ranked[i].Rank = ranked[i-1].Rank
+		}
+	}
+	return ranked
+}
+
+// Leaderboard ranks a competition's participants. excludeSystem nil uses the
+// competition's own setting.
+func (s *CompetitionService) Leaderboard(ctx context.Context, c *Competition, excludeSystem *bool) (*Leaderboard, error) {
+	exclude := c.ExcludeSystem
+	if excludeSystem != nil {
+		exclude = *excludeSystem
+	}
+
+	// The two latest snapshots: the finished standings and the ranks before them
+	var snapshots []int
+	rows, err := config.DB.Query(ctx, `
+		SELECT DISTINCT session_id FROM competition_snapshots
+		WHERE competition_id = $1 ORDER BY session_id DESC LIMIT 2
+	`, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		snapshots = append(snapshots, id)
+	}
+	rows.Close()
+
+	lb := &Leaderboard{Competition: *c, UpdatedAt: time.Now()}
+	var standings []Standing
+	var prevSession int
+	if c.Status == CompetitionFinished && len(snapshots) > 0 {
+		if standings, err = s.snapshot(ctx, c.ID, snapshots[0]); err != nil {
+			return nil, err
+		}
+		var number int
+		if err := config.DB.QueryRow(ctx, "SELECT session_number FROM trading_sessions WHERE id = $1", snapshots[0]).Scan(&number); err == nil {
+			lb.SessionNumber = &number
+		}
+		if len(snapshots) > 1 {
+			prevSession = snapshots[1]
+		}
+	} else {
+		var latest int
+		if err := config.DB.QueryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM trading_sessions").Scan(&latest); err != nil {
+			return nil, err
+		}
+		if standings, err = equities(ctx, config.DB, c, latest); err != nil {
+			return nil, err
+		}
+		lb.Live = true
+		if len(snapshots) > 0 {
+			prevSession = snapshots[0]
+		}
+	}
+	lb.Standings = rank(standings, exclude)
+
+	if prevSession != 0 {
+		prev, err := s.snapshot(ctx, c.ID, prevSession)
+		if err != nil {
+			return nil, err
+		}
+		prevRanks := map[string]int{}
+		for _, st := range rank(prev, exclude) {
+			prevRanks[st.UserID] = st.Rank
+		}
+		for i := range lb.Standings {
+			if r, ok := prevRanks[lb.Standings[i].UserID]; ok {
+				lb.Standings[i].PrevRank = &r
+			}
+		}
+	}
+	return lb, nil
+}
+
+// snapshot loads the stored standings of one session
+func (s *CompetitionService) snapshot(ctx context.Context, competitionId, sessionId int) ([]Standing, error) {
+	rows, err := config.DB.Query(ctx, `
+		SELECT u.id::text, u.username, u.full_name, COALESCE(u.role, 'USER'), COALESCE(cp.baseline_equity, cs.equity)::float8,
+			cs.cash::float8, cs.holdings::float8, cs.equity::float8, cs.return_pct::float8
+		FROM competition_snapshots cs
+		JOIN users u ON u.id = cs.user_id
+		LEFT JOIN competition_participants cp ON cp.competition_id = cs.competition_id AND cp.user_id = cs.user_id
+		WHERE cs.competition_id = $1 AND cs.session_id = $2
+	`, competitionId, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var standings []Standing
+	for rows.Next() {
+		var st Standing
+		if err := rows.Scan(&st.UserID, &st.Username, &st.FullName, &st.role, &st.Baseline, &st.Cash, &st.Holdings, &st.Equity, &st.ReturnPct); err != nil {
+			return nil, err
+		}
+		standings = append(standings, st)
+	}
+	return standings, rows.Err()
+}
+
+// History returns every snapshot of a competition, by session then rank
+func (s *CompetitionService) History(ctx context.Context, id int, userId string) ([]SnapshotRow, error) {
+	query := `
+		SELECT ts.session_number, u.id::text, u.username, cs.equity::float8, cs.return_pct::float8, cs.rank
+		FROM competition_snapshots cs
+		JOIN trading_sessions ts ON ts.id = cs.session_id
+		JOIN users u ON u.id = cs.user_id
+		WHERE cs.competition_id = $1
+	`
+	args := []interface{}{id}
+	if userId != "" {
+		query += " AND cs.user_id = $2"
+		args = append(args, userId)
+	}
+	query += " ORDER BY ts.session_number, cs.rank NULLS LAST, u.username"
+
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []SnapshotRow{}
+	for rows.Next() {
+		var r SnapshotRow
+		if err := rows.Scan(&r.SessionNumber, &r.UserID, &r.Username, &r.Equity, &r.ReturnPct, &r.Rank); err != nil {
+			return nil, err
+		}
+		items = append(items, r)
+	}
+	return items, rows.Err()
+}
+
+// SnapshotSession stores the equity of every competition running in a closed session
+// and broadcasts the new standings
+func (s *CompetitionService) SnapshotSession(ctx context.Context, sessionId int) error {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	running, err := snapshot(ctx, tx, sessionId, false)
+	if err != nil || len(running) == 0 {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	for _, c := range running {
+		// The status may have just become FINISHED
+		if c, err := s.Get(ctx, c.ID); err == nil {
+			s.broadcast(ctx, c)
+		}
+	}
+	log.Printf("🏆 Session %d: %d competition snapshot(s) stored", sessionId, len(running))
+	return nil
+}
+
+// BackfillSnapshots stores the snapshots a failed SnapshotSession left out of the last
+// closed session, inside the session open transaction. Nothing trades or settles between
+// a close and the next open, so the equities are the ones the close would have recorded.
+func (s *CompetitionService) BackfillSnapshots(ctx context.Context, tx pgx.Tx) error {
+	var sessionId int
+	err := tx.QueryRow(ctx, "SELECT id FROM trading_sessions WHERE status = 'CLOSED' ORDER BY id DESC LIMIT 1").Scan(&sessionId)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	filled, err := snapshot(ctx, tx, sessionId, true)
+	if err != nil {
+		return err
+	}
+	if len(filled) > 0 {
+		log.Printf("🏆 Session %d: %d missing competition snapshot(s) back-filled", sessionId, len(filled))
+	}
+	return nil
+}
+
+// snapshot stores the standings of every competition running in sessionId and returns
+// those competitions. missingOnly skips competitions that already have snapshots for it.
+func snapshot(ctx context.Context, tx pgx.Tx, sessionId int, missingOnly bool) ([]*Competition, error) {
+	rows, err := tx.Query(ctx, competitionSelect+`
+		WHERE c.start_session <= (SELECT session_number FROM trading_sessions WHERE id = $1)
+			AND c.end_session >= (SELECT session_number FROM trading_sessions WHERE id = $1)
+			AND NOT ($2 AND EXISTS (SELECT 1 FROM competition_snapshots cs WHERE cs.competition_id = c.id AND cs.session_id = $1))
+	`, sessionId, missingOnly)
+	if err != nil {
+		return nil, err
+	}
+	var running []*Competition
+	for rows.Next() {
+		c, err := scanCompetition(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		running = append(running, c)
+	}
+	rows.Close()
+
+	for _, c := range running {
+		standings, err := equities(ctx, tx, c, sessionId)
+		if err != nil {
+			return nil, err
+		}
+		ranks := map[string]int{}
+		for _, st := range rank(standings, c.ExcludeSystem) {
+			ranks[st.UserID] = st.Rank
+		}
+		for _, st := range standings {
+			var r *int
+			if v, ok := ranks[st.UserID]; ok {
+				r = &v
+			}
+			_, err := tx.Exec(ctx, `
+				INSERT INTO competition_snapshots (competition_id, session_id, user_id, cash, holdings, equity, return_pct, rank)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+				ON CONFLICT (competition_id, session_id, user_id) DO UPDATE SET
+					cash = EXCLUDED.cash, holdings = EXCLUDED.holdings, equity = EXCLUDED.equity,
+					return_pct = EXCLUDED.return_pct, rank = EXCLUDED.rank, created_at = NOW()
+			`, c.ID, sessionId, st.UserID, st.Cash, st.Holdings, st.Equity, st.ReturnPct, r)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return running, nil
+}
+
+// broadcastActive pushes the live standings of every running competition
+func (s *CompetitionService) broadcastActive(ctx context.Context) {
+	items, err := s.List(ctx)
+	if err != nil {
+		log.Println("Leaderboard broadcast error:", err)
+		return
+	}
+	for i := range items {
+		if items[i].Status == CompetitionActive {
+			s.broadcast(ctx, &items[i])
+		}
+	}
+}
+
+func (s *CompetitionService) broadcast(ctx context.Context, c *Competition) {
+	if engine.Engine.IoServer == nil {
+		return
+	}
+	lb, err := s.Leaderboard(ctx, c, nil)
+	if err != nil {
+		log.Println("Leaderboard broadcast error:", err)
+		return
+	}
+	engine.Engine.IoServer.Emit("leaderboard_update", lb)
+}
+
+func round4(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
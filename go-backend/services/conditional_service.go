@@ -0,0 +1,295 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+
+	"github.com/jackc/pgx/v5"
+	socketio "github.com/zishang520/socket.io/v2/socket"
+)
+
+// Conditional order kinds
+const (
+	CondStopMarket = "STOP_MARKET" // market order once the price falls to (SELL) / rises to (BUY) the trigger
+	CondStopLimit  = "STOP_LIMIT"  // same trigger as STOP_MARKET, places a limit order
+	CondTakeProfit = "TAKE_PROFIT" // market (or limit) order once the price rises to (SELL) / falls to (BUY) the trigger
+)
+
+// Conditional order statuses
+const (
+	CondArmed     = "ARMED"
+	CondTriggered = "TRIGGERED"
+	CondPlaced    = "PLACED"
+	CondRejected  = "REJECTED"
+	CondCanceled  = "CANCELED"
+)
+
+type ConditionalOrder struct {
+	ID             string     `json:"id"`
+	Symbol         string     `json:"symbol"`
+	Kind           string     `json:"kind"`
+	Type           string     `json:"type"`
+	TriggerPrice   float64    `json:"trigger_price"`
+	LimitPrice     *float64   `json:"limit_price"`
+	Quantity       int64      `json:"quantity"`
+	TimeInForce    string     `json:"time_in_force"`
+	Status         string     `json:"status"`
+	TriggeredPrice *float64   `json:"triggered_price"`
+	OrderID        *string    `json:"order_id"`
+	RejectReason   *string    `json:"reject_reason"`
+	CreatedAt      time.Time  `json:"created_at"`
+	TriggeredAt    *time.Time `json:"triggered_at"`
+}
+
+type ConditionalService struct{}
+
+var GlobalConditionalService = &ConditionalService{}
+
+// Start rejects the orders a previous run triggered but never placed, then subscribes
+// the service to settled trades
+func (s *ConditionalService) Start() {
+	s.rejectStranded(context.Background())
+	engine.Engine.OnTrade(s.onTrade)
+}
+
+// rejectStranded rejects TRIGGERED orders without an order: the process stopped between
+// the trigger and place. They are not placed again, as the order may have gone through
+// before the conditional row was updated, and the price has moved on since.
+func (s *ConditionalService) rejectStranded(ctx context.Context) {
+	rows, err := config.DB.Query(ctx, `
+		UPDATE conditional_orders c
+		SET status = 'REJECTED', reject_reason = $1, updated_at = NOW()
+		FROM stocks s
+		WHERE c.stock_id = s.id AND c.status = 'TRIGGERED' AND c.order_id IS NULL
+		RETURNING c.id, c.user_id, s.symbol, c.kind, c.type, c.trigger_price, c.limit_price, c.quantity, c.time_in_force,
+			c.status, c.triggered_price, c.reject_reason, c.created_at, c.triggered_at
+	`, "Server berhenti sebelum order ditempatkan")
+	if err != nil {
+		log.Println("Stranded conditional order check failed:", err)
+		return
+	}
+	type stranded struct {
+		userId string
+		co     ConditionalOrder
+	}
+	var rejected []stranded
+	for rows.Next() {
+		var t stranded
+		co := &t.co
+		if err := rows.Scan(&co.ID, &t.userId, &co.Symbol, &co.Kind, &co.Type, &co.TriggerPrice, &co.LimitPrice, &co.Quantity, &co.TimeInForce,
+			&co.Status, &co.TriggeredPrice, &co.RejectReason, &co.CreatedAt, &co.TriggeredAt); err != nil {
+			log.Println("Stranded conditional order scan failed:", err)
+			continue
+		}
+		rejected = append(rejected, t)
+	}
+	rows.Close()
+
+	for _, t := range rejected {
+		s.notify(t.userId, &t.co)
+	}
+	if len(rejected) > 0 {
+		log.Printf("⚠️ %d stranded conditional order(s) rejected", len(rejected))
+	}
+}
+
+func (s *ConditionalService) Create(userId string, symbol string, kind string, orderType string, triggerPrice float64, limitPrice *float64, quantity int64, timeInForce string) (*ConditionalOrder, error) {
+	switch kind {
+	case CondStopMarket, CondStopLimit, CondTakeProfit:
+	default:
+		return nil, errors.New("Jenis order tidak valid (STOP_MARKET/STOP_LIMIT/TAKE_PROFIT)")
+	}
+	if orderType != "BUY" && orderType != "SELL" {
+		return nil, errors.New("Invalid order type")
+	}
+	if triggerPrice <= 0 || quantity <= 0 {
+		return nil, errors.New("Harga trigger dan jumlah harus lebih dari 0")
+	}
+	if kind == CondStopLimit && limitPrice == nil {
+		return nil, errors.New("STOP_LIMIT membutuhkan limit_price")
+	}
+	if kind == CondStopMarket {
+		limitPrice = nil
+	}
+	if limitPrice != nil && !isValidTickSize(*limitPrice) {
+		return nil, errors.New("Harga tidak sesuai fraksi (Tick Size)")
+	}
+
+	// Market orders placed on trigger are always IOC; limit orders rest as DAY or GTC
+	if limitPrice == nil {
+		timeInForce = engine.TIFIOC
+	} else if timeInForce == "" {
+		timeInForce = engine.TIFDay
+	} else if timeInForce != engine.TIFDay && timeInForce != engine.TIFGTC {
+		return nil, errors.New("Time in force untuk order bersyarat hanya DAY atau GTC")
+	}
+
+	ctx := context.Background()
+	var stockId int
+	err := config.DB.QueryRow(ctx, "SELECT id FROM stocks WHERE symbol = $1 AND is_active = true", symbol).Scan(&stockId)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, errors.New("Saham tidak ditemukan")
+		}
+		return nil, err
+	}
+
+	co := ConditionalOrder{
+		Symbol: symbol, Kind: kind, Type: orderType, TriggerPrice: triggerPrice,
+		LimitPrice: limitPrice, Quantity: quantity, TimeInForce: timeInForce,
+	}
+	err = config.DB.QueryRow(ctx, `
+		INSERT INTO conditional_orders (user_id, stock_id, kind, type, trigger_price, limit_price, quantity, time_in_force)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, status, created_at
+	`, userId, stockId, kind, orderType, triggerPrice, limitPrice, quantity, timeInForce).Scan(&co.ID, &co.Status, &co.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	s.notify(userId, &co)
+	return &co, nil
+}
+
+func (s *ConditionalService) List(userId string) ([]ConditionalOrder, error) {
+	rows, err := config.DB.Query(context.Background(), `
+		SELECT c.id, s.symbol, c.kind, c.type, c.trigger_price, c.limit_price, c.quantity, c.time_in_force,
+			c.status, c.triggered_price, c.order_id, c.reject_reason, c.created_at, c.triggered_at
+		FROM conditional_orders c
+		JOIN stocks s ON c.stock_id = s.id
+		WHERE c.user_id = $1
+		ORDER BY c.created_at DESC
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ConditionalOrder{}
+	for rows.Next() {
+		var co ConditionalOrder
+		if err := rows.Scan(&co.ID, &co.Symbol, &co.Kind, &co.Type, &co.TriggerPrice, &co.LimitPrice, &co.Quantity, &co.TimeInForce,
+			&co.Status, &co.TriggeredPrice, &co.OrderID, &co.RejectReason, &co.CreatedAt, &co.TriggeredAt); err != nil {
+			continue
+		}
+		items = append(items, co)
+	}
+	return items, nil
+}
+
+func (s *ConditionalService) Cancel(userId string, id string) error {
+	ctx := context.Background()
+	var co ConditionalOrder
+	err := config.DB.QueryRow(ctx, `
+		UPDATE conditional_orders c
+		SET status = 'CANCELED', updated_at = NOW()
+		FROM stocks s
+		WHERE c.id = $1 AND c.user_id = $2 AND c.status = 'ARMED' AND c.stock_id = s.id
+		RETURNING c.id, s.symbol, c.kind, c.type, c.trigger_price, c.limit_price, c.quantity, c.time_in_force, c.status, c.created_at
+	`, id, userId).Scan(&co.ID, &co.Symbol, &co.Kind, &co.Type, &co.TriggerPrice, &co.LimitPrice, &co.Quantity, &co.TimeInForce, &co.Status, &co.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return errors.New("Order bersyarat tidak ditemukan atau sudah tidak aktif")
+		}
+		return err
+	}
+
+	s.notify(userId, &co)
+	return nil
+}
+
+// onTrade places every conditional order the last trade price has reached.
+// The ARMED -> TRIGGERED update is atomic, so concurrent trades trigger each order once.
+func (s *ConditionalService) onTrade(symbol string, price float64, qty int64) {
+	ctx := context.Background()
+	rows, err := config.DB.Query(ctx, `
+		UPDATE conditional_orders c
+		SET status = 'TRIGGERED', triggered_price = $2, triggered_at = NOW(), updated_at = NOW()
+		FROM stocks s
+		WHERE c.stock_id = s.id AND s.symbol = $1 AND c.status = 'ARMED' AND (
+			(c.kind IN ('STOP_MARKET', 'STOP_LIMIT') AND (
+				(c.type = 'SELL' AND $2 <= c.trigger_price) OR (c.type = 'BUY' AND $2 >= c.trigger_price)))
+			OR
+			(c.kind = 'TAKE_PROFIT' AND (
+				(c.type = 'SELL' AND $2 >= c.trigger_price) OR (c.type = 'BUY' AND $2 <= c.trigger_price)))
+		)
+		RETURNING c.id, c.user_id, c.kind, c.type, c.trigger_price, c.limit_price, c.quantity, c.time_in_force, c.created_at, c.triggered_at
+	`, symbol, price)
+	if err != nil {
+		log.Println("Conditional order evaluation failed:", err)
+		return
+	}
+
+	type triggered struct {
+		userId string
+		co     ConditionalOrder
+	}
+	var fired []triggered
+	var unread []string
+	for rows.Next() {
+		var t triggered
+		if err := rows.Scan(&t.co.ID, &t.userId, &t.co.Kind, &t.co.Type, &t.co.TriggerPrice, &t.co.LimitPrice, &t.co.Quantity, &t.co.TimeInForce, &t.co.CreatedAt, &t.co.TriggeredAt); err != nil {
+			log.Println("Triggered conditional order scan failed:", err)
+			if t.co.ID != "" {
+				unread = append(unread, t.co.ID)
+			}
+			continue
+		}
+		t.co.Symbol = symbol
+		t.co.Status = CondTriggered
+		t.co.TriggeredPrice = &price
+		fired = append(fired, t)
+	}
+	rows.Close()
+
+	// An order that could not be read is armed again for the next trade
+	for _, id := range unread {
+		_, err := config.DB.Exec(ctx, `
+			UPDATE conditional_orders SET status = 'ARMED', triggered_price = NULL, triggered_at = NULL, updated_at = NOW()
+			WHERE id = $1 AND status = 'TRIGGERED' AND order_id IS NULL
+		`, id)
+		if err != nil {
+			log.Println("Failed to re-arm conditional order:", err)
+		}
+	}
+
+	for _, t := range fired {
+		s.notify(t.userId, &t.co)
+		s.place(t.userId, &t.co)
+	}
+}
+
+func (s *ConditionalService) place(userId string, co *ConditionalOrder) {
+	priceType, price := engine.PriceTypeMarket, 0.0
+	if co.LimitPrice != nil {
+		priceType, price = engine.PriceTypeLimit, *co.LimitPrice
+	}
+
+	ctx := context.Background()
+	order, err := GlobalOrderService.PlaceOrder(userId, co.Symbol, co.Type, priceType, co.TimeInForce, price, co.Quantity, 0)
+	if err != nil {
+		reason := err.Error()
+		co.Status, co.RejectReason = CondRejected, &reason
+		_, err = config.DB.Exec(ctx, "UPDATE conditional_orders SET status = 'REJECTED', reject_reason = $1, updated_at = NOW() WHERE id = $2", reason, co.ID)
+	} else {
+		co.Status, co.OrderID = CondPlaced, &order.ID
+		_, err = config.DB.Exec(ctx, "UPDATE conditional_orders SET status = 'PLACED', order_id = $1, updated_at = NOW() WHERE id = $2", order.ID, co.ID)
+	}
+	if err != nil {
+		log.Println("Failed to update conditional order:", err)
+	}
+
+	s.notify(userId, co)
+}
+
+func (s *ConditionalService) notify(userId string, co *ConditionalOrder) {
+	if engine.Engine == nil || engine.Engine.IoServer == nil {
+		return
+	}
+	engine.Engine.IoServer.To(socketio.Room("user:"+userId)).Emit("conditional_order_update", co)
+}
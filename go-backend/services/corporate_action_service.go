@@ -0,0 +1,697 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+	"mbit-backend-go/core/fees"
+	"mbit-backend-go/core/ledger"
+
+	"github.com/jackc/pgx/v5"
+	socketio "github.com/zishang520/socket.io/v2/socket"
+)
+
+// Corporate actions: stock splits, reverse splits and bonus shares.
+// An action turns every ratio_old shares into ratio_new shares, so quantities are
+// multiplied and prices divided by factor = ratio_new / ratio_old. It is applied by an
+// admin while the market is closed, in one transaction: holdings (lots and average cost),
+// open orders and their reservations, armed conditional orders, max_shares, announced
+// dividends and the price history (candles, stock_candles and daily_stock_data are
+// back-adjusted). Shares that no longer make a whole lot are paid out in cash at the
+// adjusted last close. Trades keep the prices they executed at.
+
+// Corporate action types
+const (
+	ActionSplit        = "SPLIT"         // e.g. 1:2, every share becomes two
+	ActionReverseSplit = "REVERSE_SPLIT" // e.g. 5:1, five shares become one
+	ActionBonus        = "BONUS"         // ratio_new bonus shares for every ratio_old held
+)
+
+// maxActionRatio bounds both sides of a ratio
+const maxActionRatio = 1000
+
+var (
+	ErrCorporateActionNotFound = errors.New("Corporate action tidak ditemukan")
+	ErrCorporateActionMarket   = errors.New("Corporate action hanya bisa dijalankan saat pasar tutup")
+)
+
+type CorporateAction struct {
+	ID               string     `json:"id"`
+	Symbol           string     `json:"symbol"`
+	ActionType       string     `json:"action_type"`
+	RatioOld         int64      `json:"ratio_old"` // shares before ...
+	RatioNew         int64      `json:"ratio_new"` // ... and after, bonus shares included
+	Factor           float64    `json:"factor"`
+	EffectiveSession *int       `json:"effective_session"` // first session trading at the new prices
+	ReferencePrice   float64    `json:"reference_price"`   // last close before the action
+	AdjustedPrice    float64    `json:"adjusted_price"`    // the same close after it, on a valid tick
+	MaxSharesBefore  int64      `json:"max_shares_before"`
+	MaxSharesAfter   int64      `json:"max_shares_after"`
+	Holders          int        `json:"holders"`
+	LotsBefore       int64      `json:"lots_before"`
+	LotsAfter        int64      `json:"lots_after"`
+	CashInLieu       float64    `json:"cash_in_lieu"`
+	OrdersAdjusted   int        `json:"orders_adjusted"` // open and armed conditional orders
+	OrdersCanceled   int        `json:"orders_canceled"` // ... left with less than one lot
+	Memo             *string    `json:"memo"`
+	AppliedAt        *time.Time `json:"applied_at"`
+}
+
+// CorporateActionHolder is one holder's adjustment
+type CorporateActionHolder struct {
+	ActionID         string     `json:"action_id"`
+	UserID           string     `json:"user_id"`
+	Username         string     `json:"username,omitempty"`
+	Symbol           string     `json:"symbol"`
+	ActionType       string     `json:"action_type"`
+	QuantityBefore   int64      `json:"quantity_before"` // lots
+	QuantityAfter    int64      `json:"quantity_after"`
+	AvgPriceBefore   float64    `json:"avg_price_before"`
+	AvgPriceAfter    float64    `json:"avg_price_after"`
+	FractionalShares int64      `json:"fractional_shares"` // shares, not lots, paid out in cash
+	CashInLieu       float64    `json:"cash_in_lieu"`
+	AppliedAt        *time.Time `json:"applied_at"`
+}
+
+type CorporateActionParams struct {
+	Symbol     string
+	ActionType string
+	RatioOld   int64
+	RatioNew   int64 // for BONUS, the bonus shares per RatioOld held
+	Memo       string
+}
+
+// actionRatio rescales quantities and prices of one corporate action
+type actionRatio struct {
+	old, new int64
+}
+
+func (r actionRatio) factor() float64 {
+	return float64(r.new) / float64(r.old)
+}
+
+// lots is the whole lots that lots becomes, rounded down
+func (r actionRatio) lots(lots int64) int64 {
+	return lots * r.new / r.old
+}
+
+// shares splits a holding into whole lots and the shares left over
+func (r actionRatio) shares(lots int64) (int64, int64) {
+	shares := lots * 100 * r.new / r.old
+	return shares / 100, shares % 100
+}
+
+// orderPrice moves a limit price to the new scale without making the order more
+// aggressive: bids round down and offers round up to a valid tick
+func (r actionRatio) orderPrice(side string, price float64) float64 {
+	if price <= 0 {
+		return price
+	}
+	p := price / r.factor()
+	tick := tickSize(p)
+	if side == engine.SideBuy {
+		p = math.Floor(p/tick+1e-9) * tick
+	} else {
+		p = math.Ceil(p/tick-1e-9) * tick
+	}
+	return math.Max(p, 1)
+}
+
+// order rescales a resting order; false when less than one lot is left
+func (r actionRatio) order(side string, o engine.ParsedOrder) (engine.ParsedOrder, bool) {
+	d := &o.Data
+	d.RemainingQuantity = r.lots(d.RemainingQuantity)
+	if d.RemainingQuantity <= 0 {
+		return o, false
+	}
+	d.Quantity = r.lots(d.Quantity)
+	o.Price = r.orderPrice(side, o.Price)
+	d.Price = o.Price
+	if d.AvgPriceAtOrder != nil {
+		avg := round4(*d.AvgPriceAtOrder / r.factor())
+		d.AvgPriceAtOrder = &avg
+	}
+	if d.DisplayQuantity > 0 {
+		d.DisplayQuantity = max(r.lots(d.DisplayQuantity), 1)
+		if d.DisplayQuantity >= d.Quantity {
+			d.DisplayQuantity = 0
+		}
+		d.VisibleQuantity = 0 // the book deals a new slice
+	}
+	return o, true
+}
+
+type CorporateActionService struct{}
+
+var GlobalCorporateActionService = &CorporateActionService{}
+
+const corporateActionSelect = `
+	SELECT a.id::text, s.symbol, a.action_type, a.ratio_old, a.ratio_new, a.effective_session,
+		a.reference_price::float8, a.adjusted_price::float8, a.max_shares_before, a.max_shares_after,
+		a.holders, a.lots_before, a.lots_after, a.cash_in_lieu::float8, a.orders_adjusted, a.orders_canceled,
+		a.memo, a.applied_at
+	FROM corporate_actions a
+	JOIN stocks s ON s.id = a.stock_id
+`
+
+func scanCorporateAction(row pgx.Row) (*CorporateAction, error) {
+	var a CorporateAction
+	err := row.Scan(&a.ID, &a.Symbol, &a.ActionType, &a.RatioOld, &a.RatioNew, &a.EffectiveSession,
+		&a.ReferencePrice, &a.AdjustedPrice, &a.MaxSharesBefore, &a.MaxSharesAfter,
+		&a.Holders, &a.LotsBefore, &a.LotsAfter, &a.CashInLieu, &a.OrdersAdjusted, &a.OrdersCanceled,
+		&a.Memo, &a.AppliedAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrCorporateActionNotFound
+	}
+	a.Factor = round4(float64(a.RatioNew) / float64(a.RatioOld))
+	return &a, err
+}
+
+// List returns corporate actions, latest first, optionally of one symbol
+func (s *CorporateActionService) List(ctx context.Context, symbol string) ([]CorporateAction, error) {
+	query := corporateActionSelect
+	args := []interface{}{}
+	if symbol != "" {
+		query += " WHERE s.symbol = $1"
+		args = append(args, strings.ToUpper(symbol))
+	}
+	query += " ORDER BY a.applied_at DESC"
+
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []CorporateAction{}
+	for rows.Next() {
+		a, err := scanCorporateAction(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *a)
+	}
+	return items, rows.Err()
+}
+
+func (s *CorporateActionService) Get(ctx context.Context, id string) (*CorporateAction, error) {
+	return scanCorporateAction(config.DB.QueryRow(ctx, corporateActionSelect+" WHERE a.id::text = $1", id))
+}
+
+// Holders lists the adjustments of an action, or of a user when userId is set
+func (s *CorporateActionService) Holders(ctx context.Context, actionId, userId string) ([]CorporateActionHolder, error) {
+	query := `
+		SELECT h.action_id::text, h.user_id::text, u.username, s.symbol, a.action_type,
+			h.quantity_before, h.quantity_after, h.avg_price_before::float8, h.avg_price_after::float8,
+			h.fractional_shares, h.cash_in_lieu::float8, a.applied_at
+		FROM corporate_action_holders h
+		JOIN corporate_actions a ON a.id = h.action_id
+		JOIN stocks s ON s.id = a.stock_id
+		JOIN users u ON u.id = h.user_id
+		WHERE 1=1
+	`
+	args := []interface{}{}
+	argCounter := 1
+	if actionId != "" {
+		query += fmt.Sprintf(" AND h.action_id::text = $%d", argCounter)
+		args = append(args, actionId)
+		argCounter++
+	}
+	if userId != "" {
+		query += fmt.Sprintf(" AND h.user_id = $%d", argCounter)
+		args = append(args, userId)
+		argCounter++
+	}
+	query += " ORDER BY a.applied_at DESC, h.quantity_before DESC"
+
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []CorporateActionHolder{}
+	for rows.Next() {
+		var h CorporateActionHolder
+		if err := rows.Scan(&h.ActionID, &h.UserID, &h.Username, &h.Symbol, &h.ActionType,
+			&h.QuantityBefore, &h.QuantityAfter, &h.AvgPriceBefore, &h.AvgPriceAfter,
+			&h.FractionalShares, &h.CashInLieu, &h.AppliedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, h)
+	}
+	return items, rows.Err()
+}
+
+// Apply runs a corporate action on a stock. The market must be closed; the session
+// lock keeps it closed until the action is committed.
+func (s *CorporateActionService) Apply(ctx context.Context, adminId string, p CorporateActionParams) (*CorporateAction, error) {
+	p.Symbol = strings.ToUpper(strings.TrimSpace(p.Symbol))
+	p.ActionType = strings.ToUpper(strings.TrimSpace(p.ActionType))
+	if p.RatioOld <= 0 || p.RatioNew <= 0 || p.RatioOld > maxActionRatio || p.RatioNew > maxActionRatio {
+		return nil, fmt.Errorf("Rasio harus antara 1 dan %d", maxActionRatio)
+	}
+	switch p.ActionType {
+	case ActionSplit:
+		if p.RatioNew <= p.RatioOld {
+			return nil, errors.New("Rasio stock split harus menambah jumlah saham (mis. 1:2)")
+		}
+	case ActionReverseSplit:
+		if p.RatioNew >= p.RatioOld {
+			return nil, errors.New("Rasio reverse split harus mengurangi jumlah saham (mis. 5:1)")
+		}
+	case ActionBonus:
+		p.RatioNew += p.RatioOld
+	default:
+		return nil, errors.New("Jenis corporate action tidak valid (SPLIT/REVERSE_SPLIT/BONUS)")
+	}
+	g := gcd(p.RatioOld, p.RatioNew)
+	ratio := actionRatio{old: p.RatioOld / g, new: p.RatioNew / g}
+
+	GlobalSessionService.mu.Lock()
+	defer GlobalSessionService.mu.Unlock()
+
+	sess, err := GlobalSessionService.running(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if sess != nil {
+		return nil, ErrCorporateActionMarket
+	}
+
+	var stockId int
+	var maxShares int64
+	var inIPO, inRights, hasShorts bool
+	err = config.DB.QueryRow(ctx, `
+		SELECT s.id, COALESCE(s.max_shares, 0),
+			EXISTS (SELECT 1 FROM ipos WHERE stock_id = s.id AND status IN ('PENDING', 'OFFERING', 'ALLOTTED')),
+			EXISTS (SELECT 1 FROM rights_issues WHERE (stock_id = s.id OR rights_stock_id = s.id) AND status IN ('ANNOUNCED', 'RECORDED', 'EXERCISING')),
+			EXISTS (SELECT 1 FROM short_positions WHERE stock_id = s.id AND quantity > 0)
+				OR EXISTS (SELECT 1 FROM orders WHERE stock_id = s.id AND is_short AND status IN ('PENDING', 'PARTIAL'))
+		FROM stocks s WHERE s.symbol = $1
+	`, p.Symbol).Scan(&stockId, &maxShares, &inIPO, &inRights, &hasShorts)
+	if err == pgx.ErrNoRows {
+		return nil, errors.New("Saham tidak ditemukan")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if inIPO {
+		return nil, errors.New("Saham ini sedang dalam proses IPO")
+	}
+	if inRights {
+		return nil, errors.New("Saham ini sedang dalam proses rights issue")
+	}
+	// Borrowed lots are not rescaled
+	if hasShorts {
+		return nil, errors.New("Masih ada posisi atau order short untuk saham ini")
+	}
+
+	var id string
+	var canceled []engine.CanceledOrder
+	err = engine.Engine.WithSymbolLock(p.Symbol, func() error {
+		id, canceled, err = s.apply(ctx, adminId, stockId, maxShares, p, ratio)
+		if err != nil {
+			return err
+		}
+		// Nothing should rest while the market is closed, but keep Redis and memory in step
+		engine.Engine.RewriteBook(p.Symbol, ratio.order)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("🧩 %s %s %d:%d applied (%d holders, %d orders adjusted, %d canceled)",
+		a.ActionType, a.Symbol, a.RatioOld, a.RatioNew, a.Holders, a.OrdersAdjusted, a.OrdersCanceled)
+	s.notify(ctx, a, canceled)
+	return a, nil
+}
+
+// apply does the database side of an action in one transaction
+func (s *CorporateActionService) apply(ctx context.Context, adminId string, stockId int, maxShares int64, p CorporateActionParams, ratio actionRatio) (string, []engine.CanceledOrder, error) {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// 1. Reference price: the close the next session would open from
+	var lastDaily *int
+	var reference float64 = 1000
+	err = tx.QueryRow(ctx, "SELECT id, COALESCE(close_price, prev_close)::float8 FROM daily_stock_data WHERE stock_id = $1 ORDER BY session_id DESC LIMIT 1", stockId).Scan(&lastDaily, &reference)
+	if err == pgx.ErrNoRows {
+		err = tx.QueryRow(ctx, "SELECT close_price::float8 FROM candles WHERE stock_id = $1 ORDER BY timestamp DESC LIMIT 1", stockId).Scan(&reference)
+		if err == pgx.ErrNoRows {
+			reference, err = 1000, nil
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	adjusted := math.Max(roundToTick(reference/ratio.factor()), 1)
+
+	var id string
+	err = tx.QueryRow(ctx, `
+		INSERT INTO corporate_actions (stock_id, action_type, ratio_old, ratio_new, effective_session, reference_price, adjusted_price,
+			max_shares_before, max_shares_after, memo, applied_by)
+		VALUES ($1, $2, $3, $4, (SELECT COALESCE(MAX(session_number), 0) + 1 FROM trading_sessions), $5, $6, $7, $8, NULLIF($9, ''), $10)
+		RETURNING id::text
+	`, stockId, p.ActionType, ratio.old, ratio.new, reference, adjusted, maxShares, ratio.lots(maxShares), strings.TrimSpace(p.Memo), adminId).Scan(&id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 2. Holdings: whole lots stay, the shares left over are paid out
+	rows, err := tx.Query(ctx, `
+		SELECT user_id::text, quantity_owned, COALESCE(avg_buy_price, 0)::float8
+		FROM portfolios
+		WHERE stock_id = $1 AND quantity_owned > 0
+		FOR UPDATE
+	`, stockId)
+	if err != nil {
+		return "", nil, err
+	}
+	type holding struct {
+		userId string
+		lots   int64
+		avg    float64
+	}
+	var holdings []holding
+	for rows.Next() {
+		var h holding
+		if err := rows.Scan(&h.userId, &h.lots, &h.avg); err != nil {
+			rows.Close()
+			return "", nil, err
+		}
+		holdings = append(holdings, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+
+	j := ledger.New(ledger.ReasonCorporateAction, ledger.RefCorporateAction, id)
+	j.Memo = fmt.Sprintf("%s %s %d:%d", p.ActionType, p.Symbol, ratio.old, ratio.new)
+	var lotsBefore, lotsAfter int64
+	var cashInLieu float64
+	for _, h := range holdings {
+		lots, fraction := ratio.shares(h.lots)
+		avg := round4(h.avg / ratio.factor())
+		cash := round4(float64(fraction) * adjusted)
+
+		if _, err := tx.Exec(ctx, "UPDATE portfolios SET quantity_owned = $1, avg_buy_price = $2 WHERE user_id = $3 AND stock_id = $4",
+			lots, avg, h.userId, stockId); err != nil {
+			return "", nil, err
+		}
+		j.Shares(ledger.External, ledger.Shares(h.userId), stockId, lots-h.lots)
+		if cash > 0 {
+			if _, err := tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn + $1 WHERE id = $2", cash, h.userId); err != nil {
+				return "", nil, err
+			}
+			j.Cash(ledger.External, ledger.Cash(h.userId), cash)
+		}
+		_, err := tx.Exec(ctx, `
+			INSERT INTO corporate_action_holders (action_id, user_id, quantity_before, quantity_after, avg_price_before, avg_price_after, fractional_shares, cash_in_lieu)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`, id, h.userId, h.lots, lots, h.avg, avg, fraction, cash)
+		if err != nil {
+			return "", nil, err
+		}
+		lotsBefore += h.lots
+		lotsAfter += lots
+		cashInLieu += cash
+	}
+	if err := ledger.Post(ctx, tx, j); err != nil {
+		return "", nil, err
+	}
+
+	// 3. Open orders, with the same rescaling as the book. BUY orders release the part of
+	// their reservation the cheaper price no longer needs.
+	adjustedOrders, canceled, err := adjustOpenOrders(ctx, tx, stockId, ratio)
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE portfolios p SET locked_quantity = COALESCE((
+			SELECT SUM(o.remaining_quantity) FROM orders o
+			WHERE o.user_id = p.user_id AND o.stock_id = p.stock_id AND o.type = 'SELL' AND o.status IN ('PENDING', 'PARTIAL')
+		), 0)
+		WHERE p.stock_id = $1
+	`, stockId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	armed, disarmed, err := adjustConditionalOrders(ctx, tx, stockId, ratio)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 4. Supply and announced dividends, per share
+	if _, err := tx.Exec(ctx, "UPDATE stocks SET max_shares = $1 WHERE id = $2", ratio.lots(maxShares), stockId); err != nil {
+		return "", nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE dividends SET dividend_per_share = ROUND(dividend_per_share * $2::numeric / $3::numeric, 4)
+		WHERE stock_id = $1 AND status = 'ANNOUNCED'
+	`, stockId, ratio.old, ratio.new)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 5. Back-adjusted price history: prices divided and volumes multiplied by the factor
+	for _, q := range []string{
+		`UPDATE daily_stock_data SET
+			prev_close = ROUND(prev_close * $2::numeric / $3::numeric, 4),
+			open_price = ROUND(open_price * $2::numeric / $3::numeric, 4),
+			high_price = ROUND(high_price * $2::numeric / $3::numeric, 4),
+			low_price = ROUND(low_price * $2::numeric / $3::numeric, 4),
+			close_price = ROUND(close_price * $2::numeric / $3::numeric, 4),
+			ara_limit = ROUND(ara_limit * $2::numeric / $3::numeric, 4),
+			arb_limit = ROUND(arb_limit * $2::numeric / $3::numeric, 4),
+			volume = ROUND(volume * $3::numeric / $2::numeric)
+		WHERE stock_id = $1`,
+		`UPDATE candles SET
+			open_price = ROUND(open_price * $2::numeric / $3::numeric, 2),
+			high_price = ROUND(high_price * $2::numeric / $3::numeric, 2),
+			low_price = ROUND(low_price * $2::numeric / $3::numeric, 2),
+			close_price = ROUND(close_price * $2::numeric / $3::numeric, 2),
+			volume = ROUND(volume * $3::numeric / $2::numeric)
+		WHERE stock_id = $1`,
+		`UPDATE stock_candles SET
+			open_price = ROUND(open_price * $2::numeric / $3::numeric, 2),
+			high_price = ROUND(high_price * $2::numeric / $3::numeric, 2),
+			low_price = ROUND(low_price * $2::numeric / $3::numeric, 2),
+			close_price = ROUND(close_price * $2::numeric / $3::numeric, 2),
+			volume = ROUND(volume * $3::numeric / $2::numeric)
+		WHERE stock_id = $1`,
+	} {
+		if _, err := tx.Exec(ctx, q, stockId, ratio.old, ratio.new); err != nil {
+			return "", nil, err
+		}
+	}
+	// The next session opens from the adjusted close, which must be a valid price
+	if lastDaily != nil {
+		if _, err := tx.Exec(ctx, "UPDATE daily_stock_data SET close_price = $1 WHERE id = $2", adjusted, *lastDaily); err != nil {
+			return "", nil, err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE corporate_actions SET holders = $2, lots_before = $3, lots_after = $4, cash_in_lieu = $5,
+			orders_adjusted = $6, orders_canceled = $7
+		WHERE id::text = $1
+	`, id, len(holdings), lotsBefore, lotsAfter, cashInLieu, adjustedOrders+armed, len(canceled)+disarmed)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", nil, err
+	}
+	return id, canceled, nil
+}
+
+// adjustOpenOrders rescales the live orders of a stock. Orders left with less than one
+// lot are canceled and returned.
+func adjustOpenOrders(ctx context.Context, tx pgx.Tx, stockId int, ratio actionRatio) (int, []engine.CanceledOrder, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT id::text, user_id::text, type, price::float8, quantity, remaining_quantity, display_quantity,
+			avg_price_at_order::float8, fee_commission_pct::float8, fee_levy_pct::float8, fee_tax_pct::float8
+		FROM orders
+		WHERE stock_id = $1 AND status IN ('PENDING', 'PARTIAL')
+		FOR UPDATE
+	`, stockId)
+	if err != nil {
+		return 0, nil, err
+	}
+	type openOrder struct {
+		o       engine.ParsedOrder
+		display *int64
+		rates   fees.Rates
+		kind    string
+	}
+	var open []openOrder
+	for rows.Next() {
+		var oo openOrder
+		d := &oo.o.Data
+		if err := rows.Scan(&d.OrderId, &d.UserId, &oo.kind, &oo.o.Price, &d.Quantity, &d.RemainingQuantity, &oo.display,
+			&d.AvgPriceAtOrder, &oo.rates.CommissionPct, &oo.rates.LevyPct, &oo.rates.TaxPct); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		d.StockId = stockId
+		if oo.display != nil {
+			d.DisplayQuantity = *oo.display
+		}
+		open = append(open, oo)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	adjusted := 0
+	var canceled []engine.CanceledOrder
+	for _, oo := range open {
+		before := oo.o.Data
+		next, ok := ratio.order(engine.SideKey(oo.kind), oo.o)
+		if !ok {
+			// Locked shares are recounted from the orders left once they are all adjusted
+			c, ok, err := engine.CancelOrderTx(ctx, tx, before.OrderId)
+			if err != nil {
+				return 0, nil, err
+			}
+			if ok {
+				canceled = append(canceled, *c)
+			}
+			continue
+		}
+
+		d := next.Data
+		if oo.kind == "BUY" {
+			release := oo.rates.Reserve(oo.o.Price, before.RemainingQuantity) - oo.rates.Reserve(next.Price, d.RemainingQuantity)
+			if err := ledger.ReleaseCash(ctx, tx, d.UserId, d.OrderId, release); err != nil {
+				return 0, nil, err
+			}
+		}
+		var display *int64
+		if d.DisplayQuantity > 0 {
+			display = &d.DisplayQuantity
+		}
+		_, err := tx.Exec(ctx, `
+			UPDATE orders SET price = $2, quantity = $3, remaining_quantity = $4, display_quantity = $5,
+				avg_price_at_order = $6, updated_at = NOW()
+			WHERE id::text = $1
+		`, d.OrderId, next.Price, d.Quantity, d.RemainingQuantity, display, d.AvgPriceAtOrder)
+		if err != nil {
+			return 0, nil, err
+		}
+		adjusted++
+	}
+	return adjusted, canceled, nil
+}
+
+// adjustConditionalOrders rescales armed stop and take-profit orders; those left with
+// less than one lot are canceled
+func adjustConditionalOrders(ctx context.Context, tx pgx.Tx, stockId int, ratio actionRatio) (int, int, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT id::text, type, trigger_price::float8, limit_price::float8, quantity
+		FROM conditional_orders
+		WHERE stock_id = $1 AND status = 'ARMED'
+		FOR UPDATE
+	`, stockId)
+	if err != nil {
+		return 0, 0, err
+	}
+	type armedOrder struct {
+		id, kind string
+		trigger  float64
+		limit    *float64
+		quantity int64
+	}
+	var armed []armedOrder
+	for rows.Next() {
+		var a armedOrder
+		if err := rows.Scan(&a.id, &a.kind, &a.trigger, &a.limit, &a.quantity); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		armed = append(armed, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	adjusted, canceled := 0, 0
+	for _, a := range armed {
+		qty := ratio.lots(a.quantity)
+		if qty <= 0 {
+			if _, err := tx.Exec(ctx, "UPDATE conditional_orders SET status = 'CANCELED', updated_at = NOW() WHERE id::text = $1", a.id); err != nil {
+				return 0, 0, err
+			}
+			canceled++
+			continue
+		}
+		trigger := math.Max(roundToTick(a.trigger/ratio.factor()), 1)
+		var limit *float64
+		if a.limit != nil {
+			l := ratio.orderPrice(engine.SideKey(a.kind), *a.limit)
+			limit = &l
+		}
+		_, err := tx.Exec(ctx, `
+			UPDATE conditional_orders SET trigger_price = $2, limit_price = $3, quantity = $4, updated_at = NOW()
+			WHERE id::text = $1
+		`, a.id, trigger, limit, qty)
+		if err != nil {
+			return 0, 0, err
+		}
+		adjusted++
+	}
+	return adjusted, canceled, nil
+}
+
+// notify announces the action to everyone (charts are back-adjusted), sends each holder
+// its adjustment and tells the owners of canceled orders
+func (s *CorporateActionService) notify(ctx context.Context, a *CorporateAction, canceled []engine.CanceledOrder) {
+	if engine.Engine == nil || engine.Engine.IoServer == nil {
+		return
+	}
+	engine.Engine.IoServer.Emit("corporate_action", a)
+
+	holders, err := s.Holders(ctx, a.ID, "")
+	if err != nil {
+		log.Println("Corporate action notification error:", err)
+		return
+	}
+	for _, h := range holders {
+		h.Username = ""
+		engine.Engine.IoServer.To(socketio.Room("user:"+h.UserID)).Emit("corporate_action_update", h)
+	}
+	for _, o := range canceled {
+		engine.Engine.NotifyOrderStatus(o.UserId, map[string]interface{}{
+			"order_id": o.OrderId, "status": "CANCELED", "price": o.Price,
+			"matched_quantity": 0, "remaining_quantity": o.RemainingQuantity,
+			"symbol": a.Symbol, "type": o.Type, "reason": "CORPORATE_ACTION",
+		})
+	}
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
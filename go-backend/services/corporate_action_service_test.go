@@ -0,0 +1,58 @@
+package services
+
+import (
+	"testing"
+
+	"mbit-backend-go/core/engine"
+)
+
+func TestActionRatioShares(t *testing.T) {
+	tests := []struct {
+		name       string
+		ratio      actionRatio
+		lots       int64
+		wantLots   int64
+		wantShares int64
+	}{
+		{"split 1:2", actionRatio{1, 2}, 3, 6, 0},
+		{"reverse split 2:1 leaves odd shares", actionRatio{2, 1}, 3, 1, 50},
+		{"reverse split 3:1 below one lot", actionRatio{3, 1}, 1, 0, 33},
+		{"bonus 10:11", actionRatio{10, 11}, 5, 5, 50},
+		{"bonus 10:11 on whole lots", actionRatio{10, 11}, 10, 11, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lots, shares := tt.ratio.shares(tt.lots)
+			if lots != tt.wantLots || shares != tt.wantShares {
+				t.Errorf("shares(%d) = %d lots + %d shares, want %d + %d", tt.lots, lots, shares, tt.wantLots, tt.wantShares)
+			}
+		})
+	}
+}
+
+func TestActionRatioOrderPrice(t *testing.T) {
+	tests := []struct {
+		name  string
+		ratio actionRatio
+		side  string
+		price float64
+		want  float64
+	}{
+		{"split bid rounds down", actionRatio{1, 2}, engine.SideBuy, 1005, 500},
+		{"split offer rounds up", actionRatio{1, 2}, engine.SideSell, 1005, 505},
+		{"split on a valid tick", actionRatio{1, 2}, engine.SideBuy, 1000, 500},
+		{"reverse split bid rounds down", actionRatio{3, 1}, engine.SideBuy, 101, 302},
+		{"reverse split offer rounds up", actionRatio{3, 1}, engine.SideSell, 101, 304},
+		{"reverse split on a valid tick", actionRatio{3, 1}, engine.SideSell, 100, 300},
+		{"bid floored at 1", actionRatio{1, 10}, engine.SideBuy, 5, 1},
+		{"offer at 1", actionRatio{1, 10}, engine.SideSell, 5, 1},
+		{"market order keeps no price", actionRatio{1, 2}, engine.SideBuy, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ratio.orderPrice(tt.side, tt.price); got != tt.want {
+				t.Errorf("orderPrice(%s, %v) = %v, want %v", tt.side, tt.price, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,491 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+	"mbit-backend-go/core/ledger"
+
+	"github.com/jackc/pgx/v5"
+	socketio "github.com/zishang520/socket.io/v2/socket"
+)
+
+// Cash dividends.
+// A dividend is announced with cum, ex and pay sessions (by session_number). When the
+// cum session closes, every holder's quantity_owned is recorded as an allocation; lots
+// bought from the ex session on are not entitled. When the pay session opens, each
+// allocation is credited to balance_rdn net of withholding tax.
+
+// Dividend statuses
+const (
+	DividendAnnounced = "ANNOUNCED"
+	DividendRecorded  = "RECORDED"
+	DividendPaid      = "PAID"
+	DividendCanceled  = "CANCELED"
+)
+
+// DefaultDividendTaxPct is the withholding tax on cash dividends
+const DefaultDividendTaxPct = 10.0
+
+var (
+	ErrDividendNotFound = errors.New("Dividen tidak ditemukan")
+	ErrDividendPaid     = errors.New("Dividen sudah dibayar atau dibatalkan")
+)
+
+type Dividend struct {
+	ID                string     `json:"id"`
+	Symbol            string     `json:"symbol"`
+	DividendPerShare  float64    `json:"dividend_per_share"`
+	CumSession        *int       `json:"cum_session"`
+	ExSession         *int       `json:"ex_session"`
+	PaySession        *int       `json:"pay_session"`
+	WithholdingTaxPct float64    `json:"withholding_tax_pct"`
+	Status            string     `json:"status"`
+	TotalPayout       float64    `json:"total_payout"` // gross, known once recorded
+	Holders           int        `json:"holders"`
+	CreatedAt         *time.Time `json:"created_at"`
+	RecordedAt        *time.Time `json:"recorded_at"`
+	PaidAt            *time.Time `json:"paid_at"`
+}
+
+// DividendAllocation is one holder's entitlement
+type DividendAllocation struct {
+	DividendID       string     `json:"dividend_id"`
+	UserID           string     `json:"user_id"`
+	Username         string     `json:"username,omitempty"`
+	Symbol           string     `json:"symbol"`
+	DividendPerShare float64    `json:"dividend_per_share"`
+	Quantity         int64      `json:"quantity"` // lots at the cum session close
+	GrossAmount      float64    `json:"gross_amount"`
+	TaxAmount        float64    `json:"tax_amount"`
+	NetAmount        float64    `json:"net_amount"`
+	Status           string     `json:"status"`
+	PaySession       *int       `json:"pay_session"`
+	PaidAt           *time.Time `json:"paid_at"`
+}
+
+type DividendService struct{}
+
+var GlobalDividendService = &DividendService{}
+
+const dividendSelect = `
+	SELECT d.id::text, s.symbol, d.dividend_per_share::float8, d.cum_session, d.ex_session, d.pay_session,
+		d.withholding_tax_pct::float8, d.status, d.total_payout::float8,
+		(SELECT COUNT(*) FROM dividend_allocations a WHERE a.dividend_id = d.id),
+		d.created_at, d.recorded_at,
+		CASE WHEN d.status = 'PAID' THEN d.distributed_at END
+	FROM dividends d
+	JOIN stocks s ON s.id = d.stock_id
+`
+
+func scanDividend(row pgx.Row) (*Dividend, error) {
+	var d Dividend
+	var paidAt *time.Time
+	err := row.Scan(&d.ID, &d.Symbol, &d.DividendPerShare, &d.CumSession, &d.ExSession, &d.PaySession,
+		&d.WithholdingTaxPct, &d.Status, &d.TotalPayout, &d.Holders, &d.CreatedAt, &d.RecordedAt, &paidAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrDividendNotFound
+	}
+	d.PaidAt = paidAt
+	return &d, err
+}
+
+// List returns dividends, latest cum session first. symbol and status are optional.
+func (s *DividendService) List(ctx context.Context, symbol, status string) ([]Dividend, error) {
+	query := dividendSelect + " WHERE 1=1"
+	args := []interface{}{}
+	argCounter := 1
+	if symbol != "" {
+		query += fmt.Sprintf(" AND s.symbol = $%d", argCounter)
+		args = append(args, strings.ToUpper(symbol))
+		argCounter++
+	}
+	if status != "" {
+		query += fmt.Sprintf(" AND d.status = $%d", argCounter)
+		args = append(args, strings.ToUpper(status))
+		argCounter++
+	}
+	query += " ORDER BY d.cum_session DESC NULLS LAST, d.distributed_at DESC"
+
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Dividend{}
+	for rows.Next() {
+		d, err := scanDividend(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *d)
+	}
+	return items, rows.Err()
+}
+
+func (s *DividendService) Get(ctx context.Context, id string) (*Dividend, error) {
+	return scanDividend(config.DB.QueryRow(ctx, dividendSelect+" WHERE d.id::text = $1", id))
+}
+
+// Declare announces a cash dividend. exSession defaults to the session after cumSession.
+func (s *DividendService) Declare(ctx context.Context, adminId, symbol string, perShare float64, cumSession int, exSession *int, paySession int, taxPct *float64) (*Dividend, error) {
+	if perShare <= 0 {
+		return nil, errors.New("Dividen per saham harus lebih dari 0")
+	}
+	ex := cumSession + 1
+	if exSession != nil {
+		ex = *exSession
+	}
+	if ex <= cumSession {
+		return nil, errors.New("Ex-date harus setelah cum-date")
+	}
+	if paySession < ex {
+		return nil, errors.New("Pay-date tidak boleh sebelum ex-date")
+	}
+	tax := DefaultDividendTaxPct
+	if taxPct != nil {
+		tax = *taxPct
+	}
+	if tax < 0 || tax > 100 {
+		return nil, errors.New("Pajak dividen harus antara 0 dan 100 persen")
+	}
+
+	// The cum session must still be able to close: the running one or a later one
+	var first int
+	err := config.DB.QueryRow(ctx, `
+		SELECT COALESCE(MAX(session_number) FILTER (WHERE status <> 'CLOSED'), MAX(session_number) + 1, 1)
+		FROM trading_sessions
+	`).Scan(&first)
+	if err != nil {
+		return nil, err
+	}
+	if cumSession < first {
+		return nil, fmt.Errorf("Cum-date paling cepat sesi %d", first)
+	}
+
+	var stockId int
+	if err := config.DB.QueryRow(ctx, "SELECT id FROM stocks WHERE symbol = $1", strings.ToUpper(symbol)).Scan(&stockId); err != nil {
+		return nil, errors.New("Saham tidak ditemukan")
+	}
+
+	var id string
+	err = config.DB.QueryRow(ctx, `
+		INSERT INTO dividends (stock_id, dividend_per_share, total_payout, cum_session, ex_session, pay_session, withholding_tax_pct, status, declared_by)
+		VALUES ($1, $2, 0, $3, $4, $5, $6, 'ANNOUNCED', $7)
+		RETURNING id::text
+	`, stockId, perShare, cumSession, ex, paySession, tax, adminId).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+// Cancel withdraws a dividend that has not been paid, with its allocations
+func (s *DividendService) Cancel(ctx context.Context, id string) error {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "UPDATE dividends SET status = 'CANCELED' WHERE id::text = $1 AND status IN ('ANNOUNCED', 'RECORDED')", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		if _, err := s.Get(ctx, id); err != nil {
+			return err
+		}
+		return ErrDividendPaid
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM dividend_allocations WHERE dividend_id::text = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Allocations lists the entitlements of a dividend, or of a user when userId is set
+func (s *DividendService) Allocations(ctx context.Context, dividendId, userId string) ([]DividendAllocation, error) {
+	query := `
+		SELECT a.dividend_id::text, a.user_id::text, u.username, s.symbol, d.dividend_per_share::float8,
+			a.quantity_owned, COALESCE(a.gross_amount, a.amount)::float8, a.tax_amount::float8, a.amount::float8,
+			d.status, d.pay_session, a.paid_at
+		FROM dividend_allocations a
+		JOIN dividends d ON d.id = a.dividend_id
+		JOIN stocks s ON s.id = d.stock_id
+		JOIN users u ON u.id = a.user_id
+		WHERE 1=1
+	`
+	args := []interface{}{}
+	argCounter := 1
+	if dividendId != "" {
+		query += fmt.Sprintf(" AND a.dividend_id::text = $%d", argCounter)
+		args = append(args, dividendId)
+		argCounter++
+	}
+	if userId != "" {
+		query += fmt.Sprintf(" AND a.user_id = $%d", argCounter)
+		args = append(args, userId)
+		argCounter++
+	}
+	query += " ORDER BY d.cum_session DESC NULLS LAST, a.amount DESC"
+
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []DividendAllocation{}
+	for rows.Next() {
+		var a DividendAllocation
+		if err := rows.Scan(&a.DividendID, &a.UserID, &a.Username, &a.Symbol, &a.DividendPerShare, &a.Quantity,
+			&a.GrossAmount, &a.TaxAmount, &a.NetAmount, &a.Status, &a.PaySession, &a.PaidAt); err != nil {
+			return nil, err
+		}
+		items = append(items, a)
+	}
+	return items, rows.Err()
+}
+
+// RecordDue snapshots the holders of every dividend whose cum session closed, inside the
+// session close transaction, and returns the dividends recorded. Buyers of shares sold
+// short are holders too, so each open short position pays the dividend on its lots at
+// the record date (see chargeShortDividend).
+func (s *DividendService) RecordDue(ctx context.Context, tx pgx.Tx, sessionId int) ([]string, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT d.id::text FROM dividends d
+		WHERE d.status = 'ANNOUNCED'
+			AND d.cum_session <= (SELECT session_number FROM trading_sessions WHERE id = $1)
+		FOR UPDATE
+	`, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	var due []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+
+	for _, id := range due {
+		// Gross and tax per holder, rounded to the rupiah cent like the balance columns
+		_, err := tx.Exec(ctx, `
+			INSERT INTO dividend_allocations (dividend_id, user_id, quantity_owned, gross_amount, tax_amount, amount)
+			SELECT d.id, p.user_id, p.quantity_owned, x.gross, x.tax, x.gross - x.tax
+			FROM dividends d
+			JOIN portfolios p ON p.stock_id = d.stock_id AND p.quantity_owned > 0
+			CROSS JOIN LATERAL (
+				SELECT ROUND(d.dividend_per_share * p.quantity_owned * 100, 4) AS gross,
+					ROUND(d.dividend_per_share * p.quantity_owned * 100 * d.withholding_tax_pct / 100, 4) AS tax
+			) x
+			WHERE d.id::text = $1
+			ON CONFLICT (dividend_id, user_id) DO NOTHING
+		`, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := chargeShortDividend(ctx, tx, id, sessionId); err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE dividends SET status = 'RECORDED', recorded_at = NOW(),
+				total_payout = COALESCE((SELECT SUM(gross_amount) FROM dividend_allocations WHERE dividend_id = dividends.id), 0)
+			WHERE id::text = $1
+		`, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return due, nil
+}
+
+// NotifyRecorded tells the holders of dividends recorded by a committed close
+func (s *DividendService) NotifyRecorded(ctx context.Context, sessionId int, ids []string) {
+	for _, id := range ids {
+		s.notify(ctx, id)
+	}
+	if len(ids) > 0 {
+		log.Printf("💰 Session %d: %d dividend(s) recorded", sessionId, len(ids))
+	}
+}
+
+// chargeShortDividend takes a dividend's gross amount from every open short position in
+// its stock
+func chargeShortDividend(ctx context.Context, tx pgx.Tx, id string, sessionId int) error {
+	rows, err := tx.Query(ctx, `
+		SELECT sp.user_id::text, sp.stock_id, s.symbol, sp.quantity, sp.avg_short_price::float8, sp.collateral::float8, d.dividend_per_share::float8
+		FROM dividends d
+		JOIN stocks s ON s.id = d.stock_id
+		JOIN short_positions sp ON sp.stock_id = d.stock_id AND sp.quantity > 0
+		WHERE d.id::text = $1
+		FOR UPDATE OF sp
+	`, id)
+	if err != nil {
+		return err
+	}
+	type short struct {
+		userId          string
+		stockId         int
+		symbol          string
+		lots            int64
+		avg, collateral float64
+		perShare        float64
+	}
+	var shorts []short
+	for rows.Next() {
+		var sh short
+		if err := rows.Scan(&sh.userId, &sh.stockId, &sh.symbol, &sh.lots, &sh.avg, &sh.collateral, &sh.perShare); err != nil {
+			rows.Close()
+			return err
+		}
+		shorts = append(shorts, sh)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(shorts) == 0 {
+		return err
+	}
+
+	j := ledger.New(ledger.ReasonShortDividend, ledger.RefDividend, id)
+	j.Memo = fmt.Sprintf("Dividen %s Rp%g/saham atas posisi short", shorts[0].symbol, shorts[0].perShare)
+	for _, sh := range shorts {
+		amount := round4(sh.perShare * float64(sh.lots) * 100)
+		fromCollateral, _, err := chargeShort(ctx, tx, j, sh.userId, sh.stockId, sh.collateral, amount)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO short_fills (session_id, user_id, stock_id, kind, quantity, price, avg_short_price, collateral, pnl)
+			VALUES ($1, $2, $3, 'DIVIDEND', $4, $5, $6, $7, $8)
+		`, sessionId, sh.userId, sh.stockId, sh.lots, sh.perShare, sh.avg, fromCollateral, -amount)
+		if err != nil {
+			return err
+		}
+	}
+	return ledger.Post(ctx, tx, j)
+}
+
+// PayDue credits every recorded dividend whose pay session has started
+func (s *DividendService) PayDue(ctx context.Context, sessionId int) error {
+	rows, err := config.DB.Query(ctx, `
+		SELECT id::text FROM dividends
+		WHERE status = 'RECORDED'
+			AND pay_session <= (SELECT session_number FROM trading_sessions WHERE id = $1)
+		ORDER BY cum_session
+	`, sessionId)
+	if err != nil {
+		return err
+	}
+	var due []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+
+	for _, id := range due {
+		if err := s.pay(ctx, id, sessionId); err != nil {
+			return fmt.Errorf("dividend %s: %w", id, err)
+		}
+		s.notify(ctx, id)
+	}
+	if len(due) > 0 {
+		log.Printf("💰 Session %d: %d dividend(s) paid", sessionId, len(due))
+	}
+	return nil
+}
+
+// pay credits one dividend's allocations and journals them from EXTERNAL
+func (s *DividendService) pay(ctx context.Context, id string, sessionId int) error {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var symbol string
+	var perShare float64
+	err = tx.QueryRow(ctx, `
+		UPDATE dividends d SET status = 'PAID', session_id = $2, distributed_at = NOW()
+		FROM stocks s
+		WHERE d.id::text = $1 AND d.status = 'RECORDED' AND s.id = d.stock_id
+		RETURNING s.symbol, d.dividend_per_share::float8
+	`, id, sessionId).Scan(&symbol, &perShare)
+	if err == pgx.ErrNoRows {
+		return nil // paid or canceled meanwhile
+	}
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx, `
+		UPDATE dividend_allocations SET paid_at = NOW()
+		WHERE dividend_id::text = $1 AND paid_at IS NULL
+		RETURNING user_id::text, amount::float8
+	`, id)
+	if err != nil {
+		return err
+	}
+	type credit struct {
+		userId string
+		amount float64
+	}
+	var credits []credit
+	for rows.Next() {
+		var c credit
+		if err := rows.Scan(&c.userId, &c.amount); err != nil {
+			rows.Close()
+			return err
+		}
+		credits = append(credits, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	j := ledger.New(ledger.ReasonDividend, ledger.RefDividend, id)
+	j.Memo = fmt.Sprintf("Dividen %s Rp%g/saham", symbol, perShare)
+	for _, c := range credits {
+		if _, err := tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn + $1 WHERE id = $2", c.amount, c.userId); err != nil {
+			return err
+		}
+		j.Cash(ledger.External, ledger.Cash(c.userId), c.amount)
+	}
+	if err := ledger.Post(ctx, tx, j); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// notify sends each holder its allocation of a dividend
+func (s *DividendService) notify(ctx context.Context, id string) {
+	if engine.Engine == nil || engine.Engine.IoServer == nil {
+		return
+	}
+	items, err := s.Allocations(ctx, id, "")
+	if err != nil {
+		log.Println("Dividend notification error:", err)
+		return
+	}
+	for _, a := range items {
+		a.Username = ""
+		engine.Engine.IoServer.To(socketio.Room("user:"+a.UserID)).Emit("dividend_update", a)
+	}
+}
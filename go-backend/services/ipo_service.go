@@ -0,0 +1,757 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+	"mbit-backend-go/core/ledger"
+
+	"github.com/jackc/pgx/v5"
+	socketio "github.com/zishang520/socket.io/v2/socket"
+)
+
+// IPO book-building.
+// An offering runs from its start to its end session (by session_number). Subscribers
+// pay the offering price up front: the amount is held in reserved_rdn like a BUY order.
+// When the end session closes the lots are allotted, pro-rata or by lottery when the
+// offer is oversubscribed, and the rest of each payment is refunded. The stock is
+// activated when its listing session opens, with the offering price as prev_close.
+// Quantities are in lots, like max_shares and quantity_owned.
+
+// IPO statuses
+const (
+	IPOPending  = "PENDING"  // before the offering window
+	IPOOffering = "OFFERING" // open for subscriptions
+	IPOAllotted = "ALLOTTED" // lots credited, waiting for the listing session
+	IPOListed   = "LISTED"
+	IPOCanceled = "CANCELED"
+)
+
+// Subscription statuses
+const (
+	SubscriptionPending     = "PENDING"
+	SubscriptionAllotted    = "ALLOTTED"
+	SubscriptionNotAllotted = "NOT_ALLOTTED"
+	SubscriptionCanceled    = "CANCELED"
+)
+
+// Allocation methods for oversubscribed offers
+const (
+	AllocationProRata = "PRO_RATA" // in proportion to the lots requested
+	AllocationLottery = "LOTTERY"  // lots dealt one at a time in a random order
+)
+
+var (
+	ErrIPONotFound      = errors.New("IPO tidak ditemukan")
+	ErrIPONotOffering   = errors.New("IPO tidak sedang dalam masa penawaran")
+	ErrIPONotCancelable = errors.New("IPO yang sudah dijatahkan tidak bisa dibatalkan")
+)
+
+type IPO struct {
+	ID                string     `json:"id"`
+	Symbol            string     `json:"symbol"`
+	Name              string     `json:"name"`
+	OfferingPrice     float64    `json:"offering_price"`
+	TotalShares       int64      `json:"total_shares"` // lots offered
+	OfferStartSession *int       `json:"offer_start_session"`
+	OfferEndSession   *int       `json:"offer_end_session"`
+	ListingSession    *int       `json:"listing_session"`
+	AllocationMethod  string     `json:"allocation_method"`
+	Status            string     `json:"status"`
+	Subscribers       int        `json:"subscribers"`
+	SubscribedShares  int64      `json:"subscribed_shares"`
+	AllottedShares    int64      `json:"allotted_shares"`
+	CreatedAt         time.Time  `json:"created_at"`
+	AllottedAt        *time.Time `json:"allotted_at"`
+	ListedAt          *time.Time `json:"listed_at"`
+}
+
+type IPOSubscription struct {
+	ID               string    `json:"id"`
+	IPOID            string    `json:"ipo_id"`
+	Symbol           string    `json:"symbol"`
+	UserID           string    `json:"user_id"`
+	Username         string    `json:"username,omitempty"`
+	Quantity         int64     `json:"quantity"`
+	ReservedAmount   float64   `json:"reserved_amount"`
+	AllottedQuantity int64     `json:"allotted_quantity"`
+	RefundAmount     float64   `json:"refund_amount"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+type IPOService struct{}
+
+var GlobalIPOService = &IPOService{}
+
+// Pending subscriptions count towards the book; allotted ones once the book is closed
+const ipoSelect = `
+	SELECT i.id::text, s.symbol, s.name, i.offering_price::float8, i.total_shares,
+		i.offer_start_session, i.offer_end_session, i.listing_session, i.allocation_method, i.status,
+		COUNT(sub.id), COALESCE(SUM(sub.quantity), 0), i.allotted_shares, i.created_at, i.allotted_at, i.listed_at
+	FROM ipos i
+	JOIN stocks s ON s.id = i.stock_id
+	LEFT JOIN ipo_subscriptions sub ON sub.ipo_id = i.id AND sub.status <> 'CANCELED'
+`
+
+const ipoGroupBy = " GROUP BY i.id, s.symbol, s.name"
+
+func scanIPO(row pgx.Row) (*IPO, error) {
+	var i IPO
+	err := row.Scan(&i.ID, &i.Symbol, &i.Name, &i.OfferingPrice, &i.TotalShares,
+		&i.OfferStartSession, &i.OfferEndSession, &i.ListingSession, &i.AllocationMethod, &i.Status,
+		&i.Subscribers, &i.SubscribedShares, &i.AllottedShares, &i.CreatedAt, &i.AllottedAt, &i.ListedAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrIPONotFound
+	}
+	return &i, err
+}
+
+// List returns offerings, newest first, optionally of one status
+func (s *IPOService) List(ctx context.Context, status string) ([]IPO, error) {
+	query := ipoSelect
+	args := []interface{}{}
+	if status != "" {
+		query += " WHERE i.status = $1"
+		args = append(args, strings.ToUpper(status))
+	}
+	query += ipoGroupBy + " ORDER BY i.created_at DESC"
+
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []IPO{}
+	for rows.Next() {
+		i, err := scanIPO(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *i)
+	}
+	return items, rows.Err()
+}
+
+func (s *IPOService) Get(ctx context.Context, id string) (*IPO, error) {
+	return scanIPO(config.DB.QueryRow(ctx, ipoSelect+" WHERE i.id::text = $1"+ipoGroupBy, id))
+}
+
+type CreateIPOParams struct {
+	Symbol            string
+	Name              string // for a new stock
+	OfferingPrice     float64
+	TotalShares       int64 // lots
+	OfferStartSession int
+	OfferEndSession   int
+	ListingSession    int
+	AllocationMethod  string
+}
+
+// Create opens a book for a new stock, or an existing inactive one
+func (s *IPOService) Create(ctx context.Context, adminId string, p CreateIPOParams) (*IPO, error) {
+	p.Symbol = strings.ToUpper(strings.TrimSpace(p.Symbol))
+	if p.AllocationMethod == "" {
+		p.AllocationMethod = AllocationProRata
+	}
+	switch {
+	case p.Symbol == "":
+		return nil, errors.New("Symbol wajib diisi")
+	case p.OfferingPrice <= 0 || roundToTick(p.OfferingPrice) != p.OfferingPrice:
+		return nil, errors.New("Harga penawaran tidak sesuai fraksi (Tick Size)")
+	case p.TotalShares <= 0:
+		return nil, errors.New("Jumlah lot yang ditawarkan harus lebih dari 0")
+	case p.OfferEndSession < p.OfferStartSession:
+		return nil, errors.New("Sesi akhir penawaran tidak boleh sebelum sesi awal")
+	case p.ListingSession <= p.OfferEndSession:
+		return nil, errors.New("Sesi listing harus setelah masa penawaran")
+	case p.AllocationMethod != AllocationProRata && p.AllocationMethod != AllocationLottery:
+		return nil, errors.New("Metode penjatahan tidak valid (PRO_RATA/LOTTERY)")
+	}
+
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var running *int
+	var next int
+	err = tx.QueryRow(ctx, `
+		SELECT MAX(session_number) FILTER (WHERE status <> 'CLOSED'), COALESCE(MAX(session_number), 0) + 1
+		FROM trading_sessions
+	`).Scan(&running, &next)
+	if err != nil {
+		return nil, err
+	}
+	first := next
+	if running != nil {
+		first = *running
+	}
+	if p.OfferStartSession < first {
+		return nil, fmt.Errorf("Masa penawaran paling cepat mulai sesi %d", first)
+	}
+
+	// The stock trades only from its listing session on
+	var stockId int
+	var active bool
+	var maxShares, issued int64
+	err = tx.QueryRow(ctx, `
+		SELECT s.id, COALESCE(s.is_active, false), COALESCE(s.max_shares, 0), COALESCE((SELECT SUM(quantity_owned) FROM portfolios WHERE stock_id = s.id), 0)
+		FROM stocks s WHERE s.symbol = $1
+	`, p.Symbol).Scan(&stockId, &active, &maxShares, &issued)
+	if err == pgx.ErrNoRows {
+		if strings.TrimSpace(p.Name) == "" {
+			return nil, errors.New("Name wajib diisi untuk saham baru")
+		}
+		err = tx.QueryRow(ctx, `
+			INSERT INTO stocks (symbol, name, max_shares, is_active)
+			VALUES ($1, $2, $3, false)
+			RETURNING id
+		`, p.Symbol, strings.TrimSpace(p.Name), p.TotalShares).Scan(&stockId)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		if active {
+			return nil, errors.New("Saham sudah tercatat dan aktif")
+		}
+		if issued+p.TotalShares > maxShares {
+			return nil, errors.New("Melebihi batas max_shares")
+		}
+		var open int
+		if err := tx.QueryRow(ctx, "SELECT COUNT(*) FROM ipos WHERE stock_id = $1 AND status IN ('PENDING', 'OFFERING', 'ALLOTTED')", stockId).Scan(&open); err != nil {
+			return nil, err
+		}
+		if open > 0 {
+			return nil, errors.New("Saham ini sudah memiliki IPO yang berjalan")
+		}
+	}
+
+	status := IPOPending
+	if running != nil && p.OfferStartSession <= *running {
+		status = IPOOffering
+	}
+
+	var id string
+	err = tx.QueryRow(ctx, `
+		INSERT INTO ipos (stock_id, total_shares, offering_price, offer_start_session, offer_end_session, listing_session, allocation_method, status, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id::text
+	`, stockId, p.TotalShares, p.OfferingPrice, p.OfferStartSession, p.OfferEndSession, p.ListingSession, p.AllocationMethod, status, adminId).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+// Subscribe books lots of an offering, or changes the user's booking. The payment
+// difference is reserved or released.
+func (s *IPOService) Subscribe(ctx context.Context, userId, ipoId string, lots int64) (*IPOSubscription, error) {
+	if lots <= 0 {
+		return nil, errors.New("Jumlah lot harus lebih dari 0")
+	}
+
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var status string
+	var price float64
+	var total int64
+	var open bool
+	err = tx.QueryRow(ctx, `
+		SELECT status, offering_price::float8, total_shares, offer_end_session >= `+currentSessionNumber+`
+		FROM ipos WHERE id::text = $1 FOR UPDATE
+	`, ipoId).Scan(&status, &price, &total, &open)
+	if err == pgx.ErrNoRows {
+		return nil, ErrIPONotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The window ends with its last session, even before the allotment has run
+	if status != IPOOffering || !open {
+		return nil, ErrIPONotOffering
+	}
+	if lots > total {
+		return nil, fmt.Errorf("Maksimal %d lot", total)
+	}
+
+	var subId string
+	var held float64
+	err = tx.QueryRow(ctx, `
+		SELECT id::text, CASE WHEN status = 'PENDING' THEN reserved_amount ELSE 0 END::float8
+		FROM ipo_subscriptions WHERE ipo_id::text = $1 AND user_id = $2
+	`, ipoId, userId).Scan(&subId, &held)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+
+	amount := price * float64(lots) * 100
+	delta := amount - held
+	if delta > 0 {
+		var balance float64
+		if err := tx.QueryRow(ctx, "SELECT balance_rdn FROM users WHERE id = $1 FOR UPDATE", userId).Scan(&balance); err != nil {
+			return nil, err
+		}
+		if balance < delta {
+			return nil, errors.New("Saldo RDN tidak mencukupi")
+		}
+	}
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO ipo_subscriptions (ipo_id, user_id, quantity, reserved_amount, status)
+		VALUES ($1::uuid, $2, $3, $4, 'PENDING')
+		ON CONFLICT (ipo_id, user_id) DO UPDATE SET
+			quantity = EXCLUDED.quantity, reserved_amount = EXCLUDED.reserved_amount,
+			status = 'PENDING', updated_at = NOW()
+		RETURNING id::text
+	`, ipoId, userId, lots, amount).Scan(&subId)
+	if err != nil {
+		return nil, err
+	}
+
+	if delta > 0 {
+		err = ledger.ReserveIPO(ctx, tx, userId, subId, delta)
+	} else {
+		err = ledger.ReleaseIPO(ctx, tx, userId, subId, -delta)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	subs, err := s.Subscriptions(ctx, ipoId, userId)
+	if err != nil || len(subs) == 0 {
+		return nil, err
+	}
+	return &subs[0], nil
+}
+
+// Unsubscribe withdraws the user's booking while the offering is open
+func (s *IPOService) Unsubscribe(ctx context.Context, userId, ipoId string) error {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var status string
+	var open bool
+	err = tx.QueryRow(ctx, "SELECT status, offer_end_session >= "+currentSessionNumber+" FROM ipos WHERE id::text = $1 FOR UPDATE", ipoId).Scan(&status, &open)
+	if err == pgx.ErrNoRows {
+		return ErrIPONotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != IPOOffering || !open {
+		return ErrIPONotOffering
+	}
+
+	var subId string
+	var held float64
+	err = tx.QueryRow(ctx, `
+		UPDATE ipo_subscriptions
+		SET status = 'CANCELED', updated_at = NOW()
+		WHERE ipo_id::text = $1 AND user_id = $2 AND status = 'PENDING'
+		RETURNING id::text, reserved_amount::float8
+	`, ipoId, userId).Scan(&subId, &held)
+	if err == pgx.ErrNoRows {
+		return errors.New("Pesanan IPO tidak ditemukan")
+	}
+	if err != nil {
+		return err
+	}
+	if err := ledger.ReleaseIPO(ctx, tx, userId, subId, held); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Cancel withdraws an offering before allotment and refunds every subscriber
+func (s *IPOService) Cancel(ctx context.Context, ipoId string) error {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var status string
+	err = tx.QueryRow(ctx, "SELECT status FROM ipos WHERE id::text = $1 FOR UPDATE", ipoId).Scan(&status)
+	if err == pgx.ErrNoRows {
+		return ErrIPONotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != IPOPending && status != IPOOffering {
+		return ErrIPONotCancelable
+	}
+
+	subs, err := pendingSubscriptions(ctx, tx, ipoId)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if err := ledger.ReleaseIPO(ctx, tx, sub.UserID, sub.ID, sub.ReservedAmount); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, "UPDATE ipo_subscriptions SET status = 'CANCELED', refund_amount = reserved_amount, updated_at = NOW() WHERE ipo_id::text = $1 AND status = 'PENDING'", ipoId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE ipos SET status = 'CANCELED' WHERE id::text = $1", ipoId); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	s.notify(ctx, ipoId)
+	return nil
+}
+
+// Subscriptions lists the bookings of an offering, or of a user when ipoId is empty
+func (s *IPOService) Subscriptions(ctx context.Context, ipoId, userId string) ([]IPOSubscription, error) {
+	query := `
+		SELECT sub.id::text, sub.ipo_id::text, s.symbol, sub.user_id::text, u.username, sub.quantity,
+			sub.reserved_amount::float8, sub.allotted_quantity, sub.refund_amount::float8, sub.status, sub.created_at
+		FROM ipo_subscriptions sub
+		JOIN ipos i ON i.id = sub.ipo_id
+		JOIN stocks s ON s.id = i.stock_id
+		JOIN users u ON u.id = sub.user_id
+		WHERE 1=1
+	`
+	args := []interface{}{}
+	argCounter := 1
+	if ipoId != "" {
+		query += fmt.Sprintf(" AND sub.ipo_id::text = $%d", argCounter)
+		args = append(args, ipoId)
+		argCounter++
+	}
+	if userId != "" {
+		query += fmt.Sprintf(" AND sub.user_id = $%d", argCounter)
+		args = append(args, userId)
+		argCounter++
+	}
+	query += " ORDER BY sub.created_at DESC"
+
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []IPOSubscription{}
+	for rows.Next() {
+		var sub IPOSubscription
+		if err := rows.Scan(&sub.ID, &sub.IPOID, &sub.Symbol, &sub.UserID, &sub.Username, &sub.Quantity,
+			&sub.ReservedAmount, &sub.AllottedQuantity, &sub.RefundAmount, &sub.Status, &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, sub)
+	}
+	return items, rows.Err()
+}
+
+// pendingSubscriptions returns the open bookings of an offering, first come first
+func pendingSubscriptions(ctx context.Context, tx pgx.Tx, ipoId string) ([]IPOSubscription, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT id::text, user_id::text, quantity, reserved_amount::float8
+		FROM ipo_subscriptions
+		WHERE ipo_id::text = $1 AND status = 'PENDING'
+		ORDER BY created_at, id
+		FOR UPDATE
+	`, ipoId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []IPOSubscription
+	for rows.Next() {
+		var sub IPOSubscription
+		if err := rows.Scan(&sub.ID, &sub.UserID, &sub.Quantity, &sub.ReservedAmount); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// StartSession runs in the transaction that opens a session: offerings whose window
+// starts now open for subscriptions, and allotted offerings whose listing session
+// this is get their stock activated. It returns the offering price of every stock
+// listed, to be used as its prev_close.
+func (s *IPOService) StartSession(ctx context.Context, tx pgx.Tx, sessionId, sessionNumber int) (map[int]float64, error) {
+	_, err := tx.Exec(ctx, `
+		UPDATE ipos SET status = 'OFFERING', start_offering_session_id = $1
+		WHERE status = 'PENDING' AND offer_start_session <= $2
+	`, sessionId, sessionNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, `
+		UPDATE ipos SET status = 'LISTED', listing_session_id = $1, listed_at = NOW()
+		WHERE status = 'ALLOTTED' AND listing_session <= $2
+		RETURNING stock_id, offering_price::float8
+	`, sessionId, sessionNumber)
+	if err != nil {
+		return nil, err
+	}
+	listed := map[int]float64{}
+	for rows.Next() {
+		var stockId int
+		var price float64
+		if err := rows.Scan(&stockId, &price); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		listed[stockId] = price
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for stockId := range listed {
+		if _, err := tx.Exec(ctx, "UPDATE stocks SET is_active = true WHERE id = $1", stockId); err != nil {
+			return nil, err
+		}
+		log.Printf("🔔 IPO: stock %d listed", stockId)
+	}
+	return listed, nil
+}
+
+// AllotDue closes the book of every offering whose last session closed, inside the
+// session close transaction, and returns the offerings allotted
+func (s *IPOService) AllotDue(ctx context.Context, tx pgx.Tx, sessionId int) ([]string, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT id::text FROM ipos
+		WHERE status = 'OFFERING'
+			AND offer_end_session <= (SELECT session_number FROM trading_sessions WHERE id = $1)
+	`, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	var due []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+
+	var allotted []string
+	for _, id := range due {
+		ok, err := s.allot(ctx, tx, id, sessionId)
+		if err != nil {
+			return nil, fmt.Errorf("IPO %s: %w", id, err)
+		}
+		if ok {
+			allotted = append(allotted, id)
+		}
+	}
+	return allotted, nil
+}
+
+// NotifyAllotted tells the subscribers of offerings allotted by a committed close
+func (s *IPOService) NotifyAllotted(ctx context.Context, sessionId int, ids []string) {
+	for _, id := range ids {
+		s.notify(ctx, id)
+	}
+	if len(ids) > 0 {
+		log.Printf("🔔 Session %d: %d IPO(s) allotted", sessionId, len(ids))
+	}
+}
+
+// allot credits the allotted lots at the offering price and refunds the rest of each
+// subscriber's payment. Returns false if the offering is not OFFERING anymore.
+func (s *IPOService) allot(ctx context.Context, tx pgx.Tx, ipoId string, sessionId int) (bool, error) {
+	var stockId int
+	var price float64
+	var total int64
+	var method string
+	err := tx.QueryRow(ctx, `
+		SELECT stock_id, offering_price::float8, total_shares, allocation_method
+		FROM ipos WHERE id::text = $1 AND status = 'OFFERING'
+		FOR UPDATE
+	`, ipoId).Scan(&stockId, &price, &total, &method)
+	if err == pgx.ErrNoRows {
+		return false, nil // canceled meanwhile
+	}
+	if err != nil {
+		return false, err
+	}
+
+	subs, err := pendingSubscriptions(ctx, tx, ipoId)
+	if err != nil {
+		return false, err
+	}
+	requests := make([]int64, len(subs))
+	for i, sub := range subs {
+		requests[i] = sub.Quantity
+	}
+	h := fnv.New64a()
+	h.Write([]byte(ipoId))
+	allotted := allocateIPO(method, total, requests, int64(h.Sum64()))
+
+	var totalAllotted int64
+	for i, sub := range subs {
+		lots := allotted[i]
+		cost := price * float64(lots) * 100
+		refund := sub.ReservedAmount - cost
+
+		if err := ledger.ReleaseIPO(ctx, tx, sub.UserID, sub.ID, refund); err != nil {
+			return false, err
+		}
+		status := SubscriptionNotAllotted
+		if lots > 0 {
+			status = SubscriptionAllotted
+			if _, err := tx.Exec(ctx, "UPDATE users SET reserved_rdn = reserved_rdn - $1 WHERE id = $2", cost, sub.UserID); err != nil {
+				return false, err
+			}
+			_, err := tx.Exec(ctx, `
+				INSERT INTO portfolios (user_id, stock_id, quantity_owned, avg_buy_price)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT (user_id, stock_id) DO UPDATE SET
+				avg_buy_price = ((portfolios.avg_buy_price * portfolios.quantity_owned) + ($4 * $3)) / (portfolios.quantity_owned + $3),
+				quantity_owned = portfolios.quantity_owned + $3
+			`, sub.UserID, stockId, lots, price)
+			if err != nil {
+				return false, err
+			}
+			j := ledger.New(ledger.ReasonIPOAllotment, ledger.RefIPO, sub.ID).
+				Cash(ledger.Reserved(sub.UserID), ledger.External, cost).
+				Shares(ledger.External, ledger.Shares(sub.UserID), stockId, lots)
+			if err := ledger.Post(ctx, tx, j); err != nil {
+				return false, err
+			}
+		}
+		_, err := tx.Exec(ctx, `
+			UPDATE ipo_subscriptions SET status = $1, allotted_quantity = $2, refund_amount = $3, updated_at = NOW()
+			WHERE id::text = $4
+		`, status, lots, refund, sub.ID)
+		if err != nil {
+			return false, err
+		}
+		totalAllotted += lots
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE ipos SET status = 'ALLOTTED', allotted_shares = $1, allotted_at = NOW(), end_offering_session_id = $2
+		WHERE id::text = $3
+	`, totalAllotted, sessionId, ipoId)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// allocateIPO splits lots over the requests, in request order. Without
+// oversubscription every request is filled.
+func allocateIPO(method string, lots int64, requests []int64, seed int64) []int64 {
+	allotted := make([]int64, len(requests))
+	var demand int64
+	for _, q := range requests {
+		demand += q
+	}
+	if demand <= lots {
+		copy(allotted, requests)
+		return allotted
+	}
+
+	if method == AllocationLottery {
+		// Deal one lot to every unfilled subscriber per round; whole rounds at once,
+		// the last partial round in a random (but reproducible) order
+		order := rand.New(rand.NewSource(seed)).Perm(len(requests))
+		remaining := lots
+		for remaining > 0 {
+			var open []int
+			least := int64(-1)
+			for _, i := range order {
+				if left := requests[i] - allotted[i]; left > 0 {
+					open = append(open, i)
+					if least < 0 || left < least {
+						least = left
+					}
+				}
+			}
+			if rounds := min(least, remaining/int64(len(open))); rounds > 0 {
+				for _, i := range open {
+					allotted[i] += rounds
+				}
+				remaining -= rounds * int64(len(open))
+				continue
+			}
+			for _, i := range open[:remaining] {
+				allotted[i]++
+			}
+			remaining = 0
+		}
+		return allotted
+	}
+
+	// Pro-rata: round down, then hand the leftover lots to the largest remainders,
+	// earlier subscriptions first
+	var given int64
+	remainders := make([]int64, len(requests))
+	for i, q := range requests {
+		allotted[i] = q * lots / demand
+		remainders[i] = q * lots % demand
+		given += allotted[i]
+	}
+	idx := make([]int, len(requests))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return remainders[idx[a]] > remainders[idx[b]] })
+	for _, i := range idx {
+		if given == lots {
+			break
+		}
+		allotted[i]++
+		given++
+	}
+	return allotted
+}
+
+// notify sends each subscriber the state of its booking
+func (s *IPOService) notify(ctx context.Context, ipoId string) {
+	if engine.Engine == nil || engine.Engine.IoServer == nil {
+		return
+	}
+	subs, err := s.Subscriptions(ctx, ipoId, "")
+	if err != nil {
+		log.Println("IPO notification error:", err)
+		return
+	}
+	for _, sub := range subs {
+		sub.Username = ""
+		engine.Engine.IoServer.To(socketio.Room("user:"+sub.UserID)).Emit("ipo_update", sub)
+	}
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestAllocateIPOProRata(t *testing.T) {
+	tests := []struct {
+		name     string
+		lots     int64
+		requests []int64
+		want     []int64
+	}{
+		{"undersubscribed fills every request", 10, []int64{2, 3}, []int64{2, 3}},
+		{"exactly subscribed", 5, []int64{2, 3}, []int64{2, 3}},
+		{"proportional", 50, []int64{60, 40}, []int64{30, 20}},
+		{"leftover to the largest remainder", 7, []int64{5, 3, 2}, []int64{4, 2, 1}},
+		{"equal remainders favour earlier subscriptions", 2, []int64{1, 1, 1}, []int64{1, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allocateIPO(AllocationProRata, tt.lots, tt.requests, 1); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("allocateIPO() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateIPOLottery(t *testing.T) {
+	tests := []struct {
+		name     string
+		lots     int64
+		requests []int64
+		fixed    map[int]int64 // allotments the draw cannot change
+		drawn    []int64       // the other allotments, sorted; who gets which depends on the seed
+	}{
+		{"undersubscribed fills every request", 10, []int64{2, 3}, map[int]int64{0: 2, 1: 3}, nil},
+		{"whole rounds", 6, []int64{4, 2, 3}, map[int]int64{0: 2, 1: 2, 2: 2}, nil},
+		{"small requests filled first", 6, []int64{5, 1, 3}, map[int]int64{1: 1}, []int64{2, 3}},
+		{"fewer lots than subscribers", 2, []int64{3, 3, 3, 3}, nil, []int64{0, 0, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := allocateIPO(AllocationLottery, tt.lots, tt.requests, 42)
+
+			if again := allocateIPO(AllocationLottery, tt.lots, tt.requests, 42); !reflect.DeepEqual(got, again) {
+				t.Errorf("same seed drew %v then %v", got, again)
+			}
+			var drawn []int64
+			for i, q := range got {
+				if want, ok := tt.fixed[i]; !ok {
+					drawn = append(drawn, q)
+				} else if q != want {
+					t.Errorf("subscriber %d allotted %d, want %d", i, q, want)
+				}
+			}
+			slices.Sort(drawn)
+			if !slices.Equal(drawn, tt.drawn) {
+				t.Errorf("drawn allotments %v, want %v in some order", drawn, tt.drawn)
+			}
+		})
+	}
+}
@@ -2,47 +2,44 @@ package services
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"math"
 	"time"
 
 	"mbit-backend-go/config"
 	"mbit-backend-go/core/engine"
+	"mbit-backend-go/core/fees"
+	"mbit-backend-go/core/ledger"
 	"mbit-backend-go/models"
 
 	"github.com/jackc/pgx/v5"
-	"github.com/redis/go-redis/v9"
 )
 
 type OrderService struct{}
 
-func (s *OrderService) PlaceOrder(userId string, symbol string, orderType string, price float64, quantity int64) (*models.Order, error) {
-	ctx := context.Background()
-	tx, err := config.DB.Begin(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer tx.Rollback(ctx)
+// tradingContext is the stock and session state an order is validated against
+type tradingContext struct {
+	StockId       int
+	AraLimit      float64
+	ArbLimit      float64
+	SessionId     int
+	SessionStatus string
+}
 
-	// 1. Get Stock Data & Session
-	// Optimized query to get stock and session data
-	var stockId int
-	var araLimit, arbLimit float64
-	var sessionId int
-	var sessionStatus string
+func loadTradingContext(ctx context.Context, tx pgx.Tx, symbol string) (*tradingContext, error) {
+	var tc tradingContext
 
+	// Optimized query to get stock and session data
 	query := `
 		SELECT s.id, d.ara_limit, d.arb_limit, d.session_id, ts.status
 		FROM stocks s
 		JOIN daily_stock_data d ON s.id = d.stock_id
 		JOIN trading_sessions ts ON d.session_id = ts.id
-		WHERE s.symbol = $1 AND ts.status IN ('OPEN', 'PRE_OPEN', 'LOCKED')
+		WHERE s.symbol = $1 AND ts.status IN ('OPEN', 'PRE_OPEN', 'LOCKED', 'BREAK', 'PRE_CLOSE')
 		ORDER BY ts.id DESC LIMIT 1
 	`
-	err = tx.QueryRow(ctx, query, symbol).Scan(&stockId, &araLimit, &arbLimit, &sessionId, &sessionStatus)
+	err := tx.QueryRow(ctx, query, symbol).Scan(&tc.StockId, &tc.AraLimit, &tc.ArbLimit, &tc.SessionId, &tc.SessionStatus)
 
 	if err != nil {
 		// Try CLOSED
@@ -51,33 +48,117 @@ func (s *OrderService) PlaceOrder(userId string, symbol string, orderType string
 				SELECT s.id, d.ara_limit, d.arb_limit, d.session_id
 				FROM stocks s
 				JOIN daily_stock_data d ON s.id = d.stock_id
-				WHERE s.symbol = $1
+				WHERE s.symbol = $1 AND s.is_active = true
 				ORDER BY d.session_id DESC LIMIT 1
 			`
-			err = tx.QueryRow(ctx, queryClosed, symbol).Scan(&stockId, &araLimit, &arbLimit, &sessionId)
+			err = tx.QueryRow(ctx, queryClosed, symbol).Scan(&tc.StockId, &tc.AraLimit, &tc.ArbLimit, &tc.SessionId)
 			if err != nil {
 				return nil, errors.New("Saham tidak ditemukan")
 			}
-			sessionStatus = "CLOSED"
+			tc.SessionStatus = "CLOSED"
 		} else {
 			return nil, err
 		}
 	}
+	return &tc, nil
+}
+
+// displayQuantity > 0 makes an iceberg order: only that many lots are shown at a time.
+func (s *OrderService) PlaceOrder(userId string, symbol string, orderType string, priceType string, timeInForce string, price float64, quantity int64, displayQuantity int64) (*models.Order, error) {
+	// 0. Order Type & Time in Force
+	if priceType == "" {
+		priceType = engine.PriceTypeLimit
+	}
+	if timeInForce == "" {
+		timeInForce = engine.TIFDay
+		if priceType == engine.PriceTypeMarket {
+			timeInForce = engine.TIFIOC
+		}
+	}
+	if priceType != engine.PriceTypeLimit && priceType != engine.PriceTypeMarket {
+		return nil, errors.New("Tipe harga tidak valid (LIMIT/MARKET)")
+	}
+	switch timeInForce {
+	case engine.TIFDay, engine.TIFGTC, engine.TIFIOC, engine.TIFFOK:
+	default:
+		return nil, errors.New("Time in force tidak valid (DAY/GTC/IOC/FOK)")
+	}
+	if priceType == engine.PriceTypeMarket && timeInForce != engine.TIFIOC && timeInForce != engine.TIFFOK {
+		return nil, errors.New("Market order hanya mendukung IOC atau FOK")
+	}
+	immediate := timeInForce == engine.TIFIOC || timeInForce == engine.TIFFOK
+
+	var displayQty *int64
+	if displayQuantity != 0 {
+		if priceType != engine.PriceTypeLimit || immediate {
+			return nil, errors.New("Iceberg hanya untuk order LIMIT DAY/GTC")
+		}
+		if displayQuantity < 0 || displayQuantity >= quantity {
+			return nil, errors.New("Display quantity harus lebih dari 0 dan lebih kecil dari jumlah order")
+		}
+		displayQty = &displayQuantity
+	}
+
+	ctx := context.Background()
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// 1. Get Stock Data & Session
+	tc, err := loadTradingContext(ctx, tx, symbol)
+	if err != nil {
+		return nil, err
+	}
+	stockId, araLimit, arbLimit, sessionId, sessionStatus := tc.StockId, tc.AraLimit, tc.ArbLimit, tc.SessionId, tc.SessionStatus
 
 	if sessionStatus == "LOCKED" {
 		return nil, errors.New("Market sedang Locked (IEP Calculation). Tidak bisa pasang order.")
 	}
+	if sessionStatus == "BREAK" {
+		return nil, errors.New("Market sedang istirahat. Order bisa dipasang kembali saat sesi 2 dibuka.")
+	}
 
-	// 2. Validate Price
-	if !isValidTickSize(price) {
-		return nil, errors.New("Harga tidak sesuai fraksi (Tick Size)")
+	if immediate && sessionStatus != "OPEN" {
+		return nil, fmt.Errorf("Order %s hanya bisa dipasang saat market OPEN", timeInForce)
 	}
-	if price > araLimit || price < arbLimit {
-		return nil, errors.New("Harga melampaui batas ARA/ARB")
+
+	// Trading halt: nothing is accepted while HALTED; the re-opening auction takes
+	// resting orders only, like the other call auctions
+	if h := engine.Engine.HaltOf(symbol); h != nil && sessionStatus == "OPEN" {
+		if h.Phase == engine.HaltHalted {
+			return nil, fmt.Errorf("Perdagangan %s sedang dihentikan sementara (%s). Order belum bisa dipasang.", symbol, h.Reason)
+		}
+		if immediate {
+			return nil, fmt.Errorf("Order %s tidak bisa dipasang saat lelang pembukaan kembali %s", timeInForce, symbol)
+		}
 	}
 
-	totalCost := price * float64(quantity*100)
+	// 2. Validate Price
+	// Market orders sweep the book up to the daily limit: BUY is priced (and reserved) at ARA,
+	// SELL at ARB. Price improvement on each fill is refunded by the engine.
+	if priceType == engine.PriceTypeMarket {
+		price = araLimit
+		if orderType == "SELL" {
+			price = arbLimit
+		}
+	} else {
+		if !isValidTickSize(price) {
+			return nil, errors.New("Harga tidak sesuai fraksi (Tick Size)")
+		}
+		if price > araLimit || price < arbLimit {
+			return nil, errors.New("Harga melampaui batas ARA/ARB")
+		}
+	}
+
+	// Fee rates are fixed on the order, so its reservation covers the settlement fee
+	rates, err := fees.Resolve(ctx, tx, userId, stockId, orderType)
+	if err != nil { return nil, err }
+
+	totalCost := rates.Reserve(price, quantity)
 	var avgPriceAtOrder *float64
+	var shortMarginPct float64 // > 0: a short sale, see short_service.go
 
 	// 3. Balance / Portfolio Check
 	if orderType == "BUY" {
@@ -87,25 +168,39 @@ func (s *OrderService) PlaceOrder(userId string, symbol string, orderType string
 		if balance < totalCost {
 			return nil, errors.New("Saldo RDN tidak cukup")
 		}
-		_, err = tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn - $1 WHERE id = $2", totalCost, userId)
-		if err != nil { return nil, err }
 	} else if orderType == "SELL" {
-		var ownedQty int64
+		var ownedQty, lockedQty int64
 		var avgPrice float64
-		err = tx.QueryRow(ctx, "SELECT quantity_owned, avg_buy_price FROM portfolios WHERE user_id = $1 AND stock_id = $2 FOR UPDATE", userId, stockId).Scan(&ownedQty, &avgPrice)
-		if err != nil {
-			if err == pgx.ErrNoRows { return nil, errors.New("Anda tidak memiliki saham ini") }
+		err = tx.QueryRow(ctx, "SELECT quantity_owned, locked_quantity, avg_buy_price FROM portfolios WHERE user_id = $1 AND stock_id = $2 FOR UPDATE", userId, stockId).Scan(&ownedQty, &lockedQty, &avgPrice)
+		if err != nil && err != pgx.ErrNoRows {
 			return nil, err
 		}
-		avgPriceAtOrder = &avgPrice
-
-		// Check locked quantity
-		var lockedQty int64
-		err = tx.QueryRow(ctx, "SELECT COALESCE(SUM(remaining_quantity), 0) FROM orders WHERE user_id = $1 AND stock_id = $2 AND type = 'SELL' AND status IN ('PENDING', 'PARTIAL')", userId, stockId).Scan(&lockedQty)
-		if err != nil { return nil, err }
+		owned := err == nil
+		if owned {
+			avgPriceAtOrder = &avgPrice
+		}
 
 		if ownedQty-lockedQty < quantity {
-			return nil, fmt.Errorf("Jumlah saham tidak cukup. Anda punya %d lot, tapi %d lot sudah ada di antrean jual.", ownedQty, lockedQty)
+			// Not enough lots: users who opted in sell the whole order short
+			shortMarginPct, err = shortSaleMargin(ctx, tx, userId, stockId)
+			if err != nil { return nil, err }
+			switch {
+			case shortMarginPct == 0 && !owned:
+				return nil, errors.New("Anda tidak memiliki saham ini")
+			case shortMarginPct == 0:
+				return nil, fmt.Errorf("Jumlah saham tidak cukup. Anda punya %d lot, tapi %d lot sudah ada di antrean jual.", ownedQty, lockedQty)
+			case ownedQty-lockedQty > 0:
+				return nil, fmt.Errorf("Jual dulu %d lot yang Anda miliki sebelum short sell", ownedQty-lockedQty)
+			}
+
+			totalCost = ledger.ShortMargin(price, quantity, shortMarginPct)
+			avgPriceAtOrder = nil
+			var balance float64
+			err = tx.QueryRow(ctx, "SELECT balance_rdn FROM users WHERE id = $1 FOR UPDATE", userId).Scan(&balance)
+			if err != nil { return nil, err }
+			if balance < totalCost {
+				return nil, fmt.Errorf("Saldo RDN tidak cukup untuk initial margin short sell (%.0f)", totalCost)
+			}
 		}
 	} else {
 		return nil, errors.New("Invalid order type")
@@ -114,18 +209,28 @@ func (s *OrderService) PlaceOrder(userId string, symbol string, orderType string
 	// 4. Insert Order
 	var orderID string
 	err = tx.QueryRow(ctx, `
-		INSERT INTO orders (user_id, stock_id, session_id, type, price, quantity, remaining_quantity, status, avg_price_at_order)
-		VALUES ($1, $2, $3, $4, $5, $6, $6, 'PENDING', $7)
+		INSERT INTO orders (user_id, stock_id, session_id, type, price, quantity, remaining_quantity, status, avg_price_at_order, price_type, time_in_force, display_quantity,
+			fee_commission_pct, fee_levy_pct, fee_tax_pct, is_short, margin_pct)
+		VALUES ($1, $2, $3, $4, $5, $6, $6, 'PENDING', $7, $8, $9, $10, $11, $12, $13, $14, $15)
 		RETURNING id
-	`, userId, stockId, sessionId, orderType, price, quantity, avgPriceAtOrder).Scan(&orderID)
+	`, userId, stockId, sessionId, orderType, price, quantity, avgPriceAtOrder, priceType, timeInForce, displayQty,
+		rates.CommissionPct, rates.LevyPct, rates.TaxPct, shortMarginPct > 0, shortMarginPct).Scan(&orderID)
+	if err != nil { return nil, err }
+
+	// 5. Reserve the cost or short margin / lock the shares
+	if orderType == "BUY" || shortMarginPct > 0 {
+		err = ledger.ReserveCash(ctx, tx, userId, orderID, totalCost)
+	} else {
+		err = ledger.LockShares(ctx, tx, userId, stockId, quantity)
+	}
 	if err != nil { return nil, err }
 
 	if err := tx.Commit(ctx); err != nil {
 		return nil, err
 	}
 
-	// 5. Redis & Engine
-	if sessionStatus == "OPEN" || sessionStatus == "PRE_OPEN" {
+	// 6. Book & Engine
+	if sessionStatus == "OPEN" || sessionStatus == "PRE_OPEN" || sessionStatus == "PRE_CLOSE" {
 		timestamp := time.Now().UnixMilli()
 		redisPayload := models.RedisOrderData{
 			OrderId:           orderID,
@@ -136,98 +241,259 @@ func (s *OrderService) PlaceOrder(userId string, symbol string, orderType string
 			Timestamp:         timestamp,
 			RemainingQuantity: quantity,
 			AvgPriceAtOrder:   avgPriceAtOrder,
+			PriceType:         priceType,
+			TimeInForce:       timeInForce,
+			DisplayQuantity:   displayQuantity,
 		}
 
-		payloadBytes, _ := json.Marshal(redisPayload)
-		key := fmt.Sprintf("orderbook:%s:%s", symbol, func() string { if orderType == "BUY" { return "buy" } else { return "sell" } }())
-
-		if err := config.RedisMain.ZAdd(context.Background(), key, redis.Z{
-			Score:  price,
-			Member: string(payloadBytes),
-		}).Err(); err != nil {
-			log.Println("Failed to add to Redis:", err)
-			// Non-fatal? The order is in DB. But Engine won't see it.
-			// Ideally should retry or fail.
+		if immediate {
+			// IOC/FOK never rest in the book
+			engine.Engine.MatchImmediate(symbol, engine.SideKey(orderType), timeInForce, redisPayload)
+		} else {
+			engine.Engine.AddOrder(symbol, engine.SideKey(orderType), redisPayload)
+			engine.Engine.Match(symbol)
 		}
-
-		engine.Engine.Match(symbol)
 	}
 
-	return &models.Order{ID: orderID, Status: "PENDING"}, nil
+	return &models.Order{ID: orderID, Status: "PENDING", Price: price, PriceType: priceType, TimeInForce: timeInForce, DisplayQuantity: displayQty, IsShort: shortMarginPct > 0}, nil
 }
 
-func (s *OrderService) CancelOrder(userId string, orderId string) error {
-	ctx := context.Background()
-	tx, err := config.DB.Begin(ctx)
-	if err != nil { return err }
-	defer tx.Rollback(ctx)
-
-	// 1. Get Order
-	var o models.Order
+// orderSymbol looks up the symbol of a user's order, so its symbol lock can be taken
+// before the order row is locked
+func orderSymbol(ctx context.Context, userId, orderId string) (string, error) {
 	var symbol string
-	// Join stocks to get symbol
-	err = tx.QueryRow(ctx, `
-		SELECT o.id, o.stock_id, o.type, o.price, o.remaining_quantity, o.status, s.symbol
+	err := config.DB.QueryRow(ctx, `
+		SELECT s.symbol
 		FROM orders o
 		JOIN stocks s ON o.stock_id = s.id
 		WHERE o.id = $1 AND o.user_id = $2
-		FOR UPDATE
-	`, orderId, userId).Scan(&o.ID, &o.StockID, &o.Type, &o.Price, &o.RemainingQty, &o.Status, &symbol)
+	`, orderId, userId).Scan(&symbol)
+	if err == pgx.ErrNoRows {
+		return "", errors.New("Order tidak ditemukan")
+	}
+	return symbol, err
+}
+
+func (s *OrderService) CancelOrder(userId string, orderId string) error {
+	ctx := context.Background()
+	symbol, err := orderSymbol(ctx, userId, orderId)
+	if err != nil { return err }
 
+	// The symbol lock keeps the engine from matching the order between the DB cancel
+	// and its removal from the book
+	err = engine.Engine.WithSymbolLock(symbol, func() error {
+		tx, err := config.DB.Begin(ctx)
+		if err != nil { return err }
+		defer tx.Rollback(ctx)
+
+		// 1. Check Order
+		var status string
+		err = tx.QueryRow(ctx, "SELECT status FROM orders WHERE id = $1 AND user_id = $2 FOR UPDATE", orderId, userId).Scan(&status)
+		if err != nil {
+			if err == pgx.ErrNoRows { return errors.New("Order tidak ditemukan") }
+			return err
+		}
+
+		if status != "PENDING" && status != "PARTIAL" {
+			return fmt.Errorf("Order tidak bisa dibatalkan (status: %s)", status)
+		}
+
+		// 2. Cancel, releasing the reservation
+		if _, _, err := engine.CancelOrderTx(ctx, tx, orderId); err != nil { return err }
+
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+
+		// 3. Book Removal (Redis snapshot is written behind)
+		engine.Engine.RemoveOrder(symbol, orderId)
+		return nil
+	})
 	if err != nil {
-		if err == pgx.ErrNoRows { return errors.New("Order tidak ditemukan") }
 		return err
 	}
 
-	if o.Status != "PENDING" && o.Status != "PARTIAL" {
-		return fmt.Errorf("Order tidak bisa dibatalkan (status: %s)", o.Status)
-	}
+	engine.Engine.BroadcastOrderBook(symbol)
+	return nil
+}
+
+// AmendOrder changes the price and/or total quantity of a resting LIMIT order.
+// A zero price or quantity leaves that field unchanged. quantity includes lots already matched.
+// Reducing the quantity keeps time priority; a price change or an increase sends the order
+// to the back of the queue at its price.
+func (s *OrderService) AmendOrder(userId string, orderId string, price float64, quantity int64) (*models.Order, error) {
+	ctx := context.Background()
+	symbol, err := orderSymbol(ctx, userId, orderId)
+	if err != nil { return nil, err }
+
+	var o models.Order
+	var rates fees.Rates
+	var newPrice float64
+	var newQty, newRem int64
+	var keepPriority, inBook bool
 
-	// 2. Refund
-	if o.Type == "BUY" {
-		refund := o.Price * float64(o.RemainingQty*100)
-		_, err = tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn + $1 WHERE id = $2", refund, userId)
+	err = engine.Engine.WithSymbolLock(symbol, func() error {
+		tx, err := config.DB.Begin(ctx)
 		if err != nil { return err }
-	}
+		defer tx.Rollback(ctx)
+
+		// 1. Get Order
+		var marginPct float64
+		err = tx.QueryRow(ctx, `
+			SELECT id, stock_id, type, price, quantity, remaining_quantity, status, price_type, time_in_force,
+				fee_commission_pct, fee_levy_pct, fee_tax_pct, is_short, margin_pct
+			FROM orders
+			WHERE id = $1 AND user_id = $2
+			FOR UPDATE
+		`, orderId, userId).Scan(&o.ID, &o.StockID, &o.Type, &o.Price, &o.Quantity, &o.RemainingQty, &o.Status, &o.PriceType, &o.TimeInForce,
+			&rates.CommissionPct, &rates.LevyPct, &rates.TaxPct, &o.IsShort, &marginPct)
+		if err != nil {
+			if err == pgx.ErrNoRows { return errors.New("Order tidak ditemukan") }
+			return err
+		}
 
-	// 3. Update Status
-	_, err = tx.Exec(ctx, "UPDATE orders SET status = 'CANCELED', updated_at = NOW() WHERE id = $1", orderId)
-	if err != nil { return err }
+		if o.Status != "PENDING" && o.Status != "PARTIAL" {
+			return fmt.Errorf("Order tidak bisa diubah (status: %s)", o.Status)
+		}
+		if o.PriceType != engine.PriceTypeLimit || (o.TimeInForce != engine.TIFDay && o.TimeInForce != engine.TIFGTC) {
+			return errors.New("Hanya order LIMIT DAY/GTC yang bisa diubah")
+		}
 
-	// 4. Redis Removal
-	// This is tricky because we need to match the member string exactly or parse it.
-	// Node implementation scans ZRANGE.
-	key := fmt.Sprintf("orderbook:%s:%s", symbol, func() string { if o.Type == "BUY" { return "buy" } else { return "sell" } }())
+		tc, err := loadTradingContext(ctx, tx, symbol)
+		if err != nil { return err }
+		if tc.SessionStatus == "LOCKED" {
+			return errors.New("Market sedang Locked (IEP Calculation). Tidak bisa ubah order.")
+		}
+		if h := engine.Engine.HaltOf(symbol); h != nil && h.Phase == engine.HaltHalted && tc.SessionStatus == "OPEN" {
+			return fmt.Errorf("Perdagangan %s sedang dihentikan sementara (%s). Order belum bisa diubah.", symbol, h.Reason)
+		}
 
-	// We do this AFTER commit to ensure DB consistency? No, inside transaction implies logic consistency.
-	// But Redis isn't transactional with PG.
-	// If Redis fails, order is cancelled in DB but stuck in Orderbook. BAD.
-	// But we can't rollback Redis easily if DB commit fails.
-	// Best effort: Remove from Redis after DB commit.
+		// 2. Validate
+		newPrice, newQty = o.Price, o.Quantity
+		if price > 0 { newPrice = price }
+		if quantity > 0 { newQty = quantity }
+		if newPrice == o.Price && newQty == o.Quantity {
+			return errors.New("Tidak ada perubahan pada order")
+		}
 
-	if err := tx.Commit(ctx); err != nil {
-		return err
-	}
+		// Lots taken off by self-trade prevention are gone like matched ones
+		var reduced int64
+		err = tx.QueryRow(ctx, `
+			SELECT COALESCE(SUM(quantity), 0) FROM stp_events
+			WHERE user_id = $1 AND ((buy_order_id = $2 AND buy_action = 'DECREMENTED') OR (sell_order_id = $2 AND sell_action = 'DECREMENTED'))
+		`, userId, orderId).Scan(&reduced)
+		if err != nil { return err }
+
+		filled := o.Quantity - o.RemainingQty
+		if newQty <= filled && reduced > 0 {
+			return fmt.Errorf("Jumlah baru harus lebih besar dari %d lot (%d lot sudah match, %d lot dikurangi STP)", filled, filled-reduced, reduced)
+		}
+		if newQty <= filled {
+			return fmt.Errorf("Jumlah baru harus lebih besar dari yang sudah match (%d lot)", filled)
+		}
+		newRem = newQty - filled
 
-	go func() {
-		// Clean from Redis
-		orders, err := config.RedisMain.ZRange(context.Background(), key, 0, -1).Result()
-		if err != nil { return }
+		if newPrice != o.Price {
+			if !isValidTickSize(newPrice) {
+				return errors.New("Harga tidak sesuai fraksi (Tick Size)")
+			}
+			if newPrice > tc.AraLimit || newPrice < tc.ArbLimit {
+				return errors.New("Harga melampaui batas ARA/ARB")
+			}
+		}
+
+		// 3. Re-reserve Balance / Short Margin / Shares
+		if o.Type == "BUY" || o.IsShort {
+			hold := rates.Reserve
+			if o.IsShort {
+				hold = func(price float64, lots int64) float64 { return ledger.ShortMargin(price, lots, marginPct) }
+			}
+			delta := hold(newPrice, newRem) - hold(o.Price, o.RemainingQty)
+			if delta > 0 {
+				var balance float64
+				err = tx.QueryRow(ctx, "SELECT balance_rdn FROM users WHERE id = $1 FOR UPDATE", userId).Scan(&balance)
+				if err != nil { return err }
+				if balance < delta {
+					return errors.New("Saldo RDN tidak cukup")
+				}
+			}
+			if delta > 0 {
+				err = ledger.ReserveCash(ctx, tx, userId, orderId, delta)
+			} else {
+				err = ledger.ReleaseCash(ctx, tx, userId, orderId, -delta)
+			}
+			if err != nil { return err }
+		} else if newRem != o.RemainingQty {
+			if newRem > o.RemainingQty {
+				var ownedQty, lockedQty int64
+				err = tx.QueryRow(ctx, "SELECT quantity_owned, locked_quantity FROM portfolios WHERE user_id = $1 AND stock_id = $2 FOR UPDATE", userId, o.StockID).Scan(&ownedQty, &lockedQty)
+				if err != nil {
+					if err == pgx.ErrNoRows { return errors.New("Anda tidak memiliki saham ini") }
+					return err
+				}
+				// This order's own lots are part of lockedQty
+				lockedQty -= o.RemainingQty
 
-		for _, member := range orders {
-			var data models.RedisOrderData
-			if err := json.Unmarshal([]byte(member), &data); err == nil {
-				if data.OrderId == orderId {
-					config.RedisMain.ZRem(context.Background(), key, member)
-					break
+				if ownedQty-lockedQty < newRem {
+					return fmt.Errorf("Jumlah saham tidak cukup. Anda punya %d lot, tapi %d lot sudah ada di antrean jual.", ownedQty, lockedQty)
 				}
 			}
+			err = ledger.LockShares(ctx, tx, userId, o.StockID, newRem-o.RemainingQty)
+			if err != nil { return err }
 		}
-		// Trigger broadcast
-		engine.Engine.BroadcastOrderBook(symbol)
-	}()
 
-	return nil
+		// 4. Update Order
+		keepPriority = newPrice == o.Price && newRem <= o.RemainingQty
+		_, err = tx.Exec(ctx, `
+			UPDATE orders
+			SET price = $1, quantity = $2, remaining_quantity = $3, updated_at = NOW(),
+				priority_at = CASE WHEN $4 THEN priority_at ELSE NOW() END,
+				display_quantity = CASE WHEN display_quantity >= $2 THEN NULL ELSE display_quantity END
+			WHERE id = $5
+		`, newPrice, newQty, newRem, keepPriority, orderId)
+		if err != nil { return err }
+
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+
+		// 5. Book (only resting while a session is running)
+		var cur engine.ParsedOrder
+		cur, inBook = engine.Engine.Book(symbol).Get(orderId)
+		if inBook {
+			cur.Data.Price = newPrice
+			cur.Data.Quantity = newQty
+			cur.Data.RemainingQuantity = newRem
+			if !keepPriority {
+				cur.Data.Timestamp = time.Now().UnixMilli()
+				cur.Data.VisibleQuantity = 0 // iceberg shows a fresh slice
+			}
+			if cur.Data.DisplayQuantity >= newQty {
+				// Shrunk below its display size: no longer an iceberg
+				cur.Data.DisplayQuantity, cur.Data.VisibleQuantity = 0, 0
+			}
+			engine.Engine.AddOrder(symbol, engine.SideKey(o.Type), cur.Data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	engine.Engine.NotifyOrderStatus(userId, map[string]interface{}{
+		"order_id": orderId, "status": "AMENDED", "price": newPrice,
+		"quantity": newQty, "matched_quantity": newQty - newRem, "remaining_quantity": newRem,
+		"priority_kept": keepPriority,
+		"symbol": symbol, "type": o.Type,
+	})
+
+	if inBook {
+		// A new price may cross the spread; Match broadcasts the book either way
+		engine.Engine.Match(symbol)
+	}
+
+	o.Price, o.Quantity, o.RemainingQty = newPrice, newQty, newRem
+	return &o, nil
 }
 
 // Helper: Tick Size Validation
@@ -0,0 +1,809 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+	"mbit-backend-go/core/ledger"
+
+	"github.com/jackc/pgx/v5"
+	socketio "github.com/zishang520/socket.io/v2/socket"
+)
+
+// Rights issues.
+// Every ratio_old lots held when the cum session closes earn ratio_new lots of rights.
+// Rights are held as a temporary stock <SYMBOL>-R in portfolios; each lot of rights buys
+// one new lot at the exercise price from the exercise start to the exercise end session.
+// Tradeable rights are activated for that window and trade through the matching engine
+// like any stock, listed at their theoretical price. When the end session closes, rights
+// that were not exercised lapse and the rights stock is deactivated. New shares are
+// issued within the stock's max_shares. Quantities are in lots.
+
+// Rights issue statuses
+const (
+	RightsAnnounced  = "ANNOUNCED"
+	RightsRecorded   = "RECORDED"   // rights credited, exercise window not started
+	RightsExercising = "EXERCISING" // exercise window open
+	RightsCompleted  = "COMPLETED"  // window closed, the rest lapsed
+	RightsCanceled   = "CANCELED"
+)
+
+// rightsSuffix makes the symbol of the rights stock
+const rightsSuffix = "-R"
+
+var (
+	ErrRightsNotFound      = errors.New("Rights issue tidak ditemukan")
+	ErrRightsNotExercising = errors.New("Rights issue tidak sedang dalam masa exercise")
+	ErrRightsNotCancelable = errors.New("Rights issue yang sudah dicatat tidak bisa dibatalkan")
+)
+
+type RightsIssue struct {
+	ID                   string     `json:"id"`
+	Symbol               string     `json:"symbol"`
+	RightsSymbol         string     `json:"rights_symbol"`
+	RatioOld             int64      `json:"ratio_old"` // lots held ...
+	RatioNew             int64      `json:"ratio_new"` // ... earn this many lots of rights
+	ExercisePrice        float64    `json:"exercise_price"`
+	CumSession           int        `json:"cum_session"`
+	ExerciseStartSession int        `json:"exercise_start_session"`
+	ExerciseEndSession   int        `json:"exercise_end_session"`
+	Tradeable            bool       `json:"tradeable"`
+	Status               string     `json:"status"`
+	ListingPrice         *float64   `json:"listing_price"`
+	TotalRights          int64      `json:"total_rights"`
+	ExercisedRights      int64      `json:"exercised_rights"`
+	LapsedRights         int64      `json:"lapsed_rights"`
+	Holders              int        `json:"holders"`
+	CreatedAt            time.Time  `json:"created_at"`
+	RecordedAt           *time.Time `json:"recorded_at"`
+	StartedAt            *time.Time `json:"started_at"`
+	CompletedAt          *time.Time `json:"completed_at"`
+}
+
+// RightsEntitlement is one user's rights of an issue, granted or bought
+type RightsEntitlement struct {
+	RightsIssueID   string     `json:"rights_issue_id"`
+	UserID          string     `json:"user_id"`
+	Username        string     `json:"username,omitempty"`
+	Symbol          string     `json:"symbol"`
+	RightsSymbol    string     `json:"rights_symbol"`
+	ExercisePrice   float64    `json:"exercise_price"`
+	Status          string     `json:"status"`
+	QuantityHeld    int64      `json:"quantity_held"` // lots at the cum session close
+	RightsGranted   int64      `json:"rights_granted"`
+	RightsHeld      int64      `json:"rights_held"` // lots of rights in the portfolio now
+	RightsExercised int64      `json:"rights_exercised"`
+	RightsLapsed    int64      `json:"rights_lapsed"`
+	ExerciseEnd     int        `json:"exercise_end_session"`
+	UpdatedAt       *time.Time `json:"updated_at"`
+}
+
+type AnnounceRightsParams struct {
+	Symbol               string
+	RatioOld             int64
+	RatioNew             int64
+	ExercisePrice        float64
+	CumSession           int
+	ExerciseStartSession int // default cum session + 1
+	ExerciseEndSession   int
+	Tradeable            bool
+}
+
+type RightsService struct{}
+
+var GlobalRightsService = &RightsService{}
+
+const rightsSelect = `
+	SELECT r.id::text, s.symbol, COALESCE(rs.symbol, s.symbol || '` + rightsSuffix + `'), r.ratio_old, r.ratio_new,
+		r.exercise_price::float8, r.cum_session, r.exercise_start_session, r.exercise_end_session, r.tradeable,
+		r.status, r.listing_price::float8, r.total_rights, r.exercised_rights, r.lapsed_rights,
+		(SELECT COUNT(*) FROM rights_entitlements e WHERE e.rights_issue_id = r.id AND e.rights_granted > 0),
+		r.created_at, r.recorded_at, r.started_at, r.completed_at
+	FROM rights_issues r
+	JOIN stocks s ON s.id = r.stock_id
+	LEFT JOIN stocks rs ON rs.id = r.rights_stock_id
+`
+
+func scanRights(row pgx.Row) (*RightsIssue, error) {
+	var r RightsIssue
+	err := row.Scan(&r.ID, &r.Symbol, &r.RightsSymbol, &r.RatioOld, &r.RatioNew,
+		&r.ExercisePrice, &r.CumSession, &r.ExerciseStartSession, &r.ExerciseEndSession, &r.Tradeable,
+		&r.Status, &r.ListingPrice, &r.TotalRights, &r.ExercisedRights, &r.LapsedRights,
+		&r.Holders, &r.CreatedAt, &r.RecordedAt, &r.StartedAt, &r.CompletedAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrRightsNotFound
+	}
+	return &r, err
+}
+
+// List returns rights issues, latest cum session first. symbol and status are optional.
+func (s *RightsService) List(ctx context.Context, symbol, status string) ([]RightsIssue, error) {
+	query := rightsSelect + " WHERE 1=1"
+	args := []interface{}{}
+	argCounter := 1
+	if symbol != "" {
+		query += fmt.Sprintf(" AND s.symbol = $%d", argCounter)
+		args = append(args, strings.ToUpper(symbol))
+		argCounter++
+	}
+	if status != "" {
+		query += fmt.Sprintf(" AND r.status = $%d", argCounter)
+		args = append(args, strings.ToUpper(status))
+		argCounter++
+	}
+	query += " ORDER BY r.cum_session DESC, r.created_at DESC"
+
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []RightsIssue{}
+	for rows.Next() {
+		r, err := scanRights(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *r)
+	}
+	return items, rows.Err()
+}
+
+func (s *RightsService) Get(ctx context.Context, id string) (*RightsIssue, error) {
+	return scanRights(config.DB.QueryRow(ctx, rightsSelect+" WHERE r.id::text = $1", id))
+}
+
+// Announce declares a rights issue on an active stock
+func (s *RightsService) Announce(ctx context.Context, adminId string, p AnnounceRightsParams) (*RightsIssue, error) {
+	p.Symbol = strings.ToUpper(strings.TrimSpace(p.Symbol))
+	if p.ExerciseStartSession == 0 {
+		p.ExerciseStartSession = p.CumSession + 1
+	}
+	switch {
+	case p.Symbol == "":
+		return nil, errors.New("Symbol wajib diisi")
+	case len(p.Symbol)+len(rightsSuffix) > 10:
+		return nil, errors.New("Symbol terlalu panjang untuk saham rights")
+	case p.RatioOld <= 0 || p.RatioNew <= 0 || p.RatioOld > maxActionRatio || p.RatioNew > maxActionRatio:
+		return nil, fmt.Errorf("Rasio harus antara 1 dan %d", maxActionRatio)
+	case p.ExercisePrice <= 0 || roundToTick(p.ExercisePrice) != p.ExercisePrice:
+		return nil, errors.New("Harga exercise tidak sesuai fraksi (Tick Size)")
+	case p.ExerciseStartSession <= p.CumSession:
+		return nil, errors.New("Masa exercise harus mulai setelah cum-date")
+	case p.ExerciseEndSession < p.ExerciseStartSession:
+		return nil, errors.New("Sesi akhir exercise tidak boleh sebelum sesi awal")
+	}
+
+	// The cum session must still be able to close: the running one or a later one
+	var first int
+	err := config.DB.QueryRow(ctx, `
+		SELECT COALESCE(MAX(session_number) FILTER (WHERE status <> 'CLOSED'), MAX(session_number) + 1, 1)
+		FROM trading_sessions
+	`).Scan(&first)
+	if err != nil {
+		return nil, err
+	}
+	if p.CumSession < first {
+		return nil, fmt.Errorf("Cum-date paling cepat sesi %d", first)
+	}
+
+	var stockId int
+	var active, busy, hasShorts bool
+	err = config.DB.QueryRow(ctx, `
+		SELECT s.id, COALESCE(s.is_active, false),
+			EXISTS (SELECT 1 FROM rights_issues r WHERE (r.stock_id = s.id AND r.status IN ('ANNOUNCED', 'RECORDED', 'EXERCISING')) OR r.rights_stock_id = s.id),
+			EXISTS (SELECT 1 FROM short_positions WHERE stock_id = s.id AND quantity > 0)
+				OR EXISTS (SELECT 1 FROM orders WHERE stock_id = s.id AND is_short AND status IN ('PENDING', 'PARTIAL'))
+		FROM stocks s WHERE s.symbol = $1
+	`, p.Symbol).Scan(&stockId, &active, &busy, &hasShorts)
+	if err == pgx.ErrNoRows || (err == nil && !active) {
+		return nil, errors.New("Saham tidak ditemukan atau tidak aktif")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if busy {
+		return nil, errors.New("Saham ini sudah memiliki rights issue yang berjalan")
+	}
+	// Buyers of borrowed lots would be granted rights nobody owes; short sales stay
+	// closed until the holders are recorded (see shortSaleMargin)
+	if hasShorts {
+		return nil, errors.New("Masih ada posisi atau order short untuk saham ini")
+	}
+
+	var id string
+	err = config.DB.QueryRow(ctx, `
+		INSERT INTO rights_issues (stock_id, ratio_old, ratio_new, exercise_price, cum_session, exercise_start_session, exercise_end_session, tradeable, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id::text
+	`, stockId, p.RatioOld, p.RatioNew, p.ExercisePrice, p.CumSession, p.ExerciseStartSession, p.ExerciseEndSession, p.Tradeable, adminId).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+// Cancel withdraws a rights issue before its holders are recorded
+func (s *RightsService) Cancel(ctx context.Context, id string) error {
+	tag, err := config.DB.Exec(ctx, "UPDATE rights_issues SET status = 'CANCELED' WHERE id::text = $1 AND status = 'ANNOUNCED'", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		if _, err := s.Get(ctx, id); err != nil {
+			return err
+		}
+		return ErrRightsNotCancelable
+	}
+	return nil
+}
+
+// Entitlements lists the rights of an issue, or of a user when userId is set
+func (s *RightsService) Entitlements(ctx context.Context, issueId, userId string) ([]RightsEntitlement, error) {
+	query := `
+		SELECT e.rights_issue_id::text, e.user_id::text, u.username, s.symbol, COALESCE(rs.symbol, ''),
+			r.exercise_price::float8, r.status, e.quantity_held, e.rights_granted, COALESCE(p.quantity_owned, 0),
+			e.rights_exercised, e.rights_lapsed, r.exercise_end_session, e.updated_at
+		FROM rights_entitlements e
+		JOIN rights_issues r ON r.id = e.rights_issue_id
+		JOIN stocks s ON s.id = r.stock_id
+		LEFT JOIN stocks rs ON rs.id = r.rights_stock_id
+		LEFT JOIN portfolios p ON p.user_id = e.user_id AND p.stock_id = r.rights_stock_id
+		JOIN users u ON u.id = e.user_id
+		WHERE 1=1
+	`
+	args := []interface{}{}
+	argCounter := 1
+	if issueId != "" {
+		query += fmt.Sprintf(" AND e.rights_issue_id::text = $%d", argCounter)
+		args = append(args, issueId)
+		argCounter++
+	}
+	if userId != "" {
+		query += fmt.Sprintf(" AND e.user_id = $%d", argCounter)
+		args = append(args, userId)
+		argCounter++
+	}
+	query += " ORDER BY r.cum_session DESC, e.rights_granted DESC"
+
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []RightsEntitlement{}
+	for rows.Next() {
+		var e RightsEntitlement
+		if err := rows.Scan(&e.RightsIssueID, &e.UserID, &e.Username, &e.Symbol, &e.RightsSymbol,
+			&e.ExercisePrice, &e.Status, &e.QuantityHeld, &e.RightsGranted, &e.RightsHeld,
+			&e.RightsExercised, &e.RightsLapsed, &e.ExerciseEnd, &e.UpdatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// Entitlement returns the user's rights of an issue, nil if the user has none
+func (s *RightsService) Entitlement(ctx context.Context, issueId, userId string) (*RightsEntitlement, error) {
+	items, err := s.Entitlements(ctx, issueId, userId)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return &items[0], nil
+}
+
+// Exercise converts lots of rights into new shares, paying the exercise price from
+// balance_rdn. Rights locked in open SELL orders cannot be exercised.
+func (s *RightsService) Exercise(ctx context.Context, userId, issueId string, quantity int64) (*RightsEntitlement, error) {
+	if quantity <= 0 {
+		return nil, errors.New("Jumlah lot harus lebih dari 0")
+	}
+
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var stockId int
+	var rightsStockId *int
+	var symbol, status string
+	var price float64
+	var open bool
+	err = tx.QueryRow(ctx, `
+		SELECT r.stock_id, r.rights_stock_id, s.symbol, r.status, r.exercise_price::float8,
+			r.exercise_end_session >= `+currentSessionNumber+`
+		FROM rights_issues r JOIN stocks s ON s.id = r.stock_id
+		WHERE r.id::text = $1
+		FOR UPDATE OF r
+	`, issueId).Scan(&stockId, &rightsStockId, &symbol, &status, &price, &open)
+	if err == pgx.ErrNoRows {
+		return nil, ErrRightsNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The window ends with its last session, even before the lapse has run
+	if status != RightsExercising || rightsStockId == nil || !open {
+		return nil, ErrRightsNotExercising
+	}
+
+	var held, locked int64
+	var rightsCost float64
+	err = tx.QueryRow(ctx, `
+		SELECT quantity_owned, locked_quantity, COALESCE(avg_buy_price, 0)::float8
+		FROM portfolios WHERE user_id = $1 AND stock_id = $2
+		FOR UPDATE
+	`, userId, *rightsStockId).Scan(&held, &locked, &rightsCost)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+	if held-locked < quantity {
+		return nil, fmt.Errorf("Rights tidak mencukupi (tersedia %d lot)", max(held-locked, 0))
+	}
+
+	// New shares come out of the authorized supply
+	var maxShares, issued int64
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(s.max_shares, 0), COALESCE((SELECT SUM(quantity_owned) FROM portfolios WHERE stock_id = s.id), 0)
+		FROM stocks s WHERE s.id = $1
+		FOR UPDATE
+	`, stockId).Scan(&maxShares, &issued)
+	if err != nil {
+		return nil, err
+	}
+	if issued+quantity > maxShares {
+		return nil, errors.New("Melebihi batas max_shares")
+	}
+
+	amount := price * float64(quantity) * 100
+	var balance float64
+	if err := tx.QueryRow(ctx, "SELECT balance_rdn FROM users WHERE id = $1 FOR UPDATE", userId).Scan(&balance); err != nil {
+		return nil, err
+	}
+	if balance < amount {
+		return nil, errors.New("Saldo RDN tidak mencukupi")
+	}
+
+	// Pay, give up the rights and receive the shares. Their cost includes what was paid
+	// for the rights themselves.
+	if _, err := tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn - $1 WHERE id = $2", amount, userId); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE portfolios SET quantity_owned = quantity_owned - $1 WHERE user_id = $2 AND stock_id = $3", quantity, userId, *rightsStockId); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO portfolios (user_id, stock_id, quantity_owned, avg_buy_price)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, stock_id) DO UPDATE SET
+			avg_buy_price = CASE WHEN portfolios.quantity_owned + EXCLUDED.quantity_owned > 0
+				THEN (portfolios.avg_buy_price * portfolios.quantity_owned + EXCLUDED.avg_buy_price * EXCLUDED.quantity_owned)
+					/ (portfolios.quantity_owned + EXCLUDED.quantity_owned)
+				ELSE EXCLUDED.avg_buy_price END,
+			quantity_owned = portfolios.quantity_owned + EXCLUDED.quantity_owned
+	`, userId, stockId, quantity, price+rightsCost)
+	if err != nil {
+		return nil, err
+	}
+
+	j := ledger.New(ledger.ReasonRightsExercise, ledger.RefRights, issueId)
+	j.Memo = fmt.Sprintf("Exercise %d lot rights %s @%g", quantity, symbol, price)
+	j.Shares(ledger.Shares(userId), ledger.External, *rightsStockId, quantity).
+		Cash(ledger.Cash(userId), ledger.External, amount).
+		Shares(ledger.External, ledger.Shares(userId), stockId, quantity)
+	if err := ledger.Post(ctx, tx, j); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, "INSERT INTO rights_exercises (rights_issue_id, user_id, quantity, amount) VALUES ($1, $2, $3, $4)", issueId, userId, quantity, amount); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO rights_entitlements (rights_issue_id, user_id, rights_exercised)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (rights_issue_id, user_id) DO UPDATE SET
+			rights_exercised = rights_entitlements.rights_exercised + EXCLUDED.rights_exercised, updated_at = NOW()
+	`, issueId, userId, quantity)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE rights_issues SET exercised_rights = exercised_rights + $1 WHERE id::text = $2", quantity, issueId); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return s.Entitlement(ctx, issueId, userId)
+}
+
+// dueIssues returns the ids of issues in status whose session column has been reached
+func dueIssues(ctx context.Context, q rowsQuerier, status, column string, sessionId int) ([]string, error) {
+	rows, err := q.Query(ctx, `
+		SELECT id::text FROM rights_issues
+		WHERE status = $1
+			AND `+column+` <= (SELECT session_number FROM trading_sessions WHERE id = $2)
+		ORDER BY cum_session
+	`, status, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		due = append(due, id)
+	}
+	return due, rows.Err()
+}
+
+// RecordDue credits the rights of every issue whose cum session closed, inside the
+// session close transaction, and returns the issues recorded
+func (s *RightsService) RecordDue(ctx context.Context, tx pgx.Tx, sessionId int) ([]string, error) {
+	due, err := dueIssues(ctx, tx, RightsAnnounced, "cum_session", sessionId)
+	if err != nil {
+		return nil, err
+	}
+	var recorded []string
+	for _, id := range due {
+		ok, err := s.record(ctx, tx, id)
+		if err != nil {
+			return nil, fmt.Errorf("rights issue %s: %w", id, err)
+		}
+		if ok {
+			recorded = append(recorded, id)
+		}
+	}
+	return recorded, nil
+}
+
+// NotifyRecorded tells the holders of rights issues recorded by a committed close
+func (s *RightsService) NotifyRecorded(ctx context.Context, sessionId int, ids []string) {
+	for _, id := range ids {
+		s.notify(ctx, id)
+	}
+	if len(ids) > 0 {
+		log.Printf("📜 Session %d: %d rights issue(s) recorded", sessionId, len(ids))
+	}
+}
+
+// record snapshots the holders, creates the rights stock (inactive) and credits the
+// rights. Returns false if the issue is not ANNOUNCED anymore.
+func (s *RightsService) record(ctx context.Context, tx pgx.Tx, id string) (bool, error) {
+	var stockId int
+	var symbol, name string
+	err := tx.QueryRow(ctx, `
+		SELECT r.stock_id, s.symbol, s.name
+		FROM rights_issues r JOIN stocks s ON s.id = r.stock_id
+		WHERE r.id::text = $1 AND r.status = 'ANNOUNCED'
+		FOR UPDATE OF r
+	`, id).Scan(&stockId, &symbol, &name)
+	if err == pgx.ErrNoRows {
+		return false, nil // canceled meanwhile
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO rights_entitlements (rights_issue_id, user_id, quantity_held, rights_granted)
+		SELECT r.id, p.user_id, p.quantity_owned, p.quantity_owned * r.ratio_new / r.ratio_old
+		FROM rights_issues r
+		JOIN portfolios p ON p.stock_id = r.stock_id
+		WHERE r.id::text = $1 AND p.quantity_owned * r.ratio_new / r.ratio_old > 0
+	`, id)
+	if err != nil {
+		return false, err
+	}
+	var total int64
+	if err := tx.QueryRow(ctx, "SELECT COALESCE(SUM(rights_granted), 0) FROM rights_entitlements WHERE rights_issue_id::text = $1", id).Scan(&total); err != nil {
+		return false, err
+	}
+
+	// A previous, completed rights issue of the stock may have left the symbol behind
+	var rightsStockId int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO stocks (symbol, name, max_shares, is_active)
+		VALUES ($1, $2, $3, false)
+		ON CONFLICT (symbol) DO UPDATE SET name = EXCLUDED.name, max_shares = EXCLUDED.max_shares, is_active = false
+		RETURNING id
+	`, symbol+rightsSuffix, "HMETD "+name, total).Scan(&rightsStockId)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := tx.Query(ctx, "SELECT user_id::text, rights_granted FROM rights_entitlements WHERE rights_issue_id::text = $1", id)
+	if err != nil {
+		return false, err
+	}
+	type grant struct {
+		userId string
+		lots   int64
+	}
+	var grants []grant
+	for rows.Next() {
+		var g grant
+		if err := rows.Scan(&g.userId, &g.lots); err != nil {
+			rows.Close()
+			return false, err
+		}
+		grants = append(grants, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	j := ledger.New(ledger.ReasonRightsDistribution, ledger.RefRights, id)
+	j.Memo = "Rights " + symbol + rightsSuffix
+	for _, g := range grants {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO portfolios (user_id, stock_id, quantity_owned, avg_buy_price)
+			VALUES ($1, $2, $3, 0)
+			ON CONFLICT (user_id, stock_id) DO UPDATE SET
+				avg_buy_price = CASE WHEN portfolios.quantity_owned > 0
+					THEN portfolios.avg_buy_price * portfolios.quantity_owned / (portfolios.quantity_owned + EXCLUDED.quantity_owned)
+					ELSE 0 END,
+				quantity_owned = portfolios.quantity_owned + EXCLUDED.quantity_owned
+		`, g.userId, rightsStockId, g.lots)
+		if err != nil {
+			return false, err
+		}
+		j.Shares(ledger.External, ledger.Shares(g.userId), rightsStockId, g.lots)
+	}
+	if err := ledger.Post(ctx, tx, j); err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE rights_issues SET status = 'RECORDED', rights_stock_id = $2, total_rights = $3, recorded_at = NOW()
+		WHERE id::text = $1
+	`, id, rightsStockId, total)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// StartSession opens the exercise window of recorded issues, inside the session open
+// transaction. Tradeable rights stocks are activated; the returned map holds their
+// listing price by stock id, to be used as prev_close.
+func (s *RightsService) StartSession(ctx context.Context, tx pgx.Tx, sessionId, sessionNumber int) (map[int]float64, error) {
+	rows, err := tx.Query(ctx, `
+		UPDATE rights_issues SET status = 'EXERCISING', started_at = NOW()
+		WHERE status = 'RECORDED' AND exercise_start_session <= $1
+		RETURNING id::text, stock_id, rights_stock_id, ratio_old, ratio_new, exercise_price::float8, tradeable
+	`, sessionNumber)
+	if err != nil {
+		return nil, err
+	}
+	type started struct {
+		id                     string
+		stockId, rightsStockId int
+		ratioOld, ratioNew     int64
+		price                  float64
+		tradeable              bool
+	}
+	var issues []started
+	for rows.Next() {
+		var r started
+		if err := rows.Scan(&r.id, &r.stockId, &r.rightsStockId, &r.ratioOld, &r.ratioNew, &r.price, &r.tradeable); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		issues = append(issues, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	listed := map[int]float64{}
+	for _, r := range issues {
+		if !r.tradeable {
+			continue
+		}
+		var last float64
+		err := tx.QueryRow(ctx, "SELECT COALESCE(close_price, prev_close)::float8 FROM daily_stock_data WHERE stock_id = $1 ORDER BY session_id DESC LIMIT 1", r.stockId).Scan(&last)
+		if err != nil && err != pgx.ErrNoRows {
+			return nil, err
+		}
+		price := theoreticalRightsPrice(last, r.price, r.ratioOld, r.ratioNew)
+		if _, err := tx.Exec(ctx, "UPDATE stocks SET is_active = true WHERE id = $1", r.rightsStockId); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(ctx, "UPDATE rights_issues SET listing_price = $1 WHERE id::text = $2", price, r.id); err != nil {
+			return nil, err
+		}
+		listed[r.rightsStockId] = price
+		log.Printf("📜 Rights: stock %d listed at %.2f", r.rightsStockId, price)
+	}
+	return listed, nil
+}
+
+// theoreticalRightsPrice is the value of one right: the theoretical ex-rights price
+// (TERP) minus the exercise price, at least the smallest price
+func theoreticalRightsPrice(last, exercise float64, ratioOld, ratioNew int64) float64 {
+	value := float64(ratioOld) * (last - exercise) / float64(ratioOld+ratioNew)
+	return math.Max(roundToTick(value), 1)
+}
+
+// completedIssue is a rights issue whose exercise window CloseDue ended
+type completedIssue struct {
+	id           string
+	rightsSymbol string
+	canceled     []engine.CanceledOrder
+}
+
+// CloseDue ends the exercise window of every issue whose end session closed, inside the
+// session close transaction. The caller passes the result to NotifyCompleted once the
+// close commits.
+func (s *RightsService) CloseDue(ctx context.Context, tx pgx.Tx, sessionId int) ([]completedIssue, error) {
+	due, err := dueIssues(ctx, tx, RightsExercising, "exercise_end_session", sessionId)
+	if err != nil {
+		return nil, err
+	}
+	var completed []completedIssue
+	for _, id := range due {
+		rightsSymbol, canceled, err := s.lapse(ctx, tx, id)
+		if err != nil {
+			return nil, fmt.Errorf("rights issue %s: %w", id, err)
+		}
+		if rightsSymbol != "" {
+			completed = append(completed, completedIssue{id, rightsSymbol, canceled})
+		}
+	}
+	return completed, nil
+}
+
+// NotifyCompleted clears the books of lapsed rights and tells their holders
+func (s *RightsService) NotifyCompleted(ctx context.Context, sessionId int, completed []completedIssue) {
+	for _, c := range completed {
+		engine.Engine.ClearBook(c.rightsSymbol)
+		for _, o := range c.canceled {
+			engine.Engine.NotifyOrderStatus(o.UserId, map[string]interface{}{
+				"order_id": o.OrderId, "status": "CANCELED", "price": o.Price,
+				"matched_quantity": 0, "remaining_quantity": o.RemainingQuantity,
+				"symbol": c.rightsSymbol, "type": o.Type, "reason": "RIGHTS_LAPSED",
+			})
+		}
+		s.notify(ctx, c.id)
+	}
+	if len(completed) > 0 {
+		log.Printf("📜 Session %d: %d rights issue(s) completed", sessionId, len(completed))
+	}
+}
+
+// lapse cancels the open orders on the rights, removes the rights left and deactivates
+// the rights stock. Returns an empty symbol if the issue is not EXERCISING anymore.
+func (s *RightsService) lapse(ctx context.Context, tx pgx.Tx, id string) (string, []engine.CanceledOrder, error) {
+	var rightsStockId int
+	var rightsSymbol string
+	err := tx.QueryRow(ctx, `
+		SELECT r.rights_stock_id, rs.symbol
+		FROM rights_issues r JOIN stocks rs ON rs.id = r.rights_stock_id
+		WHERE r.id::text = $1 AND r.status = 'EXERCISING'
+		FOR UPDATE OF r
+	`, id).Scan(&rightsStockId, &rightsSymbol)
+	if err == pgx.ErrNoRows {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	// GTC orders outlive the session close
+	rows, err := tx.Query(ctx, "SELECT id::text FROM orders WHERE stock_id = $1 AND status IN ('PENDING', 'PARTIAL')", rightsStockId)
+	if err != nil {
+		return "", nil, err
+	}
+	var orderIds []string
+	for rows.Next() {
+		var orderId string
+		if err := rows.Scan(&orderId); err != nil {
+			rows.Close()
+			return "", nil, err
+		}
+		orderIds = append(orderIds, orderId)
+	}
+	rows.Close()
+	var canceled []engine.CanceledOrder
+	for _, orderId := range orderIds {
+		o, ok, err := engine.CancelOrderTx(ctx, tx, orderId)
+		if err != nil {
+			return "", nil, err
+		}
+		if ok {
+			canceled = append(canceled, *o)
+		}
+	}
+
+	rows, err = tx.Query(ctx, `
+		UPDATE portfolios SET quantity_owned = 0, locked_quantity = 0
+		FROM (SELECT user_id, quantity_owned FROM portfolios WHERE stock_id = $1 AND quantity_owned > 0 FOR UPDATE) old
+		WHERE portfolios.stock_id = $1 AND portfolios.user_id = old.user_id
+		RETURNING portfolios.user_id::text, old.quantity_owned
+	`, rightsStockId)
+	if err != nil {
+		return "", nil, err
+	}
+	type lapsed struct {
+		userId string
+		lots   int64
+	}
+	var left []lapsed
+	var total int64
+	for rows.Next() {
+		var l lapsed
+		if err := rows.Scan(&l.userId, &l.lots); err != nil {
+			rows.Close()
+			return "", nil, err
+		}
+		left = append(left, l)
+		total += l.lots
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+
+	j := ledger.New(ledger.ReasonRightsLapse, ledger.RefRights, id)
+	j.Memo = "Rights " + rightsSymbol + " hangus"
+	for _, l := range left {
+		j.Shares(ledger.Shares(l.userId), ledger.External, rightsStockId, l.lots)
+		_, err := tx.Exec(ctx, `
+			INSERT INTO rights_entitlements (rights_issue_id, user_id, rights_lapsed)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (rights_issue_id, user_id) DO UPDATE SET
+				rights_lapsed = rights_entitlements.rights_lapsed + EXCLUDED.rights_lapsed, updated_at = NOW()
+		`, id, l.userId, l.lots)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if err := ledger.Post(ctx, tx, j); err != nil {
+		return "", nil, err
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE stocks SET is_active = false WHERE id = $1", rightsStockId); err != nil {
+		return "", nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE rights_issues SET status = 'COMPLETED', lapsed_rights = $2, completed_at = NOW()
+		WHERE id::text = $1
+	`, id, total)
+	if err != nil {
+		return "", nil, err
+	}
+	return rightsSymbol, canceled, nil
+}
+
+// notify sends each entitled user its rights of an issue
+func (s *RightsService) notify(ctx context.Context, id string) {
+	if engine.Engine == nil || engine.Engine.IoServer == nil {
+		return
+	}
+	items, err := s.Entitlements(ctx, id, "")
+	if err != nil {
+		log.Println("Rights notification error:", err)
+		return
+	}
+	for _, e := range items {
+		e.Username = ""
+		engine.Engine.IoServer.To(socketio.Room("user:"+e.UserID)).Emit("rights_update", e)
+	}
+}
@@ -0,0 +1,935 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+	_ "time/tzdata" // schedule timezones must resolve on hosts without zoneinfo
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+	"mbit-backend-go/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/robfig/cron/v3"
+)
+
+// Session lifecycle: PRE_OPEN -> LOCKED -> OPEN [-> BREAK -> OPEN] -> PRE_CLOSE -> CLOSED.
+// Scheduled sessions follow market_schedule; sessions opened by an admin run pre-open and
+// locked for the configured durations and then stay OPEN until closed. The phase is always
+// derived from the clock and the session row, so after a restart the scheduler resumes
+// whatever phase the market should be in.
+
+var (
+	ErrSessionRunning = errors.New("Sudah ada sesi trading yang sedang berjalan")
+	ErrNoSession      = errors.New("Tidak ada sesi yang sedang berjalan")
+
+	ErrInvalidAuctionPolicy = errors.New("Kebijakan alokasi lelang tidak valid (PRICE_TIME/PRO_RATA)")
+)
+
+// activeStatuses is every status of a running session
+const activeStatuses = "('PRE_OPEN', 'LOCKED', 'OPEN', 'BREAK', 'PRE_CLOSE')"
+
+// currentSessionNumber is the session_number of the running session, or of the next
+// one between sessions
+const currentSessionNumber = "(SELECT COALESCE(MAX(session_number) FILTER (WHERE status <> 'CLOSED'), MAX(session_number) + 1, 1) FROM trading_sessions)"
+
+type SessionSchedule struct {
+	Enabled          bool    `json:"enabled"`
+	Timezone         string  `json:"timezone"`
+	TradingDays      []int32 `json:"trading_days"` // ISO weekday, 1 = Monday
+	PreOpenAt        string  `json:"pre_open_at"`  // HH:MM:SS, exchange time
+	LockedAt         string  `json:"locked_at"`
+	Session1At       string  `json:"session1_at"`
+	BreakAt          *string `json:"break_at"` // nil = no break
+	Session2At       *string `json:"session2_at"`
+	PreCloseAt       string  `json:"pre_close_at"`
+	CloseAt          string  `json:"close_at"`
+	ManualPreOpenSec int     `json:"manual_pre_open_seconds"`
+	ManualLockedSec  int     `json:"manual_locked_seconds"`
+	CloseVWAPMinutes int     `json:"close_vwap_minutes"` // closing price window when the closing auction did not trade
+	AuctionPolicy    string  `json:"auction_policy"`     // allocation policy of scheduled sessions
+}
+
+type MarketHoliday struct {
+	Date        string `json:"date"` // YYYY-MM-DD
+	Description string `json:"description"`
+}
+
+type runningSession struct {
+	ID          int
+	Status      string
+	StartedAt   time.Time
+	Scheduled   bool
+	TradingDate *string
+}
+
+type SessionService struct {
+	mu sync.Mutex // serializes phase changes between the scheduler and admin endpoints
+}
+
+var GlobalSessionService = &SessionService{}
+
+// Start restores the engine phase from the DB and lets the cron drive transitions
+func (s *SessionService) Start(c *cron.Cron) {
+	if sess, err := s.running(context.Background()); err == nil && sess != nil {
+		engine.Engine.SessionStatus = sess.Status
+		log.Printf("⏰ Resuming session %d in %s", sess.ID, sess.Status)
+	}
+	s.Tick()
+
+	c.AddFunc("@every 5s", s.Tick)
+}
+
+// Tick moves the running session (or the schedule) to the phase it should be in now
+func (s *SessionService) Tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.advance(context.Background(), time.Now()); err != nil {
+		log.Println("Session scheduler error:", err)
+	}
+}
+
+func (s *SessionService) advance(ctx context.Context, now time.Time) error {
+	sched, err := s.GetSchedule(ctx)
+	if err != nil {
+		return err
+	}
+	sess, err := s.running(ctx)
+	if err != nil {
+		return err
+	}
+
+	if sess == nil {
+		if !sched.Enabled {
+			return nil
+		}
+		target, tradingDate, err := s.scheduledPhase(ctx, sched, now)
+		if err != nil || target == engine.StatusClosed {
+			return err
+		}
+		// Opened once per trading day; a scheduled session closed early by an admin stays closed
+		var done bool
+		if err := config.DB.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM trading_sessions WHERE scheduled = true AND trading_date = $1::date)", tradingDate).Scan(&done); err != nil || done {
+			return err
+		}
+		session, err := s.open(ctx, true, &tradingDate, sched.AuctionPolicy)
+		if err != nil {
+			return err
+		}
+		sess = &runningSession{ID: session.ID, Status: session.Status, StartedAt: session.StartedAt, Scheduled: true, TradingDate: &tradingDate}
+	}
+
+	target := s.manualPhase(sched, sess, now)
+	if sess.Scheduled {
+		var tradingDate string
+		target, tradingDate, err = s.scheduledPhase(ctx, sched, now)
+		if err != nil {
+			return err
+		}
+		if sess.TradingDate == nil || *sess.TradingDate != tradingDate {
+			target = engine.StatusClosed
+		}
+	}
+
+	// Step through every phase in between, so a restart still runs the auctions it missed
+	for {
+		next := nextPhase(sess.Status, target)
+		if next == "" {
+			return nil
+		}
+		if err := s.transition(ctx, sess.ID, sess.Status, next); err != nil {
+			return err
+		}
+		sess.Status = next
+	}
+}
+
+// scheduledPhase is the phase market_schedule puts now in, plus its trading date
+func (s *SessionService) scheduledPhase(ctx context.Context, sched *SessionSchedule, now time.Time) (string, string, error) {
+	loc, err := time.LoadLocation(sched.Timezone)
+	if err != nil {
+		loc = time.Local
+	}
+	local := now.In(loc)
+	tradingDate := local.Format("2006-01-02")
+
+	weekday := int32(local.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	isTradingDay := false
+	for _, d := range sched.TradingDays {
+		if d == weekday {
+			isTradingDay = true
+		}
+	}
+	if !isTradingDay {
+		return engine.StatusClosed, tradingDate, nil
+	}
+
+	var holiday bool
+	if err := config.DB.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM market_holidays WHERE holiday_date = $1::date)", tradingDate).Scan(&holiday); err != nil {
+		return "", "", err
+	}
+	if holiday {
+		return engine.StatusClosed, tradingDate, nil
+	}
+
+	// HH:MM:SS strings compare in time order
+	t := local.Format("15:04:05")
+	switch {
+	case t < sched.PreOpenAt:
+		return engine.StatusClosed, tradingDate, nil
+	case t < sched.LockedAt:
+		return engine.StatusPreOpen, tradingDate, nil
+	case t < sched.Session1At:
+		return engine.StatusLocked, tradingDate, nil
+	case sched.BreakAt != nil && t >= *sched.BreakAt && t < *sched.Session2At:
+		return engine.StatusBreak, tradingDate, nil
+	case t < sched.PreCloseAt:
+		return engine.StatusOpen, tradingDate, nil
+	case t < sched.CloseAt:
+		return engine.StatusPreClose, tradingDate, nil
+	}
+	return engine.StatusClosed, tradingDate, nil
+}
+
+// manualPhase is the phase of an admin-opened session: timed pre-open and locked, then OPEN
+func (s *SessionService) manualPhase(sched *SessionSchedule, sess *runningSession, now time.Time) string {
+	elapsed := now.Sub(sess.StartedAt)
+	preOpen := time.Duration(sched.ManualPreOpenSec) * time.Second
+	locked := time.Duration(sched.ManualLockedSec) * time.Second
+	switch {
+	case elapsed < preOpen:
+		return engine.StatusPreOpen
+	case elapsed < preOpen+locked:
+		return engine.StatusLocked
+	}
+	// Phases past OPEN (break, pre-close, close) are admin-driven for manual sessions
+	if sess.Status == engine.StatusPreOpen || sess.Status == engine.StatusLocked {
+		return engine.StatusOpen
+	}
+	return sess.Status
+}
+
+var phaseRank = map[string]int{
+	engine.StatusPreOpen:  0,
+	engine.StatusLocked:   1,
+	engine.StatusOpen:     2,
+	engine.StatusBreak:    3,
+	engine.StatusPreClose: 4,
+	engine.StatusClosed:   5,
+}
+
+// nextPhase is the phase after cur on the way to target, or "" when there is nothing to do.
+// Sessions only move forward; OPEN after BREAK is the second session.
+func nextPhase(cur, target string) string {
+	if cur == target {
+		return ""
+	}
+	if cur == engine.StatusBreak && target == engine.StatusOpen {
+		return engine.StatusOpen
+	}
+	if phaseRank[target] <= phaseRank[cur] {
+		return ""
+	}
+	switch cur {
+	case engine.StatusPreOpen:
+		return engine.StatusLocked
+	case engine.StatusLocked:
+		return engine.StatusOpen
+	case engine.StatusOpen:
+		if target == engine.StatusBreak {
+			return engine.StatusBreak
+		}
+		return engine.StatusPreClose
+	case engine.StatusBreak:
+		return engine.StatusPreClose
+	case engine.StatusPreClose:
+		return engine.StatusClosed
+	}
+	return ""
+}
+
+func (s *SessionService) transition(ctx context.Context, sessionId int, from, to string) error {
+	if to == engine.StatusClosed {
+		_, err := s.close(ctx)
+		return err
+	}
+
+	symbols, err := activeSymbols(ctx)
+	if err != nil {
+		return err
+	}
+	// Leaving the opening call auction uncrosses the book at the IEP. It runs while the
+	// session is still LOCKED, so no order reaches continuous matching on a crossed book.
+	if to == engine.StatusOpen && from != engine.StatusBreak {
+		uncross(symbols)
+	}
+
+	if _, err := config.DB.Exec(ctx, "UPDATE trading_sessions SET status = $1 WHERE id = $2", to, sessionId); err != nil {
+		return err
+	}
+	engine.Engine.SessionStatus = to
+	log.Printf("⏰ Session %d: %s -> %s", sessionId, from, to)
+	s.notifyPhase(sessionId, to)
+
+	// PRE_OPEN/LOCKED/PRE_CLOSE publish the IEP, OPEN resumes continuous matching
+	for _, sym := range symbols {
+		engine.Engine.Match(sym)
+	}
+	return nil
+}
+
+// uncross executes the call auction of every symbol at its IEP and returns the
+// auctions that traded, by symbol. Halted symbols are left to their re-opening auction.
+func uncross(symbols []string) map[string]*engine.IEPResult {
+	results := make(map[string]*engine.IEPResult)
+	for _, sym := range symbols {
+		if engine.Engine.HaltOf(sym) != nil {
+			continue
+		}
+		err := engine.Engine.WithSymbolLock(sym, func() error {
+			iep, err := engine.GlobalIEPEngine.ExecuteIEP(sym, engine.Engine)
+			if iep != nil && iep.MatchedVolume > 0 {
+				results[sym] = iep
+			}
+			return err
+		})
+		if err != nil {
+			log.Printf("Auction %s failed: %v", sym, err)
+		}
+	}
+	return results
+}
+
+func activeSymbols(ctx context.Context) ([]string, error) {
+	rows, err := config.DB.Query(ctx, "SELECT symbol FROM stocks WHERE is_active = true")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var symbols []string
+	for rows.Next() {
+		var sym string
+		if err := rows.Scan(&sym); err == nil {
+			symbols = append(symbols, sym)
+		}
+	}
+	return symbols, nil
+}
+
+func (s *SessionService) running(ctx context.Context) (*runningSession, error) {
+	var sess runningSession
+	err := config.DB.QueryRow(ctx, `
+		SELECT id, status, started_at, scheduled, to_char(trading_date, 'YYYY-MM-DD')
+		FROM trading_sessions
+		WHERE status IN `+activeStatuses+`
+		ORDER BY id DESC LIMIT 1
+	`).Scan(&sess.ID, &sess.Status, &sess.StartedAt, &sess.Scheduled, &sess.TradingDate)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (s *SessionService) notifyPhase(sessionId int, status string) {
+	if engine.Engine.IoServer == nil {
+		return
+	}
+	engine.Engine.IoServer.Emit("session_status", map[string]interface{}{
+		"session_id": sessionId,
+		"status":     status,
+		"timestamp":  time.Now().UnixMilli(),
+	})
+}
+
+// Open starts a manual session in PRE_OPEN; the scheduler takes it to OPEN.
+// An empty auctionPolicy defaults to price-time.
+func (s *SessionService) Open(auctionPolicy string) (*models.MarketSession, error) {
+	if auctionPolicy == "" {
+		auctionPolicy = engine.AuctionPriceTime
+	}
+	if !engine.IsValidAuctionPolicy(auctionPolicy) {
+		return nil, ErrInvalidAuctionPolicy
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open(context.Background(), false, nil, auctionPolicy)
+}
+
+// SetAuctionPolicy changes the allocation policy of the running session's next auctions
+func (s *SessionService) SetAuctionPolicy(policy string) error {
+	if !engine.IsValidAuctionPolicy(policy) {
+		return ErrInvalidAuctionPolicy
+	}
+	tag, err := config.DB.Exec(context.Background(), "UPDATE trading_sessions SET auction_policy = $1 WHERE status IN "+activeStatuses, policy)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSession
+	}
+	return nil
+}
+
+// Close runs the closing auction if the session is in PRE_CLOSE, sets the closing
+// prices and closes the session
+func (s *SessionService) Close() (*CloseResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.close(context.Background())
+}
+
+// SetPhase moves a manual session to BREAK, back to OPEN or into PRE_CLOSE
+func (s *SessionService) SetPhase(to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if to != engine.StatusBreak && to != engine.StatusOpen && to != engine.StatusPreClose {
+		return errors.New("Fase hanya bisa BREAK, OPEN atau PRE_CLOSE")
+	}
+	ctx := context.Background()
+	sess, err := s.running(ctx)
+	if err != nil {
+		return err
+	}
+	if sess == nil {
+		return ErrNoSession
+	}
+	if sess.Scheduled {
+		return errors.New("Sesi terjadwal mengikuti jadwal bursa")
+	}
+	if nextPhase(sess.Status, to) != to {
+		return fmt.Errorf("Tidak bisa pindah dari %s ke %s", sess.Status, to)
+	}
+	return s.transition(ctx, sess.ID, sess.Status, to)
+}
+
+func (s *SessionService) open(ctx context.Context, scheduled bool, tradingDate *string, auctionPolicy string) (*models.MarketSession, error) {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// 1. Check existing session
+	var count int
+	err = tx.QueryRow(ctx, "SELECT COUNT(*) FROM trading_sessions WHERE status IN "+activeStatuses).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrSessionRunning
+	}
+
+	// 2. Create new session (PRE_OPEN)
+	var session models.MarketSession
+	err = tx.QueryRow(ctx, `
+		INSERT INTO trading_sessions (session_number, status, started_at, scheduled, trading_date, auction_policy)
+		VALUES (
+			COALESCE((SELECT MAX(session_number) FROM trading_sessions), 0) + 1,
+			'PRE_OPEN',
+			NOW(),
+			$1,
+			COALESCE($2::date, CURRENT_DATE),
+			$3
+		)
+		RETURNING id, session_number, status, started_at
+	`, scheduled, tradingDate, auctionPolicy).Scan(&session.ID, &session.SessionNo, &session.Status, &session.StartedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// A close whose short marks or competition snapshot failed is back-filled before
+	// anything moves holdings; positions are marked first, as at the close
+	marks, err := GlobalShortService.BackfillMarks(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := GlobalCompetitionService.BackfillSnapshots(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	// IPOs: offering windows open, allotted stocks list at their offering price
+	listed, err := GlobalIPOService.StartSession(ctx, tx, session.ID, session.SessionNo)
+	if err != nil {
+		return nil, err
+	}
+	// Rights issues: exercise windows open, tradeable rights list at their theoretical price
+	rights, err := GlobalRightsService.StartSession(ctx, tx, session.ID, session.SessionNo)
+	if err != nil {
+		return nil, err
+	}
+	for stockId, price := range rights {
+		listed[stockId] = price
+	}
+
+	// 3. Init Daily Stock Data
+	// Fetch active stocks
+	rows, err := tx.Query(ctx, "SELECT id, symbol FROM stocks WHERE is_active = true")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type Stock struct {
+		ID     int
+		Symbol string
+	}
+	var stocks []Stock
+	for rows.Next() {
+		var st Stock
+		if err := rows.Scan(&st.ID, &st.Symbol); err != nil {
+			return nil, err
+		}
+		stocks = append(stocks, st)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, stock := range stocks {
+		// Get last close price: the closing price set at the last close,
+		// then the last candle, then the default
+		var prevClose float64 = 1000 // Default
+		if price, ok := listed[stock.ID]; ok {
+			prevClose = price
+		} else if err = tx.QueryRow(ctx, "SELECT COALESCE(close_price, prev_close) FROM daily_stock_data WHERE stock_id = $1 ORDER BY session_id DESC LIMIT 1", stock.ID).Scan(&prevClose); err == pgx.ErrNoRows {
+			err = tx.QueryRow(ctx, "SELECT close_price FROM candles WHERE stock_id = $1 ORDER BY timestamp DESC LIMIT 1", stock.ID).Scan(&prevClose)
+			if err == pgx.ErrNoRows {
+				prevClose = 1000
+			}
+		}
+
+		araLimit, arbLimit := CalculateLimits(prevClose)
+
+		_, err = tx.Exec(ctx, `
+			INSERT INTO daily_stock_data (stock_id, session_id, prev_close, open_price, close_price, ara_limit, arb_limit)
+			VALUES ($1, $2, $3, $3, $3, $4, $5)
+		`, stock.ID, session.ID, prevClose, araLimit, arbLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("✅ Init %s: prev=%.2f, ara=%.2f, arb=%.2f", stock.Symbol, prevClose, araLimit, arbLimit)
+	}
+
+	// Competitions starting now record their participants' equity at the previous close
+	if err := GlobalCompetitionService.StartSession(ctx, tx, session.ID, session.SessionNo); err != nil {
+		return nil, err
+	}
+
+	// 4. Move Pending Orders from Offline and GTC orders from the previous session
+	// Find previous session ID
+	type bandCancel struct {
+		engine.CanceledOrder
+		symbol string
+	}
+	var outOfBand []bandCancel
+	// Carried orders only enter the book once the session is committed: a failed open
+	// (retried by the scheduler) must not leave them behind
+	type resting struct {
+		symbol, side string
+		payload      models.RedisOrderData
+	}
+	var carriedIn []resting
+	var prevSessionId int
+	err = tx.QueryRow(ctx, "SELECT id FROM trading_sessions WHERE status = 'CLOSED' AND id < $1 ORDER BY ended_at DESC LIMIT 1", session.ID).Scan(&prevSessionId)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		// Move pending orders (DAY orders were already canceled at close, so what is left
+		// is offline orders and GTC orders, possibly partially filled)
+		_, err = tx.Exec(ctx, "UPDATE orders SET session_id = $1 WHERE session_id = $2 AND status IN ('PENDING', 'PARTIAL')", session.ID, prevSessionId)
+		if err != nil {
+			return nil, err
+		}
+
+		// Load into the book
+		// Fetch moved orders with the new session's price band
+		rows, err := tx.Query(ctx, `
+			SELECT o.id, o.user_id, o.stock_id, o.price, o.quantity, o.remaining_quantity, COALESCE(o.priority_at, o.created_at), o.type,
+				o.avg_price_at_order, o.price_type, o.time_in_force, o.display_quantity, s.symbol, d.ara_limit, d.arb_limit
+			FROM orders o
+			JOIN stocks s ON o.stock_id = s.id
+			LEFT JOIN daily_stock_data d ON d.stock_id = o.stock_id AND d.session_id = o.session_id
+			WHERE o.session_id = $1 AND o.status IN ('PENDING', 'PARTIAL')
+		`, session.ID)
+		if err != nil {
+			return nil, err
+		}
+		type carried struct {
+			models.Order
+			symbol   string
+			ts       time.Time
+			ara, arb *float64
+		}
+		var orders []carried
+		for rows.Next() {
+			var c carried
+			o := &c.Order
+			if err := rows.Scan(&o.ID, &o.UserID, &o.StockID, &o.Price, &o.Quantity, &o.RemainingQty, &c.ts, &o.Type, &o.AvgPriceAtOrder, &o.PriceType, &o.TimeInForce, &o.DisplayQuantity, &c.symbol, &c.ara, &c.arb); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			orders = append(orders, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, c := range orders {
+			o := c.Order
+			// A carried order priced outside the new ARA/ARB band is canceled and
+			// refunded, as PlaceOrder would reject it
+			if c.ara != nil && c.arb != nil && (o.Price > *c.ara || o.Price < *c.arb) {
+				canceled, ok, err := engine.CancelOrderTx(ctx, tx, o.ID)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					outOfBand = append(outOfBand, bandCancel{*canceled, c.symbol})
+				}
+				log.Printf("⚠️ Carried order %s %s @ %.2f canceled: outside ARA/ARB %.2f-%.2f", o.ID, c.symbol, o.Price, *c.arb, *c.ara)
+				continue
+			}
+			payload := models.RedisOrderData{
+				OrderId:           o.ID,
+				UserId:            o.UserID,
+				StockId:           o.StockID,
+				Price:             o.Price,
+				Quantity:          o.Quantity,
+				RemainingQuantity: o.RemainingQty,
+				Timestamp:         c.ts.UnixMilli(),
+				AvgPriceAtOrder:   o.AvgPriceAtOrder,
+				PriceType:         o.PriceType,
+				TimeInForce:       o.TimeInForce,
+			}
+			if o.DisplayQuantity != nil {
+				payload.DisplayQuantity = *o.DisplayQuantity
+			}
+			carriedIn = append(carriedIn, resting{c.symbol, engine.SideKey(o.Type), payload})
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	for _, c := range carriedIn {
+		engine.Engine.AddOrder(c.symbol, c.side, c.payload)
+	}
+	GlobalShortService.NotifyMarks(marks)
+
+	engine.Engine.SessionStatus = engine.StatusPreOpen
+	log.Printf("⏰ Session %d started: PRE_OPEN", session.ID)
+	s.notifyPhase(session.ID, engine.StatusPreOpen)
+	for _, o := range outOfBand {
+		engine.Engine.NotifyOrderStatus(o.UserId, map[string]interface{}{
+			"order_id": o.OrderId, "status": "CANCELED", "price": o.Price,
+			"matched_quantity": 0, "remaining_quantity": o.RemainingQuantity,
+			"symbol": o.symbol, "type": o.Type, "reason": "PRICE_LIMIT",
+		})
+	}
+
+	if err := GlobalDividendService.PayDue(ctx, session.ID); err != nil {
+		log.Println("Dividend payment failed:", err)
+	}
+
+	return &session, nil
+}
+
+func (s *SessionService) close(ctx context.Context) (*CloseResult, error) {
+	sched, err := s.GetSchedule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing call auction. The engine stays in PRE_CLOSE until the close commits, so a
+	// retry uncrosses whatever is left and settles from the auction reports.
+	auctions := map[string]*engine.IEPResult{}
+	if engine.Engine.SessionStatus == engine.StatusPreClose {
+		if symbols, err := activeSymbols(ctx); err == nil {
+			auctions = uncross(symbols)
+		}
+	}
+
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// 1. Update status sesi jadi CLOSED
+	var sessionId int
+	err = tx.QueryRow(ctx, `
+		UPDATE trading_sessions
+		SET status = 'CLOSED', ended_at = NOW()
+		WHERE status IN `+activeStatuses+`
+		RETURNING id
+	`).Scan(&sessionId)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrNoSession
+		}
+		return nil, err
+	}
+
+	// Closing prices become the next session's prev_close
+	prices, err := settleClosingPrices(ctx, tx, sessionId, auctions, sched.CloseVWAPMinutes)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Cancel semua order yang masih PENDING/PARTIAL, kecuali GTC (dibawa ke sesi berikutnya)
+	// Ambil dulu semua order untuk di-refund
+	rows, err := tx.Query(ctx, `
+		SELECT o.id
+		FROM orders o
+		WHERE o.session_id = $1 AND o.status IN ('PENDING', 'PARTIAL') AND o.time_in_force <> 'GTC'
+	`, sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	var orders []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			orders = append(orders, id)
+		}
+	}
+	rows.Close()
+
+	// Kembalikan saldo RDN / margin / saham yang terkunci, lalu status order jadi CANCELED
+	for _, id := range orders {
+		if _, _, err := engine.CancelOrderTx(ctx, tx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	// Holders at the close of a cum session are entitled to its dividends; short
+	// positions open at that close pay them. Recorded with the close, so a failure
+	// retries the whole close instead of snapshotting later holders.
+	dividends, err := GlobalDividendService.RecordDue(ctx, tx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	// Rights go to the holders at the close of their cum session in the same way
+	rights, err := GlobalRightsService.RecordDue(ctx, tx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	// Offerings whose last session this is are allotted with it, so the book never
+	// stays open past its window
+	ipos, err := GlobalIPOService.AllotDue(ctx, tx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	// Rights left at the end of the exercise window lapse with the close, so they can
+	// neither be exercised nor traded in the next session
+	lapsed, err := GlobalRightsService.CloseDue(ctx, tx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	engine.Engine.SessionStatus = engine.StatusClosed
+	// Halts do not carry over to the next session; a close that rolls back keeps them
+	engine.Engine.ClearHalts()
+
+	// IMPORTANT: Flush all orderbook data (memory + Redis snapshot).
+	// GTC orders are loaded back into the book by the next open.
+	if symbols, err := activeSymbols(ctx); err == nil {
+		for _, sym := range symbols {
+			engine.Engine.ClearBook(sym)
+		}
+	}
+
+	log.Printf("⏰ Session %d closed, %d orders canceled", sessionId, len(orders))
+	s.notifyPhase(sessionId, engine.StatusClosed)
+
+	GlobalDividendService.NotifyRecorded(ctx, sessionId, dividends)
+	// Closing prices are final: short positions are marked to market (and bought in below
+	// the maintenance margin) before competitions mark their participants' equity
+	if err := GlobalShortService.MarkToMarket(ctx, sessionId); err != nil {
+		log.Println("Short mark to market failed:", err)
+	}
+	if err := GlobalCompetitionService.SnapshotSession(ctx, sessionId); err != nil {
+		log.Println("Competition snapshot failed:", err)
+	}
+	GlobalIPOService.NotifyAllotted(ctx, sessionId, ipos)
+	GlobalRightsService.NotifyRecorded(ctx, sessionId, rights)
+	GlobalRightsService.NotifyCompleted(ctx, sessionId, lapsed)
+	return &CloseResult{CanceledOrders: len(orders), ClosingPrices: prices}, nil
+}
+
+// CalculateLimits returns the ARA/ARB price limits for a previous close
+func CalculateLimits(prevClose float64) (float64, float64) {
+	// Simple Indonesia Stock Exchange logic approximation or mirroring src/core/market-logic.ts
+	// < 200: 35%
+	// 200 - 5000: 25%
+	// > 5000: 20%
+	var percentage float64
+	if prevClose < 200 {
+		percentage = 0.35
+	} else if prevClose < 5000 {
+		percentage = 0.25
+	} else {
+		percentage = 0.20
+	}
+
+	limitUp := prevClose * (1 + percentage)
+	limitDown := prevClose * (1 - percentage)
+
+	return math.Floor(limitUp), math.Ceil(limitDown) // Simplified
+}
+
+// Schedule
+
+func (s *SessionService) GetSchedule(ctx context.Context) (*SessionSchedule, error) {
+	var sc SessionSchedule
+	err := config.DB.QueryRow(ctx, `
+		SELECT enabled, timezone, trading_days,
+			to_char(pre_open_at, 'HH24:MI:SS'), to_char(locked_at, 'HH24:MI:SS'), to_char(session1_at, 'HH24:MI:SS'),
+			to_char(break_at, 'HH24:MI:SS'), to_char(session2_at, 'HH24:MI:SS'),
+			to_char(pre_close_at, 'HH24:MI:SS'), to_char(close_at, 'HH24:MI:SS'),
+			manual_pre_open_seconds, manual_locked_seconds, close_vwap_minutes, auction_policy
+		FROM market_schedule WHERE id = 1
+	`).Scan(&sc.Enabled, &sc.Timezone, &sc.TradingDays,
+		&sc.PreOpenAt, &sc.LockedAt, &sc.Session1At, &sc.BreakAt, &sc.Session2At, &sc.PreCloseAt, &sc.CloseAt,
+		&sc.ManualPreOpenSec, &sc.ManualLockedSec, &sc.CloseVWAPMinutes, &sc.AuctionPolicy)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			// Not configured: scheduler off, manual sessions keep the old 15s/5s timings
+			return &SessionSchedule{Timezone: "Asia/Jakarta", ManualPreOpenSec: 15, ManualLockedSec: 5, CloseVWAPMinutes: 10, AuctionPolicy: engine.AuctionPriceTime}, nil
+		}
+		return nil, err
+	}
+	return &sc, nil
+}
+
+func (s *SessionService) UpdateSchedule(sc SessionSchedule) (*SessionSchedule, error) {
+	if _, err := time.LoadLocation(sc.Timezone); err != nil {
+		return nil, errors.New("Zona waktu tidak valid")
+	}
+	for _, d := range sc.TradingDays {
+		if d < 1 || d > 7 {
+			return nil, errors.New("Hari bursa harus 1 (Senin) sampai 7 (Minggu)")
+		}
+	}
+	if (sc.BreakAt == nil) != (sc.Session2At == nil) {
+		return nil, errors.New("break_at dan session2_at harus diisi keduanya atau dikosongkan")
+	}
+	if sc.ManualPreOpenSec < 0 || sc.ManualLockedSec < 0 {
+		return nil, errors.New("Durasi sesi manual tidak boleh negatif")
+	}
+	if sc.CloseVWAPMinutes <= 0 {
+		return nil, errors.New("close_vwap_minutes harus lebih dari 0")
+	}
+	if sc.AuctionPolicy == "" {
+		sc.AuctionPolicy = engine.AuctionPriceTime
+	}
+	if !engine.IsValidAuctionPolicy(sc.AuctionPolicy) {
+		return nil, ErrInvalidAuctionPolicy
+	}
+
+	times := []*string{&sc.PreOpenAt, &sc.LockedAt, &sc.Session1At}
+	if sc.BreakAt != nil {
+		times = append(times, sc.BreakAt, sc.Session2At)
+	}
+	times = append(times, &sc.PreCloseAt, &sc.CloseAt)
+	for i, t := range times {
+		norm, err := normalizeClock(*t)
+		if err != nil {
+			return nil, err
+		}
+		*t = norm
+		if i > 0 && *times[i-1] >= norm {
+			return nil, errors.New("Jam fase harus berurutan: pre_open < locked < session1 < break < session2 < pre_close < close")
+		}
+	}
+
+	ctx := context.Background()
+	_, err := config.DB.Exec(ctx, `
+		INSERT INTO market_schedule (id, enabled, timezone, trading_days, pre_open_at, locked_at, session1_at, break_at, session2_at, pre_close_at, close_at, manual_pre_open_seconds, manual_locked_seconds, close_vwap_minutes, auction_policy, updated_at)
+		VALUES (1, $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NOW())
+		ON CONFLICT (id) DO UPDATE SET
+			enabled = EXCLUDED.enabled, timezone = EXCLUDED.timezone, trading_days = EXCLUDED.trading_days,
+			pre_open_at = EXCLUDED.pre_open_at, locked_at = EXCLUDED.locked_at, session1_at = EXCLUDED.session1_at,
+			break_at = EXCLUDED.break_at, session2_at = EXCLUDED.session2_at,
+			pre_close_at = EXCLUDED.pre_close_at, close_at = EXCLUDED.close_at,
+			manual_pre_open_seconds = EXCLUDED.manual_pre_open_seconds, manual_locked_seconds = EXCLUDED.manual_locked_seconds,
+			close_vwap_minutes = EXCLUDED.close_vwap_minutes, auction_policy = EXCLUDED.auction_policy, updated_at = NOW()
+	`, sc.Enabled, sc.Timezone, sc.TradingDays, sc.PreOpenAt, sc.LockedAt, sc.Session1At, sc.BreakAt, sc.Session2At,
+		sc.PreCloseAt, sc.CloseAt, sc.ManualPreOpenSec, sc.ManualLockedSec, sc.CloseVWAPMinutes, sc.AuctionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetSchedule(ctx)
+}
+
+// normalizeClock accepts HH:MM or HH:MM:SS and returns HH:MM:SS
+func normalizeClock(v string) (string, error) {
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.Format("15:04:05"), nil
+		}
+	}
+	return "", fmt.Errorf("Format jam tidak valid: %q (gunakan HH:MM)", v)
+}
+
+func (s *SessionService) ListHolidays(ctx context.Context) ([]MarketHoliday, error) {
+	rows, err := config.DB.Query(ctx, "SELECT to_char(holiday_date, 'YYYY-MM-DD'), COALESCE(description, '') FROM market_holidays WHERE holiday_date >= CURRENT_DATE ORDER BY holiday_date")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []MarketHoliday{}
+	for rows.Next() {
+		var h MarketHoliday
+		if err := rows.Scan(&h.Date, &h.Description); err == nil {
+			items = append(items, h)
+		}
+	}
+	return items, nil
+}
+
+func (s *SessionService) AddHoliday(date, description string) error {
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return errors.New("Format tanggal tidak valid (YYYY-MM-DD)")
+	}
+	_, err := config.DB.Exec(context.Background(), `
+		INSERT INTO market_holidays (holiday_date, description) VALUES ($1::date, $2)
+		ON CONFLICT (holiday_date) DO UPDATE SET description = EXCLUDED.description
+	`, date, description)
+	return err
+}
+
+func (s *SessionService) RemoveHoliday(date string) error {
+	tag, err := config.DB.Exec(context.Background(), "DELETE FROM market_holidays WHERE holiday_date = $1::date", date)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.New("Hari libur tidak ditemukan")
+	}
+	return nil
+}
@@ -0,0 +1,638 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"mbit-backend-go/config"
+	"mbit-backend-go/core/engine"
+	"mbit-backend-go/core/ledger"
+
+	"github.com/jackc/pgx/v5"
+	socketio "github.com/zishang520/socket.io/v2/socket"
+)
+
+// Short selling.
+// Users opt in per account. A SELL order for more lots than the user has available is
+// then a short sale of the whole order (available lots must be sold first): it reserves
+// the initial margin, a percent of the order value, from balance_rdn. At each fill the
+// lots are borrowed and owed in short_positions, and the proceeds plus the margin become
+// the position's collateral (core/engine/short.go). BUY fills cover the position first.
+// When a session closes every position is marked to market at the closing price: the
+// borrow fee is taken from the collateral, and a position whose equity (collateral less
+// market value) falls below the maintenance margin is bought in at the closing price.
+// What a position owes beyond its collateral is taken from the available balance, never
+// below zero; the rest is the user's margin debt (a margin call), collected from the
+// available balance at the next session closes. New short sales wait until it is paid.
+
+// Short mark statuses
+const (
+	ShortMarkOK    = "OK"
+	ShortMarkBuyIn = "BUY_IN"
+)
+
+type ShortSettings struct {
+	IsEnabled            bool      `json:"is_enabled"`
+	InitialMarginPct     float64   `json:"initial_margin_pct"`     // of the order value, reserved when placed
+	MaintenanceMarginPct float64   `json:"maintenance_margin_pct"` // minimum equity / market value
+	BorrowFeePct         float64   `json:"borrow_fee_pct"`         // of the market value, per session
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+// ShortSettingsParams changes the fields that are set
+type ShortSettingsParams struct {
+	IsEnabled            *bool
+	InitialMarginPct     *float64
+	MaintenanceMarginPct *float64
+	BorrowFeePct         *float64
+}
+
+// ShortPosition is a user's borrowed lots of one stock, valued at the current price
+type ShortPosition struct {
+	StockID       int        `json:"stock_id"`
+	Symbol        string     `json:"symbol"`
+	Quantity      int64      `json:"quantity"` // lots owed
+	AvgShortPrice float64    `json:"avg_short_price"`
+	Collateral    float64    `json:"collateral"`
+	BorrowFees    float64    `json:"borrow_fees"`
+	CurrentPrice  float64    `json:"current_price"`
+	MarketValue   float64    `json:"market_value"`
+	Equity        float64    `json:"equity"`       // collateral - market value
+	MarginRatio   float64    `json:"margin_ratio"` // equity / market value, percent
+	UnrealizedPL  float64    `json:"unrealized_pl"`
+	OpenedAt      *time.Time `json:"opened_at"`
+}
+
+type ShortFill struct {
+	ID            int64     `json:"id"`
+	TradeID       *string   `json:"trade_id"`
+	OrderID       *string   `json:"order_id"`
+	SessionID     *int      `json:"session_id"`
+	Symbol        string    `json:"symbol"`
+	Kind          string    `json:"kind"` // SHORT, COVER, BUY_IN or DIVIDEND
+	Quantity      int64     `json:"quantity"`
+	Price         float64   `json:"price"`
+	AvgShortPrice float64   `json:"avg_short_price"`
+	Collateral    float64   `json:"collateral"`
+	Fee           float64   `json:"fee"`
+	PnL           *float64  `json:"pnl"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type ShortMark struct {
+	SessionID   int       `json:"session_id"`
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username,omitempty"`
+	Symbol      string    `json:"symbol"`
+	Quantity    int64     `json:"quantity"`
+	Price       float64   `json:"price"`
+	MarketValue float64   `json:"market_value"`
+	BorrowFee   float64   `json:"borrow_fee"`
+	Collateral  float64   `json:"collateral"`
+	Equity      float64   `json:"equity"`
+	MarginRatio float64   `json:"margin_ratio"`
+	Status      string    `json:"status"`
+	Debt        float64   `json:"debt"` // buy-in shortfall left as margin debt
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type ShortService struct{}
+
+var GlobalShortService = &ShortService{}
+
+func (s *ShortService) Settings(ctx context.Context) (*ShortSettings, error) {
+	var st ShortSettings
+	err := config.DB.QueryRow(ctx, `
+		SELECT is_enabled, initial_margin_pct::float8, maintenance_margin_pct::float8, borrow_fee_pct::float8, updated_at
+		FROM short_selling_settings WHERE id = 1
+	`).Scan(&st.IsEnabled, &st.InitialMarginPct, &st.MaintenanceMarginPct, &st.BorrowFeePct, &st.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return nil, errors.New("Pengaturan short selling belum ada, jalankan migration_add_short_selling.sql")
+	}
+	return &st, err
+}
+
+// UpdateSettings changes the settings. New margins apply to orders placed afterwards and
+// to the next mark to market.
+func (s *ShortService) UpdateSettings(ctx context.Context, p ShortSettingsParams) (*ShortSettings, error) {
+	st, err := s.Settings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.IsEnabled != nil {
+		st.IsEnabled = *p.IsEnabled
+	}
+	if p.InitialMarginPct != nil {
+		st.InitialMarginPct = *p.InitialMarginPct
+	}
+	if p.MaintenanceMarginPct != nil {
+		st.MaintenanceMarginPct = *p.MaintenanceMarginPct
+	}
+	if p.BorrowFeePct != nil {
+		st.BorrowFeePct = *p.BorrowFeePct
+	}
+	switch {
+	case st.InitialMarginPct <= 0 || st.InitialMarginPct > 1000:
+		return nil, errors.New("Initial margin harus antara 0 dan 1000 persen")
+	case st.MaintenanceMarginPct < 0 || st.MaintenanceMarginPct > st.InitialMarginPct:
+		return nil, errors.New("Maintenance margin harus antara 0 dan initial margin")
+	case st.BorrowFeePct < 0 || st.BorrowFeePct > 100:
+		return nil, errors.New("Biaya pinjam harus antara 0 dan 100 persen")
+	}
+
+	_, err = config.DB.Exec(ctx, `
+		UPDATE short_selling_settings
+		SET is_enabled = $1, initial_margin_pct = $2, maintenance_margin_pct = $3, borrow_fee_pct = $4, updated_at = NOW()
+		WHERE id = 1
+	`, st.IsEnabled, st.InitialMarginPct, st.MaintenanceMarginPct, st.BorrowFeePct)
+	if err != nil {
+		return nil, err
+	}
+	return s.Settings(ctx)
+}
+
+// Enabled reports whether the user opted in to short selling
+func (s *ShortService) Enabled(ctx context.Context, userId string) (bool, error) {
+	var enabled bool
+	err := config.DB.QueryRow(ctx, "SELECT short_enabled FROM users WHERE id = $1", userId).Scan(&enabled)
+	return enabled, err
+}
+
+// SetEnabled opts the user in or out. Opting out only stops new short sales; open
+// positions stay until they are covered.
+func (s *ShortService) SetEnabled(ctx context.Context, userId string, enabled bool) error {
+	_, err := config.DB.Exec(ctx, "UPDATE users SET short_enabled = $1 WHERE id = $2", enabled, userId)
+	return err
+}
+
+// shortSaleMargin returns the initial margin percent a short sale of the stock by the
+// user is placed with, or 0 if the user cannot sell it short. Rights stocks cannot be
+// sold short, they lapse; nor can a stock whose rights issue is announced, until its
+// holders are recorded.
+func shortSaleMargin(ctx context.Context, tx pgx.Tx, userId string, stockId int) (float64, error) {
+	var pct, debt float64
+	var inRights bool
+	err := tx.QueryRow(ctx, `
+		SELECT st.initial_margin_pct::float8, u.margin_debt::float8,
+			EXISTS (SELECT 1 FROM rights_issues WHERE stock_id = $2 AND status = 'ANNOUNCED')
+		FROM short_selling_settings st
+		JOIN users u ON u.id = $1
+		WHERE st.id = 1 AND st.is_enabled AND u.short_enabled
+			AND NOT EXISTS (SELECT 1 FROM rights_issues WHERE rights_stock_id = $2)
+	`, userId, stockId).Scan(&pct, &debt, &inRights)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if debt > 0 {
+		return 0, fmt.Errorf("Lunasi margin call Rp%.0f sebelum short sell lagi", debt)
+	}
+	if inRights {
+		return 0, errors.New("Short sell saham ini ditutup sampai pemegang rights issue tercatat")
+	}
+	return pct, nil
+}
+
+// chargeShort collects amount a short position owes (a buy-in, or a dividend on the
+// borrowed lots): from its collateral first, then
+// the user's available balance down to zero. The rest becomes margin debt. Entries go
+// to EXTERNAL on j. Returns what was taken from the collateral and the new debt.
+func chargeShort(ctx context.Context, tx pgx.Tx, j *ledger.Journal, userId string, stockId int, collateral, amount float64) (float64, float64, error) {
+	fromCollateral := min(amount, max(collateral, 0))
+	var balance float64
+	if err := tx.QueryRow(ctx, "SELECT balance_rdn FROM users WHERE id = $1 FOR UPDATE", userId).Scan(&balance); err != nil {
+		return 0, 0, err
+	}
+	fromBalance := min(amount-fromCollateral, max(balance, 0))
+	debt := round4(amount - fromCollateral - fromBalance)
+
+	if _, err := tx.Exec(ctx, "UPDATE short_positions SET collateral = collateral - $1, updated_at = NOW() WHERE user_id = $2 AND stock_id = $3", fromCollateral, userId, stockId); err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn - $1, margin_debt = margin_debt + $2 WHERE id = $3", fromBalance, debt, userId); err != nil {
+		return 0, 0, err
+	}
+	j.Cash(ledger.Margin(userId), ledger.External, fromCollateral).
+		Cash(ledger.Cash(userId), ledger.External, fromBalance).
+		Cash(ledger.Debt(userId), ledger.External, debt)
+	return fromCollateral, debt, nil
+}
+
+// collectDebts pays margin debts from the available balance, as far as it goes
+func (s *ShortService) collectDebts(ctx context.Context, sessionId int) error {
+	tx, err := config.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		UPDATE users u SET margin_debt = u.margin_debt - x.amount, balance_rdn = u.balance_rdn - x.amount
+		FROM (
+			SELECT id, LEAST(margin_debt, balance_rdn) AS amount FROM users
+			WHERE margin_debt > 0 AND balance_rdn > 0
+			FOR UPDATE
+		) x
+		WHERE u.id = x.id
+		RETURNING u.id::text, x.amount::float8
+	`)
+	if err != nil {
+		return err
+	}
+	j := ledger.New(ledger.ReasonMarginCallPayment, ledger.RefSession, strconv.Itoa(sessionId))
+	for rows.Next() {
+		var userId string
+		var amount float64
+		if err := rows.Scan(&userId, &amount); err != nil {
+			rows.Close()
+			return err
+		}
+		j.Cash(ledger.Cash(userId), ledger.Debt(userId), amount)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := ledger.Post(ctx, tx, j); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Positions returns the user's open short positions at the current price
+func (s *ShortService) Positions(ctx context.Context, userId string) ([]ShortPosition, error) {
+	rows, err := config.DB.Query(ctx, `
+		SELECT sp.stock_id, s.symbol, sp.quantity, sp.avg_short_price::float8, sp.collateral::float8, sp.borrow_fees::float8,
+			COALESCE(d.close_price, d.prev_close, sp.last_price, sp.avg_short_price)::float8, sp.opened_at
+		FROM short_positions sp
+		JOIN stocks s ON s.id = sp.stock_id
+		LEFT JOIN LATERAL (
+			SELECT close_price, prev_close FROM daily_stock_data
+			WHERE stock_id = sp.stock_id
+			ORDER BY session_id DESC LIMIT 1
+		) d ON true
+		WHERE sp.user_id = $1 AND sp.quantity > 0
+		ORDER BY s.symbol
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	positions := []ShortPosition{}
+	for rows.Next() {
+		var p ShortPosition
+		if err := rows.Scan(&p.StockID, &p.Symbol, &p.Quantity, &p.AvgShortPrice, &p.Collateral, &p.BorrowFees,
+			&p.CurrentPrice, &p.OpenedAt); err != nil {
+			return nil, err
+		}
+		p.MarketValue = p.CurrentPrice * float64(p.Quantity) * 100
+		p.Equity = round4(p.Collateral - p.MarketValue)
+		if p.MarketValue > 0 {
+			p.MarginRatio = round4(p.Equity / p.MarketValue * 100)
+		}
+		p.UnrealizedPL = (p.AvgShortPrice - p.CurrentPrice) * float64(p.Quantity) * 100
+		positions = append(positions, p)
+	}
+	return positions, rows.Err()
+}
+
+// Fills returns the user's short sales, covers and buy-ins, newest first
+func (s *ShortService) Fills(ctx context.Context, userId string) ([]ShortFill, error) {
+	rows, err := config.DB.Query(ctx, `
+		SELECT f.id, f.trade_id::text, f.order_id::text, f.session_id, s.symbol, f.kind, f.quantity, f.price::float8,
+			f.avg_short_price::float8, f.collateral::float8, f.fee::float8, f.pnl::float8, f.created_at
+		FROM short_fills f
+		JOIN stocks s ON s.id = f.stock_id
+		WHERE f.user_id = $1
+		ORDER BY f.created_at DESC, f.id DESC
+		LIMIT 200
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fills := []ShortFill{}
+	for rows.Next() {
+		var f ShortFill
+		if err := rows.Scan(&f.ID, &f.TradeID, &f.OrderID, &f.SessionID, &f.Symbol, &f.Kind, &f.Quantity, &f.Price,
+			&f.AvgShortPrice, &f.Collateral, &f.Fee, &f.PnL, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		fills = append(fills, f)
+	}
+	return fills, rows.Err()
+}
+
+// Marks returns the mark to market history, of a user or (userId empty) of everyone in
+// a session. sessionId 0 is every session.
+func (s *ShortService) Marks(ctx context.Context, userId string, sessionId int) ([]ShortMark, error) {
+	query := `
+		SELECT m.session_id, m.user_id::text, u.username, s.symbol, m.quantity, m.price::float8, m.market_value::float8,
+			m.borrow_fee::float8, m.collateral::float8, m.equity::float8, m.margin_ratio::float8, m.status, m.debt::float8, m.created_at
+		FROM short_marks m
+		JOIN stocks s ON s.id = m.stock_id
+		JOIN users u ON u.id = m.user_id
+		WHERE 1=1
+	`
+	args := []interface{}{}
+	argCounter := 1
+	if userId != "" {
+		query += fmt.Sprintf(" AND m.user_id = $%d", argCounter)
+		args = append(args, userId)
+		argCounter++
+	}
+	if sessionId > 0 {
+		query += fmt.Sprintf(" AND m.session_id = $%d", argCounter)
+		args = append(args, sessionId)
+		argCounter++
+	}
+	query += " ORDER BY m.session_id DESC, m.margin_ratio LIMIT 500"
+
+	rows, err := config.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	marks := []ShortMark{}
+	for rows.Next() {
+		var m ShortMark
+		if err := rows.Scan(&m.SessionID, &m.UserID, &m.Username, &m.Symbol, &m.Quantity, &m.Price, &m.MarketValue,
+			&m.BorrowFee, &m.Collateral, &m.Equity, &m.MarginRatio, &m.Status, &m.Debt, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		marks = append(marks, m)
+	}
+	return marks, rows.Err()
+}
+
+// MarkToMarket collects margin debts, then values every open short position at the
+// closing price of the session, charges the borrow fee and buys in the positions below
+// the maintenance margin. Runs once the session is closed; positions already marked for
+// it are skipped. A position that fails is left unmarked for BackfillMarks and the
+// others are still marked.
+func (s *ShortService) MarkToMarket(ctx context.Context, sessionId int) error {
+	st, err := s.Settings(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.collectDebts(ctx, sessionId); err != nil {
+		log.Println("Margin call failed:", err)
+	}
+
+	marked, failed, err := s.markPositions(ctx, config.DB, sessionId, st)
+	if err != nil {
+		return err
+	}
+	s.NotifyMarks(marked)
+	if failed > 0 {
+		return fmt.Errorf("%d short position(s) not marked", failed)
+	}
+	return nil
+}
+
+// BackfillMarks marks the positions a failed MarkToMarket left out of the last closed
+// session, inside the session open transaction. The caller passes the result to
+// NotifyMarks once the open commits.
+func (s *ShortService) BackfillMarks(ctx context.Context, tx pgx.Tx) ([]MarkedPosition, error) {
+	var sessionId int
+	err := tx.QueryRow(ctx, "SELECT id FROM trading_sessions WHERE status = 'CLOSED' ORDER BY id DESC LIMIT 1").Scan(&sessionId)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.Settings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	marked, failed, err := s.markPositions(ctx, tx, sessionId, st)
+	if err != nil {
+		return nil, err
+	}
+	if failed > 0 {
+		log.Printf("📉 Session %d: %d short position(s) still not marked", sessionId, failed)
+	}
+	return marked, nil
+}
+
+// MarkedPosition is a position marked by markPositions, with the orders its buy-in canceled
+type MarkedPosition struct {
+	Mark     *ShortMark
+	Canceled []engine.CanceledOrder
+}
+
+// txStarter is the pool, or a transaction to mark positions under savepoints
+type txStarter interface {
+	rowsQuerier
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// markPositions marks every open position not marked for sessionId yet, each in its own
+// transaction (a savepoint under db if db is a transaction). A position that fails is
+// logged and counted; the rest are still marked.
+func (s *ShortService) markPositions(ctx context.Context, db txStarter, sessionId int, st *ShortSettings) ([]MarkedPosition, int, error) {
+	rows, err := db.Query(ctx, `
+		SELECT sp.user_id::text, sp.stock_id, s.symbol, px.price
+		FROM short_positions sp
+		JOIN stocks s ON s.id = sp.stock_id
+		JOIN LATERAL (
+			SELECT COALESCE(d.close_price, d.prev_close)::float8 AS price
+			FROM daily_stock_data d
+			WHERE d.stock_id = sp.stock_id AND d.session_id <= $1
+			ORDER BY d.session_id DESC LIMIT 1
+		) px ON px.price > 0
+		WHERE sp.quantity > 0
+			AND NOT EXISTS (SELECT 1 FROM short_marks m WHERE m.session_id = $1 AND m.user_id = sp.user_id AND m.stock_id = sp.stock_id)
+	`, sessionId)
+	if err != nil {
+		return nil, 0, err
+	}
+	type position struct {
+		userId  string
+		stockId int
+		symbol  string
+		price   float64
+	}
+	var positions []position
+	for rows.Next() {
+		var p position
+		if err := rows.Scan(&p.userId, &p.stockId, &p.symbol, &p.price); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		positions = append(positions, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var marked []MarkedPosition
+	buyIns, failed := 0, 0
+	for _, p := range positions {
+		m, canceled, err := s.mark(ctx, db, sessionId, p.userId, p.stockId, p.price, st)
+		if err != nil {
+			failed++
+			log.Printf("Short mark %s %s failed: %v", p.userId, p.symbol, err)
+			continue
+		}
+		if m == nil {
+			continue
+		}
+		if m.Status == ShortMarkBuyIn {
+			buyIns++
+		}
+		m.Symbol = p.symbol
+		marked = append(marked, MarkedPosition{Mark: m, Canceled: canceled})
+	}
+	if len(marked) > 0 {
+		log.Printf("📉 Session %d: %d short position(s) marked, %d bought in", sessionId, len(marked), buyIns)
+	}
+	return marked, failed, nil
+}
+
+// NotifyMarks takes the orders of bought-in positions off the book and tells the owners
+func (s *ShortService) NotifyMarks(marked []MarkedPosition) {
+	for _, p := range marked {
+		m := p.Mark
+		for _, o := range p.Canceled {
+			engine.Engine.RemoveOrder(m.Symbol, o.OrderId)
+			engine.Engine.NotifyOrderStatus(o.UserId, map[string]interface{}{
+				"order_id": o.OrderId, "status": "CANCELED", "price": o.Price,
+				"matched_quantity": 0, "remaining_quantity": o.RemainingQuantity,
+				"symbol": m.Symbol, "type": o.Type, "reason": "SHORT_BUY_IN",
+			})
+		}
+		if engine.Engine != nil && engine.Engine.IoServer != nil {
+			engine.Engine.IoServer.To(socketio.Room("user:"+m.UserID)).Emit("short_update", m)
+		}
+	}
+}
+
+// mark values one position in its own transaction. A bought-in position's open short
+// SELL orders on the stock are canceled with it; the caller takes them off the book.
+func (s *ShortService) mark(ctx context.Context, db txStarter, sessionId int, userId string, stockId int, price float64, st *ShortSettings) (*ShortMark, []engine.CanceledOrder, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var qty int64
+	var avg, collateral float64
+	err = tx.QueryRow(ctx, `
+		SELECT quantity, avg_short_price::float8, collateral::float8
+		FROM short_positions
+		WHERE user_id = $1 AND stock_id = $2 AND quantity > 0
+		FOR UPDATE
+	`, userId, stockId).Scan(&qty, &avg, &collateral)
+	if err == pgx.ErrNoRows {
+		return nil, nil, nil // covered meanwhile
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := &ShortMark{SessionID: sessionId, UserID: userId, Quantity: qty, Price: price, Status: ShortMarkOK}
+	m.MarketValue = price * float64(qty) * 100
+	m.BorrowFee = min(round4(m.MarketValue*st.BorrowFeePct/100), max(collateral, 0))
+	m.Collateral = collateral - m.BorrowFee
+	m.Equity = round4(m.Collateral - m.MarketValue)
+	m.MarginRatio = round4(m.Equity / m.MarketValue * 100)
+
+	ref := strconv.Itoa(sessionId)
+	fee := ledger.New(ledger.ReasonShortBorrowFee, ledger.RefSession, ref).Cash(ledger.Margin(userId), ledger.Fees, m.BorrowFee)
+	if err := ledger.Post(ctx, tx, fee); err != nil {
+		return nil, nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE short_positions
+		SET collateral = collateral - $1, borrow_fees = borrow_fees + $1, last_price = $2, margin_ratio = $3, updated_at = NOW()
+		WHERE user_id = $4 AND stock_id = $5
+	`, m.BorrowFee, price, m.MarginRatio, userId, stockId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var canceled []engine.CanceledOrder
+	if m.MarginRatio < st.MaintenanceMarginPct {
+		// Buy-in at the close: the collateral pays for the lots, then the available
+		// balance; the rest of the collateral is released
+		m.Status = ShortMarkBuyIn
+		pnl := (avg - price) * float64(qty) * 100
+
+		j := ledger.New(ledger.ReasonShortBuyIn, ledger.RefSession, ref).
+			Shares(ledger.External, ledger.Short(userId), stockId, qty)
+		j.Memo = fmt.Sprintf("Buy-in %d lot @%g, margin %.2f%%", qty, price, m.MarginRatio)
+		paid, debt, err := chargeShort(ctx, tx, j, userId, stockId, m.Collateral, m.MarketValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		m.Debt = debt
+		refund := round4(m.Collateral - paid)
+		j.Cash(ledger.Margin(userId), ledger.Cash(userId), refund)
+
+		if _, err := tx.Exec(ctx, "UPDATE users SET balance_rdn = balance_rdn + $1 WHERE id = $2", refund, userId); err != nil {
+			return nil, nil, err
+		}
+		if _, err := tx.Exec(ctx, "UPDATE short_positions SET quantity = 0, collateral = 0, updated_at = NOW() WHERE user_id = $1 AND stock_id = $2", userId, stockId); err != nil {
+			return nil, nil, err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO short_fills (session_id, user_id, stock_id, kind, quantity, price, avg_short_price, collateral, pnl)
+			VALUES ($1, $2, $3, 'BUY_IN', $4, $5, $6, $7, $8)
+		`, sessionId, userId, stockId, qty, price, avg, m.Collateral, pnl)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := ledger.Post(ctx, tx, j); err != nil {
+			return nil, nil, err
+		}
+
+		// GTC short sales would open the position again
+		rows, err := tx.Query(ctx, "SELECT id::text FROM orders WHERE user_id = $1 AND stock_id = $2 AND is_short AND status IN ('PENDING', 'PARTIAL')", userId, stockId)
+		if err != nil {
+			return nil, nil, err
+		}
+		var orderIds []string
+		for rows.Next() {
+			var orderId string
+			if err := rows.Scan(&orderId); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			orderIds = append(orderIds, orderId)
+		}
+		rows.Close()
+		for _, orderId := range orderIds {
+			o, ok, err := engine.CancelOrderTx(ctx, tx, orderId)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				canceled = append(canceled, *o)
+			}
+		}
+	}
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO short_marks (session_id, user_id, stock_id, quantity, price, market_value, borrow_fee, collateral, equity, margin_ratio, status, debt)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING created_at
+	`, sessionId, userId, stockId, qty, price, m.MarketValue, m.BorrowFee, m.Collateral, m.Equity, m.MarginRatio, m.Status, m.Debt).Scan(&m.CreatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, canceled, tx.Commit(ctx)
+}